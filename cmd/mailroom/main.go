@@ -25,6 +25,7 @@ import (
 	_ "github.com/nyaruka/mailroom/core/tasks/msgs"
 	_ "github.com/nyaruka/mailroom/core/tasks/schedules"
 	_ "github.com/nyaruka/mailroom/core/tasks/starts"
+	_ "github.com/nyaruka/mailroom/core/tasks/streams"
 	_ "github.com/nyaruka/mailroom/core/tasks/timeouts"
 	_ "github.com/nyaruka/mailroom/services/ivr/twiml"
 	_ "github.com/nyaruka/mailroom/services/ivr/vonage"
@@ -42,6 +43,7 @@ import (
 	_ "github.com/nyaruka/mailroom/web/simulation"
 	_ "github.com/nyaruka/mailroom/web/surveyor"
 	_ "github.com/nyaruka/mailroom/web/ticket"
+	_ "github.com/nyaruka/mailroom/web/trigger"
 
 	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
@@ -0,0 +1,134 @@
+package eventstream
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/pkg/errors"
+)
+
+// events are queued in the eventstream_event table by the same transaction that handles them, so that they're only
+// published if that transaction commits, and are never lost once it has. Events are published in id order per org, and
+// as a contact's events are always handled under that contact's lock, that is the order they happened.
+
+// EventID is the id of a queued event
+type EventID int64
+
+// Event is the envelope for an engine event published to the event stream
+type Event struct {
+	ID          EventID           `json:"-"`
+	Type        string            `json:"type"`
+	OrgID       models.OrgID      `json:"org_id"`
+	ContactID   models.ContactID  `json:"contact_id"`
+	ContactUUID flows.ContactUUID `json:"contact_uuid"`
+	SessionID   models.SessionID  `json:"session_id,omitempty"`
+	Event       json.RawMessage   `json:"event"`
+}
+
+// NewEvent creates a new event stream event for the given engine event which happened in the given scene
+func NewEvent(orgID models.OrgID, scene *models.Scene, e flows.Event) *Event {
+	return &Event{
+		Type:        e.Type(),
+		OrgID:       orgID,
+		ContactID:   scene.ContactID(),
+		ContactUUID: scene.ContactUUID(),
+		SessionID:   scene.SessionID(),
+		Event:       jsonx.MustMarshal(e),
+	}
+}
+
+type queuedEvent struct {
+	ID        EventID      `db:"id"`
+	OrgID     models.OrgID `db:"org_id"`
+	Data      string       `db:"data"`
+	CreatedOn time.Time    `db:"created_on"`
+}
+
+const sqlInsertEvents = `
+INSERT INTO eventstream_event(org_id, data, created_on) VALUES(:org_id, :data, :created_on)`
+
+// Queue adds the given events, in order, to the events waiting to be published. This should be called with the
+// transaction that handled the events.
+func Queue(ctx context.Context, tx models.Queryer, events []*Event) error {
+	queued := make([]*queuedEvent, len(events))
+	for i, e := range events {
+		queued[i] = &queuedEvent{OrgID: e.OrgID, Data: string(jsonx.MustMarshal(e)), CreatedOn: dates.Now()}
+	}
+
+	return errors.Wrap(models.BulkQuery(ctx, "queued stream events", tx, sqlInsertEvents, queued), "error queuing events")
+}
+
+// QueuedOrgs returns the ids of the orgs which have events waiting to be published
+func QueuedOrgs(ctx context.Context, db models.Queryer) ([]models.OrgID, error) {
+	var orgIDs []models.OrgID
+	err := db.SelectContext(ctx, &orgIDs, `SELECT DISTINCT org_id FROM eventstream_event`)
+	return orgIDs, errors.Wrap(err, "error reading orgs with queued events")
+}
+
+const sqlSelectQueuedEvents = `
+  SELECT id, org_id, data, created_on
+    FROM eventstream_event
+   WHERE org_id = $1
+ORDER BY id
+   LIMIT $2`
+
+// Peek returns up to the given number of the org's oldest events without removing them
+func Peek(ctx context.Context, db models.Queryer, orgID models.OrgID, count int) ([]*Event, error) {
+	var queued []*queuedEvent
+	if err := db.SelectContext(ctx, &queued, sqlSelectQueuedEvents, orgID, count); err != nil {
+		return nil, errors.Wrap(err, "error reading queued events")
+	}
+
+	events := make([]*Event, len(queued))
+	for i, q := range queued {
+		events[i] = &Event{ID: q.ID}
+		if err := json.Unmarshal([]byte(q.Data), events[i]); err != nil {
+			return nil, errors.Wrap(err, "error unmarshaling queued event")
+		}
+	}
+	return events, nil
+}
+
+// Ack removes the given events once they've been published
+func Ack(ctx context.Context, db models.Queryer, events []*Event) error {
+	ids := make([]EventID, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+	}
+
+	_, err := db.ExecContext(ctx, `DELETE FROM eventstream_event WHERE id = ANY($1)`, pq.Array(ids))
+	return errors.Wrap(err, "error removing published events")
+}
+
+// Sink is something which events can be published to
+type Sink interface {
+	Name() string
+
+	// Publish publishes the given events in order, and only returns nil if they have all been published
+	Publish(context.Context, []*Event) error
+}
+
+// NewSink creates a new sink from the given URL
+func NewSink(sinkURL, secret string) (Sink, error) {
+	u, err := url.Parse(sinkURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid event stream URL")
+	}
+
+	switch u.Scheme {
+	case "redis", "rediss":
+		return newRedisSink(u)
+	case "http", "https":
+		return newHTTPSink(sinkURL, secret), nil
+	case "file":
+		return newFileSink(u.Path), nil
+	}
+	return nil, errors.Errorf("unsupported event stream scheme: %s", u.Scheme)
+}
@@ -0,0 +1,93 @@
+package eventstream_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/eventstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testEvents = []*eventstream.Event{
+	{Type: "msg_created", OrgID: 1, ContactID: 10000, ContactUUID: "6393abc0-283d-4c9b-a1b3-641a035c34bf", Event: []byte(`{"type":"msg_created"}`)},
+	{Type: "contact_groups_changed", OrgID: 1, ContactID: 10000, ContactUUID: "6393abc0-283d-4c9b-a1b3-641a035c34bf", SessionID: 123, Event: []byte(`{"type":"contact_groups_changed"}`)},
+}
+
+func TestNewSink(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		name string
+		err  string
+	}{
+		{"redis://localhost:6379/15?stream=events&maxlen=1000", "redis", ""},
+		{"https://warehouse.example.com/events", "http", ""},
+		{"file:///tmp/events.ndjson", "file", ""},
+		{"redis://localhost:6379/15?maxlen=lots", "", "invalid event stream maxlen: lots"},
+		{"ftp://example.com/events", "", "unsupported event stream scheme: ftp"},
+	} {
+		sink, err := eventstream.NewSink(tc.url, "")
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, "error mismatch for %s", tc.url)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, tc.name, sink.Name(), "name mismatch for %s", tc.url)
+		}
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var body []byte
+	var signature string
+	status := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get(eventstream.SignatureHeader)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink, err := eventstream.NewSink(server.URL, "sesame")
+	require.NoError(t, err)
+
+	err = sink.Publish(context.Background(), testEvents)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"type": "msg_created", "org_id": 1, "contact_id": 10000, "contact_uuid": "6393abc0-283d-4c9b-a1b3-641a035c34bf", "event": {"type": "msg_created"}},
+		{"type": "contact_groups_changed", "org_id": 1, "contact_id": 10000, "contact_uuid": "6393abc0-283d-4c9b-a1b3-641a035c34bf", "session_id": 123, "event": {"type": "contact_groups_changed"}}
+	]`, string(body))
+	assert.Regexp(t, `^t=\d+,v1=[0-9a-f]{64}$`, signature)
+
+	status = http.StatusServiceUnavailable
+
+	err = sink.Publish(context.Background(), testEvents)
+	assert.EqualError(t, err, "event stream request returned non-2XX status: 503")
+}
+
+func TestSign(t *testing.T) {
+	sig := eventstream.Sign("sesame", time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC), []byte(`[]`))
+	assert.Equal(t, "t=1686830400,v1=3bb4d3488a9c9d7cdff4a3c8b36ae9a423c965f4677540057ca38b03d694760b", sig)
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+
+	sink, err := eventstream.NewSink("file://"+path, "")
+	require.NoError(t, err)
+
+	assert.NoError(t, sink.Publish(context.Background(), testEvents[:1]))
+	assert.NoError(t, sink.Publish(context.Background(), testEvents[1:]))
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"type":"msg_created","org_id":1,"contact_id":10000,"contact_uuid":"6393abc0-283d-4c9b-a1b3-641a035c34bf","event":{"type":"msg_created"}}
+{"type":"contact_groups_changed","org_id":1,"contact_id":10000,"contact_uuid":"6393abc0-283d-4c9b-a1b3-641a035c34bf","session_id":123,"event":{"type":"contact_groups_changed"}}
+`, string(contents))
+}
@@ -0,0 +1,44 @@
+package eventstream
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"sync"
+
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/pkg/errors"
+)
+
+// a sink which appends events as newline delimited JSON to a file, configured like file:///var/log/mailroom/events.ndjson
+type fileSink struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func newFileSink(path string) Sink {
+	return &fileSink{path: path}
+}
+
+func (s *fileSink) Name() string { return "file" }
+
+func (s *fileSink) Publish(ctx context.Context, events []*Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "error opening event stream file %s", s.path)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, e := range events {
+		w.Write(jsonx.MustMarshal(e))
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Wrapf(err, "error writing to event stream file %s", s.path)
+	}
+	return errors.Wrapf(f.Sync(), "error syncing event stream file %s", s.path)
+}
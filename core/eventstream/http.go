@@ -0,0 +1,69 @@
+package eventstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/pkg/errors"
+)
+
+// SignatureHeader is the header which contains the signature of requests to an HTTP sink
+const SignatureHeader = "X-Mailroom-Signature"
+
+var httpSinkClient = &http.Client{Timeout: time.Second * 30}
+
+// a sink which POSTs batches of events as a JSON array to a webhook, signing them if a secret is configured
+type httpSink struct {
+	url    string
+	secret string
+}
+
+func newHTTPSink(url, secret string) Sink {
+	return &httpSink{url: url, secret: secret}
+}
+
+func (s *httpSink) Name() string { return "http" }
+
+func (s *httpSink) Publish(ctx context.Context, events []*Event) error {
+	body := jsonx.MustMarshal(events)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "error creating event stream request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if s.secret != "" {
+		req.Header.Set(SignatureHeader, Sign(s.secret, dates.Now(), body))
+	}
+
+	trace, err := httpx.DoTrace(httpSinkClient, req, nil, nil, 1024)
+	if err != nil {
+		return errors.Wrap(err, "error making event stream request")
+	}
+	if trace.Response.StatusCode/100 != 2 {
+		return errors.Errorf("event stream request returned non-2XX status: %d", trace.Response.StatusCode)
+	}
+	return nil
+}
+
+// Sign generates the signature header value for the given body sent at the given time, which receivers can verify by
+// calculating the HMAC-SHA256 of the timestamp, a period and the body
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := fmt.Sprint(t.Unix())
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
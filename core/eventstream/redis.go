@@ -0,0 +1,74 @@
+package eventstream
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/pkg/errors"
+)
+
+const defaultStreamName = "mailroom:events"
+
+// a sink which adds events to a Redis stream, configured like redis://localhost:6379/0?stream=events&maxlen=100000
+type redisSink struct {
+	rp     *redis.Pool
+	stream string
+	maxLen int
+}
+
+func newRedisSink(u *url.URL) (Sink, error) {
+	stream := u.Query().Get("stream")
+	if stream == "" {
+		stream = defaultStreamName
+	}
+
+	maxLen := 0
+	if m := u.Query().Get("maxlen"); m != "" {
+		var err error
+		if maxLen, err = strconv.Atoi(m); err != nil {
+			return nil, errors.Errorf("invalid event stream maxlen: %s", m)
+		}
+	}
+
+	// strip our own params from the URL before dialing
+	dialURL := *u
+	dialURL.RawQuery = ""
+
+	rp := &redis.Pool{
+		MaxActive:   2,
+		MaxIdle:     2,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(dialURL.String())
+		},
+	}
+
+	return &redisSink{rp: rp, stream: stream, maxLen: maxLen}, nil
+}
+
+func (s *redisSink) Name() string { return "redis" }
+
+func (s *redisSink) Publish(ctx context.Context, events []*Event) error {
+	rc, err := s.rp.GetContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error connecting to event stream redis")
+	}
+	defer rc.Close()
+
+	for _, e := range events {
+		args := []any{s.stream}
+		if s.maxLen > 0 {
+			args = append(args, "MAXLEN", "~", s.maxLen)
+		}
+		args = append(args, "*", "type", e.Type, "org_id", e.OrgID, "contact_uuid", string(e.ContactUUID), "data", jsonx.MustMarshal(e))
+
+		if _, err := rc.Do("XADD", args...); err != nil {
+			return errors.Wrapf(err, "error adding event to stream %s", s.stream)
+		}
+	}
+	return nil
+}
@@ -225,7 +225,7 @@ func RunTestCases(t *testing.T, ctx context.Context, rt *runtime.Runtime, tcs []
 				Events:  make([]flows.Event, 0, len(mods)),
 			}
 
-			scene := models.NewSceneForContact(flowContact, tc.ModifierUser.SafeID())
+			scene := models.NewSceneForContact(flowContact, tc.ModifierUser.SafeID(), models.ContactChangeSourceAPI)
 
 			// apply our modifiers
 			for _, mod := range mods {
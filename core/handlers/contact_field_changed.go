@@ -31,5 +31,7 @@ func handleContactFieldChanged(ctx context.Context, rt *runtime.Runtime, tx *sql
 	scene.AppendToEventPreCommitHook(hooks.UpdateCampaignEventsHook, event)
 	scene.AppendToEventPostCommitHook(hooks.ContactModifiedHook, event)
 
+	scene.AuditContactChange(event)
+
 	return nil
 }
@@ -73,5 +73,7 @@ func handleContactGroupsChanged(ctx context.Context, rt *runtime.Runtime, tx *sq
 		scene.AppendToEventPostCommitHook(hooks.ContactModifiedHook, event)
 	}
 
+	scene.AuditContactChange(event)
+
 	return nil
 }
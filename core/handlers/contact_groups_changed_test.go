@@ -1,14 +1,18 @@
 package handlers_test
 
 import (
+	"fmt"
 	"testing"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/actions"
 	"github.com/nyaruka/mailroom/core/handlers"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestContactGroupsChanged(t *testing.T) {
@@ -60,3 +64,47 @@ func TestContactGroupsChanged(t *testing.T) {
 
 	handlers.RunTestCases(t, ctx, rt, tcs)
 }
+
+func TestContactGroupsChangedTriggers(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	testdata.InsertGroupJoinedTrigger(rt, testdata.Org1, testdata.Favorites, testdata.TestersGroup, nil)
+
+	testers := assets.NewGroupReference(testdata.TestersGroup.UUID, "Testers")
+	doctors := assets.NewGroupReference(testdata.DoctorsGroup.UUID, "Doctors")
+
+	tcs := []handlers.TestCase{
+		{
+			Actions: handlers.ContactActionMap{
+				testdata.Cathy: []flows.Action{
+					actions.NewAddContactGroups(handlers.NewActionUUID(), []*assets.GroupReference{testers}),
+				},
+				testdata.George: []flows.Action{
+					actions.NewAddContactGroups(handlers.NewActionUUID(), []*assets.GroupReference{doctors}),
+				},
+			},
+			Assertions: []handlers.Assertion{
+				func(t *testing.T, rt *runtime.Runtime) error {
+					rc := rt.RP.Get()
+					defer rc.Close()
+
+					// cathy joined testers so has a trigger event queued, george joined doctors so doesn't
+					cathyEvents, err := redis.Strings(rc.Do("LRANGE", fmt.Sprintf("c:1:%d", testdata.Cathy.ID), 0, -1))
+					assert.NoError(t, err)
+					assert.Len(t, cathyEvents, 1)
+					assert.Contains(t, cathyEvents[0], `"type":"trigger_event"`)
+					assert.Contains(t, cathyEvents[0], `"type":"group_joined"`)
+
+					georgeEvents, err := redis.Strings(rc.Do("LRANGE", fmt.Sprintf("c:1:%d", testdata.George.ID), 0, -1))
+					assert.NoError(t, err)
+					assert.Len(t, georgeEvents, 0)
+					return nil
+				},
+			},
+		},
+	}
+
+	handlers.RunTestCases(t, ctx, rt, tcs)
+}
@@ -29,5 +29,7 @@ func handleContactLanguageChanged(ctx context.Context, rt *runtime.Runtime, tx *
 	scene.AppendToEventPreCommitHook(hooks.CommitLanguageChangesHook, event)
 	scene.AppendToEventPostCommitHook(hooks.ContactModifiedHook, event)
 
+	scene.AuditContactChange(event)
+
 	return nil
 }
@@ -29,5 +29,7 @@ func handleContactNameChanged(ctx context.Context, rt *runtime.Runtime, tx *sqlx
 	scene.AppendToEventPreCommitHook(hooks.CommitNameChangesHook, event)
 	scene.AppendToEventPostCommitHook(hooks.ContactModifiedHook, event)
 
+	scene.AuditContactChange(event)
+
 	return nil
 }
@@ -29,5 +29,7 @@ func handleContactStatusChanged(ctx context.Context, rt *runtime.Runtime, tx *sq
 	scene.AppendToEventPreCommitHook(hooks.CommitStatusChangesHook, event)
 	scene.AppendToEventPostCommitHook(hooks.ContactModifiedHook, event)
 
+	scene.AuditContactChange(event)
+
 	return nil
 }
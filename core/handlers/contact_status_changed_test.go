@@ -1,13 +1,17 @@
 package handlers_test
 
 import (
+	"fmt"
 	"testing"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/modifiers"
 	"github.com/nyaruka/mailroom/core/handlers"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestContactStatusChanged(t *testing.T) {
@@ -61,3 +65,44 @@ func TestContactStatusChanged(t *testing.T) {
 
 	handlers.RunTestCases(t, ctx, rt, tcs)
 }
+
+func TestContactStatusChangedTriggers(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	testdata.InsertOptInTrigger(rt, testdata.Org1, testdata.Favorites)
+
+	queued := func(contact *testdata.Contact) int {
+		rc := rt.RP.Get()
+		defer rc.Close()
+
+		n, err := redis.Int(rc.Do("LLEN", fmt.Sprintf("c:1:%d", contact.ID)))
+		if err != nil {
+			panic(err)
+		}
+		return n
+	}
+
+	rt.DB.MustExec(`UPDATE contacts_contact SET status = 'B' WHERE id = $1`, testdata.Cathy.ID)
+	rt.DB.MustExec(`UPDATE contacts_contact SET status = 'S' WHERE id = $1`, testdata.Bob.ID)
+
+	tcs := []handlers.TestCase{
+		{
+			Modifiers: handlers.ContactModifierMap{
+				testdata.Cathy: []flows.Modifier{modifiers.NewStatus(flows.ContactStatusActive)},
+				testdata.Bob:   []flows.Modifier{modifiers.NewStatus(flows.ContactStatusActive)},
+			},
+			Assertions: []handlers.Assertion{
+				func(t *testing.T, rt *runtime.Runtime) error {
+					// bob was stopped so being reactivated counts as opting in, cathy was only blocked so doesn't
+					assert.Equal(t, 1, queued(testdata.Bob))
+					assert.Equal(t, 0, queued(testdata.Cathy))
+					return nil
+				},
+			},
+		},
+	}
+
+	handlers.RunTestCases(t, ctx, rt, tcs)
+}
@@ -36,5 +36,7 @@ func handleContactURNsChanged(ctx context.Context, rt *runtime.Runtime, tx *sqlx
 	scene.AppendToEventPreCommitHook(hooks.CommitURNChangesHook, change)
 	scene.AppendToEventPostCommitHook(hooks.ContactModifiedHook, event)
 
+	scene.AuditContactChange(event)
+
 	return nil
 }
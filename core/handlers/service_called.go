@@ -77,6 +77,7 @@ func handleServiceCalled(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx,
 			)
 		}
 
+		log.SetContactID(scene.ContactID())
 		scene.AppendToEventPreCommitHook(hooks.InsertHTTPLogsHook, log)
 	}
 
@@ -55,6 +55,7 @@ func handleWebhookCalled(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx,
 			event.Retries,
 			event.CreatedOn(),
 		)
+		httpLog.SetContactID(scene.ContactID())
 		scene.AppendToEventPreCommitHook(hooks.InsertHTTPLogsHook, httpLog)
 	}
 
@@ -41,6 +41,23 @@ func (h *commitFieldChangesHook) Apply(ctx context.Context, rt *runtime.Runtime,
 			updates[field.UUID()] = event.Value
 		}
 
+		// look for triggers for changes to these fields
+		for fieldUUID, value := range updates {
+			field := oa.FieldByUUID(fieldUUID)
+			trigger := models.FindMatchingFieldChangedTrigger(oa, scene.Contact(), field)
+
+			var text string
+			if value != nil {
+				text = value.Text.Native()
+			}
+
+			appendTriggerEvent(oa, scene, trigger, map[string]any{
+				"type":  "field_changed",
+				"field": map[string]any{"key": field.Key(), "name": field.Name()},
+				"value": text,
+			})
+		}
+
 		// trim out deletes, adding to our list of global deletes
 		for k, v := range updates {
 			if v == nil || v.Text.Native() == "" {
@@ -23,7 +23,7 @@ func (h *commitGroupChangesHook) Apply(ctx context.Context, rt *runtime.Runtime,
 	changed := make(map[models.ContactID]bool, len(scenes))
 
 	// we remove from our groups at once, build up our list
-	for _, events := range scenes {
+	for scene, events := range scenes {
 		// we use these sets to track what our final add or remove should be
 		seenAdds := make(map[models.GroupID]*models.GroupAdd)
 		seenRemoves := make(map[models.GroupID]*models.GroupRemove)
@@ -42,6 +42,15 @@ func (h *commitGroupChangesHook) Apply(ctx context.Context, rt *runtime.Runtime,
 		for _, add := range seenAdds {
 			adds = append(adds, add)
 			changed[add.ContactID] = true
+
+			// look for a trigger for joining this group
+			if group := oa.GroupByID(add.GroupID); group != nil {
+				trigger := models.FindMatchingGroupJoinedTrigger(oa, scene.Contact(), group)
+				appendTriggerEvent(oa, scene, trigger, map[string]any{
+					"type":  "group_joined",
+					"group": map[string]any{"uuid": group.UUID(), "name": group.Name()},
+				})
+			}
 		}
 
 		for _, remove := range seenRemoves {
@@ -3,6 +3,7 @@ package hooks
 import (
 	"context"
 
+	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/events"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/runtime"
@@ -19,14 +20,33 @@ type commitStatusChangesHook struct{}
 // Apply commits our contact status change
 func (h *commitStatusChangesHook) Apply(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
 
+	// get the statuses the contacts are changing from, so we only consider opting in or out when they actually do
+	contactIDs := make([]models.ContactID, 0, len(scenes))
+	for scene := range scenes {
+		contactIDs = append(contactIDs, scene.ContactID())
+	}
+	previous, err := models.GetContactStatuses(ctx, tx, contactIDs)
+	if err != nil {
+		return errors.Wrapf(err, "error loading previous contact statuses")
+	}
+
 	statusChanges := make([]*models.ContactStatusChange, 0, len(scenes))
 	for scene, es := range scenes {
 
 		event := es[len(es)-1].(*events.ContactStatusChangedEvent)
 		statusChanges = append(statusChanges, &models.ContactStatusChange{ContactID: scene.ContactID(), Status: event.Status})
+
+		// look for triggers for the contact opting in (i.e. being unstopped) or opting out
+		wasStopped := previous[scene.ContactID()] == models.ContactStatusStopped
+
+		if event.Status == flows.ContactStatusActive && wasStopped {
+			appendTriggerEvent(oa, scene, models.FindMatchingOptInTrigger(oa, scene.Contact()), map[string]any{"type": "opt_in"})
+		} else if event.Status == flows.ContactStatusStopped && !wasStopped {
+			appendTriggerEvent(oa, scene, models.FindMatchingOptOutTrigger(oa, scene.Contact()), map[string]any{"type": "opt_out"})
+		}
 	}
 
-	err := models.UpdateContactStatus(ctx, tx, statusChanges)
+	err = models.UpdateContactStatus(ctx, tx, statusChanges)
 	if err != nil {
 		return errors.Wrapf(err, "error updating contact statuses")
 	}
@@ -0,0 +1,57 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+// QueueTriggerEventsHook is our hook for queuing events for contact changes which matched triggers
+var QueueTriggerEventsHook models.EventCommitHook = &queueTriggerEventsHook{}
+
+type queueTriggerEventsHook struct{}
+
+// Apply queues the trigger events to be handled by each contact's queue
+func (h *queueTriggerEventsHook) Apply(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for _, es := range scenes {
+		for _, e := range es {
+			evt := e.(*models.TriggerEvent)
+			task := &queue.Task{Type: models.TriggerEventType, OrgID: int(evt.OrgID), Task: jsonx.MustMarshal(evt), QueuedOn: dates.Now()}
+
+			err := queue.AddContactTask(rc, task.OrgID, int(evt.ContactID), task, false)
+			if err != nil {
+				return errors.Wrapf(err, "error queuing trigger event")
+			}
+		}
+	}
+
+	return nil
+}
+
+// adds a trigger event to be queued after commit if a trigger matched a change to the contact of the given scene
+func appendTriggerEvent(oa *models.OrgAssets, scene *models.Scene, trigger *models.Trigger, params map[string]any) {
+	if trigger == nil {
+		return
+	}
+
+	// changes made by the triggered flow itself can't re-trigger it
+	if scene.Session() != nil && scene.Session().CurrentFlowID() == trigger.FlowID() {
+		return
+	}
+
+	scene.AppendToEventPostCommitHook(QueueTriggerEventsHook, &models.TriggerEvent{
+		ContactID: scene.ContactID(),
+		OrgID:     oa.OrgID(),
+		TriggerID: trigger.ID(),
+		Params:    jsonx.MustMarshal(params),
+	})
+}
@@ -0,0 +1,37 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/eventstream"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	models.RegisterEventStreamHook(StreamEventsHook)
+}
+
+// StreamEventsHook is our hook for queuing events to be published to the event stream
+var StreamEventsHook models.EventCommitHook = &streamEventsHook{}
+
+type streamEventsHook struct{}
+
+// Apply queues the events of each scene, in the order they happened, to be published to the event stream
+func (h *streamEventsHook) Apply(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	for scene, es := range scenes {
+		events := make([]*eventstream.Event, len(es))
+		for i, e := range es {
+			events[i] = eventstream.NewEvent(oa.OrgID(), scene, e.(flows.Event))
+		}
+
+		if err := eventstream.Queue(ctx, tx, events); err != nil {
+			return errors.Wrapf(err, "error queuing events for contact %d", scene.ContactID())
+		}
+	}
+
+	return nil
+}
@@ -93,6 +93,13 @@ func (b *Broadcast) CreateBatch(contactIDs []ContactID, isLast bool) *BroadcastB
 	}
 }
 
+// BroadcastExists returns whether the given org has a broadcast with the given id
+func BroadcastExists(ctx context.Context, db Queryer, orgID OrgID, id BroadcastID) (bool, error) {
+	var exists bool
+	err := db.GetContext(ctx, &exists, `SELECT EXISTS(SELECT 1 FROM msgs_broadcast WHERE org_id = $1 AND id = $2)`, orgID, id)
+	return exists, errors.Wrapf(err, "error checking for broadcast #%d", id)
+}
+
 // MarkBroadcastSent marks the given broadcast as sent
 func MarkBroadcastSent(ctx context.Context, db Queryer, id BroadcastID) error {
 	_, err := db.ExecContext(ctx, `UPDATE msgs_broadcast SET status = 'S', modified_on = now() WHERE id = $1`, id)
@@ -184,13 +191,18 @@ type BroadcastBatch struct {
 	IsLast        bool                        `json:"is_last"`
 }
 
-func (b *BroadcastBatch) CreateMessages(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets) ([]*Msg, error) {
-	// load all our contacts
-	contacts, err := LoadContacts(ctx, rt.DB, oa, b.ContactIDs)
+// LoadContacts loads the contacts of this batch
+func (b *BroadcastBatch) LoadContacts(ctx context.Context, db Queryer, oa *OrgAssets) ([]*Contact, error) {
+	contacts, err := LoadContacts(ctx, db, oa, b.ContactIDs)
 	if err != nil {
 		return nil, errors.Wrap(err, "error loading contacts for broadcast")
 	}
+	return contacts, nil
+}
 
+// CreateMessages creates and inserts this batch's messages for the given contacts, which should have been loaded with
+// LoadContacts
+func (b *BroadcastBatch) CreateMessages(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, contacts []*Contact) ([]*Msg, error) {
 	// for each contact, build our message
 	msgs := make([]*Msg, 0, len(contacts))
 
@@ -206,7 +218,7 @@ func (b *BroadcastBatch) CreateMessages(ctx context.Context, rt *runtime.Runtime
 	}
 
 	// insert them in a single request
-	err = InsertMessages(ctx, rt.DB, msgs)
+	err := InsertMessages(ctx, rt.DB, msgs)
 	if err != nil {
 		return nil, errors.Wrap(err, "error inserting broadcast messages")
 	}
@@ -214,6 +226,26 @@ func (b *BroadcastBatch) CreateMessages(ctx context.Context, rt *runtime.Runtime
 	return msgs, nil
 }
 
+// ChannelCounts returns the number of messages this batch will send on each channel, based on the current destinations
+// of the given contacts, which should have been loaded with LoadContacts
+func (b *BroadcastBatch) ChannelCounts(oa *OrgAssets, contacts []*Contact) (map[*Channel]int, error) {
+	counts := make(map[*Channel]int, 2)
+
+	for _, c := range contacts {
+		contact, err := c.FlowContact(oa)
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating flow contact for broadcast message")
+		}
+
+		out, ch := NewMsgOut(oa, contact, "", nil, nil, envs.NilLocale)
+		if ch != nil && out.UnsendableReason() == flows.NilUnsendableReason {
+			counts[ch]++
+		}
+	}
+
+	return counts, nil
+}
+
 // creates an outgoing message for the given contact - can return nil if resultant message has no content and thus is a noop
 func (b *BroadcastBatch) createMessage(rt *runtime.Runtime, oa *OrgAssets, c *Contact) (*Msg, error) {
 	contact, err := c.FlowContact(oa)
@@ -233,14 +265,7 @@ func (b *BroadcastBatch) createMessage(rt *runtime.Runtime, oa *OrgAssets, c *Co
 	locale := envs.NewLocale(lang, envs.NilCountry)
 
 	if b.TemplateState == TemplateStateUnevaluated {
-		// build up the minimum viable context for templates
-		templateCtx := types.NewXObject(map[string]types.XValue{
-			"contact": flows.Context(oa.Env(), contact),
-			"fields":  flows.Context(oa.Env(), contact.Fields()),
-			"globals": flows.Context(oa.Env(), oa.SessionAssets().Globals()),
-			"urns":    flows.ContextFunc(oa.Env(), contact.URNs().MapContext),
-		})
-		text, _ = excellent.EvaluateTemplate(oa.Env(), templateCtx, text, nil)
+		text, _ = excellent.EvaluateTemplate(oa.Env(), NewTemplateContext(oa, contact), text, nil)
 	}
 
 	// don't create a message if we have no content
@@ -258,3 +283,14 @@ func (b *BroadcastBatch) createMessage(rt *runtime.Runtime, oa *OrgAssets, c *Co
 
 	return msg, nil
 }
+
+// NewTemplateContext builds the minimum viable context for evaluating templates in messages sent to the given contact
+// outside of a flow
+func NewTemplateContext(oa *OrgAssets, contact *flows.Contact) *types.XObject {
+	return types.NewXObject(map[string]types.XValue{
+		"contact": flows.Context(oa.Env(), contact),
+		"fields":  flows.Context(oa.Env(), contact.Fields()),
+		"globals": flows.Context(oa.Env(), oa.SessionAssets().Globals()),
+		"urns":    flows.ContextFunc(oa.Env(), contact.URNs().MapContext),
+	})
+}
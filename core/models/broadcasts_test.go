@@ -56,7 +56,10 @@ func TestNonPersistentBroadcasts(t *testing.T) {
 	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
 	require.NoError(t, err)
 
-	msgs, err := batch.CreateMessages(ctx, rt, oa)
+	contacts, err := batch.LoadContacts(ctx, rt.DB, oa)
+	require.NoError(t, err)
+
+	msgs, err := batch.CreateMessages(ctx, rt, oa, contacts)
 	require.NoError(t, err)
 
 	assert.Equal(t, 2, len(msgs))
@@ -184,7 +187,10 @@ func TestBroadcastBatchCreateMessage(t *testing.T) {
 
 		rt.DB.MustExec(`UPDATE contacts_contact SET language = $2 WHERE id = $1`, testdata.Cathy.ID, tc.contactLanguage)
 
-		msgs, err := batch.CreateMessages(ctx, rt, oa)
+		contacts, err := batch.LoadContacts(ctx, rt.DB, oa)
+		require.NoError(t, err)
+
+		msgs, err := batch.CreateMessages(ctx, rt, oa, contacts)
 		if tc.expectedError != "" {
 			assert.EqualError(t, err, tc.expectedError, "error mismatch in test case %d", i)
 		} else {
@@ -32,6 +32,7 @@ const (
 	ChannelLogTypeIVRCallback = "ivr_callback"
 	ChannelLogTypeIVRStatus   = "ivr_status"
 	ChannelLogTypeIVRHangup   = "ivr_hangup"
+	ChannelLogTypeAndroidSync = "android_sync"
 )
 
 type ChannelError struct {
@@ -150,7 +151,12 @@ type stChannelLog struct {
 }
 
 func (l *stChannelLog) path() string {
-	return path.Join("channels", string(l.ChannelUUID), string(l.UUID[:4]), fmt.Sprintf("%s.json", l.UUID))
+	return channelLogPath(l.ChannelUUID, l.UUID)
+}
+
+// returns the path in logs storage of the attached channel log with the given UUID
+func channelLogPath(channelUUID assets.ChannelUUID, logUUID ChannelLogUUID) string {
+	return path.Join("channels", string(channelUUID), string(logUUID[:4]), fmt.Sprintf("%s.json", logUUID))
 }
 
 // InsertChannelLogs writes the given channel logs to the db
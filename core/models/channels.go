@@ -35,6 +35,7 @@ const (
 	ChannelConfigCallbackDomain      = "callback_domain"
 	ChannelConfigMaxConcurrentEvents = "max_concurrent_events"
 	ChannelConfigFCMID               = "FCM_ID"
+	ChannelConfigDedupeByContent     = "dedupe_by_content"
 )
 
 // Channel is the mailroom struct that represents channels
@@ -104,6 +105,13 @@ func (c *Channel) Parent() *assets.ChannelReference { return c.c.Parent }
 // Config returns the config for this channel
 func (c *Channel) Config() map[string]interface{} { return c.c.Config }
 
+// DedupeByContent returns whether incoming messages without external IDs on this channel should be checked for
+// duplicates by their content, which channels opt in to if they can't supply external IDs
+func (c *Channel) DedupeByContent() bool {
+	dedupe, _ := c.c.Config[ChannelConfigDedupeByContent].(bool)
+	return dedupe
+}
+
 // ConfigValue returns the config value for the passed in key
 func (c *Channel) ConfigValue(key string, def string) string {
 	value := c.c.Config[key]
@@ -0,0 +1,236 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ConsentChangedEventType is the event type of contact audit entries which record consent changes
+	ConsentChangedEventType = "consent_changed"
+
+	configConsentKeywords = "consent_keywords"
+)
+
+// ConsentKeywords are the STOP and START keywords for a language, which are read from the consent_keywords key of the
+// org config, e.g. {"eng": {"stop": ["stop", "unsubscribe"], "start": ["start"]}}
+type ConsentKeywords struct {
+	Stop  []string
+	Start []string
+}
+
+// ConsentKeywordsForLanguage gets the consent keywords the org has configured for the given language, falling back to
+// those of the org's default language, and returns nil if there are none
+func ConsentKeywordsForLanguage(org *Org, lang envs.Language) *ConsentKeywords {
+	config, _ := org.o.Config[configConsentKeywords].(map[string]any)
+	if len(config) == 0 {
+		return nil
+	}
+
+	for _, l := range []envs.Language{lang, org.DefaultLanguage()} {
+		if l == envs.NilLanguage {
+			continue
+		}
+		if byAction, ok := config[string(l)].(map[string]any); ok {
+			return &ConsentKeywords{Stop: keywordList(byAction["stop"]), Start: keywordList(byAction["start"])}
+		}
+	}
+	return nil
+}
+
+func keywordList(v any) []string {
+	values, _ := v.([]any)
+	keywords := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok && strings.TrimSpace(s) != "" {
+			keywords = append(keywords, s)
+		}
+	}
+	return keywords
+}
+
+// Match checks whether the given message text is one of these keywords, returning the keyword and whether it's a STOP
+// keyword. A message only matches if it consists entirely of the keyword, ignoring case and punctuation.
+func (k *ConsentKeywords) Match(text string) (string, bool) {
+	normalized := normalizeKeyword(text)
+	if normalized == "" {
+		return "", false
+	}
+
+	for _, kw := range k.Stop {
+		if normalizeKeyword(kw) == normalized {
+			return kw, true
+		}
+	}
+	for _, kw := range k.Start {
+		if normalizeKeyword(kw) == normalized {
+			return kw, false
+		}
+	}
+	return "", false
+}
+
+func normalizeKeyword(s string) string {
+	return strings.ToLower(strings.Join(utils.TokenizeString(s), " "))
+}
+
+// URNConsent is the consent of a URN to receive messages on a channel, as recorded in contact audit entries
+type URNConsent struct {
+	URN      urns.URN                 `json:"urn"`
+	Channel  *assets.ChannelReference `json:"channel"`
+	OptedOut bool                     `json:"opted_out"`
+	Keyword  string                   `json:"keyword,omitempty"`
+	MsgUUID  flows.MsgUUID            `json:"msg_uuid,omitempty"`
+}
+
+// IsOptedOut returns whether the given URN has opted out of receiving messages on the given channel
+func IsOptedOut(ctx context.Context, db Queryer, channel *Channel, urn urns.URN) (bool, error) {
+	var optedOut bool
+	err := db.GetContext(ctx, &optedOut, `SELECT EXISTS(SELECT 1 FROM msgs_optout WHERE channel_id = $1 AND urn_identity = $2)`, channel.ID(), urn.Identity())
+	return optedOut, errors.Wrap(err, "error checking URN opt-out")
+}
+
+const sqlSelectOptedOutMsgs = `
+SELECT m.idx
+  FROM unnest($1::int[], $2::text[]) WITH ORDINALITY AS m(channel_id, urn_identity, idx)
+  JOIN msgs_optout o ON o.channel_id = m.channel_id AND o.urn_identity = m.urn_identity`
+
+// outgoing messages with these statuses haven't been sent yet and so can still be failed if their URN has opted out
+var optOutCandidateStatuses = map[MsgStatus]bool{
+	MsgStatusPending:      true,
+	MsgStatusInitializing: true,
+	MsgStatusQueued:       true,
+	MsgStatusErrored:      true,
+	MsgStatusScheduled:    true,
+}
+
+// whether the msgs_optout table has been found, so that until it's been created by RapidPro's migrations, opt-outs are
+// just ignored rather than failing every attempt to send a message
+var optOutsTableExists atomic.Bool
+
+// FailOptedOutMsgs fails any of the given outgoing messages which haven't yet been sent but are to URNs which have opted
+// out of receiving messages on their channels, looking up opt-outs for all of them with a single query. It's called by
+// InsertMessages for new messages, and for existing messages which are about to be sent again, in which case they're
+// also failed in the database.
+func FailOptedOutMsgs(ctx context.Context, db Queryer, msgs []*Msg) error {
+	candidates := make([]*Msg, 0, len(msgs))
+	channelIDs := make([]ChannelID, 0, len(msgs))
+	identities := make([]string, 0, len(msgs))
+
+	for _, m := range msgs {
+		if m.Direction() == DirectionOut && optOutCandidateStatuses[m.Status()] && m.ChannelID() != NilChannelID && m.URN() != urns.NilURN {
+			candidates = append(candidates, m)
+			channelIDs = append(channelIDs, m.ChannelID())
+			identities = append(identities, string(m.URN().Identity()))
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if !optOutsTableExists.Load() {
+		var exists bool
+		if err := db.GetContext(ctx, &exists, `SELECT to_regclass('msgs_optout') IS NOT NULL`); err != nil {
+			return errors.Wrap(err, "error checking for URN opt-outs table")
+		}
+		if !exists {
+			return nil
+		}
+		optOutsTableExists.Store(true)
+	}
+
+	var optedOut []int
+	if err := db.SelectContext(ctx, &optedOut, sqlSelectOptedOutMsgs, pq.Array(channelIDs), pq.Array(identities)); err != nil {
+		return errors.Wrap(err, "error looking up URN opt-outs")
+	}
+
+	existing := make([]*Msg, 0, len(optedOut))
+
+	for _, idx := range optedOut {
+		m := candidates[idx-1]
+		if m.ID() != flows.MsgID(NilMsgID) {
+			existing = append(existing, m)
+		} else {
+			m.m.Status = MsgStatusFailed
+			m.m.FailedReason = MsgFailedOptedOut
+			m.m.NextAttempt = nil
+		}
+	}
+
+	if len(existing) > 0 {
+		return FailMessages(ctx, db, existing, MsgFailedOptedOut)
+	}
+	return nil
+}
+
+// fails any of the given messages which are to URNs that have opted out, and returns those which can still be sent
+func failOptedOutAndFilter(ctx context.Context, db Queryer, msgs []*Msg) ([]*Msg, error) {
+	if err := FailOptedOutMsgs(ctx, db, msgs); err != nil {
+		return nil, err
+	}
+
+	sendable := make([]*Msg, 0, len(msgs))
+	for _, m := range msgs {
+		if m.Status() != MsgStatusFailed {
+			sendable = append(sendable, m)
+		}
+	}
+	return sendable, nil
+}
+
+const sqlInsertOptOut = `
+INSERT INTO msgs_optout(org_id, channel_id, urn_identity, created_on) VALUES($1, $2, $3, $4)
+    ON CONFLICT (channel_id, urn_identity) DO NOTHING`
+
+const sqlDeleteOptOut = `DELETE FROM msgs_optout WHERE channel_id = $1 AND urn_identity = $2`
+
+// RecordConsentChange opts the given URN out of or back in to receiving messages on the given channel, recording the
+// change as an entry in the contact's audit log. Returns whether consent actually changed.
+func RecordConsentChange(ctx context.Context, db Queryer, orgID OrgID, contactID ContactID, channel *Channel, urn urns.URN, optOut bool, keyword string, msgUUID flows.MsgUUID) (bool, error) {
+	now := dates.Now()
+	identity := urn.Identity()
+
+	var res sql.Result
+	var err error
+	if optOut {
+		res, err = db.ExecContext(ctx, sqlInsertOptOut, orgID, channel.ID(), identity, now)
+	} else {
+		res, err = db.ExecContext(ctx, sqlDeleteOptOut, channel.ID(), identity)
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "error updating URN opt-out")
+	}
+
+	// nothing to record if the URN was already opted out or in
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return false, nil
+	}
+
+	audit := &ContactAudit{
+		OrgID:     orgID,
+		ContactID: contactID,
+		Source:    ContactChangeSourceSystem,
+		EventType: ConsentChangedEventType,
+		Attribute: "consent",
+		Before:    auditValue(&URNConsent{URN: identity, Channel: channel.ChannelReference(), OptedOut: !optOut}),
+		After:     auditValue(&URNConsent{URN: identity, Channel: channel.ChannelReference(), OptedOut: optOut, Keyword: keyword, MsgUUID: msgUUID}),
+		CreatedOn: now,
+	}
+
+	if err := InsertContactAudits(ctx, db, []*ContactAudit{audit}); err != nil {
+		return false, errors.Wrap(err, "error recording consent change")
+	}
+
+	return true, nil
+}
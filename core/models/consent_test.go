@@ -0,0 +1,136 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsentKeywords(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// no keywords configured
+	assert.Nil(t, models.ConsentKeywordsForLanguage(oa.Org(), "eng"))
+
+	rt.DB.MustExec(`UPDATE orgs_org SET config = config || '{"consent_keywords": {"eng": {"stop": ["stop", "stop all"], "start": ["start"]}, "spa": {"stop": ["parar"], "start": ["iniciar"]}}}'::jsonb, flow_languages = '{"eng", "spa"}' WHERE id = $1`, testdata.Org1.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	eng := models.ConsentKeywordsForLanguage(oa.Org(), "eng")
+	assert.Equal(t, &models.ConsentKeywords{Stop: []string{"stop", "stop all"}, Start: []string{"start"}}, eng)
+	assert.Equal(t, []string{"parar"}, models.ConsentKeywordsForLanguage(oa.Org(), "spa").Stop)
+	assert.Equal(t, eng, models.ConsentKeywordsForLanguage(oa.Org(), "kin"))            // falls back to org default language
+	assert.Equal(t, eng, models.ConsentKeywordsForLanguage(oa.Org(), envs.NilLanguage)) // as does no language
+
+	tcs := []struct {
+		text    string
+		keyword string
+		optOut  bool
+	}{
+		{"stop", "stop", true},
+		{" STOP! ", "stop", true},
+		{"Stop all", "stop all", true},
+		{"start", "start", false},
+		{"please stop", "", false},
+		{"", "", false},
+	}
+
+	for _, tc := range tcs {
+		keyword, optOut := eng.Match(tc.text)
+		assert.Equal(t, tc.keyword, keyword, "keyword mismatch for '%s'", tc.text)
+		assert.Equal(t, tc.optOut, optOut, "opt-out mismatch for '%s'", tc.text)
+	}
+}
+
+func TestRecordConsentChange(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	twilio := oa.ChannelByID(testdata.TwilioChannel.ID)
+	vonage := oa.ChannelByID(testdata.VonageChannel.ID)
+
+	optedOut, err := models.IsOptedOut(ctx, rt.DB, twilio, testdata.Cathy.URN)
+	assert.NoError(t, err)
+	assert.False(t, optedOut)
+
+	changed, err := models.RecordConsentChange(ctx, rt.DB, testdata.Org1.ID, testdata.Cathy.ID, twilio, testdata.Cathy.URN, true, "stop", flows.MsgUUID("0a1ec4ab-0a36-4c3c-a4d5-4e5d1d4d8b5e"))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	// URN is only opted out on that channel
+	optedOut, _ = models.IsOptedOut(ctx, rt.DB, twilio, testdata.Cathy.URN)
+	assert.True(t, optedOut)
+	optedOut, _ = models.IsOptedOut(ctx, rt.DB, vonage, testdata.Cathy.URN)
+	assert.False(t, optedOut)
+
+	// opting out again isn't a change
+	changed, err = models.RecordConsentChange(ctx, rt.DB, testdata.Org1.ID, testdata.Cathy.ID, twilio, testdata.Cathy.URN, true, "stop", flows.MsgUUID("7e3ec2b8-1b94-4e0a-a1a4-5bda2c09b0a5"))
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// and outgoing messages to that URN on that channel are failed, but not those to other URNs or on other channels
+	_, cathy := testdata.Cathy.Load(rt, oa)
+	_, bob := testdata.Bob.Load(rt, oa)
+
+	newMsg := func(contact *flows.Contact, urn urns.URN, channel *models.Channel) *models.Msg {
+		out := flows.NewMsgOut(urn, channel.ChannelReference(), "Hi", nil, nil, nil, flows.NilMsgTopic, envs.NilLocale, flows.NilUnsendableReason)
+		msg, err := models.NewOutgoingChatMsg(rt, oa.Org(), channel, contact, out, dates.Now(), models.NilUserID)
+		require.NoError(t, err)
+		return msg
+	}
+
+	msg1 := newMsg(cathy, testdata.Cathy.URN, twilio)
+	msg2 := newMsg(cathy, testdata.Cathy.URN, vonage)
+	msg3 := newMsg(bob, testdata.Bob.URN, twilio)
+
+	err = models.InsertMessages(ctx, rt.DB, []*models.Msg{msg1, msg2, msg3})
+	require.NoError(t, err)
+
+	assert.Equal(t, models.MsgStatusFailed, msg1.Status())
+	assert.Equal(t, models.MsgFailedOptedOut, msg1.FailedReason())
+	assert.Equal(t, models.MsgStatusQueued, msg2.Status())
+	assert.Equal(t, models.MsgStatusQueued, msg3.Status())
+
+	assertdb.Query(t, rt.DB, `SELECT status, failed_reason FROM msgs_msg WHERE id = $1`, msg1.ID()).Columns(map[string]any{"status": "F", "failed_reason": "P"})
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_msg WHERE id = $1`, msg2.ID()).Returns("Q")
+
+	// an existing message which is about to be retried is failed in the database instead
+	msg4 := testdata.InsertErroredOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", 1, time.Now().Add(-time.Minute), false)
+
+	retries, err := models.GetMessagesForRetry(ctx, rt.DB)
+	require.NoError(t, err)
+	assert.Len(t, retries, 0)
+
+	assertdb.Query(t, rt.DB, `SELECT status, failed_reason FROM msgs_msg WHERE id = $1`, msg4.ID()).Columns(map[string]any{"status": "F", "failed_reason": "P"})
+
+	changed, err = models.RecordConsentChange(ctx, rt.DB, testdata.Org1.ID, testdata.Cathy.ID, twilio, testdata.Cathy.URN, false, "start", flows.MsgUUID("d4d0b4c5-9f57-4a8c-b9d7-4b0e0d8e3e0f"))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	optedOut, _ = models.IsOptedOut(ctx, rt.DB, twilio, testdata.Cathy.URN)
+	assert.False(t, optedOut)
+
+	// both changes are recorded in the contact's audit log
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactaudit WHERE contact_id = $1 AND event_type = 'consent_changed'`, testdata.Cathy.ID).Returns(2)
+	assertdb.Query(t, rt.DB, `SELECT after::jsonb->>'keyword' FROM contacts_contactaudit WHERE contact_id = $1 AND event_type = 'consent_changed' ORDER BY id LIMIT 1`, testdata.Cathy.ID).Returns("stop")
+}
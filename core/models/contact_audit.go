@@ -0,0 +1,239 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/null/v2"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ContactAuditID is our type for contact audit entry ids
+type ContactAuditID int64
+
+// ContactChangeSource is where a change to a contact came from
+type ContactChangeSource string
+
+// contact change sources
+const (
+	ContactChangeSourceAPI    = ContactChangeSource("A")
+	ContactChangeSourceFlow   = ContactChangeSource("F")
+	ContactChangeSourceImport = ContactChangeSource("I")
+	ContactChangeSourceSystem = ContactChangeSource("S")
+)
+
+// ContactAudit is an entry in a contact's audit log recording a single change to the contact
+type ContactAudit struct {
+	ID        ContactAuditID      `db:"id"         json:"id"`
+	OrgID     OrgID               `db:"org_id"     json:"-"`
+	ContactID ContactID           `db:"contact_id" json:"contact_id"`
+	UserID    UserID              `db:"user_id"    json:"user_id,omitempty"`
+	FlowID    FlowID              `db:"flow_id"    json:"flow_id,omitempty"`
+	Source    ContactChangeSource `db:"source"     json:"source"`
+	EventType string              `db:"event_type" json:"event_type"`
+	Attribute string              `db:"attribute"  json:"attribute"`
+	Before    null.JSON           `db:"before"     json:"before"`
+	After     null.JSON           `db:"after"      json:"after"`
+	CreatedOn time.Time           `db:"created_on" json:"created_on"`
+}
+
+// builds and inserts the audit entries for the contact changes in the given scenes. The before value of each change
+// is the contact's value for the changed attribute in the database, as loaded for all scenes at once, or as changed by
+// a previous event in the same scene.
+func insertSceneContactAudits(ctx context.Context, tx *sqlx.Tx, oa *OrgAssets, scenes []*Scene) error {
+	contactIDs := make([]ContactID, 0, len(scenes))
+	for _, s := range scenes {
+		if len(s.auditEvents) > 0 {
+			contactIDs = append(contactIDs, s.ContactID())
+		}
+	}
+	if len(contactIDs) == 0 {
+		return nil
+	}
+
+	contacts, err := LoadContacts(ctx, tx, oa, contactIDs)
+	if err != nil {
+		return errors.Wrap(err, "error loading contacts for audit")
+	}
+
+	contactsByID := make(map[ContactID]*Contact, len(contacts))
+	for _, c := range contacts {
+		contactsByID[c.ID()] = c
+	}
+
+	audits := make([]*ContactAudit, 0, len(contactIDs))
+
+	for _, s := range scenes {
+		if len(s.auditEvents) == 0 {
+			continue
+		}
+
+		// contact may have been deleted since the scene was loaded, in which case there's nothing to audit
+		contact := contactsByID[s.ContactID()]
+		if contact == nil {
+			logrus.WithField("contact_id", s.ContactID()).WithField("org_id", oa.OrgID()).Warn("skipping audit of changes to missing contact")
+			s.auditEvents = nil
+			continue
+		}
+
+		state := contactAuditState(contact)
+
+		for _, e := range s.auditEvents {
+			audit, err := newContactAudit(oa, s, state, e)
+			if err != nil {
+				return err
+			}
+			audits = append(audits, audit)
+		}
+
+		s.auditEvents = nil
+	}
+
+	return InsertContactAudits(ctx, tx, audits)
+}
+
+// creates a new audit entry for the given contact change event, updating the given contact state with the change
+func newContactAudit(oa *OrgAssets, scene *Scene, state map[string]any, e flows.Event) (*ContactAudit, error) {
+	var attribute string
+	var after any
+
+	switch typed := e.(type) {
+	case *events.ContactNameChangedEvent:
+		attribute, after = "name", nilIfEmpty(typed.Name)
+	case *events.ContactLanguageChangedEvent:
+		attribute, after = "language", nilIfEmpty(typed.Language)
+	case *events.ContactStatusChangedEvent:
+		attribute, after = "status", typed.Status
+	case *events.ContactFieldChangedEvent:
+		attribute = "fields." + typed.Field.Key
+		if typed.Value != nil {
+			after = typed.Value.Text.Native()
+		}
+	case *events.ContactURNsChangedEvent:
+		attribute, after = "urns", typed.URNs
+	case *events.ContactGroupsChangedEvent:
+		attribute, after = "groups", changeGroups(state["groups"].([]*assets.GroupReference), typed.GroupsAdded, typed.GroupsRemoved)
+	default:
+		return nil, errors.Errorf("can't audit event of type %s", e.Type())
+	}
+
+	before := state[attribute]
+	state[attribute] = after
+
+	audit := &ContactAudit{
+		OrgID:     oa.OrgID(),
+		ContactID: scene.ContactID(),
+		UserID:    scene.UserID(),
+		Source:    scene.Source(),
+		EventType: e.Type(),
+		Attribute: attribute,
+		Before:    auditValue(before),
+		After:     auditValue(after),
+		CreatedOn: e.CreatedOn(),
+	}
+	if scene.Session() != nil {
+		audit.FlowID = scene.Session().CurrentFlowID()
+	}
+	return audit, nil
+}
+
+// gets the state of the given contact which changes are audited against
+func contactAuditState(contact *Contact) map[string]any {
+	groups := make([]*assets.GroupReference, 0, len(contact.Groups()))
+	for _, g := range contact.Groups() {
+		groups = append(groups, assets.NewGroupReference(g.UUID(), g.Name()))
+	}
+
+	state := map[string]any{
+		"name":     nilIfEmpty(contact.Name()),
+		"language": nilIfEmpty(string(contact.Language())),
+		"status":   contactToFlowStatus[contact.Status()],
+		"urns":     contact.URNs(),
+		"groups":   changeGroups(groups, nil, nil),
+	}
+	for key, value := range contact.Fields() {
+		if value != nil {
+			state["fields."+key] = value.Text.Native()
+		}
+	}
+	return state
+}
+
+// applies additions and removals to a list of groups, returning a new list sorted by name
+func changeGroups(groups, added, removed []*assets.GroupReference) []*assets.GroupReference {
+	byUUID := make(map[assets.GroupUUID]*assets.GroupReference, len(groups)+len(added))
+	for _, g := range groups {
+		byUUID[g.UUID] = g
+	}
+	for _, g := range added {
+		byUUID[g.UUID] = g
+	}
+	for _, g := range removed {
+		delete(byUUID, g.UUID)
+	}
+
+	changed := make([]*assets.GroupReference, 0, len(byUUID))
+	for _, g := range byUUID {
+		changed = append(changed, g)
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Name < changed[j].Name })
+	return changed
+}
+
+func nilIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func auditValue(v any) null.JSON {
+	if v == nil {
+		return nil
+	}
+	return null.JSON(jsonx.MustMarshal(v))
+}
+
+const insertContactAuditsSQL = `
+INSERT INTO contacts_contactaudit( org_id,  contact_id,  user_id,  flow_id,  source,  event_type,  attribute,  before,  after,  created_on)
+                           VALUES(:org_id, :contact_id, :user_id, :flow_id, :source, :event_type, :attribute, :before, :after, :created_on)
+RETURNING id
+`
+
+// InsertContactAudits inserts the given contact audit entries
+func InsertContactAudits(ctx context.Context, db Queryer, audits []*ContactAudit) error {
+	return BulkQuery(ctx, "inserted contact audits", db, insertContactAuditsSQL, audits)
+}
+
+const selectContactAuditsSQL = `
+SELECT id, org_id, contact_id, user_id, flow_id, source, event_type, attribute, before, after, created_on
+  FROM contacts_contactaudit
+ WHERE org_id = $1 AND contact_id = $2 AND ($3 = 0 OR id < $3)
+ ORDER BY id DESC
+ LIMIT $4`
+
+// GetContactAudits gets the audit entries for the given contact, newest first, optionally only those before the given id
+func GetContactAudits(ctx context.Context, db Queryer, orgID OrgID, contactID ContactID, beforeID ContactAuditID, limit int) ([]*ContactAudit, error) {
+	rows, err := db.QueryxContext(ctx, selectContactAuditsSQL, orgID, contactID, beforeID, limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying audits for contact %d", contactID)
+	}
+	defer rows.Close()
+
+	audits := make([]*ContactAudit, 0, limit)
+	for rows.Next() {
+		a := &ContactAudit{}
+		if err := rows.StructScan(a); err != nil {
+			return nil, errors.Wrap(err, "error scanning contact audit")
+		}
+		audits = append(audits, a)
+	}
+	return audits, nil
+}
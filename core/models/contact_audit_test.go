@@ -0,0 +1,74 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/modifiers"
+	_ "github.com/nyaruka/mailroom/core/handlers"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactAudits(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	oa := testdata.Org1.Load(rt)
+	_, cathy := testdata.Cathy.Load(rt, oa)
+	testers := oa.SessionAssets().Groups().Get(testdata.TestersGroup.UUID)
+
+	_, err := models.ApplyModifiers(ctx, rt, oa, testdata.Admin.ID, models.ContactChangeSourceAPI, map[*flows.Contact][]flows.Modifier{
+		cathy: {
+			modifiers.NewName("Kathy"),
+			modifiers.NewName("Catherine"),
+			modifiers.NewGroups([]*flows.Group{testers}, modifiers.GroupsAdd),
+		},
+	})
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactaudit WHERE contact_id = $1`, testdata.Cathy.ID).Returns(3)
+
+	// consecutive changes to the same attribute are chained
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactaudit WHERE contact_id = $1 AND attribute = 'name' AND before = '"Cathy"' AND after = '"Kathy"' AND user_id = $2 AND source = 'A'`, testdata.Cathy.ID, testdata.Admin.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactaudit WHERE contact_id = $1 AND attribute = 'name' AND before = '"Kathy"' AND after = '"Catherine"'`, testdata.Cathy.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactaudit WHERE contact_id = $1 AND attribute = 'groups' AND jsonb_array_length(before) = 1 AND jsonb_array_length(after) = 2 AND after @> '[{"name": "Testers"}]'`, testdata.Cathy.ID).Returns(1)
+
+	audits, err := models.GetContactAudits(ctx, rt.DB, testdata.Org1.ID, testdata.Cathy.ID, 0, 2)
+	require.NoError(t, err)
+	assert.Len(t, audits, 2)
+	assert.Equal(t, "contact_groups_changed", audits[0].EventType)
+	assert.Equal(t, "name", audits[1].Attribute)
+	assert.Equal(t, `"Catherine"`, string(audits[1].After))
+
+	audits, err = models.GetContactAudits(ctx, rt.DB, testdata.Org1.ID, testdata.Cathy.ID, audits[1].ID, 10)
+	require.NoError(t, err)
+	assert.Len(t, audits, 1)
+	assert.Equal(t, `"Cathy"`, string(audits[0].Before))
+
+	// changes from imports record that as their source
+	_, err = models.ApplyModifiers(ctx, rt, oa, models.NilUserID, models.ContactChangeSourceImport, map[*flows.Contact][]flows.Modifier{
+		cathy: {modifiers.NewStatus(flows.ContactStatusBlocked)},
+	})
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactaudit WHERE contact_id = $1 AND attribute = 'status' AND before = '"active"' AND after = '"blocked"' AND user_id IS NULL AND source = 'I'`, testdata.Cathy.ID).Returns(1)
+
+	// changes to a contact which has been deleted aren't audited but don't prevent other changes being committed
+	_, bob := testdata.Bob.Load(rt, oa)
+	rt.DB.MustExec(`UPDATE contacts_contact SET is_active = FALSE WHERE id = $1`, testdata.Bob.ID)
+
+	_, err = models.ApplyModifiers(ctx, rt, oa, models.NilUserID, models.ContactChangeSourceAPI, map[*flows.Contact][]flows.Modifier{
+		cathy: {modifiers.NewName("Cat")},
+		bob:   {modifiers.NewName("Robert")},
+	})
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactaudit WHERE contact_id = $1 AND after = '"Cat"'`, testdata.Cathy.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactaudit WHERE contact_id = $1`, testdata.Bob.ID).Returns(0)
+}
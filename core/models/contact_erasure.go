@@ -0,0 +1,182 @@
+package models
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/gocommon/storage"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/null/v2"
+	"github.com/pkg/errors"
+)
+
+// ContactErasure is a report of what was removed when erasing a contact's data
+type ContactErasure struct {
+	ErasedOn            time.Time `json:"erased_on"`
+	SessionsInterrupted int       `json:"sessions_interrupted"`
+	SessionOutputs      int       `json:"session_outputs"`
+	ChannelLogs         int       `json:"channel_logs"`
+	HTTPLogs            int       `json:"http_logs"`
+	AuditEntries        int       `json:"audit_entries"`
+	QueuedEvents        int       `json:"queued_events"`
+	SearchDocuments     int       `json:"search_documents"`
+}
+
+// Total returns the total number of things that were removed or redacted
+func (e *ContactErasure) Total() int {
+	return e.SessionsInterrupted + e.SessionOutputs + e.ChannelLogs + e.HTTPLogs + e.AuditEntries + e.QueuedEvents + e.SearchDocuments
+}
+
+// what we overwrite session outputs in storage with, since storage doesn't support deletion
+var redactedSessionOutput = []byte(`{"redacted":true}`)
+
+const sqlSelectSessionOutputsForContact = `
+SELECT id, output_url
+  FROM flows_flowsession
+ WHERE contact_id = $1 AND (output IS NOT NULL OR output_url IS NOT NULL)`
+
+// RedactSessionOutputs overwrites the outputs of the given contact's sessions in session storage, i.e. the objects
+// written to Session.StoragePath, and clears the outputs and output URLs on the sessions themselves. Waiting sessions
+// should be interrupted first. Returns the number of sessions redacted.
+func RedactSessionOutputs(ctx context.Context, rt *runtime.Runtime, contactID ContactID) (int, error) {
+	var sessions []struct {
+		ID        SessionID   `db:"id"`
+		OutputURL null.String `db:"output_url"`
+	}
+	if err := rt.DB.SelectContext(ctx, &sessions, sqlSelectSessionOutputsForContact, contactID); err != nil {
+		return 0, errors.Wrapf(err, "error selecting sessions for contact #%d", contactID)
+	}
+
+	sessionIDs := make([]SessionID, len(sessions))
+	uploads := make([]*storage.Upload, 0, len(sessions))
+
+	for i, s := range sessions {
+		sessionIDs[i] = s.ID
+
+		if s.OutputURL != "" {
+			// strip just the path out of our output URL
+			u, err := url.Parse(string(s.OutputURL))
+			if err != nil {
+				return 0, errors.Wrapf(err, "error parsing output URL: %s", s.OutputURL)
+			}
+
+			uploads = append(uploads, &storage.Upload{Path: u.Path, Body: redactedSessionOutput, ContentType: "application/json"})
+		}
+	}
+
+	if len(uploads) > 0 {
+		if err := rt.SessionStorage.BatchPut(ctx, uploads); err != nil {
+			return 0, errors.Wrapf(err, "error overwriting session outputs in storage")
+		}
+	}
+
+	if len(sessionIDs) > 0 {
+		_, err := rt.DB.ExecContext(ctx, `UPDATE flows_flowsession SET output = NULL, output_url = NULL WHERE id = ANY($1)`, pq.Array(sessionIDs))
+		if err != nil {
+			return 0, errors.Wrapf(err, "error clearing session outputs")
+		}
+	}
+
+	return len(sessionIDs), nil
+}
+
+const sqlSelectAttachedChannelLogsForContact = `
+SELECT ch.uuid AS channel_uuid, l.log_uuid
+  FROM (
+    SELECT channel_id, unnest(log_uuids) AS log_uuid FROM msgs_msg WHERE contact_id = $1 AND log_uuids IS NOT NULL
+     UNION ALL
+    SELECT channel_id, unnest(log_uuids) AS log_uuid FROM ivr_call WHERE contact_id = $1 AND log_uuids IS NOT NULL
+  ) l
+  JOIN channels_channel ch ON ch.id = l.channel_id`
+
+// RedactChannelLogs overwrites the channel logs in logs storage which are attached to the given contact's messages and
+// calls. Returns the number of channel logs redacted.
+func RedactChannelLogs(ctx context.Context, rt *runtime.Runtime, contactID ContactID) (int, error) {
+	var logs []struct {
+		ChannelUUID assets.ChannelUUID `db:"channel_uuid"`
+		LogUUID     ChannelLogUUID     `db:"log_uuid"`
+	}
+	if err := rt.DB.SelectContext(ctx, &logs, sqlSelectAttachedChannelLogsForContact, contactID); err != nil {
+		return 0, errors.Wrapf(err, "error selecting channel logs for contact #%d", contactID)
+	}
+
+	uploads := make([]*storage.Upload, len(logs))
+	for i, l := range logs {
+		redacted := &stChannelLog{UUID: l.LogUUID, HTTPLogs: []*httpx.Log{}, Errors: []ChannelError{}, ChannelUUID: l.ChannelUUID}
+
+		uploads[i] = &storage.Upload{Path: redacted.path(), Body: jsonx.MustMarshal(redacted), ContentType: "application/json"}
+	}
+
+	if len(uploads) > 0 {
+		if err := rt.LogStorage.BatchPut(ctx, uploads); err != nil {
+			return 0, errors.Wrapf(err, "error overwriting channel logs in storage")
+		}
+
+		// logs no longer have anything to show so detach them from their messages and calls
+		if _, err := rt.DB.ExecContext(ctx, `UPDATE msgs_msg SET log_uuids = NULL WHERE contact_id = $1 AND log_uuids IS NOT NULL`, contactID); err != nil {
+			return 0, errors.Wrapf(err, "error clearing channel logs on messages")
+		}
+		if _, err := rt.DB.ExecContext(ctx, `UPDATE ivr_call SET log_uuids = NULL WHERE contact_id = $1 AND log_uuids IS NOT NULL`, contactID); err != nil {
+			return 0, errors.Wrapf(err, "error clearing channel logs on calls")
+		}
+	}
+
+	return len(uploads), nil
+}
+
+const sqlDeleteHTTPLogsForContact = `
+DELETE FROM request_logs_httplog
+ WHERE org_id = $1 AND (
+       contact_id = $2 OR
+       airtime_transfer_id IN (SELECT id FROM airtime_airtimetransfer WHERE org_id = $1 AND contact_id = $2) OR
+       (contact_id IS NULL AND (request LIKE ANY($3) OR response LIKE ANY($3)))
+)`
+
+// DeleteHTTPLogsForContact deletes the HTTP logs in the given org which were made for the given contact, either
+// directly by its flows or by its airtime transfers. Logs made before HTTP logs recorded their contact are deleted if
+// they contain any of the contact's URN paths. Returns the number of logs deleted.
+func DeleteHTTPLogsForContact(ctx context.Context, db Queryer, orgID OrgID, contactID ContactID) (int, error) {
+	var paths []string
+	if err := db.SelectContext(ctx, &paths, `SELECT path FROM contacts_contacturn WHERE contact_id = $1`, contactID); err != nil {
+		return 0, errors.Wrapf(err, "error selecting URNs for contact #%d", contactID)
+	}
+
+	res, err := db.ExecContext(ctx, sqlDeleteHTTPLogsForContact, orgID, contactID, pq.Array(likePatterns(paths)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error deleting HTTP logs for contact #%d", contactID)
+	}
+
+	deleted, _ := res.RowsAffected()
+	return int(deleted), nil
+}
+
+// RedactContactAudits clears the before and after values of the given contact's audit log entries, leaving a record of
+// what changed and when but not the values themselves. Returns the number of entries redacted.
+func RedactContactAudits(ctx context.Context, db Queryer, contactID ContactID) (int, error) {
+	res, err := db.ExecContext(ctx, `UPDATE contacts_contactaudit SET before = NULL, after = NULL WHERE contact_id = $1 AND (before IS NOT NULL OR after IS NOT NULL)`, contactID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error redacting audit log for contact #%d", contactID)
+	}
+
+	redacted, _ := res.RowsAffected()
+	return int(redacted), nil
+}
+
+// converts the given strings to LIKE patterns which match any text containing them
+func likePatterns(vals []string) []string {
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+	patterns := make([]string, 0, len(vals))
+	for _, v := range vals {
+		if v != "" {
+			patterns = append(patterns, "%"+escaper.Replace(v)+"%")
+		}
+	}
+	return patterns
+}
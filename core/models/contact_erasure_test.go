@@ -0,0 +1,89 @@
+package models_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactErasure(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetStorage)
+
+	// give Cathy a session with its output in storage
+	sessionID := testdata.InsertFlowSession(rt, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	outputURL, err := rt.SessionStorage.Put(ctx, "orgs/1/c/6393/6393abc0-283d-4c9b-a1b3-641a035c34bf/session.json", "application/json", []byte(`{"contact":{"name":"Cathy"}}`))
+	require.NoError(t, err)
+	rt.DB.MustExec(`UPDATE flows_flowsession SET output = NULL, output_url = $2 WHERE id = $1`, sessionID, outputURL)
+
+	// and a message with an attached channel log in storage
+	msg := testdata.InsertIncomingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "hi", models.MsgStatusHandled)
+	logPath := "channels/74729f45-7f29-4868-9dc4-90e491e3c7d8/c2b4/c2b4fcbe-7fbc-4e29-8c5c-d0aa4d2b7f8c.json"
+	_, err = rt.LogStorage.Put(ctx, logPath, "application/json", []byte(`{"uuid":"c2b4fcbe-7fbc-4e29-8c5c-d0aa4d2b7f8c","http_logs":[{"request":"+16055741111"}]}`))
+	require.NoError(t, err)
+	rt.DB.MustExec(`UPDATE msgs_msg SET log_uuids = ARRAY['c2b4fcbe-7fbc-4e29-8c5c-d0aa4d2b7f8c']::uuid[] WHERE id = $1`, msg.ID())
+
+	// and HTTP logs made by her flows, one made for Bob which shouldn't be touched, and older logs made before logs
+	// were tied to contacts, one of which has her phone number
+	cathyLog := models.NewWebhookCalledLog(testdata.Org1.ID, testdata.Favorites.ID, "http://example.com", 200, `POST / HTTP/1.1\r\n\r\n{"urn":"tel:+16055741111"}`, "OK", false, time.Second, 0, time.Now())
+	cathyLog.SetContactID(testdata.Cathy.ID)
+	bobLog := models.NewWebhookCalledLog(testdata.Org1.ID, testdata.Favorites.ID, "http://example.com", 200, `POST / HTTP/1.1\r\n\r\n{"urn":"tel:+16055742222"}`, "OK", false, time.Second, 0, time.Now())
+	bobLog.SetContactID(testdata.Bob.ID)
+	olderLog1 := models.NewClassifierCalledLog(testdata.Org1.ID, testdata.Wit.ID, "http://example.com", 200, `GET /?q=+16055741111`, "OK", false, time.Second, 0, time.Now())
+	olderLog2 := models.NewClassifierCalledLog(testdata.Org1.ID, testdata.Wit.ID, "http://example.com", 200, `GET /?q=+16055742222`, "OK", false, time.Second, 0, time.Now())
+
+	err = models.InsertHTTPLogs(ctx, rt.DB, []*models.HTTPLog{cathyLog, bobLog, olderLog1, olderLog2})
+	require.NoError(t, err)
+
+	// and an unattached channel log in the database which mentions her phone number but can't be tied to her
+	rt.DB.MustExec(`INSERT INTO channels_channellog(uuid, channel_id, log_type, http_logs, errors, is_error, elapsed_ms, created_on) VALUES('5a8d1b4f-8d1b-4b0e-9c1f-6a0d2c4e8f1a', $1, 'msg_send', '[{"request": "+16055741111"}]', '[]', FALSE, 10, NOW())`, testdata.TwilioChannel.ID)
+	defer rt.DB.MustExec(`DELETE FROM channels_channellog WHERE uuid = '5a8d1b4f-8d1b-4b0e-9c1f-6a0d2c4e8f1a'`)
+
+	numSessions, err := models.RedactSessionOutputs(ctx, rt, testdata.Cathy.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numSessions)
+
+	u, _ := url.Parse(outputURL)
+	_, body, err := rt.SessionStorage.Get(ctx, u.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"redacted":true}`, string(body))
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND output IS NULL AND output_url IS NULL`, sessionID).Returns(1)
+
+	numLogs, err := models.RedactChannelLogs(ctx, rt, testdata.Cathy.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numLogs)
+
+	_, body, err = rt.LogStorage.Get(ctx, logPath)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(body), "+16055741111")
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND log_uuids IS NULL`, msg.ID()).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM channels_channellog WHERE uuid = '5a8d1b4f-8d1b-4b0e-9c1f-6a0d2c4e8f1a'`).Returns(1)
+
+	numHTTPLogs, err := models.DeleteHTTPLogsForContact(ctx, rt.DB, testdata.Org1.ID, testdata.Cathy.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, numHTTPLogs)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM request_logs_httplog`).Returns(2)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM request_logs_httplog WHERE request LIKE '%+16055741111%'`).Returns(0)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM request_logs_httplog WHERE contact_id = $1`, testdata.Cathy.ID).Returns(0)
+
+	// doing it all again finds nothing more to remove
+	numSessions, err = models.RedactSessionOutputs(ctx, rt, testdata.Cathy.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, numSessions)
+
+	numLogs, err = models.RedactChannelLogs(ctx, rt, testdata.Cathy.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, numLogs)
+
+	numHTTPLogs, err = models.DeleteHTTPLogsForContact(ctx, rt.DB, testdata.Org1.ID, testdata.Cathy.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, numHTTPLogs)
+}
@@ -0,0 +1,257 @@
+package models
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+// ContactExportFormat is the format of a contact export
+type ContactExportFormat string
+
+// contact export formats
+const (
+	ContactExportFormatJSON = ContactExportFormat("json")
+	ContactExportFormatZip  = ContactExportFormat("zip")
+)
+
+// ContentType returns the content type of exports in this format
+func (f ContactExportFormat) ContentType() string {
+	if f == ContactExportFormatZip {
+		return "application/zip"
+	}
+	return "application/json"
+}
+
+// ContactExportPath returns the path in export storage of the contact export with the given UUID
+func ContactExportPath(orgID OrgID, exportUUID uuids.UUID, format ContactExportFormat) string {
+	return path.Join("orgs", fmt.Sprintf("%d", orgID), "contact_exports", fmt.Sprintf("%s.%s", exportUUID, format))
+}
+
+// a section of a contact export, i.e. a list of items selected by a query taking org and contact ids
+type contactExportSection struct {
+	name  string
+	query string
+}
+
+var contactExportSections = []contactExportSection{
+	{"messages", sqlSelectContactExportMessages},
+	{"runs", sqlSelectContactExportRuns},
+	{"tickets", sqlSelectContactExportTickets},
+	{"campaign_fires", sqlSelectContactExportCampaignFires},
+	{"channel_events", sqlSelectContactExportChannelEvents},
+}
+
+const sqlSelectContactExportMessages = `
+SELECT ROW_TO_JSON(r) FROM (
+    SELECT m.uuid, m.direction, m.msg_type AS type, m.status, m.visibility, m.text, m.attachments, m.quick_replies, u.identity AS urn, ch.uuid AS channel_uuid, f.uuid AS flow_uuid, m.created_on, m.sent_on
+      FROM msgs_msg m
+ LEFT JOIN contacts_contacturn u ON u.id = m.contact_urn_id
+ LEFT JOIN channels_channel ch ON ch.id = m.channel_id
+ LEFT JOIN flows_flow f ON f.id = m.flow_id
+     WHERE m.org_id = $1 AND m.contact_id = $2
+  ORDER BY m.created_on, m.id
+) r`
+
+const sqlSelectContactExportRuns = `
+SELECT ROW_TO_JSON(r) FROM (
+    SELECT fr.uuid, f.uuid AS flow_uuid, f.name AS flow_name, fr.status, fr.responded, COALESCE(fr.results, '{}')::jsonb AS results, fr.created_on, fr.modified_on, fr.exited_on
+      FROM flows_flowrun fr
+      JOIN flows_flow f ON f.id = fr.flow_id
+     WHERE fr.org_id = $1 AND fr.contact_id = $2
+  ORDER BY fr.created_on, fr.id
+) r`
+
+const sqlSelectContactExportTickets = `
+SELECT ROW_TO_JSON(r) FROM (
+    SELECT t.uuid, t.status, tp.name AS topic, t.body, t.external_id, t.opened_on, t.replied_on, t.closed_on, COALESCE((
+               SELECT JSON_AGG(JSON_BUILD_OBJECT('note', e.note, 'created_on', e.created_on) ORDER BY e.created_on)
+                 FROM tickets_ticketevent e
+                WHERE e.ticket_id = t.id AND e.event_type = 'N'
+           ), '[]'::json) AS notes
+      FROM tickets_ticket t
+      JOIN tickets_topic tp ON tp.id = t.topic_id
+     WHERE t.org_id = $1 AND t.contact_id = $2
+  ORDER BY t.opened_on, t.id
+) r`
+
+const sqlSelectContactExportCampaignFires = `
+SELECT ROW_TO_JSON(r) FROM (
+    SELECT c.uuid AS campaign_uuid, c.name AS campaign_name, ce.uuid AS event_uuid, ef.scheduled, ef.fired, ef.fired_result
+      FROM campaigns_eventfire ef
+      JOIN campaigns_campaignevent ce ON ce.id = ef.event_id
+      JOIN campaigns_campaign c ON c.id = ce.campaign_id
+     WHERE c.org_id = $1 AND ef.contact_id = $2
+  ORDER BY ef.scheduled, ef.id
+) r`
+
+const sqlSelectContactExportChannelEvents = `
+SELECT ROW_TO_JSON(r) FROM (
+    SELECT e.event_type AS type, e.extra::jsonb AS extra, u.identity AS urn, ch.uuid AS channel_uuid, e.occurred_on, e.created_on
+      FROM channels_channelevent e
+      JOIN channels_channel ch ON ch.id = e.channel_id
+ LEFT JOIN contacts_contacturn u ON u.id = e.contact_urn_id
+     WHERE e.org_id = $1 AND e.contact_id = $2
+  ORDER BY e.occurred_on, e.id
+) r`
+
+// CountContactHistory returns the number of messages and runs the given contact has, as an indication of how big an
+// export of it will be
+func CountContactHistory(ctx context.Context, db Queryer, contactID ContactID) (int, error) {
+	var count int
+	err := db.GetContext(ctx, &count, `SELECT (SELECT COUNT(*) FROM msgs_msg WHERE contact_id = $1) + (SELECT COUNT(*) FROM flows_flowrun WHERE contact_id = $1)`, contactID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error counting history for contact #%d", contactID)
+	}
+	return count, nil
+}
+
+// ExportContact writes a complete export of the given contact, i.e. its fields, URNs and groups, as well as its
+// messages, runs, tickets, campaign fires and channel events, to the given writer in the given format. JSON exports are
+// a single object, and zip exports contain a JSON file for the contact and an NDJSON file for each other section.
+func ExportContact(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, contactID ContactID, format ContactExportFormat, w io.Writer) error {
+	contact, err := LoadContact(ctx, rt.ReadonlyDB, oa, contactID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading contact #%d", contactID)
+	}
+
+	flowContact, err := contact.FlowContact(oa)
+	if err != nil {
+		return errors.Wrapf(err, "error creating flow contact")
+	}
+
+	var ew contactExportWriter
+	if format == ContactExportFormatZip {
+		ew = &zipContactExportWriter{z: zip.NewWriter(w)}
+	} else {
+		ew = &jsonContactExportWriter{w: w}
+	}
+
+	if err := ew.writeContact(jsonx.MustMarshal(flowContact)); err != nil {
+		return errors.Wrapf(err, "error writing contact")
+	}
+
+	for _, section := range contactExportSections {
+		if err := exportContactSection(ctx, rt, oa.OrgID(), contactID, section, ew); err != nil {
+			return errors.Wrapf(err, "error exporting %s", section.name)
+		}
+	}
+
+	return ew.close()
+}
+
+func exportContactSection(ctx context.Context, rt *runtime.Runtime, orgID OrgID, contactID ContactID, section contactExportSection, ew contactExportWriter) error {
+	if err := ew.startSection(section.name); err != nil {
+		return err
+	}
+
+	rows, err := rt.ReadonlyDB.QueryContext(ctx, section.query, orgID, contactID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item json.RawMessage
+		if err := rows.Scan(&item); err != nil {
+			return err
+		}
+		if err := ew.writeItem(item); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// writes the parts of a contact export in a particular format
+type contactExportWriter interface {
+	writeContact(json.RawMessage) error
+	startSection(string) error
+	writeItem(json.RawMessage) error
+	close() error
+}
+
+// writes a contact export as a single JSON object with a property for the contact and each section
+type jsonContactExportWriter struct {
+	w         io.Writer
+	inSection bool
+	numItems  int
+}
+
+func (e *jsonContactExportWriter) writeContact(c json.RawMessage) error {
+	_, err := fmt.Fprintf(e.w, `{"contact":%s`, c)
+	return err
+}
+
+func (e *jsonContactExportWriter) startSection(name string) error {
+	_, err := fmt.Fprintf(e.w, `%s,"%s":[`, e.endSection(), name)
+	e.inSection = true
+	e.numItems = 0
+	return err
+}
+
+func (e *jsonContactExportWriter) writeItem(item json.RawMessage) error {
+	if e.numItems > 0 {
+		if _, err := e.w.Write([]byte(`,`)); err != nil {
+			return err
+		}
+	}
+	e.numItems++
+	_, err := e.w.Write(item)
+	return err
+}
+
+func (e *jsonContactExportWriter) close() error {
+	_, err := fmt.Fprintf(e.w, `%s}`, e.endSection())
+	return err
+}
+
+func (e *jsonContactExportWriter) endSection() string {
+	if e.inSection {
+		e.inSection = false
+		return `]`
+	}
+	return ``
+}
+
+// writes a contact export as a zip containing contact.json and an NDJSON file for each section
+type zipContactExportWriter struct {
+	z       *zip.Writer
+	current io.Writer
+}
+
+func (e *zipContactExportWriter) writeContact(c json.RawMessage) error {
+	f, err := e.z.Create("contact.json")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(c)
+	return err
+}
+
+func (e *zipContactExportWriter) startSection(name string) error {
+	var err error
+	e.current, err = e.z.Create(name + ".ndjson")
+	return err
+}
+
+func (e *zipContactExportWriter) writeItem(item json.RawMessage) error {
+	if _, err := e.current.Write(item); err != nil {
+		return err
+	}
+	_, err := e.current.Write([]byte("\n"))
+	return err
+}
+
+func (e *zipContactExportWriter) close() error {
+	return e.z.Close()
+}
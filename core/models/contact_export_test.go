@@ -0,0 +1,89 @@
+package models_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportContact(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testdata.InsertIncomingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "hi", models.MsgStatusHandled)
+	testdata.InsertOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "hello", nil, models.MsgStatusSent, false)
+	sessionID := testdata.InsertFlowSession(rt, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, models.SessionStatusCompleted, testdata.Favorites, models.NilCallID)
+	testdata.InsertFlowRun(rt, testdata.Org1, sessionID, testdata.Cathy, testdata.Favorites, models.RunStatusCompleted)
+	ticket := testdata.InsertOpenTicket(rt, testdata.Org1, testdata.Cathy, testdata.Mailgun, testdata.DefaultTopic, "Help", "", time.Now(), nil)
+	rt.DB.MustExec(`INSERT INTO tickets_ticketevent(org_id, contact_id, ticket_id, event_type, note, created_on) VALUES($1, $2, $3, 'N', 'Called her', NOW())`, testdata.Org1.ID, testdata.Cathy.ID, ticket.ID)
+	testdata.InsertOpenTicket(rt, testdata.Org1, testdata.Bob, testdata.Mailgun, testdata.DefaultTopic, "Bob's ticket", "", time.Now(), nil)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// export as a single JSON object
+	b := &bytes.Buffer{}
+	err = models.ExportContact(ctx, rt, oa, testdata.Cathy.ID, models.ContactExportFormatJSON, b)
+	require.NoError(t, err)
+
+	export := struct {
+		Contact       map[string]any   `json:"contact"`
+		Messages      []map[string]any `json:"messages"`
+		Runs          []map[string]any `json:"runs"`
+		Tickets       []map[string]any `json:"tickets"`
+		CampaignFires []map[string]any `json:"campaign_fires"`
+		ChannelEvents []map[string]any `json:"channel_events"`
+	}{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &export))
+
+	assert.Equal(t, "Cathy", export.Contact["name"])
+	assert.Len(t, export.Messages, 2)
+	assert.Equal(t, "hi", export.Messages[0]["text"])
+	assert.Equal(t, "tel:+16055741111", export.Messages[0]["urn"])
+	assert.Len(t, export.Runs, 1)
+	assert.Equal(t, "Favorites", export.Runs[0]["flow_name"])
+	assert.Len(t, export.Tickets, 1)
+	assert.Equal(t, "Help", export.Tickets[0]["body"])
+	assert.Len(t, export.Tickets[0]["notes"], 1)
+	assert.Len(t, export.CampaignFires, 0)
+	assert.Len(t, export.ChannelEvents, 0)
+
+	// export as a zip of NDJSON files
+	b = &bytes.Buffer{}
+	err = models.ExportContact(ctx, rt, oa, testdata.Cathy.ID, models.ContactExportFormatZip, b)
+	require.NoError(t, err)
+
+	z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	require.NoError(t, err)
+
+	files := make(map[string]string, len(z.File))
+	for _, f := range z.File {
+		r, err := f.Open()
+		require.NoError(t, err)
+		contents, err := io.ReadAll(r)
+		require.NoError(t, err)
+		files[f.Name] = string(contents)
+	}
+
+	assert.Len(t, files, 6)
+	assert.Contains(t, files["contact.json"], `"name":"Cathy"`)
+	assert.Equal(t, 2, bytes.Count([]byte(files["messages.ndjson"]), []byte("\n")))
+	assert.Equal(t, 1, bytes.Count([]byte(files["runs.ndjson"]), []byte("\n")))
+	assert.Equal(t, "", files["campaign_fires.ndjson"])
+
+	// and the export of a contact that doesn't exist errors
+	err = models.ExportContact(ctx, rt, oa, 123456, models.ContactExportFormatJSON, &bytes.Buffer{})
+	assert.EqualError(t, err, "error loading contact #123456: no such contact #123456 in org #1")
+
+	assert.Equal(t, "orgs/1/contact_exports/f5901b62-ba76-4003-9c62-72fdacc1b7b7.zip", models.ContactExportPath(testdata.Org1.ID, "f5901b62-ba76-4003-9c62-72fdacc1b7b7", models.ContactExportFormatZip))
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/modifiers"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+// MergePolicy decides which value is kept when both contacts being merged have a value for the same field
+type MergePolicy string
+
+// merge policies
+const (
+	MergePolicyKeepPrimary  = MergePolicy("keep")
+	MergePolicyUseSecondary = MergePolicy("replace")
+)
+
+// MergeContacts merges the secondary contact into the primary contact. The primary contact takes the URNs, groups and
+// (depending on the policy) field values of the secondary contact, as well as its messages, runs, sessions, tickets,
+// calls and fired campaign events. Its unfired campaign events are removed as the primary contact's own are kept, its
+// waiting sessions are interrupted and it is then deactivated. All of this happens in a
+// single transaction, and the changes to the primary contact are made via modifiers so that the resultant events are
+// handled like any other contact modification. Callers should have locked both contacts.
+func MergeContacts(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, userID UserID, primary, secondary *Contact, policy MergePolicy) (*flows.Contact, []flows.Event, error) {
+	if primary.ID() == secondary.ID() {
+		return nil, nil, errors.New("can't merge a contact with itself")
+	}
+
+	flowContact, err := primary.FlowContact(oa)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating flow contact")
+	}
+
+	mods := mergeModifiers(oa, primary, secondary, policy)
+	events := modifyContacts(rt, oa, map[*flows.Contact][]flows.Modifier{flowContact: mods})[flowContact]
+
+	scene := NewSceneForContact(flowContact, userID, ContactChangeSourceAPI)
+
+	err = handleAndCommitScenes(ctx, rt, oa, []*Scene{scene}, map[*flows.Contact][]flows.Event{flowContact: events}, func(tx *sqlx.Tx) error {
+		return mergeContactData(ctx, tx, userID, primary.ID(), secondary.ID())
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error merging contact %d into %d", secondary.ID(), primary.ID())
+	}
+
+	return flowContact, events, nil
+}
+
+// builds the modifiers which will give the primary contact the URNs, groups and values of the secondary contact
+func mergeModifiers(oa *OrgAssets, primary, secondary *Contact, policy MergePolicy) []flows.Modifier {
+	mods := make([]flows.Modifier, 0, 10)
+
+	if primary.Name() == "" && secondary.Name() != "" {
+		mods = append(mods, modifiers.NewName(secondary.Name()))
+	}
+	if primary.Language() == envs.NilLanguage && secondary.Language() != envs.NilLanguage {
+		mods = append(mods, modifiers.NewLanguage(secondary.Language()))
+	}
+
+	// URNs are appended by identity so that they're taken from the secondary contact when they're inserted
+	if len(secondary.URNs()) > 0 {
+		moved := make([]urns.URN, len(secondary.URNs()))
+		for i, u := range secondary.URNs() {
+			moved[i] = u.Identity()
+		}
+		mods = append(mods, modifiers.NewURNs(moved, modifiers.URNsAppend))
+	}
+
+	for key, value := range secondary.Fields() {
+		field := oa.SessionAssets().Fields().Get(key)
+		if field == nil || value == nil {
+			continue
+		}
+		if existing := primary.Fields()[key]; existing == nil || policy == MergePolicyUseSecondary {
+			mods = append(mods, modifiers.NewField(field, value.Text.Native()))
+		}
+	}
+
+	// only manual groups are copied, smart groups are re-evaluated from the merged values
+	groups := make([]*flows.Group, 0, len(secondary.Groups()))
+	for _, g := range secondary.Groups() {
+		if g.Type() == GroupTypeManual {
+			if group := oa.SessionAssets().Groups().Get(g.UUID()); group != nil {
+				groups = append(groups, group)
+			}
+		}
+	}
+	if len(groups) > 0 {
+		mods = append(mods, modifiers.NewGroups(groups, modifiers.GroupsAdd))
+	}
+
+	return mods
+}
+
+var sqlMergeContactData = []string{
+	`UPDATE msgs_msg SET contact_id = $1 WHERE contact_id = $2`,
+	`UPDATE flows_flowrun SET contact_id = $1 WHERE contact_id = $2`,
+	`UPDATE flows_flowsession SET contact_id = $1 WHERE contact_id = $2`,
+	`UPDATE tickets_ticket SET contact_id = $1 WHERE contact_id = $2`,
+	`UPDATE tickets_ticketevent SET contact_id = $1 WHERE contact_id = $2`,
+	`UPDATE ivr_call SET contact_id = $1 WHERE contact_id = $2`,
+	`UPDATE channels_channelevent SET contact_id = $1 WHERE contact_id = $2`,
+	`UPDATE contacts_contact SET ticket_count = ticket_count + (SELECT ticket_count FROM contacts_contact WHERE id = $2) WHERE id = $1`,
+	`DELETE FROM campaigns_eventfire WHERE contact_id = $2 AND fired IS NULL`,
+	`UPDATE campaigns_eventfire SET contact_id = $1 WHERE contact_id = $2`,
+	`DELETE FROM contacts_contactgroup_contacts WHERE contact_id = $2`,
+}
+
+const sqlDeactivateMergedContact = `
+UPDATE contacts_contact
+   SET is_active = FALSE, ticket_count = 0, modified_on = NOW(), modified_by_id = $2
+ WHERE id = $1`
+
+// moves the secondary contact's data to the primary contact and deactivates the secondary contact
+func mergeContactData(ctx context.Context, tx *sqlx.Tx, userID UserID, primaryID, secondaryID ContactID) error {
+	if err := InterruptSessionsForContactsTx(ctx, tx, []ContactID{secondaryID}); err != nil {
+		return errors.Wrap(err, "error interrupting sessions")
+	}
+
+	for _, sql := range sqlMergeContactData {
+		if _, err := tx.ExecContext(ctx, sql, primaryID, secondaryID); err != nil {
+			return errors.Wrap(err, "error moving contact data")
+		}
+	}
+
+	if err := ArchiveContactTriggers(ctx, tx, []ContactID{secondaryID}); err != nil {
+		return errors.Wrap(err, "error removing contact from triggers")
+	}
+
+	if _, err := tx.ExecContext(ctx, sqlDeactivateMergedContact, secondaryID, userID); err != nil {
+		return errors.Wrap(err, "error deactivating contact")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeContacts(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// Cathy and Bob both have an age, but only Bob has a gender
+	rt.DB.MustExec(`UPDATE contacts_contact SET fields = '{"903f51da-2717-47c7-a0d3-f2f32877013d": {"text": "30", "number": 30}}' WHERE id = $1`, testdata.Cathy.ID)
+	rt.DB.MustExec(`UPDATE contacts_contact SET fields = '{"903f51da-2717-47c7-a0d3-f2f32877013d": {"text": "40", "number": 40}, "3a5891e4-756e-4dc9-8e12-b7a766168824": {"text": "M"}}' WHERE id = $1`, testdata.Bob.ID)
+	testdata.TestersGroup.Add(rt, testdata.Bob)
+
+	testdata.InsertIncomingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "hi", models.MsgStatusHandled)
+	ticket := testdata.InsertOpenTicket(rt, testdata.Org1, testdata.Bob, testdata.Mailgun, testdata.DefaultTopic, "Help", "", time.Now(), nil)
+	rt.DB.MustExec(`INSERT INTO tickets_ticketevent(org_id, contact_id, ticket_id, event_type, note, created_on) VALUES($1, $2, $3, 'N', 'Called him', NOW())`, testdata.Org1.ID, testdata.Bob.ID, ticket.ID)
+	firedID := testdata.InsertEventFire(rt, testdata.Bob, testdata.RemindersEvent1, time.Now().Add(-time.Hour))
+	rt.DB.MustExec(`UPDATE campaigns_eventfire SET fired = NOW(), fired_result = 'F' WHERE id = $1`, firedID)
+	testdata.InsertEventFire(rt, testdata.Bob, testdata.RemindersEvent2, time.Now().Add(time.Hour))
+	testdata.InsertWaitingSession(rt, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now().Add(time.Hour), true, nil)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFields|models.RefreshGroups)
+	require.NoError(t, err)
+
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+	require.NoError(t, err)
+	cathy, bob := contacts[0], contacts[1]
+	if cathy.ID() != testdata.Cathy.ID {
+		cathy, bob = bob, cathy
+	}
+
+	contact, events, err := models.MergeContacts(ctx, rt, oa, testdata.Admin.ID, cathy, bob, models.MergePolicyKeepPrimary)
+	require.NoError(t, err)
+	assert.Equal(t, "30", contact.Fields()["age"].Text.Native())
+	assert.Equal(t, "M", contact.Fields()["gender"].Text.Native())
+	assert.Equal(t, 2, len(contact.URNs()))
+	assert.True(t, len(events) > 0)
+
+	// Bob's URN, group, message, ticket and ticket events now belong to Cathy
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contacturn WHERE contact_id = $1`, testdata.Cathy.ID).Returns(2)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contact_id = $1 AND contactgroup_id = $2`, testdata.Cathy.ID, testdata.TestersGroup.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1`, testdata.Bob.ID).Returns(0)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM tickets_ticket WHERE contact_id = $1`, testdata.Cathy.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM tickets_ticketevent WHERE contact_id = $1`, testdata.Cathy.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM tickets_ticketevent WHERE contact_id = $1`, testdata.Bob.ID).Returns(0)
+
+	// as does Bob's fired campaign event, but his unfired one is removed
+	assertdb.Query(t, rt.DB, `SELECT contact_id FROM campaigns_eventfire WHERE id = $1`, firedID).Returns(int64(testdata.Cathy.ID))
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1`, testdata.Bob.ID).Returns(0)
+	assertdb.Query(t, rt.DB, `SELECT fields->'3a5891e4-756e-4dc9-8e12-b7a766168824'->>'text' FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID).Returns("M")
+
+	// Bob's session was interrupted and Bob was deactivated
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM flows_flowsession WHERE status = 'I' AND contact_id = $1`, testdata.Cathy.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND is_active = FALSE`, testdata.Bob.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contact_id = $1`, testdata.Bob.ID).Returns(0)
+
+	// with the replace policy, George's age replaces Alexandria's
+	rt.DB.MustExec(`UPDATE contacts_contact SET fields = '{"903f51da-2717-47c7-a0d3-f2f32877013d": {"text": "25", "number": 25}}' WHERE id = $1`, testdata.Alexandria.ID)
+	rt.DB.MustExec(`UPDATE contacts_contact SET fields = '{"903f51da-2717-47c7-a0d3-f2f32877013d": {"text": "52", "number": 52}}' WHERE id = $1`, testdata.George.ID)
+
+	alexandria, err := models.LoadContact(ctx, rt.DB, oa, testdata.Alexandria.ID)
+	require.NoError(t, err)
+	george, err := models.LoadContact(ctx, rt.DB, oa, testdata.George.ID)
+	require.NoError(t, err)
+
+	contact, _, err = models.MergeContacts(ctx, rt, oa, testdata.Admin.ID, alexandria, george, models.MergePolicyUseSecondary)
+	require.NoError(t, err)
+	assert.Equal(t, "52", contact.Fields()["age"].Text.Native())
+
+	_, _, err = models.MergeContacts(ctx, rt, oa, testdata.Admin.ID, alexandria, alexandria, models.MergePolicyKeepPrimary)
+	assert.EqualError(t, err, "can't merge a contact with itself")
+}
@@ -355,9 +355,9 @@ func LoadContactsByUUID(ctx context.Context, db Queryer, oa *OrgAssets, uuids []
 	return LoadContacts(ctx, db, oa, ids)
 }
 
-// GetNewestContactModifiedOn returns the newest modified_on for a contact in the passed in org
+// GetNewestContactModifiedOn returns the newest modified_on for an active contact in the passed in org
 func GetNewestContactModifiedOn(ctx context.Context, db Queryer, oa *OrgAssets) (*time.Time, error) {
-	rows, err := db.QueryxContext(ctx, "SELECT modified_on FROM contacts_contact WHERE org_id = $1 ORDER BY modified_on DESC LIMIT 1", oa.OrgID())
+	rows, err := db.QueryxContext(ctx, "SELECT modified_on FROM contacts_contact WHERE org_id = $1 AND is_active ORDER BY modified_on DESC LIMIT 1", oa.OrgID())
 	if err != nil && err != sql.ErrNoRows {
 		return nil, errors.Wrapf(err, "error selecting most recently changed contact for org: %d", oa.OrgID())
 	}
@@ -1375,6 +1375,26 @@ type contactStatusUpdate struct {
 	Status    ContactStatus `db:"status"`
 }
 
+// GetContactStatuses gets the current statuses of the given contacts
+func GetContactStatuses(ctx context.Context, db Queryer, ids []ContactID) (map[ContactID]ContactStatus, error) {
+	rows, err := db.QueryxContext(ctx, `SELECT id, status FROM contacts_contact WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying contact statuses")
+	}
+	defer rows.Close()
+
+	statuses := make(map[ContactID]ContactStatus, len(ids))
+	for rows.Next() {
+		var id ContactID
+		var status ContactStatus
+		if err := rows.Scan(&id, &status); err != nil {
+			return nil, errors.Wrapf(err, "error scanning contact status")
+		}
+		statuses[id] = status
+	}
+	return statuses, nil
+}
+
 // UpdateContactStatus updates the contacts status as the passed changes
 func UpdateContactStatus(ctx context.Context, db Queryer, changes []*ContactStatusChange) error {
 
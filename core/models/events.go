@@ -2,6 +2,7 @@ package models
 
 import (
 	"context"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/goflow/flows"
@@ -10,6 +11,7 @@ import (
 	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/nyaruka/mailroom/runtime"
 	"github.com/pkg/errors"
+	"golang.org/x/exp/maps"
 )
 
 // Scene represents the context that events are occurring in
@@ -17,6 +19,10 @@ type Scene struct {
 	contact *flows.Contact
 	session *Session
 	userID  UserID
+	source  ContactChangeSource
+
+	// contact change events to be added to the contact's audit log
+	auditEvents []flows.Event
 
 	preCommits  map[EventCommitHook][]interface{}
 	postCommits map[EventCommitHook][]interface{}
@@ -27,6 +33,7 @@ func NewSceneForSession(session *Session) *Scene {
 	return &Scene{
 		contact: session.Contact(),
 		session: session,
+		source:  ContactChangeSourceFlow,
 
 		preCommits:  make(map[EventCommitHook][]interface{}),
 		postCommits: make(map[EventCommitHook][]interface{}),
@@ -34,10 +41,11 @@ func NewSceneForSession(session *Session) *Scene {
 }
 
 // NewSceneForContact creates a new scene for the passed in contact, session will be nil
-func NewSceneForContact(contact *flows.Contact, userID UserID) *Scene {
+func NewSceneForContact(contact *flows.Contact, userID UserID, source ContactChangeSource) *Scene {
 	return &Scene{
 		contact: contact,
 		userID:  userID,
+		source:  source,
 
 		preCommits:  make(map[EventCommitHook][]interface{}),
 		postCommits: make(map[EventCommitHook][]interface{}),
@@ -62,6 +70,14 @@ func (s *Scene) Session() *Session { return s.session }
 // User returns the user ID for this scene if any
 func (s *Scene) UserID() UserID { return s.userID }
 
+// Source returns where the changes in this scene came from
+func (s *Scene) Source() ContactChangeSource { return s.source }
+
+// AuditContactChange records that the given event changed the contact, so that it's added to the contact's audit log
+func (s *Scene) AuditContactChange(e flows.Event) {
+	s.auditEvents = append(s.auditEvents, e)
+}
+
 // AppendToEventPreCommitHook adds a new event to be handled by a pre commit hook
 func (s *Scene) AppendToEventPreCommitHook(hook EventCommitHook, event interface{}) {
 	s.preCommits[hook] = append(s.preCommits[hook], event)
@@ -81,6 +97,14 @@ var eventHandlers = make(map[string]EventHandler)
 // our registry of event type to pre insert handlers
 var preHandlers = make(map[string]EventHandler)
 
+// our hook which queues handled events, in the same transaction, to be published to the event stream
+var eventStreamHook EventCommitHook
+
+// RegisterEventStreamHook registers the passed in hook as the one which publishes events to the event stream
+func RegisterEventStreamHook(hook EventCommitHook) {
+	eventStreamHook = hook
+}
+
 // RegisterEventHandler registers the passed in handler as being interested in the passed in type
 func RegisterEventHandler(eventType string, handler EventHandler) {
 	// it's a bug if we try to register more than one handler for a type
@@ -114,6 +138,10 @@ func HandleEvents(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *Org
 		if err != nil {
 			return err
 		}
+
+		if eventStreamHook != nil && rt.Config.StreamsEventType(e.Type()) {
+			scene.AppendToEventPreCommitHook(eventStreamHook, e)
+		}
 	}
 	return nil
 }
@@ -136,6 +164,11 @@ type EventCommitHook interface {
 
 // ApplyEventPreCommitHooks runs through all the pre event hooks for the passed in sessions and applies their events
 func ApplyEventPreCommitHooks(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *OrgAssets, scenes []*Scene) error {
+	// audit contact changes before any hooks write those changes to the database
+	if err := insertSceneContactAudits(ctx, tx, oa, scenes); err != nil {
+		return errors.Wrap(err, "error auditing contact changes")
+	}
+
 	// gather all our hook events together across our sessions
 	preHooks := make(map[EventCommitHook]map[*Scene][]interface{})
 	for _, s := range scenes {
@@ -187,20 +220,33 @@ func ApplyEventPostCommitHooks(ctx context.Context, rt *runtime.Runtime, tx *sql
 }
 
 // HandleAndCommitEvents takes a set of contacts and events, handles the events and applies any hooks, and commits everything
-func HandleAndCommitEvents(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, userID UserID, contactEvents map[*flows.Contact][]flows.Event) error {
+func HandleAndCommitEvents(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, userID UserID, source ContactChangeSource, contactEvents map[*flows.Contact][]flows.Event) error {
 	// create scenes for each contact
 	scenes := make([]*Scene, 0, len(contactEvents))
 	for contact := range contactEvents {
-		scene := NewSceneForContact(contact, userID)
+		scene := NewSceneForContact(contact, userID, source)
 		scenes = append(scenes, scene)
 	}
 
+	return handleAndCommitScenes(ctx, rt, oa, scenes, contactEvents, nil)
+}
+
+// handles the events for each scene and applies their hooks, calling the optional txFunc inside the same transaction as
+// the pre commit hooks so that other changes can be committed atomically with the events
+func handleAndCommitScenes(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, scenes []*Scene, contactEvents map[*flows.Contact][]flows.Event, txFunc func(*sqlx.Tx) error) error {
 	// begin the transaction for pre-commit hooks
 	tx, err := rt.DB.BeginTxx(ctx, nil)
 	if err != nil {
 		return errors.Wrapf(err, "error beginning transaction")
 	}
 
+	if txFunc != nil {
+		if err := txFunc(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	// handle the events to create the hooks on each scene
 	for _, scene := range scenes {
 		err := HandleEvents(ctx, rt, tx, oa, scene, contactEvents[scene.Contact()])
@@ -242,7 +288,74 @@ func HandleAndCommitEvents(ctx context.Context, rt *runtime.Runtime, oa *OrgAsse
 // ApplyModifiers modifies contacts by applying modifiers and handling the resultant events
 // Note that we don't load the user object from org assets because it's possible that the user isn't part
 // of the org, e.g. customer support.
-func ApplyModifiers(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, userID UserID, modifiersByContact map[*flows.Contact][]flows.Modifier) (map[*flows.Contact][]flows.Event, error) {
+func ApplyModifiers(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, userID UserID, source ContactChangeSource, modifiersByContact map[*flows.Contact][]flows.Modifier) (map[*flows.Contact][]flows.Event, error) {
+	eventsByContact := modifyContacts(rt, oa, modifiersByContact)
+
+	err := HandleAndCommitEvents(ctx, rt, oa, userID, source, eventsByContact)
+	if err != nil {
+		return nil, errors.Wrap(err, "error commiting events")
+	}
+
+	return eventsByContact, nil
+}
+
+// LockAndModifyContacts locks the given contacts, loads them and applies the given modifiers to them. Contacts which
+// can't be locked because they're busy are retried until the given timeout has passed. Returns the events for each
+// modified contact and the ids of any contacts which were never locked.
+func LockAndModifyContacts(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, userID UserID, source ContactChangeSource, ids []ContactID, mods []flows.Modifier, timeout time.Duration) (map[*flows.Contact][]flows.Event, []ContactID, error) {
+	eventsByContact := make(map[*flows.Contact][]flows.Event, len(ids))
+	remaining := ids
+	start := time.Now()
+
+	for len(remaining) > 0 && time.Since(start) < timeout {
+		modified, skipped, err := tryToLockAndModifyContacts(ctx, rt, oa, userID, source, remaining, mods)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for contact, events := range modified {
+			eventsByContact[contact] = events
+		}
+
+		remaining = skipped
+	}
+
+	return eventsByContact, remaining, nil
+}
+
+func tryToLockAndModifyContacts(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, userID UserID, source ContactChangeSource, ids []ContactID, mods []flows.Modifier) (map[*flows.Contact][]flows.Event, []ContactID, error) {
+	locks, skipped, err := LockContacts(ctx, rt, oa.OrgID(), ids, time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer UnlockContacts(rt, oa.OrgID(), locks)
+
+	contacts, err := LoadContacts(ctx, rt.DB, oa, maps.Keys(locks))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to load contacts")
+	}
+
+	modifiersByContact := make(map[*flows.Contact][]flows.Modifier, len(contacts))
+	for _, contact := range contacts {
+		flowContact, err := contact.FlowContact(oa)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error creating flow contact")
+		}
+
+		modifiersByContact[flowContact] = mods
+	}
+
+	eventsByContact, err := ApplyModifiers(ctx, rt, oa, userID, source, modifiersByContact)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return eventsByContact, skipped, nil
+}
+
+// applies the modifiers to each contact in memory and returns the resultant events
+func modifyContacts(rt *runtime.Runtime, oa *OrgAssets, modifiersByContact map[*flows.Contact][]flows.Modifier) map[*flows.Contact][]flows.Event {
 	// create an environment instance with location support
 	env := flows.NewEnvironment(oa.Env(), oa.SessionAssets().Locations())
 
@@ -259,12 +372,7 @@ func ApplyModifiers(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, use
 		eventsByContact[contact] = events
 	}
 
-	err := HandleAndCommitEvents(ctx, rt, oa, userID, eventsByContact)
-	if err != nil {
-		return nil, errors.Wrap(err, "error commiting events")
-	}
-
-	return eventsByContact, nil
+	return eventsByContact
 }
 
 // TypeSprintEnded is a pseudo event that lets add hooks for changes to a contacts current flow or flow history
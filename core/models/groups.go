@@ -167,6 +167,24 @@ func ContactIDsForGroupIDs(ctx context.Context, tx Queryer, groupIDs []GroupID)
 	return contactIDs, nil
 }
 
+const sqlSelectGroupContactIDsInRange = `
+  SELECT contact_id
+    FROM contacts_contactgroup_contacts
+   WHERE contactgroup_id = $1 AND contact_id > $2 AND contact_id <= $3
+ORDER BY contact_id
+   LIMIT $4`
+
+// GroupContactIDsInRange returns up to limit of the contacts in the passed in group with ids greater than afterID
+// and no greater than upToID, in ascending order
+func GroupContactIDsInRange(ctx context.Context, db Queryer, groupID GroupID, afterID, upToID ContactID, limit int) ([]ContactID, error) {
+	contactIDs := make([]ContactID, 0, 10)
+	err := db.SelectContext(ctx, &contactIDs, sqlSelectGroupContactIDsInRange, groupID, afterID, upToID, limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting contacts for group")
+	}
+	return contactIDs, nil
+}
+
 const updateGroupStatusSQL = `UPDATE contacts_contactgroup SET status = $2 WHERE id = $1`
 
 // UpdateGroupStatus updates the group status for the passed in group
@@ -46,6 +46,7 @@ type HTTPLog struct {
 	NumRetries        int               `db:"num_retries"`
 	CreatedOn         time.Time         `db:"created_on"`
 	FlowID            FlowID            `db:"flow_id"`
+	ContactID         ContactID         `db:"contact_id"`
 	ClassifierID      ClassifierID      `db:"classifier_id"`
 	TicketerID        TicketerID        `db:"ticketer_id"`
 	AirtimeTransferID AirtimeTransferID `db:"airtime_transfer_id"`
@@ -92,14 +93,19 @@ func NewAirtimeTransferredLog(orgID OrgID, url string, statusCode int, request,
 	return newHTTPLog(orgID, LogTypeAirtimeTransferred, url, statusCode, request, response, isError, elapsed, retries, createdOn)
 }
 
+// SetContactID sets the contact on whose behalf the call was made, e.g. by a flow
+func (h *HTTPLog) SetContactID(cid ContactID) {
+	h.ContactID = cid
+}
+
 // SetAirtimeTransferID called to set the transfer ID on a log after the transfer has been created
 func (h *HTTPLog) SetAirtimeTransferID(tid AirtimeTransferID) {
 	h.AirtimeTransferID = tid
 }
 
 const insertHTTPLogsSQL = `
-INSERT INTO request_logs_httplog( log_type,  org_id,  url,  status_code,  flow_id,  classifier_id,  ticketer_id,  airtime_transfer_id,  request,  response,  is_error,  request_time,  num_retries,  created_on)
-					      VALUES(:log_type, :org_id, :url, :status_code, :flow_id, :classifier_id, :ticketer_id, :airtime_transfer_id, :request, :response, :is_error, :request_time, :num_retries, :created_on)
+INSERT INTO request_logs_httplog( log_type,  org_id,  url,  status_code,  flow_id,  contact_id,  classifier_id,  ticketer_id,  airtime_transfer_id,  request,  response,  is_error,  request_time,  num_retries,  created_on)
+					      VALUES(:log_type, :org_id, :url, :status_code, :flow_id, :contact_id, :classifier_id, :ticketer_id, :airtime_transfer_id, :request, :response, :is_error, :request_time, :num_retries, :created_on)
 RETURNING id
 `
 
@@ -161,7 +161,7 @@ func (b *ContactImportBatch) tryImport(ctx context.Context, rt *runtime.Runtime,
 	}
 
 	// and apply in bulk
-	_, err = ApplyModifiers(ctx, rt, oa, userID, modifiersByContact)
+	_, err = ApplyModifiers(ctx, rt, oa, userID, ContactChangeSourceImport, modifiersByContact)
 	if err != nil {
 		return errors.Wrap(err, "error applying modifiers")
 	}
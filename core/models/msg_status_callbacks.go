@@ -0,0 +1,129 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/pkg/errors"
+)
+
+// MsgOrigin is where an outgoing message originated from
+type MsgOrigin string
+
+const (
+	MsgOriginFlow      = MsgOrigin("flow")
+	MsgOriginBroadcast = MsgOrigin("broadcast")
+	MsgOriginTicket    = MsgOrigin("ticket")
+	MsgOriginChat      = MsgOrigin("chat")
+)
+
+// StatusCallbackConfig is an org's configuration of status callbacks, which is read from the status_callback_url,
+// status_callback_secret and status_callback_origins keys of the org config
+type StatusCallbackConfig struct {
+	OrgID   OrgID          `db:"org_id"`
+	URL     string         `db:"url"`
+	Secret  string         `db:"secret"`
+	Origins pq.StringArray `db:"origins"`
+}
+
+// Includes returns whether status changes of messages with the given origin should be sent, which if no origins are
+// configured is all of them
+func (c *StatusCallbackConfig) Includes(origin MsgOrigin) bool {
+	if len(c.Origins) == 0 {
+		return true
+	}
+	for _, o := range c.Origins {
+		if MsgOrigin(o) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+const sqlSelectStatusCallbackConfigs = `
+SELECT id AS org_id,
+       config->>'status_callback_url' AS url,
+       COALESCE(config->>'status_callback_secret', '') AS secret,
+       ARRAY(SELECT jsonb_array_elements_text(COALESCE(config->'status_callback_origins', '[]'::jsonb))) AS origins
+  FROM orgs_org
+ WHERE is_active = TRUE AND COALESCE(config->>'status_callback_url', '') != ''
+ ORDER BY id`
+
+// GetStatusCallbackConfigs gets the status callback configs of all orgs which have them
+func GetStatusCallbackConfigs(ctx context.Context, db Queryer) ([]*StatusCallbackConfig, error) {
+	rows, err := db.QueryxContext(ctx, sqlSelectStatusCallbackConfigs)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying status callback configs")
+	}
+	defer rows.Close()
+
+	configs := make([]*StatusCallbackConfig, 0, 10)
+	for rows.Next() {
+		c := &StatusCallbackConfig{}
+		if err := rows.StructScan(c); err != nil {
+			return nil, errors.Wrap(err, "error scanning status callback config")
+		}
+		configs = append(configs, c)
+	}
+
+	return configs, nil
+}
+
+// MsgStatusChange is an outgoing message which has moved to sent, delivered or failed
+type MsgStatusChange struct {
+	ID           MsgID             `db:"id"`
+	UUID         flows.MsgUUID     `db:"uuid"`
+	ContactUUID  flows.ContactUUID `db:"contact_uuid"`
+	Status       MsgStatus         `db:"status"`
+	FailedReason MsgFailedReason   `db:"failed_reason"`
+	FlowID       FlowID            `db:"flow_id"`
+	BroadcastID  BroadcastID       `db:"broadcast_id"`
+	TicketID     TicketID          `db:"ticket_id"`
+	ModifiedOn   time.Time         `db:"modified_on"`
+}
+
+// Origin returns where the message originated from
+func (c *MsgStatusChange) Origin() MsgOrigin {
+	if c.FlowID != NilFlowID {
+		return MsgOriginFlow
+	} else if c.BroadcastID != NilBroadcastID {
+		return MsgOriginBroadcast
+	} else if c.TicketID != NilTicketID {
+		return MsgOriginTicket
+	}
+	return MsgOriginChat
+}
+
+// changes are only read once they're a few seconds old so that we don't skip over changes in transactions which
+// haven't been committed yet
+const sqlSelectMsgStatusChanges = `
+SELECT m.id, m.uuid, c.uuid AS contact_uuid, m.status, m.failed_reason, m.flow_id, m.broadcast_id, m.ticket_id, m.modified_on
+  FROM msgs_msg m
+  JOIN contacts_contact c ON c.id = m.contact_id
+ WHERE m.org_id = $1 AND m.direction = 'O' AND m.status IN ('W', 'S', 'D', 'F') AND m.created_on > NOW() - INTERVAL '7 days' AND
+       (m.modified_on > $2 OR (m.modified_on = $2 AND m.id > $3)) AND m.modified_on < NOW() - INTERVAL '5 seconds'
+ ORDER BY m.modified_on, m.id
+ LIMIT $4`
+
+// GetMsgStatusChanges gets outgoing messages in the given org which have moved to sent, delivered or failed since the
+// given modified on and ID
+func GetMsgStatusChanges(ctx context.Context, db Queryer, orgID OrgID, sinceOn time.Time, sinceID MsgID, limit int) ([]*MsgStatusChange, error) {
+	rows, err := db.QueryxContext(ctx, sqlSelectMsgStatusChanges, orgID, sinceOn, sinceID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying msg status changes")
+	}
+	defer rows.Close()
+
+	changes := make([]*MsgStatusChange, 0, limit)
+	for rows.Next() {
+		c := &MsgStatusChange{}
+		if err := rows.StructScan(c); err != nil {
+			return nil, errors.Wrap(err, "error scanning msg status change")
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
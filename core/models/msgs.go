@@ -2,6 +2,7 @@ package models
 
 import (
 	"context"
+	"crypto/sha1"
 	"database/sql/driver"
 	"fmt"
 	"strings"
@@ -65,6 +66,10 @@ const (
 	MsgStatusDelivered    = MsgStatus("D") // outgoing msg having received delivery confirmation from channel
 	MsgStatusErrored      = MsgStatus("E") // outgoing msg which has errored and will be retried
 	MsgStatusFailed       = MsgStatus("F") // outgoing msg which has failed permanently
+
+	// outgoing msg which is scheduled to be sent at next_attempt, at which point it's claimed and queued, or failed if
+	// it's been cancelled (MsgFailedCancelled), its contact is no longer active or its channel has been removed
+	MsgStatusScheduled = MsgStatus("T")
 )
 
 type MsgFailedReason null.String
@@ -78,6 +83,8 @@ const (
 	MsgFailedTooOld         = MsgFailedReason("O")
 	MsgFailedNoDestination  = MsgFailedReason("D")
 	MsgFailedChannelRemoved = MsgFailedReason("R")
+	MsgFailedCancelled      = MsgFailedReason("X") // scheduled msg cancelled before it was claimed to be sent
+	MsgFailedOptedOut       = MsgFailedReason("P") // URN opted out of messages on the channel
 )
 
 var unsendableToFailedReason = map[flows.UnsendableReason]MsgFailedReason{
@@ -161,6 +168,7 @@ func (m *Msg) URNAuth() null.String          { return m.m.URNAuth }
 func (m *Msg) OrgID() OrgID                  { return m.m.OrgID }
 func (m *Msg) FlowID() FlowID                { return m.m.FlowID }
 func (m *Msg) TicketID() TicketID            { return m.m.TicketID }
+func (m *Msg) CreatedByID() UserID           { return m.m.CreatedByID }
 func (m *Msg) ContactID() ContactID          { return m.m.ContactID }
 func (m *Msg) ContactURNID() *URNID          { return m.m.ContactURNID }
 
@@ -172,6 +180,12 @@ func (m *Msg) SetChannel(channel *Channel) {
 	}
 }
 
+// SetScheduled marks this outgoing message as scheduled to be sent at the given time
+func (m *Msg) SetScheduled(sendOn time.Time) {
+	m.m.Status = MsgStatusScheduled
+	m.m.NextAttempt = &sendOn
+}
+
 func (m *Msg) SetURN(urn urns.URN) error {
 	// noop for nil urn
 	if urn == urns.NilURN {
@@ -423,6 +437,93 @@ func GetMsgRepetitions(rp *redis.Pool, contact *flows.Contact, msg *flows.MsgOut
 	return redis.Int(msgRepetitionsScript.Do(rc, key, contact.ID(), msg.Text()))
 }
 
+const (
+	// incoming messages are considered duplicates if they have the same channel and external ID within this window..
+	incomingDuplicateExternalIDWindow = time.Hour
+
+	// or if they have no external ID but the same channel, URN and content within this window
+	incomingDuplicateContentWindow = time.Second * 30
+
+	// number of duplicates found since the count was last reported
+	incomingDuplicateCountKey = "msg_incoming_duplicates"
+)
+
+var incomingDuplicateScript = redis.NewScript(2, `
+local key, count_key, msg_id, expires = KEYS[1], KEYS[2], ARGV[1], ARGV[2]
+
+local original = redis.call("GET", key)
+if original and original ~= msg_id then
+	redis.call("INCR", count_key)
+	return tonumber(original)
+end
+
+redis.call("SET", key, msg_id, "EX", expires)
+return 0
+`)
+
+// GetIncomingDuplicate checks whether the given incoming message is a redelivery of one we've already seen, returning
+// the ID of the original message if it is. Messages are matched on channel and external ID, or when there's no external
+// ID and the channel has opted in to it, on channel, URN and a hash of their content within a short window. A message is
+// never a duplicate of itself so handling of the same message can be retried.
+func GetIncomingDuplicate(rp *redis.Pool, channel *Channel, msgID MsgID, externalID string, urn urns.URN, text string, attachments []string) (MsgID, error) {
+	key, window := incomingDuplicateKey(channel, externalID, urn, text, attachments)
+	if key == "" {
+		return NilMsgID, nil
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	originalID, err := redis.Int64(incomingDuplicateScript.Do(rc, key, incomingDuplicateCountKey, msgID, int(window/time.Second)))
+	if err != nil {
+		return NilMsgID, errors.Wrap(err, "error checking for duplicate incoming msg")
+	}
+	return MsgID(originalID), nil
+}
+
+var clearIncomingDuplicateScript = redis.NewScript(1, `
+local key, msg_id = KEYS[1], ARGV[1]
+
+if redis.call("GET", key) == msg_id then
+	redis.call("DEL", key)
+end
+`)
+
+// ClearIncomingDuplicate forgets the given incoming message, if it was the one seen by GetIncomingDuplicate, so that
+// a redelivery of it isn't ignored as a duplicate, e.g. because handling of this message failed
+func ClearIncomingDuplicate(rp *redis.Pool, channel *Channel, msgID MsgID, externalID string, urn urns.URN, text string, attachments []string) error {
+	key, _ := incomingDuplicateKey(channel, externalID, urn, text, attachments)
+	if key == "" {
+		return nil
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	_, err := clearIncomingDuplicateScript.Do(rc, key, msgID)
+	return errors.Wrap(err, "error clearing incoming msg for duplicate checking")
+}
+
+// gets the key and window used to check whether an incoming message is a duplicate, or an empty key if it can't be
+func incomingDuplicateKey(channel *Channel, externalID string, urn urns.URN, text string, attachments []string) (string, time.Duration) {
+	if externalID != "" {
+		return fmt.Sprintf("msg_incoming:%s:ext:%s", channel.UUID(), externalID), incomingDuplicateExternalIDWindow
+	} else if channel.DedupeByContent() {
+		hash := sha1.Sum([]byte(strings.Join(append([]string{string(urn.Identity()), text}, attachments...), "\n")))
+		return fmt.Sprintf("msg_incoming:%s:hash:%x", channel.UUID(), hash), incomingDuplicateContentWindow
+	}
+	return "", 0
+}
+
+// PopIncomingDuplicateCount gets the number of duplicate incoming messages found since this was last called
+func PopIncomingDuplicateCount(rc redis.Conn) (int, error) {
+	count, err := redis.Int(rc.Do("GETSET", incomingDuplicateCountKey, 0))
+	if err != nil && err != redis.ErrNil {
+		return 0, errors.Wrap(err, "error reading duplicate incoming msg count")
+	}
+	return count, nil
+}
+
 var loadMessagesSQL = `
 SELECT 
 	id,
@@ -475,6 +576,7 @@ SELECT
 	m.quick_replies,
 	m.locale,
 	m.created_on,
+	COALESCE(m.modified_on, m.created_on) AS modified_on,
 	m.direction,
 	m.status,
 	m.visibility,
@@ -503,9 +605,197 @@ ORDER BY
     m.next_attempt ASC, m.created_on ASC
 LIMIT 5000`
 
-// GetMessagesForRetry gets errored outgoing messages scheduled for retry, with an active channel
+// GetMessagesForRetry gets errored outgoing messages scheduled for retry, with an active channel. Any to URNs which
+// have since opted out are failed instead.
 func GetMessagesForRetry(ctx context.Context, db Queryer) ([]*Msg, error) {
-	return loadMessages(ctx, db, loadMessagesForRetrySQL)
+	msgs, err := loadMessages(ctx, db, loadMessagesForRetrySQL)
+	if err != nil {
+		return nil, err
+	}
+
+	return failOptedOutAndFilter(ctx, db, msgs)
+}
+
+const sqlFailScheduledMessagesForContacts = `
+UPDATE msgs_msg m
+   SET status = 'F', failed_reason = 'C', next_attempt = NULL, modified_on = NOW()
+  FROM contacts_contact c
+ WHERE m.contact_id = c.id AND m.direction = 'O' AND m.status = 'T' AND m.next_attempt <= NOW() AND (c.status != 'A' OR c.is_active = FALSE)`
+
+const sqlFailScheduledMessagesForChannels = `
+UPDATE msgs_msg m
+   SET status = 'F', failed_reason = 'R', next_attempt = NULL, modified_on = NOW()
+  FROM channels_channel ch
+ WHERE m.channel_id = ch.id AND m.direction = 'O' AND m.status = 'T' AND m.next_attempt <= NOW() AND ch.is_active = FALSE`
+
+const sqlClaimScheduledMessagesDue = `
+WITH due AS (
+    SELECT m.id
+      FROM msgs_msg m
+INNER JOIN channels_channel ch ON ch.id = m.channel_id
+INNER JOIN contacts_contact c ON c.id = m.contact_id
+     WHERE m.direction = 'O' AND m.status = 'T' AND m.next_attempt <= NOW() AND ch.is_active = TRUE AND c.status = 'A' AND c.is_active = TRUE
+  ORDER BY m.next_attempt ASC, m.created_on ASC
+     LIMIT 5000
+       FOR UPDATE OF m SKIP LOCKED
+)
+UPDATE msgs_msg m
+   SET status = 'Q', next_attempt = NULL, modified_on = NOW()
+  FROM due, contacts_contacturn u
+ WHERE m.id = due.id AND u.id = m.contact_urn_id AND m.status = 'T'
+RETURNING 
+	m.id,
+	m.uuid,
+	m.broadcast_id,
+	m.flow_id,
+	m.ticket_id,
+	m.created_by_id,
+	m.text,
+	m.attachments,
+	m.quick_replies,
+	m.locale,
+	m.created_on,
+	m.direction,
+	m.status,
+	m.visibility,
+	m.msg_count,
+	m.error_count,
+	m.next_attempt,
+	m.failed_reason,
+	m.high_priority,
+	m.external_id,
+	m.metadata,
+	m.channel_id,
+	m.contact_id,
+	m.contact_urn_id,
+	m.org_id,
+	u.identity AS "urn_urn",
+	u.auth AS "urn_auth"`
+
+// ClaimScheduledMessagesDue marks scheduled outgoing messages which are now due to be sent, with an active channel and
+// contact, as queued and returns them. Any due messages for contacts which are no longer active, on channels which
+// have been removed or to URNs which have since opted out, are failed. Checking, claiming and loading happen in a single statement so a message can't be
+// cancelled, or its contact stopped or blocked, after it's been loaded but before it's been queued.
+func ClaimScheduledMessagesDue(ctx context.Context, db Queryer) ([]*Msg, error) {
+	if _, err := db.ExecContext(ctx, sqlFailScheduledMessagesForContacts); err != nil {
+		return nil, errors.Wrap(err, "error failing scheduled messages for inactive contacts")
+	}
+	if _, err := db.ExecContext(ctx, sqlFailScheduledMessagesForChannels); err != nil {
+		return nil, errors.Wrap(err, "error failing scheduled messages for removed channels")
+	}
+
+	msgs, err := loadMessages(ctx, db, sqlClaimScheduledMessagesDue)
+	if err != nil {
+		return nil, errors.Wrap(err, "error claiming scheduled messages")
+	}
+
+	return failOptedOutAndFilter(ctx, db, msgs)
+}
+
+const sqlCancelScheduledMessage = `
+UPDATE msgs_msg
+   SET status = 'F', failed_reason = 'X', next_attempt = NULL, modified_on = NOW()
+ WHERE org_id = $1 AND id = $2 AND direction = 'O' AND status = 'T'`
+
+// CancelScheduledMessage cancels the given scheduled message, returning false if it isn't scheduled, e.g. it has
+// already been sent
+func CancelScheduledMessage(ctx context.Context, db Queryer, orgID OrgID, msgID MsgID) (bool, error) {
+	res, err := db.ExecContext(ctx, sqlCancelScheduledMessage, orgID, msgID)
+	if err != nil {
+		return false, errors.Wrapf(err, "error cancelling scheduled message #%d", msgID)
+	}
+	rows, _ := res.RowsAffected()
+	return rows == 1, nil
+}
+
+var loadMessagesForFailoverSQL = `
+SELECT
+	m.id,
+	m.uuid,
+	m.broadcast_id,
+	m.flow_id,
+	m.ticket_id,
+	m.text,
+	m.attachments,
+	m.quick_replies,
+	m.locale,
+	m.created_on,
+	m.direction,
+	m.status,
+	m.visibility,
+	m.msg_count,
+	m.error_count,
+	m.next_attempt,
+	m.failed_reason,
+	m.high_priority,
+	m.external_id,
+	m.metadata,
+	m.channel_id,
+	m.contact_id,
+	m.contact_urn_id,
+	m.org_id,
+	u.identity AS "urn_urn",
+	u.auth AS "urn_auth"
+FROM
+	msgs_msg m
+INNER JOIN
+	contacts_contacturn u ON u.id = m.contact_urn_id
+INNER JOIN
+	contacts_contact ct ON ct.id = m.contact_id
+INNER JOIN
+	orgs_org o ON o.id = m.org_id
+LEFT OUTER JOIN
+	channels_channel c ON c.id = m.channel_id
+WHERE
+	m.direction = 'O' AND m.status = 'F' AND m.failed_reason IN ('E', 'R') AND m.modified_on > NOW() - INTERVAL '1 day' AND
+	NOT (COALESCE(m.metadata, '{}')::jsonb ?| ARRAY['failover', 'failover_of']) AND
+	ct.status = 'A' AND ct.is_active = TRUE AND o.is_suspended = FALSE AND
+	COALESCE((c.config->>'failover')::boolean, (o.config->>'failover')::boolean, FALSE)
+ORDER BY
+    m.modified_on ASC, m.id ASC
+LIMIT 1000`
+
+// GetMessagesForFailover gets recently failed outgoing messages which can be failed over to another channel, i.e.
+// failed permanently on a channel or in an org with failover enabled, and not already failed over or a failover copy.
+// Candidates are found using the msgs_msg_failed_for_failover partial index so its predicate must match this query's.
+func GetMessagesForFailover(ctx context.Context, db Queryer) ([]*Msg, error) {
+	return loadMessages(ctx, db, loadMessagesForFailoverSQL)
+}
+
+// NewFailoverMsg creates a copy of the given failed outgoing message to be sent to a different URN and channel
+func NewFailoverMsg(rt *runtime.Runtime, org *Org, channel *Channel, contact *flows.Contact, out *flows.MsgOut, original *Msg) (*Msg, error) {
+	msg, err := newOutgoingTextMsg(rt, org, channel, contact, out, dates.Now(), nil, nil, original.BroadcastID(), original.TicketID(), original.m.CreatedByID)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.m.FlowID = original.FlowID()
+	msg.m.HighPriority = original.HighPriority()
+	if msg.m.Metadata == nil {
+		msg.m.Metadata = null.Map{}
+	}
+	msg.m.Metadata["failover_of"] = original.ID()
+
+	return msg, nil
+}
+
+// MsgFailover records the failover of a failed message, with a nil failover ID if there was nowhere to fail over to
+type MsgFailover struct {
+	MsgID      MsgID           `db:"msg_id"`
+	FailoverID *MsgID          `db:"failover_id"`
+	Reason     MsgFailedReason `db:"reason"`
+}
+
+const sqlRecordMsgFailovers = `
+UPDATE msgs_msg m
+   SET metadata = (COALESCE(m.metadata, '{}')::jsonb || jsonb_build_object('failover', jsonb_build_object('msg_id', r.failover_id::bigint, 'reason', r.reason::text)))::text,
+       modified_on = NOW()
+  FROM (VALUES(:msg_id, :failover_id, :reason)) AS r(msg_id, failover_id, reason)
+ WHERE m.id = r.msg_id::bigint`
+
+// RecordMsgFailovers records on each failed message why it was failed over and the ID of the copy that replaced it
+func RecordMsgFailovers(ctx context.Context, db Queryer, failovers []*MsgFailover) error {
+	return BulkQuery(ctx, "recording msg failovers", db, sqlRecordMsgFailovers, failovers)
 }
 
 func loadMessages(ctx context.Context, db Queryer, sql string, params ...interface{}) ([]*Msg, error) {
@@ -549,8 +839,12 @@ func NormalizeAttachment(cfg *runtime.Config, attachment utils.Attachment) utils
 	return utils.Attachment(fmt.Sprintf("%s:%s", attachment.ContentType(), url))
 }
 
-// InsertMessages inserts the passed in messages in a single query
+// InsertMessages inserts the passed in messages in a single query, failing any which are to URNs that have opted out
 func InsertMessages(ctx context.Context, tx Queryer, msgs []*Msg) error {
+	if err := FailOptedOutMsgs(ctx, tx, msgs); err != nil {
+		return err
+	}
+
 	is := make([]interface{}, len(msgs))
 	for i := range msgs {
 		is[i] = &msgs[i].m
@@ -612,6 +906,36 @@ func updateMessageStatus(ctx context.Context, db Queryer, msgs []*Msg, status Ms
 	return BulkQuery(ctx, "updating message status", db, sqlUpdateMsgStatus, is)
 }
 
+// RescheduleErroredMessages updates the next attempt of each of the given errored messages
+func RescheduleErroredMessages(ctx context.Context, db Queryer, msgs []*Msg, nextAttempts []time.Time) error {
+	is := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		msg.m.NextAttempt = &nextAttempts[i]
+		is[i] = &msg.m
+	}
+
+	return BulkQuery(ctx, "rescheduling errored messages", db, sqlUpdateMsgStatus, is)
+}
+
+const sqlFailMessages = `
+UPDATE msgs_msg
+   SET status = 'F', failed_reason = $2, next_attempt = NULL, modified_on = NOW()
+ WHERE id = ANY($1)`
+
+// FailMessages marks the given outgoing messages as failed(F) with the given reason
+func FailMessages(ctx context.Context, db Queryer, msgs []*Msg, reason MsgFailedReason) error {
+	ids := make([]MsgID, len(msgs))
+	for i, msg := range msgs {
+		msg.m.Status = MsgStatusFailed
+		msg.m.FailedReason = reason
+		msg.m.NextAttempt = nil
+		ids[i] = MsgID(msg.ID())
+	}
+
+	_, err := db.ExecContext(ctx, sqlFailMessages, pq.Array(ids), reason)
+	return errors.Wrap(err, "error failing messages")
+}
+
 const sqlUpdateMsgForResending = `
 UPDATE msgs_msg m
    SET channel_id = r.channel_id::int,
@@ -696,7 +1020,8 @@ func ResendMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa *OrgAsse
 		return nil, errors.Wrapf(err, "error updating non-resendable messages")
 	}
 
-	return resent, nil
+	// messages to URNs which have since opted out on their new channel are failed again
+	return failOptedOutAndFilter(ctx, db, resent)
 }
 
 const sqlFailChannelMessages = `
@@ -390,6 +390,58 @@ func TestGetMsgRepetitions(t *testing.T) {
 	assertredis.HGetAll(t, rt.RP, "msg_repetitions:2021-11-18T12:15", map[string]string{"10000|foo": "30", "10000|bar": "5", "10002|foo": "5"})
 }
 
+func TestGetIncomingDuplicate(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	// twilio channel opts in to checking for duplicates by content
+	rt.DB.MustExec(`UPDATE channels_channel SET config = config || '{"dedupe_by_content": true}'::jsonb WHERE id = $1`, testdata.TwilioChannel.ID)
+	defer rt.DB.MustExec(`UPDATE channels_channel SET config = config - 'dedupe_by_content' WHERE id = $1`, testdata.TwilioChannel.ID)
+	models.FlushCache()
+
+	oa := testdata.Org1.Load(rt)
+	twilio := oa.ChannelByID(testdata.TwilioChannel.ID)
+	vonage := oa.ChannelByID(testdata.VonageChannel.ID)
+
+	assertDuplicate := func(channel *models.Channel, msgID models.MsgID, externalID string, urn urns.URN, text string, expected models.MsgID) {
+		originalID, err := models.GetIncomingDuplicate(rt.RP, channel, msgID, externalID, urn, text, nil)
+		require.NoError(t, err)
+		assert.Equal(t, expected, originalID, "original mismatch for msg #%d", msgID)
+	}
+
+	// by external ID
+	assertDuplicate(twilio, 101, "EX1", testdata.Cathy.URN, "hi", models.NilMsgID)
+	assertDuplicate(twilio, 101, "EX1", testdata.Cathy.URN, "hi", models.NilMsgID) // same msg being retried
+	assertDuplicate(twilio, 102, "EX1", testdata.Cathy.URN, "hi", 101)
+	assertDuplicate(vonage, 103, "EX1", testdata.Cathy.URN, "hi", models.NilMsgID) // different channel
+	assertDuplicate(twilio, 104, "EX2", testdata.Cathy.URN, "hi", models.NilMsgID) // different external ID
+
+	// by content
+	assertDuplicate(twilio, 105, "", testdata.Cathy.URN, "hi", models.NilMsgID)
+	assertDuplicate(twilio, 106, "", testdata.Cathy.URN, "hi", 105)
+	assertDuplicate(twilio, 107, "", testdata.Cathy.URN, "hello", models.NilMsgID) // different text
+	assertDuplicate(twilio, 108, "", testdata.Bob.URN, "hi", models.NilMsgID)      // different URN
+	assertDuplicate(vonage, 109, "", testdata.Cathy.URN, "hi", models.NilMsgID)
+	assertDuplicate(vonage, 110, "", testdata.Cathy.URN, "hi", models.NilMsgID) // channel hasn't opted in
+
+	assertredis.Get(t, rt.RP, "msg_incoming:"+string(testdata.TwilioChannel.UUID)+":ext:EX1", "101")
+
+	// clearing a message which isn't the one seen does nothing
+	err := models.ClearIncomingDuplicate(rt.RP, twilio, 102, "EX1", testdata.Cathy.URN, "hi", nil)
+	require.NoError(t, err)
+	assertDuplicate(twilio, 102, "EX1", testdata.Cathy.URN, "hi", 101)
+
+	// but clearing the original, e.g. because its handling failed, means a redelivery is no longer a duplicate
+	err = models.ClearIncomingDuplicate(rt.RP, twilio, 101, "EX1", testdata.Cathy.URN, "hi", nil)
+	require.NoError(t, err)
+	assertDuplicate(twilio, 102, "EX1", testdata.Cathy.URN, "hi", models.NilMsgID)
+
+	err = models.ClearIncomingDuplicate(rt.RP, twilio, 105, "", testdata.Cathy.URN, "hi", nil)
+	require.NoError(t, err)
+	assertDuplicate(twilio, 111, "", testdata.Cathy.URN, "hi", models.NilMsgID)
+}
+
 func TestNormalizeAttachment(t *testing.T) {
 	_, rt := testsuite.Runtime()
 
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// config keys which can be used to override the retry policy of a single channel
+const (
+	ChannelConfigRetryMaxErrors     = "retry_max_errors"
+	ChannelConfigRetryBackoff       = "retry_backoff"        // in seconds
+	ChannelConfigRetryBackoffFactor = "retry_backoff_factor" // multiplier applied to backoff after each error
+	ChannelConfigRetryMaxBackoff    = "retry_max_backoff"    // in seconds
+	ChannelConfigRetryGiveUp        = "retry_give_up"        // in seconds
+)
+
+// RetryPolicy controls how errored outgoing messages are retried
+type RetryPolicy struct {
+	MaxErrors     int           // number of errors after which a message is failed
+	Backoff       time.Duration // delay before the first retry
+	BackoffFactor float64       // multiplier applied to the delay for each subsequent retry
+	MaxBackoff    time.Duration // maximum delay between retries
+	GiveUp        time.Duration // how long after its creation a message stops being retried and is failed as too old
+}
+
+// DefaultRetryPolicy is the retry policy for channel types which don't have a registered policy
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxErrors:     3,
+	Backoff:       5 * time.Minute,
+	BackoffFactor: 2,
+	MaxBackoff:    time.Hour,
+	GiveUp:        7 * 24 * time.Hour,
+}
+
+var registeredRetryPolicies = map[ChannelType]*RetryPolicy{}
+
+// RegisterRetryPolicy registers the retry policy for channels of the given type
+func RegisterRetryPolicy(channelType ChannelType, p *RetryPolicy) {
+	registeredRetryPolicies[channelType] = p
+}
+
+// RetryPolicyForChannel returns the retry policy for the given channel, i.e. the policy for its type with any
+// overrides from its config
+func RetryPolicyForChannel(ch *Channel) *RetryPolicy {
+	policy := *DefaultRetryPolicy
+	if p := registeredRetryPolicies[ch.Type()]; p != nil {
+		policy = *p
+	}
+
+	if v, ok := retryConfigValue(ch, ChannelConfigRetryMaxErrors); ok && v >= 1 {
+		policy.MaxErrors = int(v)
+	}
+	if v, ok := retryConfigValue(ch, ChannelConfigRetryBackoff); ok && v >= 0 {
+		policy.Backoff = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := retryConfigValue(ch, ChannelConfigRetryBackoffFactor); ok && v >= 1 {
+		policy.BackoffFactor = v
+	}
+	if v, ok := retryConfigValue(ch, ChannelConfigRetryMaxBackoff); ok && v >= 0 {
+		policy.MaxBackoff = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := retryConfigValue(ch, ChannelConfigRetryGiveUp); ok && v >= 0 {
+		policy.GiveUp = time.Duration(v * float64(time.Second))
+	}
+
+	return &policy
+}
+
+// gets a numeric retry setting from the channel config, which may have been saved as a number or a string
+func retryConfigValue(ch *Channel, key string) (float64, bool) {
+	switch v := ch.Config()[key].(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// NextAttempt returns when a message which last errored at the given time should next be retried
+func (p *RetryPolicy) NextAttempt(errorCount int, lastError time.Time) time.Time {
+	delay := float64(p.Backoff) * math.Pow(p.BackoffFactor, float64(errorCount-1))
+	if delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	return lastError.Add(time.Duration(delay))
+}
+
+// FailedReason returns the reason a message with the given error count and creation time should be failed, or
+// the nil reason if it can still be retried
+func (p *RetryPolicy) FailedReason(errorCount int, createdOn time.Time, now time.Time) MsgFailedReason {
+	if errorCount >= p.MaxErrors {
+		return MsgFailedErrorLimit
+	}
+	if p.GiveUp > 0 && now.Sub(createdOn) > p.GiveUp {
+		return MsgFailedTooOld
+	}
+	return NilMsgFailedReason
+}
+
+const sqlSelectRetryBacklog = `
+   SELECT c.channel_type, count(m.id)
+     FROM channels_channel c
+LEFT JOIN msgs_msg m ON m.channel_id = c.id AND m.direction = 'O' AND m.next_attempt IS NOT NULL AND m.status = 'E'
+    WHERE c.is_active = TRUE
+ GROUP BY c.channel_type`
+
+// GetRetryBacklog gets the number of errored outgoing messages waiting to be retried on each type of channel, including
+// zero counts for types of active channels with nothing waiting
+func GetRetryBacklog(ctx context.Context, db Queryer) (map[ChannelType]int, error) {
+	rows, err := db.QueryxContext(ctx, sqlSelectRetryBacklog)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying retry backlog")
+	}
+	defer rows.Close()
+
+	backlog := make(map[ChannelType]int)
+	for rows.Next() {
+		var channelType ChannelType
+		var count int
+		if err := rows.Scan(&channelType, &count); err != nil {
+			return nil, errors.Wrap(err, "error scanning retry backlog")
+		}
+		backlog[channelType] = count
+	}
+
+	return backlog, nil
+}
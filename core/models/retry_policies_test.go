@@ -0,0 +1,22 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := &models.RetryPolicy{MaxErrors: 3, Backoff: time.Minute, BackoffFactor: 2, MaxBackoff: 3 * time.Minute, GiveUp: time.Hour}
+	errored := time.Date(2023, 6, 20, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, errored.Add(time.Minute), policy.NextAttempt(1, errored))
+	assert.Equal(t, errored.Add(2*time.Minute), policy.NextAttempt(2, errored))
+	assert.Equal(t, errored.Add(3*time.Minute), policy.NextAttempt(3, errored)) // capped
+
+	assert.Equal(t, models.NilMsgFailedReason, policy.FailedReason(2, errored, errored.Add(time.Minute)))
+	assert.Equal(t, models.MsgFailedErrorLimit, policy.FailedReason(3, errored, errored.Add(time.Minute)))
+	assert.Equal(t, models.MsgFailedTooOld, policy.FailedReason(1, errored, errored.Add(2*time.Hour)))
+}
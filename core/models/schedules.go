@@ -24,6 +24,10 @@ const RepeatPeriodNever = RepeatPeriod("O")
 const RepeatPeriodDaily = RepeatPeriod("D")
 const RepeatPeriodWeekly = RepeatPeriod("W")
 const RepeatPeriodMonthly = RepeatPeriod("M")
+const RepeatPeriodYearly = RepeatPeriod("Y")
+
+// LastDayOfMonth can be used as a day of month or week of month to mean the last in the month
+const LastDayOfMonth = -1
 
 const Monday = 'M'
 const Tuesday = 'T'
@@ -52,6 +56,12 @@ type Schedule struct {
 		MinuteOfHour *int         `json:"repeat_minute_of_hour"`
 		DayOfMonth   *int         `json:"repeat_day_of_month"`
 		DaysOfWeek   null.String  `json:"repeat_days_of_week"`
+		WeekOfMonth  *int         `json:"repeat_week_of_month"`
+		MonthOfYear  *int         `json:"repeat_month_of_year"`
+		Interval     int          `json:"repeat_interval"`
+		EndDate      *time.Time   `json:"end_date"`
+		MaxFires     *int         `json:"max_fires"`
+		FireCount    int          `json:"fire_count"`
 		NextFire     *time.Time   `json:"next_fire"`
 		LastFire     *time.Time   `json:"last_fire"`
 		OrgID        OrgID        `json:"org_id"`
@@ -78,6 +88,27 @@ func NewSchedule(period RepeatPeriod, hourOfDay, minuteOfHour, dayOfMonth *int,
 	return sched
 }
 
+// SetRecurrence sets the number of periods between fires, and for monthly and yearly schedules, the week of the month
+// (1-4 or LastDayOfMonth) and the month of the year (1-12)
+func (s *Schedule) SetRecurrence(interval int, weekOfMonth, monthOfYear *int) {
+	s.s.Interval = interval
+	s.s.WeekOfMonth = weekOfMonth
+	s.s.MonthOfYear = monthOfYear
+}
+
+// SetEndCondition sets the date after which this schedule will no longer fire, the maximum number of times it can fire
+// and the number of times it has already fired
+func (s *Schedule) SetEndCondition(endDate *time.Time, maxFires *int, fireCount int) {
+	s.s.EndDate = endDate
+	s.s.MaxFires = maxFires
+	s.s.FireCount = fireCount
+}
+
+// SetNextFire sets when this schedule is next due to fire
+func (s *Schedule) SetNextFire(next *time.Time) {
+	s.s.NextFire = next
+}
+
 func (s *Schedule) ID() ScheduleID             { return s.s.ID }
 func (s *Schedule) OrgID() OrgID               { return s.s.OrgID }
 func (s *Schedule) Broadcast() *Broadcast      { return s.s.Broadcast }
@@ -85,14 +116,18 @@ func (s *Schedule) FlowStart() *FlowStart      { return s.s.FlowStart }
 func (s *Schedule) RepeatPeriod() RepeatPeriod { return s.s.RepeatPeriod }
 func (s *Schedule) NextFire() *time.Time       { return s.s.NextFire }
 func (s *Schedule) LastFire() *time.Time       { return s.s.LastFire }
+func (s *Schedule) FireCount() int             { return s.s.FireCount }
 func (s *Schedule) Timezone() (*time.Location, error) {
 	return time.LoadLocation(s.s.Timezone)
 }
 
-// UpdateFires updates the next and last fire for a shedule on the db
+// UpdateFires updates the next and last fire for a shedule on the db. A repeating schedule without a next fire has
+// reached its end condition and is marked as inactive.
 func (s *Schedule) UpdateFires(ctx context.Context, tx Queryer, last time.Time, next *time.Time) error {
-	_, err := tx.ExecContext(ctx, `UPDATE schedules_schedule SET last_fire = $2, next_fire = $3 WHERE id = $1`,
-		s.s.ID, last, next,
+	isActive := next != nil || s.s.RepeatPeriod == RepeatPeriodNever
+
+	_, err := tx.ExecContext(ctx, `UPDATE schedules_schedule SET last_fire = $2, next_fire = $3, fire_count = fire_count + 1, is_active = $4 WHERE id = $1`,
+		s.s.ID, last, next, isActive,
 	)
 	if err != nil {
 		return errors.Wrapf(err, "error updating schedule fire dates for: %d", s.s.ID)
@@ -100,13 +135,33 @@ func (s *Schedule) UpdateFires(ctx context.Context, tx Queryer, last time.Time,
 	return nil
 }
 
-// GetNextFire returns the next fire for this schedule (if any)
+// GetNextFire returns the next fire for this schedule (if any). It is assumed that this is being called as the schedule
+// is fired, so that a schedule which has reached its maximum number of fires or its end date has no next fire.
 func (s *Schedule) GetNextFire(tz *time.Location, now time.Time) (*time.Time, error) {
 	// Never repeats? no next fire
 	if s.s.RepeatPeriod == RepeatPeriodNever {
 		return nil, nil
 	}
 
+	next, err := s.calculateNextFire(tz, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// this fire is our last if we've reached our max fires
+	if s.s.MaxFires != nil && s.s.FireCount+1 >= *s.s.MaxFires {
+		return nil, nil
+	}
+
+	// or the next fire would be after our end date
+	if s.s.EndDate != nil && next.After(*s.s.EndDate) {
+		return nil, nil
+	}
+
+	return next, nil
+}
+
+func (s *Schedule) calculateNextFire(tz *time.Location, now time.Time) (*time.Time, error) {
 	// should have hour and minute on everything else
 	if s.s.HourOfDay == nil {
 		return nil, errors.Errorf("schedule %d has no repeat_hour_of_day set", s.s.ID)
@@ -115,6 +170,11 @@ func (s *Schedule) GetNextFire(tz *time.Location, now time.Time) (*time.Time, er
 		return nil, errors.Errorf("schedule %d has no repeat_minute_of_hour set", s.s.ID)
 	}
 
+	interval := s.s.Interval
+	if interval < 1 {
+		interval = 1
+	}
+
 	// increment now by a minute, we don't want to double schedule in case of small clock drifts between boxes or db
 	now = now.Add(time.Minute)
 
@@ -126,67 +186,136 @@ func (s *Schedule) GetNextFire(tz *time.Location, now time.Time) (*time.Time, er
 	// set our next fire to today at the specified hour and minute
 	next := time.Date(start.Year(), start.Month(), start.Day(), hour, minute, 0, 0, tz)
 
+	// intervals are counted from the fire we're making now, e.g. every 2 weeks means 2 weeks from this one, so that a
+	// late run of the cron doesn't shift the cadence. A schedule with no next fire yet counts from the current period.
+	anchor := start
+	if s.s.NextFire != nil {
+		anchor = s.s.NextFire.In(tz)
+	}
+	inStep := func(periodIndex func(time.Time) int) bool {
+		return (periodIndex(next)-periodIndex(anchor))%interval == 0
+	}
+
 	switch s.s.RepeatPeriod {
 
 	case RepeatPeriodDaily:
-		for !next.After(now) {
+		for !next.After(now) || !inStep(dayIndex) {
 			next = next.AddDate(0, 0, 1)
 		}
 		return &next, nil
 
 	case RepeatPeriodWeekly:
-		if s.s.DaysOfWeek == "" {
-			return nil, errors.Errorf("schedule %d repeats weekly but has no repeat_days_of_week", s.s.ID)
+		sendDays, err := s.sendDays()
+		if err != nil {
+			return nil, err
 		}
-
-		// build a map of the days we send on
-		sendDays := make(map[time.Weekday]bool)
-		for i := 0; i < len(s.s.DaysOfWeek); i++ {
-			day, found := dayStrToDayInt[s.s.DaysOfWeek[i]]
-			if !found {
-				return nil, errors.Errorf("schedule %d has unknown day of week: %s", s.s.ID, string(s.s.DaysOfWeek[i]))
-			}
-			sendDays[day] = true
+		if len(sendDays) == 0 {
+			return nil, errors.Errorf("schedule %d repeats weekly but has no repeat_days_of_week", s.s.ID)
 		}
 
 		// until we are in the future, increment a day until we reach a day of week we send on
-		for !next.After(now) || !sendDays[next.Weekday()] {
+		for !next.After(now) || !sendDays[next.Weekday()] || !inStep(weekIndex) {
 			next = next.AddDate(0, 0, 1)
 		}
 
 		return &next, nil
 
 	case RepeatPeriodMonthly:
-		if s.s.DayOfMonth == nil {
-			return nil, errors.Errorf("schedule %d repeats monthly but has no repeat_day_of_month", s.s.ID)
+		// try this month and then each following month until we're in the future
+		for month := 0; ; month++ {
+			year, mon, _ := start.AddDate(0, 0, -start.Day()+1).AddDate(0, month, 0).Date()
+
+			day, err := s.fireDayInMonth(year, mon, tz, "monthly")
+			if err != nil {
+				return nil, err
+			}
+
+			next = time.Date(year, mon, day, hour, minute, 0, 0, tz)
+			if next.After(now) && inStep(monthIndex) {
+				return &next, nil
+			}
 		}
 
-		// figure out our next fire day, in the case that they asked for a day greater than the number of days
-		// in a month, fire on the last day of the month instead
-		day := *s.s.DayOfMonth
-		maxDay := daysInMonth(next)
-		if day > maxDay {
-			day = maxDay
+	case RepeatPeriodYearly:
+		if s.s.MonthOfYear == nil || *s.s.MonthOfYear < 1 || *s.s.MonthOfYear > 12 {
+			return nil, errors.Errorf("schedule %d repeats yearly but has no valid repeat_month_of_year", s.s.ID)
 		}
-		next = time.Date(next.Year(), next.Month(), day, hour, minute, 0, 0, tz)
-
-		// this is in the past, move forward a month
-		for !next.After(now) {
-			next = time.Date(next.Year(), next.Month()+1, 1, hour, minute, 0, 0, tz)
-			day = *s.s.DayOfMonth
-			maxDay = daysInMonth(next)
-			if day > maxDay {
-				day = maxDay
+		mon := time.Month(*s.s.MonthOfYear)
+
+		// try this year and then each following year until we're in the future
+		for year := start.Year(); ; year++ {
+			day, err := s.fireDayInMonth(year, mon, tz, "yearly")
+			if err != nil {
+				return nil, err
+			}
+
+			next = time.Date(year, mon, day, hour, minute, 0, 0, tz)
+			if next.After(now) && inStep(yearIndex) {
+				return &next, nil
 			}
-			next = time.Date(next.Year(), next.Month(), day, hour, minute, 0, 0, tz)
 		}
 
-		return &next, nil
 	default:
 		return nil, fmt.Errorf("unknown repeat period: %s", s.s.RepeatPeriod)
 	}
 }
 
+// returns the set of weekdays this schedule fires on
+func (s *Schedule) sendDays() (map[time.Weekday]bool, error) {
+	sendDays := make(map[time.Weekday]bool)
+	for i := 0; i < len(s.s.DaysOfWeek); i++ {
+		day, found := dayStrToDayInt[s.s.DaysOfWeek[i]]
+		if !found {
+			return nil, errors.Errorf("schedule %d has unknown day of week: %s", s.s.ID, string(s.s.DaysOfWeek[i]))
+		}
+		sendDays[day] = true
+	}
+	return sendDays, nil
+}
+
+// returns the day in the given month that this schedule fires on, which is either a day of the month or a weekday in a
+// week of the month, e.g. the first Monday
+func (s *Schedule) fireDayInMonth(year int, month time.Month, tz *time.Location, period string) (int, error) {
+	maxDay := daysInMonth(time.Date(year, month, 1, 0, 0, 0, 0, tz))
+
+	if s.s.WeekOfMonth != nil {
+		week := *s.s.WeekOfMonth
+		if week != LastDayOfMonth && (week < 1 || week > 4) {
+			return 0, errors.Errorf("schedule %d has invalid repeat_week_of_month: %d", s.s.ID, week)
+		}
+		if len(s.s.DaysOfWeek) != 1 {
+			return 0, errors.Errorf("schedule %d repeats %s by week but doesn't have a single repeat_days_of_week", s.s.ID, period)
+		}
+		weekday, found := dayStrToDayInt[s.s.DaysOfWeek[0]]
+		if !found {
+			return 0, errors.Errorf("schedule %d has unknown day of week: %s", s.s.ID, string(s.s.DaysOfWeek[0]))
+		}
+
+		if week == LastDayOfMonth {
+			lastWeekday := time.Date(year, month, maxDay, 0, 0, 0, 0, tz).Weekday()
+			return maxDay - (int(lastWeekday)-int(weekday)+7)%7, nil
+		}
+
+		firstWeekday := time.Date(year, month, 1, 0, 0, 0, 0, tz).Weekday()
+		return 1 + (int(weekday)-int(firstWeekday)+7)%7 + (week-1)*7, nil
+	}
+
+	if s.s.DayOfMonth == nil {
+		return 0, errors.Errorf("schedule %d repeats %s but has no repeat_day_of_month", s.s.ID, period)
+	}
+
+	// in the case that they asked for a day greater than the number of days in a month, fire on the last day of the
+	// month instead
+	day := *s.s.DayOfMonth
+	if day == LastDayOfMonth || day > maxDay {
+		day = maxDay
+	}
+	if day < 1 {
+		return 0, errors.Errorf("schedule %d has invalid repeat_day_of_month: %d", s.s.ID, day)
+	}
+	return day, nil
+}
+
 // returns number of days in the month for the passed in date using crazy golang date magic
 func daysInMonth(t time.Time) int {
 	// day 0 of a month is previous day of previous month, months can be > 12 and roll years
@@ -194,6 +323,14 @@ func daysInMonth(t time.Time) int {
 	return lastDay.Day()
 }
 
+// functions which number the periods that a date falls in, using its date in its own location so they're unaffected by DST
+func dayIndex(t time.Time) int {
+	return int(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400)
+}
+func weekIndex(t time.Time) int  { return (dayIndex(t) + 4) / 7 } // weeks start on Sunday and 1970-01-01 was a Thursday
+func monthIndex(t time.Time) int { return t.Year()*12 + int(t.Month()) - 1 }
+func yearIndex(t time.Time) int  { return t.Year() }
+
 const selectUnfiredSchedules = `
 SELECT ROW_TO_JSON(s) FROM (SELECT
 	s.id as id,
@@ -201,7 +338,13 @@ SELECT ROW_TO_JSON(s) FROM (SELECT
 	s.repeat_minute_of_hour as repeat_minute_of_hour,
 	s.repeat_day_of_month as repeat_day_of_month,
 	s.repeat_days_of_week as repeat_days_of_week,
+	s.repeat_week_of_month as repeat_week_of_month,
+	s.repeat_month_of_year as repeat_month_of_year,
+	s.repeat_interval as repeat_interval,
 	s.repeat_period as repeat_period,
+	s.end_date as end_date,
+	s.max_fires as max_fires,
+	s.fire_count as fire_count,
 	s.next_fire as next_fire,
 	s.last_fire as last_fire,
 	s.org_id as org_id,
@@ -118,6 +118,12 @@ func TestNextFire(t *testing.T) {
 		MinuteOfHour *int
 		DayOfMonth   *int
 		DaysOfWeek   string
+		Interval     int
+		WeekOfMonth  *int
+		MonthOfYear  *int
+		EndDate      *time.Time
+		MaxFires     *int
+		Delay        time.Duration
 		Next         []*time.Time
 		Error        string
 	}{
@@ -349,15 +355,203 @@ func TestNextFire(t *testing.T) {
 			DayOfMonth:   ip(10),
 			Next:         []*time.Time{dp(2019, 3, 10, 12, 30, la)},
 		},
+		{
+			Label:        "daily repeat every 2 days",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodDaily,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			Interval:     2,
+			Next: []*time.Time{
+				dp(2019, 8, 22, 12, 35, la),
+				dp(2019, 8, 24, 12, 35, la),
+				dp(2019, 8, 26, 12, 35, la),
+			},
+		},
+		{
+			Label:        "daily repeat every 2 days across DST start",
+			Now:          time.Date(2019, 3, 9, 12, 30, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodDaily,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(30),
+			Interval:     2,
+			Next:         []*time.Time{dp(2019, 3, 11, 12, 30, la)},
+		},
+		{
+			Label:        "daily repeat every 2 days with cron running late",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodDaily,
+			HourOfDay:    ip(23),
+			MinuteOfHour: ip(59),
+			Interval:     2,
+			Delay:        time.Minute * 2,
+			Next: []*time.Time{
+				dp(2019, 8, 20, 23, 59, la),
+				dp(2019, 8, 22, 23, 59, la),
+				dp(2019, 8, 24, 23, 59, la),
+			},
+		},
+		{
+			Label:        "weekly repeat every 2 weeks",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodWeekly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			DaysOfWeek:   "MW",
+			Interval:     2,
+			Next: []*time.Time{
+				dp(2019, 8, 21, 12, 35, la),
+				dp(2019, 9, 2, 12, 35, la),
+				dp(2019, 9, 4, 12, 35, la),
+				dp(2019, 9, 16, 12, 35, la),
+			},
+		},
+		{
+			Label:        "monthly repeat on last day of month",
+			Now:          time.Date(2019, 2, 10, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodMonthly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			DayOfMonth:   ip(models.LastDayOfMonth),
+			Next: []*time.Time{
+				dp(2019, 2, 28, 12, 35, la),
+				dp(2019, 3, 31, 12, 35, la),
+				dp(2019, 4, 30, 12, 35, la),
+			},
+		},
+		{
+			Label:        "monthly repeat on first Monday",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodMonthly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			DaysOfWeek:   "M",
+			WeekOfMonth:  ip(1),
+			Next: []*time.Time{
+				dp(2019, 9, 2, 12, 35, la),
+				dp(2019, 10, 7, 12, 35, la),
+				dp(2019, 11, 4, 12, 35, la),
+			},
+		},
+		{
+			Label:        "monthly repeat on last Friday",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodMonthly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			DaysOfWeek:   "F",
+			WeekOfMonth:  ip(models.LastDayOfMonth),
+			Next: []*time.Time{
+				dp(2019, 8, 30, 12, 35, la),
+				dp(2019, 9, 27, 12, 35, la),
+			},
+		},
+		{
+			Label:        "monthly repeat on second Sunday across DST",
+			Now:          time.Date(2019, 2, 10, 12, 30, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodMonthly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(30),
+			DaysOfWeek:   "U",
+			WeekOfMonth:  ip(2),
+			Next:         []*time.Time{dp(2019, 3, 10, 12, 30, la)},
+		},
+		{
+			Label:        "monthly repeat by week without a single day of week",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodMonthly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			DaysOfWeek:   "MT",
+			WeekOfMonth:  ip(1),
+			Error:        "schedule 0 repeats monthly by week but doesn't have a single repeat_days_of_week",
+		},
+		{
+			Label:        "monthly repeat every 3 months",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodMonthly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			DayOfMonth:   ip(15),
+			Interval:     3,
+			Next: []*time.Time{
+				dp(2019, 11, 15, 12, 35, la),
+				dp(2020, 2, 15, 12, 35, la),
+			},
+		},
+		{
+			Label:        "yearly repeat with no month of year",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodYearly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			DayOfMonth:   ip(29),
+			Error:        "schedule 0 repeats yearly but has no valid repeat_month_of_year",
+		},
+		{
+			Label:        "yearly repeat on day that exceeds month",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodYearly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			DayOfMonth:   ip(29),
+			MonthOfYear:  ip(2),
+			Next: []*time.Time{
+				dp(2020, 2, 29, 12, 35, la),
+				dp(2021, 2, 28, 12, 35, la),
+			},
+		},
+		{
+			Label:        "daily repeat with max fires",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodDaily,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			MaxFires:     ip(3),
+			Next: []*time.Time{
+				dp(2019, 8, 21, 12, 35, la),
+				dp(2019, 8, 22, 12, 35, la),
+				nil,
+			},
+		},
+		{
+			Label:        "daily repeat with end date",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       models.RepeatPeriodDaily,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			EndDate:      dp(2019, 8, 22, 12, 0, la),
+			Next: []*time.Time{
+				dp(2019, 8, 21, 12, 35, la),
+				nil,
+			},
+		},
 	}
 
 tests:
 	for _, tc := range tcs {
 		// create a fake schedule
 		sched := models.NewSchedule(tc.Period, tc.HourOfDay, tc.MinuteOfHour, tc.DayOfMonth, tc.DaysOfWeek)
+		sched.SetRecurrence(tc.Interval, tc.WeekOfMonth, tc.MonthOfYear)
 		now := tc.Now
 
-		for _, n := range tc.Next {
+		for i, n := range tc.Next {
+			sched.SetEndCondition(tc.EndDate, tc.MaxFires, i)
+
 			next, err := sched.GetNextFire(tc.Location, now)
 			if err != nil {
 				if tc.Error == "" {
@@ -369,8 +563,10 @@ tests:
 			}
 			assert.Equal(t, n, next, "%s: next fire did not match", tc.Label)
 
+			// the cron fires the schedule at its next fire, possibly late
 			if n != nil {
-				now = *n
+				sched.SetNextFire(n)
+				now = n.Add(tc.Delay)
 			}
 		}
 	}
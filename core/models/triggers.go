@@ -2,15 +2,21 @@ package models
 
 import (
 	"context"
+	"encoding/json"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/dbutil"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/triggers"
 	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/null/v2"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -34,12 +40,18 @@ const (
 	IncomingCallTriggerType    = TriggerType("V")
 	ScheduleTriggerType        = TriggerType("S")
 	TicketClosedTriggerType    = TriggerType("T")
+	OptInTriggerType           = TriggerType("I")
+	OptOutTriggerType          = TriggerType("O")
+	GroupJoinedTriggerType     = TriggerType("G")
+	FieldChangedTriggerType    = TriggerType("F")
 )
 
 // match type constants
 const (
-	MatchFirst MatchType = "F"
-	MatchOnly  MatchType = "O"
+	MatchFirst    MatchType = "F" // first word of the message is one of the keywords
+	MatchOnly     MatchType = "O" // message is only one of the keywords
+	MatchContains MatchType = "C" // any word of the message is one of the keywords
+	MatchRegex    MatchType = "R" // message matches the keyword as a regular expression
 )
 
 // NilTriggerID is the nil value for trigger IDs
@@ -52,13 +64,29 @@ type Trigger struct {
 		FlowID          FlowID      `json:"flow_id"`
 		TriggerType     TriggerType `json:"trigger_type"`
 		Keyword         string      `json:"keyword"`
+		Keywords        []string    `json:"keywords"`
 		MatchType       MatchType   `json:"match_type"`
+		Priority        int         `json:"priority"`
 		ChannelID       ChannelID   `json:"channel_id"`
 		ReferrerID      string      `json:"referrer_id"`
+		GroupID         GroupID     `json:"group_id"`
+		FieldID         FieldID     `json:"field_id"`
 		IncludeGroupIDs []GroupID   `json:"include_group_ids"`
 		ExcludeGroupIDs []GroupID   `json:"exclude_group_ids"`
 		ContactIDs      []ContactID `json:"contact_ids,omitempty"`
+		ActiveDays      null.String `json:"active_days"`
+		ActiveFromTime  string      `json:"active_from_time"`
+		ActiveUntilTime string      `json:"active_until_time"`
+		ActiveFromDate  string      `json:"active_from_date"`
+		ActiveUntilDate string      `json:"active_until_date"`
 	}
+
+	regex           *regexp.Regexp
+	activeDays      map[time.Weekday]bool
+	activeFromTime  *dates.TimeOfDay
+	activeUntilTime *dates.TimeOfDay
+	activeFromDate  *dates.Date
+	activeUntilDate *dates.Date
 }
 
 // ID returns the id of this trigger
@@ -70,24 +98,274 @@ func (t *Trigger) Keyword() string            { return t.t.Keyword }
 func (t *Trigger) MatchType() MatchType       { return t.t.MatchType }
 func (t *Trigger) ChannelID() ChannelID       { return t.t.ChannelID }
 func (t *Trigger) ReferrerID() string         { return t.t.ReferrerID }
+func (t *Trigger) GroupID() GroupID           { return t.t.GroupID }
+func (t *Trigger) FieldID() FieldID           { return t.t.FieldID }
 func (t *Trigger) IncludeGroupIDs() []GroupID { return t.t.IncludeGroupIDs }
 func (t *Trigger) ExcludeGroupIDs() []GroupID { return t.t.ExcludeGroupIDs }
 func (t *Trigger) ContactIDs() []ContactID    { return t.t.ContactIDs }
+func (t *Trigger) Priority() int              { return t.t.Priority }
+func (t *Trigger) ActiveDays() string         { return string(t.t.ActiveDays) }
+func (t *Trigger) ActiveFromTime() string     { return t.t.ActiveFromTime }
+func (t *Trigger) ActiveUntilTime() string    { return t.t.ActiveUntilTime }
+func (t *Trigger) ActiveFromDate() string     { return t.t.ActiveFromDate }
+func (t *Trigger) ActiveUntilDate() string    { return t.t.ActiveUntilDate }
+
+// IsActiveAt returns whether this trigger is active at the given time, which is evaluated in the given timezone.
+// A trigger can be restricted to certain days of the week, to a time of day window (which can wrap past midnight),
+// and to a range of dates (both inclusive). Days and dates are checked against the day the window started on, so
+// a Friday 22:00-06:00 window is still active at 03:00 on Saturday. A window which starts and ends at the same time
+// covers a full day from that time.
+func (t *Trigger) IsActiveAt(now time.Time, tz *time.Location) bool {
+	now = now.In(tz)
+	started := now
+
+	if t.activeFromTime != nil && t.activeUntilTime != nil {
+		timeOfDay := dates.ExtractTimeOfDay(now)
+		afterFrom := timeOfDay.Compare(*t.activeFromTime) >= 0
+		beforeUntil := timeOfDay.Compare(*t.activeUntilTime) < 0
+
+		if t.activeFromTime.Compare(*t.activeUntilTime) < 0 {
+			if !afterFrom || !beforeUntil {
+				return false
+			}
+		} else {
+			// a window like 22:00-06:00 wraps past midnight
+			if !afterFrom && !beforeUntil {
+				return false
+			}
+
+			// and if we're past midnight then the window started the day before
+			if !afterFrom {
+				started = now.AddDate(0, 0, -1)
+			}
+		}
+	}
+
+	date := dates.ExtractDate(started)
+
+	if t.activeFromDate != nil && date.Compare(*t.activeFromDate) < 0 {
+		return false
+	}
+	if t.activeUntilDate != nil && date.Compare(*t.activeUntilDate) > 0 {
+		return false
+	}
+	if t.activeDays != nil && !t.activeDays[started.Weekday()] {
+		return false
+	}
+
+	return true
+}
+
+// AllKeywords returns the keyword of this trigger and any additional keywords, e.g. synonyms and misspellings
+func (t *Trigger) AllKeywords() []string {
+	all := make([]string, 0, 1+len(t.t.Keywords))
+	if t.t.Keyword != "" {
+		all = append(all, t.t.Keyword)
+	}
+	return append(all, t.t.Keywords...)
+}
+
 func (t *Trigger) KeywordMatchType() triggers.KeywordMatchType {
-	if t.t.MatchType == MatchFirst {
-		return triggers.KeywordMatchTypeFirstWord
+	if t.t.MatchType == MatchOnly {
+		return triggers.KeywordMatchTypeOnlyWord
 	}
-	return triggers.KeywordMatchTypeOnlyWord
+	return triggers.KeywordMatchTypeFirstWord
 }
 
-// Match returns the match for this trigger, if any
-func (t *Trigger) Match() *triggers.KeywordMatch {
-	if t.Keyword() != "" {
-		return &triggers.KeywordMatch{
-			Type:    t.KeywordMatchType(),
-			Keyword: t.Keyword(),
+// Match returns the keyword match for this trigger against the given message text, if any
+func (t *Trigger) Match(text string) *triggers.KeywordMatch {
+	if t.Keyword() == "" {
+		return nil
+	}
+
+	keyword := t.Keyword()
+
+	switch t.MatchType() {
+	case MatchRegex:
+		if t.regex != nil {
+			if m := t.regex.FindString(strings.TrimSpace(text)); m != "" {
+				keyword = m
+			}
+		}
+	default:
+		if matched := t.matchingKeyword(utils.TokenizeString(text)); matched != "" {
+			keyword = matched
 		}
 	}
+
+	return &triggers.KeywordMatch{Type: t.KeywordMatchType(), Keyword: keyword}
+}
+
+// Params returns the named captures of a regex trigger against the given message text, which are passed to the
+// started flow as trigger params
+func (t *Trigger) Params(text string) map[string]string {
+	if t.regex == nil {
+		return nil
+	}
+
+	match := t.regex.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil {
+		return nil
+	}
+
+	params := make(map[string]string)
+	for i, name := range t.regex.SubexpNames() {
+		if name != "" {
+			params[name] = match[i]
+		}
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
+
+// BuildMsgTrigger builds a flow trigger for the given message which matched this trigger
+func (t *Trigger) BuildMsgTrigger(oa *OrgAssets, flow *Flow, contact *flows.Contact, msg *flows.MsgIn) (flows.Trigger, error) {
+	trigger := triggers.NewBuilder(oa.Env(), flow.Reference(), contact).Msg(msg).WithMatch(t.Match(msg.Text())).Build()
+
+	params := t.Params(msg.Text())
+	if params == nil {
+		return trigger, nil
+	}
+
+	// goflow's msg trigger builder doesn't support params so add them to the trigger JSON and read it back
+	var envelope map[string]json.RawMessage
+	if err := jsonx.Unmarshal(jsonx.MustMarshal(trigger), &envelope); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling trigger")
+	}
+	envelope["params"] = jsonx.MustMarshal(params)
+
+	withParams, err := triggers.ReadTrigger(oa.SessionAssets(), jsonx.MustMarshal(envelope), assets.IgnoreMissing)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading trigger with params")
+	}
+	return withParams, nil
+}
+
+// returns the first of our keywords that matches the given words according to our match type
+func (t *Trigger) matchingKeyword(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
+
+	var candidates []string
+	switch t.MatchType() {
+	case MatchFirst:
+		candidates = words[:1]
+	case MatchOnly:
+		if len(words) == 1 {
+			candidates = words
+		}
+	case MatchContains:
+		candidates = words
+	}
+
+	for _, w := range candidates {
+		w = strings.ToLower(w)
+		for _, k := range t.AllKeywords() {
+			if k == w {
+				return k
+			}
+		}
+	}
+	return ""
+}
+
+// checks whether this trigger matches the given message text
+func (t *Trigger) matchesText(text string, words []string) bool {
+	if t.MatchType() == MatchRegex {
+		return t.regex != nil && t.regex.MatchString(strings.TrimSpace(text))
+	}
+	return t.matchingKeyword(words) != ""
+}
+
+// validates this trigger and prepares it for matching
+func (t *Trigger) prepare() error {
+	if err := t.prepareRestrictions(); err != nil {
+		return err
+	}
+
+	if t.TriggerType() != KeywordTriggerType {
+		return nil
+	}
+
+	if t.MatchType() == MatchRegex {
+		if strings.TrimSpace(t.Keyword()) == "" {
+			return errors.New("regex keyword trigger has no regular expression")
+		}
+		regex, err := regexp.Compile("(?i)" + t.Keyword())
+		if err != nil {
+			return errors.Wrapf(err, "invalid regular expression '%s'", t.Keyword())
+		}
+
+		// a regex which matches an empty message matches every message, and would outrank real catchall triggers
+		if regex.MatchString("") {
+			return errors.Errorf("regular expression '%s' matches empty messages", t.Keyword())
+		}
+
+		t.regex = regex
+		return nil
+	}
+
+	if len(t.AllKeywords()) == 0 {
+		return errors.New("keyword trigger has no keywords")
+	}
+
+	// keywords should be single lowercase words to be matchable
+	for i, k := range t.t.Keywords {
+		t.t.Keywords[i] = strings.ToLower(k)
+	}
+	for _, k := range t.AllKeywords() {
+		if words := utils.TokenizeString(k); len(words) != 1 || words[0] != k {
+			return errors.Errorf("keyword '%s' is not a single word", k)
+		}
+	}
+	return nil
+}
+
+// parses the day, time and date restrictions on this trigger
+func (t *Trigger) prepareRestrictions() error {
+	if t.t.ActiveDays != "" {
+		t.activeDays = make(map[time.Weekday]bool, len(t.t.ActiveDays))
+		for i := 0; i < len(t.t.ActiveDays); i++ {
+			day, found := dayStrToDayInt[t.t.ActiveDays[i]]
+			if !found {
+				return errors.Errorf("invalid day of week '%c' in active days", t.t.ActiveDays[i])
+			}
+			t.activeDays[day] = true
+		}
+	}
+
+	if (t.t.ActiveFromTime == "") != (t.t.ActiveUntilTime == "") {
+		return errors.New("active time window must have both a start and an end")
+	}
+	if t.t.ActiveFromTime != "" {
+		from, err := dates.ParseTimeOfDay("tt:mm", t.t.ActiveFromTime)
+		if err != nil {
+			return errors.Wrapf(err, "invalid active from time '%s'", t.t.ActiveFromTime)
+		}
+		until, err := dates.ParseTimeOfDay("tt:mm", t.t.ActiveUntilTime)
+		if err != nil {
+			return errors.Wrapf(err, "invalid active until time '%s'", t.t.ActiveUntilTime)
+		}
+		t.activeFromTime, t.activeUntilTime = &from, &until
+	}
+
+	if t.t.ActiveFromDate != "" {
+		from, err := dates.ParseDate(dates.ISO8601Date, t.t.ActiveFromDate)
+		if err != nil {
+			return errors.Wrapf(err, "invalid active from date '%s'", t.t.ActiveFromDate)
+		}
+		t.activeFromDate = &from
+	}
+	if t.t.ActiveUntilDate != "" {
+		until, err := dates.ParseDate(dates.ISO8601Date, t.t.ActiveUntilDate)
+		if err != nil {
+			return errors.Wrapf(err, "invalid active until date '%s'", t.t.ActiveUntilDate)
+		}
+		t.activeUntilDate = &until
+	}
 	return nil
 }
 
@@ -109,6 +387,12 @@ func loadTriggers(ctx context.Context, db Queryer, orgID OrgID) ([]*Trigger, err
 			return nil, errors.Wrap(err, "error scanning label row")
 		}
 
+		// a trigger which can't be matched shouldn't stop other triggers from loading
+		if err := trigger.prepare(); err != nil {
+			logrus.WithError(err).WithField("trigger_id", trigger.ID()).WithField("org_id", orgID).Error("ignoring invalid trigger")
+			continue
+		}
+
 		triggers = append(triggers, trigger)
 	}
 
@@ -119,29 +403,67 @@ func loadTriggers(ctx context.Context, db Queryer, orgID OrgID) ([]*Trigger, err
 
 // FindMatchingMsgTrigger finds the best match trigger for an incoming message from the given contact
 func FindMatchingMsgTrigger(oa *OrgAssets, contact *flows.Contact, text string) *Trigger {
-	// determine our message keyword
+	return findMatchingMsgTrigger(oa, contactGroupIDs(contact), text)
+}
+
+func findMatchingMsgTrigger(oa *OrgAssets, groupIDs map[GroupID]bool, text string) *Trigger {
 	words := utils.TokenizeString(text)
-	keyword := ""
-	only := false
-	if len(words) > 0 {
-		// our keyword is our first word
-		keyword = strings.ToLower(words[0])
-		only = len(words) == 1
-	}
 
 	candidates := findTriggerCandidates(oa, KeywordTriggerType, func(t *Trigger) bool {
-		return t.Keyword() == keyword && (t.MatchType() == MatchFirst || (t.MatchType() == MatchOnly && only))
+		return t.matchesText(text, words)
 	})
 
 	// if we have a matching keyword trigger return that, otherwise we move on to catchall triggers..
-	byKeyword := findBestTriggerMatch(candidates, nil, contact)
+	byKeyword := bestTriggerMatch(candidates, nil, groupIDs)
 	if byKeyword != nil {
 		return byKeyword
 	}
 
 	candidates = findTriggerCandidates(oa, CatchallTriggerType, nil)
 
-	return findBestTriggerMatch(candidates, nil, contact)
+	return bestTriggerMatch(candidates, nil, groupIDs)
+}
+
+// TriggerCandidate is a trigger which was considered when matching an incoming message
+type TriggerCandidate struct {
+	Trigger   *Trigger
+	Active    bool // whether the trigger's day, time and date restrictions allow it to match now
+	Matched   bool // whether the message text matched, which is always true for catchall triggers
+	Qualified bool // whether the channel and contact groups matched
+	Score     int
+}
+
+// ExplainMsgTrigger returns every keyword and catchall trigger considered when matching an incoming message from a
+// contact in the given groups, and the trigger that would be matched (if any)
+func ExplainMsgTrigger(oa *OrgAssets, groups []*Group, text string) ([]*TriggerCandidate, *Trigger) {
+	groupIDs := make(map[GroupID]bool, len(groups))
+	for _, g := range groups {
+		groupIDs[g.ID()] = true
+	}
+
+	words := utils.TokenizeString(text)
+	candidates := make([]*TriggerCandidate, 0, 10)
+	now, tz := dates.Now(), oa.Env().Timezone()
+
+	for _, t := range oa.Triggers() {
+		if t.TriggerType() != KeywordTriggerType && t.TriggerType() != CatchallTriggerType {
+			continue
+		}
+
+		qualified, score := triggerMatchQualifiers(t, nil, groupIDs)
+
+		candidates = append(candidates, &TriggerCandidate{
+			Trigger:   t,
+			Active:    t.IsActiveAt(now, tz),
+			Matched:   t.TriggerType() == CatchallTriggerType || t.matchesText(text, words),
+			Qualified: qualified,
+			Score:     score,
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Trigger.ID() < candidates[j].Trigger.ID() })
+
+	return candidates, findMatchingMsgTrigger(oa, groupIDs, text)
 }
 
 // FindMatchingIncomingCallTrigger finds the best match trigger for incoming calls
@@ -192,12 +514,57 @@ func FindMatchingTicketClosedTrigger(oa *OrgAssets, contact *flows.Contact) *Tri
 	return findBestTriggerMatch(candidates, nil, contact)
 }
 
-// finds trigger candidates based on type and optional filter
+// TriggerEventType is the type of contact task queued when a change to a contact outside of message handling has
+// matched a trigger
+const TriggerEventType = "trigger_event"
+
+// TriggerEvent is a change to a contact, e.g. joining a group, which has matched a trigger
+type TriggerEvent struct {
+	ContactID ContactID       `json:"contact_id"`
+	OrgID     OrgID           `json:"org_id"`
+	TriggerID TriggerID       `json:"trigger_id"`
+	Params    json.RawMessage `json:"params,omitempty"`
+}
+
+// FindMatchingOptInTrigger finds the best match trigger for a contact opting in
+func FindMatchingOptInTrigger(oa *OrgAssets, contact *flows.Contact) *Trigger {
+	candidates := findTriggerCandidates(oa, OptInTriggerType, nil)
+
+	return findBestTriggerMatch(candidates, nil, contact)
+}
+
+// FindMatchingOptOutTrigger finds the best match trigger for a contact opting out
+func FindMatchingOptOutTrigger(oa *OrgAssets, contact *flows.Contact) *Trigger {
+	candidates := findTriggerCandidates(oa, OptOutTriggerType, nil)
+
+	return findBestTriggerMatch(candidates, nil, contact)
+}
+
+// FindMatchingGroupJoinedTrigger finds the best match trigger for a contact being added to the given group
+func FindMatchingGroupJoinedTrigger(oa *OrgAssets, contact *flows.Contact, group *Group) *Trigger {
+	candidates := findTriggerCandidates(oa, GroupJoinedTriggerType, func(t *Trigger) bool {
+		return t.GroupID() == group.ID()
+	})
+
+	return findBestTriggerMatch(candidates, nil, contact)
+}
+
+// FindMatchingFieldChangedTrigger finds the best match trigger for a change to the value of the given field
+func FindMatchingFieldChangedTrigger(oa *OrgAssets, contact *flows.Contact, field *Field) *Trigger {
+	candidates := findTriggerCandidates(oa, FieldChangedTriggerType, func(t *Trigger) bool {
+		return t.FieldID() == field.ID()
+	})
+
+	return findBestTriggerMatch(candidates, nil, contact)
+}
+
+// finds trigger candidates based on type and optional filter, ignoring triggers which aren't currently active
 func findTriggerCandidates(oa *OrgAssets, type_ TriggerType, filter func(*Trigger) bool) []*Trigger {
 	candidates := make([]*Trigger, 0, 10)
+	now, tz := dates.Now(), oa.Env().Timezone()
 
 	for _, t := range oa.Triggers() {
-		if t.TriggerType() == type_ && (filter == nil || filter(t)) {
+		if t.TriggerType() == type_ && t.IsActiveAt(now, tz) && (filter == nil || filter(t)) {
 			candidates = append(candidates, t)
 		}
 	}
@@ -210,7 +577,7 @@ type triggerMatch struct {
 	score   int
 }
 
-// matching triggers are given a score based on how they matched, and this score is used to select the most
+// matching triggers are first ordered by their priority, and then given a score based on how they matched, and this score is used to select the most
 // specific match:
 //
 // channel (4) + include (2) + exclude (1) = 7
@@ -226,17 +593,24 @@ const triggerScoreByInclusion = 2
 const triggerScoreByExclusion = 1
 
 func findBestTriggerMatch(candidates []*Trigger, channel *Channel, contact *flows.Contact) *Trigger {
-	matches := make([]*triggerMatch, 0, len(candidates))
+	return bestTriggerMatch(candidates, channel, contactGroupIDs(contact))
+}
 
-	var groupIDs map[GroupID]bool
+// builds a set of the groups the given contact is in
+func contactGroupIDs(contact *flows.Contact) map[GroupID]bool {
+	if contact == nil {
+		return nil
+	}
 
-	if contact != nil {
-		// build a set of the groups this contact is in
-		groupIDs = make(map[GroupID]bool, 10)
-		for _, g := range contact.Groups().All() {
-			groupIDs[g.Asset().(*Group).ID()] = true
-		}
+	groupIDs := make(map[GroupID]bool, 10)
+	for _, g := range contact.Groups().All() {
+		groupIDs[g.Asset().(*Group).ID()] = true
 	}
+	return groupIDs
+}
+
+func bestTriggerMatch(candidates []*Trigger, channel *Channel, groupIDs map[GroupID]bool) *Trigger {
+	matches := make([]*triggerMatch, 0, len(candidates))
 
 	for _, t := range candidates {
 		matched, score := triggerMatchQualifiers(t, channel, groupIDs)
@@ -249,8 +623,13 @@ func findBestTriggerMatch(candidates []*Trigger, channel *Channel, contact *flow
 		return nil
 	}
 
-	// sort the matches to get them in descending order of score
-	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+	// sort the matches to get them in descending order of priority and then score
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].trigger.Priority() != matches[j].trigger.Priority() {
+			return matches[i].trigger.Priority() > matches[j].trigger.Priority()
+		}
+		return matches[i].score > matches[j].score
+	})
 
 	return matches[0].trigger
 }
@@ -301,9 +680,18 @@ SELECT ROW_TO_JSON(r) FROM (SELECT
 	t.flow_id as flow_id,
 	t.trigger_type as trigger_type,
 	t.keyword as keyword,
+	COALESCE(t.keywords, '{}') as keywords,
 	t.match_type as match_type,
+	COALESCE(t.priority, 0) as priority,
 	t.channel_id as channel_id,
 	COALESCE(t.referrer_id, '') as referrer_id,
+	t.group_id as group_id,
+	t.field_id as field_id,
+	t.active_days as active_days,
+	COALESCE(TO_CHAR(t.active_from_time, 'HH24:MI'), '') as active_from_time,
+	COALESCE(TO_CHAR(t.active_until_time, 'HH24:MI'), '') as active_until_time,
+	COALESCE(TO_CHAR(t.active_from_date, 'YYYY-MM-DD'), '') as active_from_date,
+	COALESCE(TO_CHAR(t.active_until_date, 'YYYY-MM-DD'), '') as active_until_date,
 	ARRAY_REMOVE(ARRAY_AGG(DISTINCT ig.contactgroup_id), NULL) as include_group_ids,
 	ARRAY_REMOVE(ARRAY_AGG(DISTINCT eg.contactgroup_id), NULL) as exclude_group_ids
 FROM 
@@ -2,7 +2,9 @@ package models_test
 
 import (
 	"testing"
+	"time"
 
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/flows"
@@ -125,6 +127,12 @@ func TestFindMatchingMsgTrigger(t *testing.T) {
 	doctorsAndNotTestersID := testdata.InsertKeywordTrigger(rt, testdata.Org1, testdata.SingleMessage, "resist", models.MatchOnly, []*testdata.Group{testdata.DoctorsGroup}, []*testdata.Group{testdata.TestersGroup})
 	doctorsCatchallID := testdata.InsertCatchallTrigger(rt, testdata.Org1, testdata.SingleMessage, []*testdata.Group{testdata.DoctorsGroup}, nil)
 	othersAllID := testdata.InsertCatchallTrigger(rt, testdata.Org1, testdata.SingleMessage, nil, nil)
+	helpID := testdata.InsertKeywordsTrigger(rt, testdata.Org1, testdata.Favorites, []string{"help", "hlep", "aide"}, models.MatchContains, 0, []*testdata.Group{testdata.DoctorsGroup}, nil)
+	helpFirstID := testdata.InsertKeywordsTrigger(rt, testdata.Org1, testdata.PickANumber, []string{"help"}, models.MatchFirst, 1, nil, nil)
+	regexID := testdata.InsertKeywordsTrigger(rt, testdata.Org1, testdata.Favorites, []string{`^REG\s*(?P<code>\d{6})$`}, models.MatchRegex, 0, nil, nil)
+	testdata.InsertKeywordsTrigger(rt, testdata.Org1, testdata.Favorites, []string{`^(BAD`}, models.MatchRegex, 0, nil, nil)
+	testdata.InsertKeywordsTrigger(rt, testdata.Org1, testdata.Favorites, []string{``}, models.MatchRegex, 0, nil, nil)
+	testdata.InsertKeywordsTrigger(rt, testdata.Org1, testdata.Favorites, []string{`.*`}, models.MatchRegex, 0, nil, nil)
 
 	// trigger for other org
 	testdata.InsertCatchallTrigger(rt, testdata.Org2, testdata.Org2Favorites, nil, nil)
@@ -157,6 +165,13 @@ func TestFindMatchingMsgTrigger(t *testing.T) {
 		{"other", cathy, doctorsCatchallID},
 		{"other", george, othersAllID},
 		{"", george, othersAllID},
+		{"can you help me", cathy, helpID},
+		{"I need AIDE", cathy, helpID},
+		{"can you hlep me", george, othersAllID},
+		{"help me", cathy, helpFirstID}, // higher priority wins over more specific match
+		{"REG 123456", george, regexID},
+		{"reg123456", george, regexID},
+		{"REG 1234567", george, othersAllID},
 	}
 
 	for _, tc := range tcs {
@@ -164,6 +179,18 @@ func TestFindMatchingMsgTrigger(t *testing.T) {
 
 		assertTrigger(t, tc.expectedTriggerID, trigger, "trigger mismatch for %s sending '%s'", tc.contact.Name(), tc.text)
 	}
+
+	// invalid, empty and match-everything regex triggers aren't loaded
+	assert.Len(t, oa.Triggers(), 10)
+
+	// named captures of regex triggers are used as params
+	regexTrigger := models.FindMatchingMsgTrigger(oa, george, "REG 123456")
+	assert.Equal(t, map[string]string{"code": "123456"}, regexTrigger.Params("REG 123456"))
+	assert.Equal(t, "REG 123456", regexTrigger.Match("REG 123456").Keyword)
+
+	helpTrigger := models.FindMatchingMsgTrigger(oa, cathy, "I need AIDE")
+	assert.Nil(t, helpTrigger.Params("I need AIDE"))
+	assert.Equal(t, "aide", helpTrigger.Match("I need AIDE").Keyword)
 }
 
 func TestFindMatchingIncomingCallTrigger(t *testing.T) {
@@ -289,6 +316,111 @@ func TestFindMatchingReferralTrigger(t *testing.T) {
 	}
 }
 
+func TestFindMatchingContactChangeTriggers(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	optInID := testdata.InsertOptInTrigger(rt, testdata.Org1, testdata.Favorites)
+	doctorsJoinedID := testdata.InsertGroupJoinedTrigger(rt, testdata.Org1, testdata.Favorites, testdata.DoctorsGroup, []*testdata.Group{testdata.TestersGroup})
+	genderChangedID := testdata.InsertFieldChangedTrigger(rt, testdata.Org1, testdata.PickANumber, testdata.GenderField)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshTriggers)
+	require.NoError(t, err)
+
+	testdata.TestersGroup.Add(rt, testdata.Bob)
+
+	_, cathy := testdata.Cathy.Load(rt, oa)
+	_, bob := testdata.Bob.Load(rt, oa)
+
+	doctors := oa.GroupByID(testdata.DoctorsGroup.ID)
+	testers := oa.GroupByID(testdata.TestersGroup.ID)
+	gender := oa.FieldByUUID(testdata.GenderField.UUID)
+	age := oa.FieldByUUID(testdata.AgeField.UUID)
+
+	assertTrigger(t, optInID, models.FindMatchingOptInTrigger(oa, cathy))
+	assertTrigger(t, models.NilTriggerID, models.FindMatchingOptOutTrigger(oa, cathy))
+	assertTrigger(t, doctorsJoinedID, models.FindMatchingGroupJoinedTrigger(oa, cathy, doctors))
+	assertTrigger(t, models.NilTriggerID, models.FindMatchingGroupJoinedTrigger(oa, bob, doctors)) // excluded as a tester
+	assertTrigger(t, models.NilTriggerID, models.FindMatchingGroupJoinedTrigger(oa, cathy, testers))
+	assertTrigger(t, genderChangedID, models.FindMatchingFieldChangedTrigger(oa, cathy, gender))
+	assertTrigger(t, models.NilTriggerID, models.FindMatchingFieldChangedTrigger(oa, cathy, age))
+}
+
+func TestTriggerRestrictions(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	rt.DB.MustExec(`DELETE FROM triggers_trigger`)
+
+	nightID := testdata.InsertCatchallTrigger(rt, testdata.Org1, testdata.SingleMessage, nil, nil)
+	testdata.RestrictTrigger(rt, nightID, "", "22:00", "06:00", "", "")
+
+	promoID := testdata.InsertKeywordTrigger(rt, testdata.Org1, testdata.Favorites, "promo", models.MatchFirst, nil, nil)
+	testdata.RestrictTrigger(rt, promoID, "MTWRF", "", "", "2023-06-01", "2023-06-30")
+
+	// only active on Friday nights, including the early hours of Saturday
+	lateID := testdata.InsertKeywordTrigger(rt, testdata.Org1, testdata.PickANumber, "late", models.MatchFirst, nil, nil)
+	testdata.RestrictTrigger(rt, lateID, "F", "22:00", "06:00", "", "")
+
+	// only active on nights starting in the first ten days of June
+	earlyID := testdata.InsertKeywordTrigger(rt, testdata.Org1, testdata.PickANumber, "early", models.MatchFirst, nil, nil)
+	testdata.RestrictTrigger(rt, earlyID, "", "22:00", "06:00", "2023-06-01", "2023-06-10")
+
+	// window which starts and ends at the same time covers a full day from 09:00 on Fridays
+	fridayID := testdata.InsertKeywordTrigger(rt, testdata.Org1, testdata.PickANumber, "friday", models.MatchFirst, nil, nil)
+	testdata.RestrictTrigger(rt, fridayID, "F", "09:00", "09:00", "", "")
+
+	// trigger with invalid restrictions which shouldn't be loaded
+	invalidID := testdata.InsertKeywordsTrigger(rt, testdata.Org1, testdata.PickANumber, []string{"promo"}, models.MatchFirst, 1, nil, nil)
+	testdata.RestrictTrigger(rt, invalidID, "MXZ", "", "", "", "")
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshTriggers)
+	require.NoError(t, err)
+	assert.Equal(t, 5, len(oa.Triggers()))
+
+	_, cathy := testdata.Cathy.Load(rt, oa)
+
+	// org is in America/Los_Angeles which is UTC-7 in June
+	tcs := []struct {
+		now               time.Time
+		text              string
+		expectedTriggerID models.TriggerID
+	}{
+		{time.Date(2023, 6, 15, 19, 0, 0, 0, time.UTC), "promo", promoID}, // Thursday noon
+		{time.Date(2023, 6, 15, 19, 0, 0, 0, time.UTC), "hi", models.NilTriggerID},
+		{time.Date(2023, 6, 16, 6, 30, 0, 0, time.UTC), "promo", promoID}, // Thursday 23:30
+		{time.Date(2023, 6, 16, 6, 30, 0, 0, time.UTC), "hi", nightID},
+		{time.Date(2023, 6, 17, 10, 0, 0, 0, time.UTC), "promo", nightID},          // Saturday 03:00
+		{time.Date(2023, 6, 17, 13, 0, 0, 0, time.UTC), "hi", models.NilTriggerID}, // Saturday 06:00
+		{time.Date(2023, 6, 17, 5, 30, 0, 0, time.UTC), "late", lateID},            // Friday 22:30
+		{time.Date(2023, 6, 17, 10, 0, 0, 0, time.UTC), "late", lateID},            // Saturday 03:00 in Friday's window
+		{time.Date(2023, 6, 16, 10, 0, 0, 0, time.UTC), "late", nightID},           // Friday 03:00 in Thursday's window
+		{time.Date(2023, 6, 18, 5, 30, 0, 0, time.UTC), "late", nightID},           // Saturday 22:30
+		{time.Date(2023, 5, 31, 19, 0, 0, 0, time.UTC), "promo", models.NilTriggerID},
+		{time.Date(2023, 6, 30, 19, 0, 0, 0, time.UTC), "promo", promoID},
+		{time.Date(2023, 7, 3, 19, 0, 0, 0, time.UTC), "promo", models.NilTriggerID},
+		{time.Date(2023, 6, 11, 10, 0, 0, 0, time.UTC), "early", earlyID},              // June 11th 03:00 in June 10th's window
+		{time.Date(2023, 6, 11, 5, 30, 0, 0, time.UTC), "early", earlyID},              // June 10th 22:30
+		{time.Date(2023, 6, 12, 5, 30, 0, 0, time.UTC), "early", nightID},              // June 11th 22:30
+		{time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC), "early", nightID},               // June 1st 03:00 in May 31st's window
+		{time.Date(2023, 6, 16, 16, 30, 0, 0, time.UTC), "friday", fridayID},           // Friday 09:30
+		{time.Date(2023, 6, 17, 15, 0, 0, 0, time.UTC), "friday", fridayID},            // Saturday 08:00 in Friday's window
+		{time.Date(2023, 6, 17, 17, 0, 0, 0, time.UTC), "friday", models.NilTriggerID}, // Saturday 10:00
+		{time.Date(2023, 6, 16, 15, 0, 0, 0, time.UTC), "friday", models.NilTriggerID}, // Friday 08:00 in Thursday's window
+	}
+
+	for _, tc := range tcs {
+		dates.SetNowSource(dates.NewFixedNowSource(tc.now))
+
+		trigger := models.FindMatchingMsgTrigger(oa, cathy, tc.text)
+
+		assertTrigger(t, tc.expectedTriggerID, trigger, "trigger mismatch for '%s' at %s", tc.text, tc.now)
+	}
+}
+
 func TestArchiveContactTriggers(t *testing.T) {
 	ctx, rt := testsuite.Runtime()
 
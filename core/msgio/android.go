@@ -1,23 +1,56 @@
 package msgio
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/runtime"
-	"github.com/pkg/errors"
-
-	"github.com/edganiukov/fcm"
 	"github.com/sirupsen/logrus"
 )
 
-// SyncAndroidChannels tries to trigger syncs of the given Android channels via FCM
-func SyncAndroidChannels(fc *fcm.Client, channels []*models.Channel) {
+// AndroidTransport sends messages to Android channels by triggering the relayer app on the device to sync via FCM
+type AndroidTransport struct {
+	// FCM client to use, which if nil is created from the runtime config when first needed
+	FCMClient *FCMClient
+
+	clientInit sync.Once
+}
+
+// Send triggers syncs of the channels of the given batches. Messages are fetched by the relayer when it syncs so
+// there are never any which need retrying.
+func (t *AndroidTransport) Send(ctx context.Context, rt *runtime.Runtime, batches []*Batch) []*models.Msg {
+	channels := make([]*models.Channel, 0, 5)
+	seen := make(map[*models.Channel]bool)
+
+	for _, b := range batches {
+		if !seen[b.Channel] {
+			channels = append(channels, b.Channel)
+			seen[b.Channel] = true
+		}
+	}
+
+	t.clientInit.Do(func() {
+		if t.FCMClient == nil {
+			t.FCMClient = CreateFCMClient(rt.Config)
+		}
+	})
+
+	SyncAndroidChannels(ctx, rt, t.FCMClient, channels)
+
+	return nil
+}
+
+// SyncAndroidChannels tries to trigger syncs of the given Android channels via FCM, writing a channel log for each
+func SyncAndroidChannels(ctx context.Context, rt *runtime.Runtime, fc *FCMClient, channels []*models.Channel) {
 	if fc == nil {
 		logrus.Warn("skipping Android sync as instance has not configured FCM")
 		return
 	}
 
+	clogs := make([]*models.ChannelLog, 0, len(channels))
+
 	for _, channel := range channels {
 		assert(channel.Type() == models.ChannelTypeAndroid, "can't sync a non-android channel")
 
@@ -27,33 +60,40 @@ func SyncAndroidChannels(fc *fcm.Client, channels []*models.Channel) {
 			continue
 		}
 
-		sync := &fcm.Message{
-			Token:       fcmID,
-			Priority:    "high",
-			CollapseKey: "sync",
-			Data:        map[string]interface{}{"msg": "sync"},
-		}
-
 		start := time.Now()
-		_, err := fc.Send(sync)
+		trace, err := fc.Send(ctx, fcmID, map[string]string{"msg": "sync"}, "sync")
+
+		clog := models.NewChannelLog(models.ChannelLogTypeAndroidSync, channel, fc.RedactValues())
+		if trace != nil {
+			clog.HTTP(trace)
+		}
 
 		if err != nil {
 			// log failures but continue, relayer will sync on its own
+			clog.Error(err)
 			logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Error("error syncing channel")
 		} else {
 			logrus.WithField("elapsed", time.Since(start)).WithField("channel_uuid", channel.UUID()).Debug("android sync complete")
 		}
+
+		clog.End()
+		clogs = append(clogs, clog)
+	}
+
+	if err := models.InsertChannelLogs(ctx, rt, clogs); err != nil {
+		logrus.WithError(err).Error("error inserting android sync channel logs")
 	}
 }
 
-// CreateFCMClient creates an FCM client based on the configured FCM API key
-func CreateFCMClient(cfg *runtime.Config) *fcm.Client {
-	if cfg.FCMKey == "" {
+// CreateFCMClient creates an FCM client based on the configured service account credentials file
+func CreateFCMClient(cfg *runtime.Config) *FCMClient {
+	if cfg.FCMCredentialsFile == "" {
 		return nil
 	}
-	client, err := fcm.NewClient(cfg.FCMKey)
+	client, err := NewFCMClientFromFile(cfg.FCMCredentialsFile)
 	if err != nil {
-		panic(errors.Wrap(err, "unable to create FCM client"))
+		logrus.WithError(err).Error("unable to create FCM client")
+		return nil
 	}
 	return client
 }
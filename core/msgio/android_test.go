@@ -1,11 +1,18 @@
 package msgio_test
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/mailroom/core/models"
@@ -14,36 +21,70 @@ import (
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-
-	"github.com/edganiukov/fcm"
 )
 
+// FCMMessage is a message received by the mock FCM endpoint
+type FCMMessage struct {
+	Token   string            `json:"token"`
+	Data    map[string]string `json:"data"`
+	Android struct {
+		Priority    string `json:"priority"`
+		CollapseKey string `json:"collapse_key"`
+	} `json:"android"`
+}
+
+// MockFCMEndpoint is a local stand-in for both the Google OAuth2 token endpoint and the FCM HTTP v1 API
 type MockFCMEndpoint struct {
 	server *httptest.Server
 	tokens []string
 
+	// number of access tokens minted by this endpoint
+	TokensMinted int
+
 	// log of messages sent to this endpoint
-	Messages []*fcm.Message
+	Messages []*FCMMessage
 }
 
 func (m *MockFCMEndpoint) Handle(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	requestBody, _ := io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path == "/token" {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || r.Form.Get("assertion") == "" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
 
-	message := &fcm.Message{}
-	jsonx.Unmarshal(requestBody, message)
+		m.TokensMinted++
+		w.WriteHeader(200)
+		w.Write([]byte(`{"access_token": "ACCESSTOKEN123", "expires_in": 3600, "token_type": "Bearer"}`))
+		return
+	}
 
-	m.Messages = append(m.Messages, message)
+	if r.URL.Path != "/v1/projects/test-project/messages:send" || r.Header.Get("Authorization") != "Bearer ACCESSTOKEN123" {
+		w.WriteHeader(401)
+		w.Write([]byte(`{"error": {"code": 401, "status": "UNAUTHENTICATED"}}`))
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
+	requestBody, _ := io.ReadAll(r.Body)
+
+	request := &struct {
+		Message *FCMMessage `json:"message"`
+	}{}
+	jsonx.Unmarshal(requestBody, request)
+
+	m.Messages = append(m.Messages, request.Message)
 
-	if utils.StringSliceContains(m.tokens, message.Token, false) {
+	if utils.StringSliceContains(m.tokens, request.Message.Token, false) {
 		w.WriteHeader(200)
-		w.Write([]byte(`{}`))
+		w.Write([]byte(`{"name": "projects/test-project/messages/1"}`))
 	} else {
-		w.WriteHeader(200)
-		w.Write([]byte(`{"error": "bad_token"}`))
+		w.WriteHeader(404)
+		w.Write([]byte(`{"error": {"code": 404, "status": "NOT_FOUND"}}`))
 	}
 }
 
@@ -51,8 +92,24 @@ func (m *MockFCMEndpoint) Stop() {
 	m.server.Close()
 }
 
-func (m *MockFCMEndpoint) Client(apiKey string) *fcm.Client {
-	client, _ := fcm.NewClient("FCMKEY123", fcm.WithEndpoint(m.server.URL))
+// Credentials returns service account credentials which point at this endpoint for minting access tokens
+func (m *MockFCMEndpoint) Credentials() []byte {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return jsonx.MustMarshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "test-project",
+		"private_key_id": "1234",
+		"private_key":    string(keyPEM),
+		"client_email":   "mailroom@test-project.iam.gserviceaccount.com",
+		"token_uri":      m.server.URL + "/token",
+	})
+}
+
+func (m *MockFCMEndpoint) Client() *msgio.FCMClient {
+	client, _ := msgio.NewFCMClient(m.Credentials())
+	client.Endpoint = m.server.URL
 	return client
 }
 
@@ -65,10 +122,12 @@ func newMockFCMEndpoint(tokens ...string) *MockFCMEndpoint {
 func TestSyncAndroidChannels(t *testing.T) {
 	ctx, rt := testsuite.Runtime()
 
+	defer testsuite.Reset(testsuite.ResetData)
+
 	mockFCM := newMockFCMEndpoint("FCMID3")
 	defer mockFCM.Stop()
 
-	fc := mockFCM.Client("FCMKEY123")
+	fc := mockFCM.Client()
 
 	// create some Android channels
 	testChannel1 := testdata.InsertChannel(rt, testdata.Org1, "A", "Android 1", []string{"tel"}, "SR", map[string]interface{}{"FCM_ID": ""})       // no FCM ID
@@ -82,26 +141,47 @@ func TestSyncAndroidChannels(t *testing.T) {
 	channel2 := oa.ChannelByID(testChannel2.ID)
 	channel3 := oa.ChannelByID(testChannel3.ID)
 
-	msgio.SyncAndroidChannels(fc, []*models.Channel{channel1, channel2, channel3})
+	msgio.SyncAndroidChannels(ctx, rt, fc, []*models.Channel{channel1, channel2, channel3})
 
 	// check that we try to sync the 2 channels with FCM IDs, even tho one fails
 	assert.Equal(t, 2, len(mockFCM.Messages))
 	assert.Equal(t, "FCMID2", mockFCM.Messages[0].Token)
 	assert.Equal(t, "FCMID3", mockFCM.Messages[1].Token)
 
-	assert.Equal(t, "high", mockFCM.Messages[0].Priority)
-	assert.Equal(t, "sync", mockFCM.Messages[0].CollapseKey)
-	assert.Equal(t, map[string]interface{}{"msg": "sync"}, mockFCM.Messages[0].Data)
+	assert.Equal(t, "high", mockFCM.Messages[0].Android.Priority)
+	assert.Equal(t, "sync", mockFCM.Messages[0].Android.CollapseKey)
+	assert.Equal(t, map[string]string{"msg": "sync"}, mockFCM.Messages[0].Data)
+
+	// access token is only minted once
+	assert.Equal(t, 1, mockFCM.TokensMinted)
+
+	// and each sync is logged against its channel, without the access token
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM channels_channellog WHERE log_type = 'android_sync' AND channel_id = $1 AND is_error = TRUE`, testChannel2.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM channels_channellog WHERE log_type = 'android_sync' AND channel_id = $1 AND is_error = FALSE`, testChannel3.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM channels_channellog WHERE http_logs::text LIKE '%ACCESSTOKEN123%'`).Returns(0)
 }
 
 func TestCreateFCMClient(t *testing.T) {
 	_, rt := testsuite.Runtime()
 
-	rt.Config.FCMKey = "1234"
+	mockFCM := newMockFCMEndpoint()
+	defer mockFCM.Stop()
+
+	credsFile := filepath.Join(t.TempDir(), "credentials.json")
+	os.WriteFile(credsFile, mockFCM.Credentials(), 0600)
+
+	rt.Config.FCMCredentialsFile = credsFile
 
 	assert.NotNil(t, msgio.CreateFCMClient(rt.Config))
 
-	rt.Config.FCMKey = ""
+	rt.Config.FCMCredentialsFile = filepath.Join(t.TempDir(), "missing.json")
+
+	assert.Nil(t, msgio.CreateFCMClient(rt.Config))
+
+	rt.Config.FCMCredentialsFile = ""
 
 	assert.Nil(t, msgio.CreateFCMClient(rt.Config))
+
+	_, err := msgio.NewFCMClient([]byte(`{"project_id": "test-project"}`))
+	assert.EqualError(t, err, "FCM credentials missing project_id, client_email, private_key or token_uri")
 }
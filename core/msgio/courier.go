@@ -180,6 +180,30 @@ func PushCourierBatch(rc redis.Conn, oa *models.OrgAssets, ch *models.Channel, m
 	return err
 }
 
+// CourierTransport sends messages by queuing them for courier
+type CourierTransport struct{}
+
+// Send queues the given batches of messages to courier
+func (t *CourierTransport) Send(ctx context.Context, rt *runtime.Runtime, batches []*Batch) []*models.Msg {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	unsent := make([]*models.Msg, 0)
+
+	for _, b := range batches {
+		err := QueueCourierMessages(rc, b.OrgAssets, b.ContactID, b.Channel, b.Msgs)
+
+		// not being able to queue a message isn't the end of the world, log but don't return an error
+		if err != nil {
+			logrus.WithField("messages", b.Msgs).WithField("contact", b.ContactID).WithError(err).Error("error queuing messages")
+
+			unsent = append(unsent, b.Msgs...)
+		}
+	}
+
+	return unsent
+}
+
 // QueueCourierMessages queues messages for a single contact to Courier
 func QueueCourierMessages(rc redis.Conn, oa *models.OrgAssets, contactID models.ContactID, channel *models.Channel, msgs []*models.Msg) error {
 	if len(msgs) == 0 {
@@ -0,0 +1,204 @@
+package msgio
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/pkg/errors"
+)
+
+const (
+	fcmDefaultEndpoint = "https://fcm.googleapis.com"
+	fcmScope           = "https://www.googleapis.com/auth/firebase.messaging"
+)
+
+// FCMRetryBackoffs are the delays between retries of requests to FCM which fail due to connection errors, rate
+// limiting or server errors
+var FCMRetryBackoffs = []time.Duration{time.Second, time.Second * 2}
+
+// service account credentials as downloaded from the Firebase console
+type fcmCredentials struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// FCMClient sends messages to devices using the FCM HTTP v1 API, authenticating with OAuth2 access tokens which are
+// minted using service account credentials
+type FCMClient struct {
+	// Endpoint is the base URL of the FCM API, which can be changed for testing
+	Endpoint string
+
+	projectID    string
+	clientEmail  string
+	privateKeyID string
+	privateKey   *rsa.PrivateKey
+	tokenURL     string
+	httpClient   *http.Client
+
+	token        string
+	tokenExpires time.Time
+	tokenMutex   sync.Mutex
+}
+
+// NewFCMClient creates a new FCM client from the given service account credentials JSON
+func NewFCMClient(credentials []byte) (*FCMClient, error) {
+	creds := &fcmCredentials{}
+	if err := jsonx.Unmarshal(credentials, creds); err != nil {
+		return nil, errors.Wrap(err, "error parsing FCM credentials")
+	}
+	if creds.ProjectID == "" || creds.ClientEmail == "" || creds.PrivateKey == "" || creds.TokenURI == "" {
+		return nil, errors.New("FCM credentials missing project_id, client_email, private_key or token_uri")
+	}
+
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(creds.PrivateKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing FCM credentials private key")
+	}
+
+	return &FCMClient{
+		Endpoint:     fcmDefaultEndpoint,
+		projectID:    creds.ProjectID,
+		clientEmail:  creds.ClientEmail,
+		privateKeyID: creds.PrivateKeyID,
+		privateKey:   privateKey,
+		tokenURL:     creds.TokenURI,
+		httpClient:   &http.Client{Timeout: time.Second * 15},
+	}, nil
+}
+
+// NewFCMClientFromFile creates a new FCM client from the service account credentials file at the given path
+func NewFCMClientFromFile(path string) (*FCMClient, error) {
+	credentials, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading FCM credentials file")
+	}
+	return NewFCMClient(credentials)
+}
+
+// Send sends a data message to the device with the given registration token, returning the HTTP trace of the send
+// request if it was made
+func (c *FCMClient) Send(ctx context.Context, token string, data map[string]string, collapseKey string) (*httpx.Trace, error) {
+	accessToken, err := c.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	body := jsonx.MustMarshal(map[string]any{
+		"message": map[string]any{
+			"token":   token,
+			"data":    data,
+			"android": map[string]any{"priority": "high", "collapse_key": collapseKey},
+		},
+	})
+
+	sendURL := fmt.Sprintf("%s/v1/projects/%s/messages:send", c.Endpoint, c.projectID)
+	trace, err := c.post(ctx, sendURL, body, map[string]string{
+		"Authorization": "Bearer " + accessToken,
+		"Content-Type":  "application/json",
+	})
+	if err != nil {
+		return trace, errors.Wrap(err, "error making FCM send request")
+	}
+	if trace.Response.StatusCode != http.StatusOK {
+		return trace, errors.Errorf("FCM send request failed with status %d", trace.Response.StatusCode)
+	}
+
+	return trace, nil
+}
+
+// RedactValues returns the values which should be redacted from logs of requests made by this client
+func (c *FCMClient) RedactValues() []string {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	if c.token == "" {
+		return nil
+	}
+	return []string{c.token}
+}
+
+// gets an access token, minting a new one if we don't have one or it is about to expire
+func (c *FCMClient) accessToken(ctx context.Context) (string, error) {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	if c.token != "" && time.Now().Before(c.tokenExpires.Add(-time.Minute)) {
+		return c.token, nil
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   c.clientEmail,
+		"scope": fcmScope,
+		"aud":   c.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	assertion := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	assertion.Header["kid"] = c.privateKeyID
+
+	signed, err := assertion.SignedString(c.privateKey)
+	if err != nil {
+		return "", errors.Wrap(err, "error signing FCM token request")
+	}
+
+	form := url.Values{"grant_type": []string{"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": []string{signed}}
+	trace, err := c.post(ctx, c.tokenURL, []byte(form.Encode()), map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "error making FCM token request")
+	}
+	if trace.Response.StatusCode != http.StatusOK {
+		return "", errors.Errorf("FCM token request failed with status %d", trace.Response.StatusCode)
+	}
+
+	resp := &struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := jsonx.Unmarshal(trace.ResponseBody, resp); err != nil || resp.AccessToken == "" {
+		return "", errors.New("FCM token response missing access_token")
+	}
+
+	c.token = resp.AccessToken
+	c.tokenExpires = now.Add(time.Duration(resp.ExpiresIn) * time.Second)
+
+	return c.token, nil
+}
+
+// makes a POST request, retrying on connection errors, rate limiting and server errors
+func (c *FCMClient) post(ctx context.Context, url string, body []byte, headers map[string]string) (*httpx.Trace, error) {
+	for retry := 0; ; retry++ {
+		req, err := httpx.NewRequest(http.MethodPost, url, bytes.NewReader(body), headers)
+		if err != nil {
+			return nil, err
+		}
+
+		trace, err := httpx.DoTrace(c.httpClient, req.WithContext(ctx), nil, nil, -1)
+
+		retryable := err != nil || trace.Response.StatusCode == http.StatusTooManyRequests || trace.Response.StatusCode >= 500
+		if !retryable || retry >= len(FCMRetryBackoffs) {
+			return trace, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return trace, ctx.Err()
+		case <-time.After(FCMRetryBackoffs[retry]):
+		}
+	}
+}
@@ -3,7 +3,6 @@ package msgio
 import (
 	"context"
 
-	"github.com/edganiukov/fcm"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/runtime"
 	"github.com/pkg/errors"
@@ -15,19 +14,19 @@ type contactAndChannel struct {
 	channel   *models.Channel
 }
 
-// SendMessages tries to send the given messages via Courier or Android syncing
-func SendMessages(ctx context.Context, rt *runtime.Runtime, tx models.Queryer, fc *fcm.Client, msgs []*models.Msg) error {
-	// messages to be sent by courier, organized by contact+channel
-	courierMsgs := make(map[contactAndChannel][]*models.Msg, 100)
+// SendMessages tries to send the given messages using the transports for their channels
+func SendMessages(ctx context.Context, rt *runtime.Runtime, tx models.Queryer, msgs []*models.Msg) error {
+	// messages to be sent, organized by contact+channel
+	batches := make(map[contactAndChannel]*Batch, 100)
 
-	// android channels that need to be notified to sync
-	androidChannels := make([]*models.Channel, 0, 5)
-	androidChannelsSeen := make(map[*models.Channel]bool)
+	// batches organized by transport, in the order we first see each transport
+	transports := make([]Transport, 0, 2)
+	transportBatches := make(map[Transport][]*Batch, 2)
 
 	// messages that need to be marked as pending
 	pending := make([]*models.Msg, 0, 1)
 
-	// walk through our messages, separate by whether they have a channel and if it's Android
+	// walk through our messages, separate by whether they have a channel and which transport that uses
 	for _, msg := range msgs {
 		// ignore any message already marked as failed (maybe org is suspended)
 		if msg.Status() == models.MsgStatusFailed {
@@ -42,50 +41,30 @@ func SendMessages(ctx context.Context, rt *runtime.Runtime, tx models.Queryer, f
 		channel := oa.ChannelByID(msg.ChannelID())
 
 		if channel != nil {
-			if channel.Type() == models.ChannelTypeAndroid {
-				if !androidChannelsSeen[channel] {
-					androidChannels = append(androidChannels, channel)
+			cc := contactAndChannel{msg.ContactID(), channel}
+			batch := batches[cc]
+			if batch == nil {
+				batch = &Batch{OrgAssets: oa, ContactID: msg.ContactID(), Channel: channel}
+				batches[cc] = batch
+
+				transport := TransportForChannel(channel)
+				if _, seen := transportBatches[transport]; !seen {
+					transports = append(transports, transport)
 				}
-				androidChannelsSeen[channel] = true
-			} else {
-				cc := contactAndChannel{msg.ContactID(), channel}
-				courierMsgs[cc] = append(courierMsgs[cc], msg)
+				transportBatches[transport] = append(transportBatches[transport], batch)
 			}
+			batch.Msgs = append(batch.Msgs, msg)
 		} else {
 			pending = append(pending, msg)
 		}
 	}
 
-	// if there are courier messages to send, do so
-	if len(courierMsgs) > 0 {
-		rc := rt.RP.Get()
-		defer rc.Close()
+	for _, transport := range transports {
+		unsent := transport.Send(ctx, rt, transportBatches[transport])
 
-		for cc, contactMsgs := range courierMsgs {
-			oa, err := models.GetOrgAssets(ctx, rt, cc.channel.OrgID())
-			if err != nil {
-				return errors.Wrap(err, "error getting org assets")
-			}
-
-			err = QueueCourierMessages(rc, oa, cc.contactID, cc.channel, contactMsgs)
-
-			// not being able to queue a message isn't the end of the world, log but don't return an error
-			if err != nil {
-				logrus.WithField("messages", contactMsgs).WithField("contact", cc.contactID).WithError(err).Error("error queuing messages")
-
-				// in the case of errors we do want to change the messages back to pending however so they
-				// get queued later. (for the common case messages are only inserted and queued, without a status update)
-				pending = append(pending, contactMsgs...)
-			}
-		}
-	}
-
-	// if we have any android messages, trigger syncs for the unique channels
-	if len(androidChannels) > 0 {
-		if fc == nil {
-			fc = CreateFCMClient(rt.Config)
-		}
-		SyncAndroidChannels(fc, androidChannels)
+		// messages that couldn't be sent should be changed back to pending so they get queued later (for the common
+		// case messages are only inserted and queued, without a status update)
+		pending = append(pending, unsent...)
 	}
 
 	// any messages that didn't get sent should be moved back to initializing(I) (they are queued(Q) at creation to
@@ -52,7 +52,10 @@ func TestSendMessages(t *testing.T) {
 	mockFCM := newMockFCMEndpoint("FCMID3")
 	defer mockFCM.Stop()
 
-	fc := mockFCM.Client("FCMKEY123")
+	fc := mockFCM.Client()
+
+	previous := msgio.RegisterTransport(models.ChannelTypeAndroid, &msgio.AndroidTransport{FCMClient: fc})
+	defer msgio.RegisterTransport(models.ChannelTypeAndroid, previous)
 
 	// create some Andoid channels
 	androidChannel1 := testdata.InsertChannel(rt, testdata.Org1, "A", "Android 1", []string{"tel"}, "SR", map[string]interface{}{"FCM_ID": "FCMID1"})
@@ -160,7 +163,7 @@ func TestSendMessages(t *testing.T) {
 		rc.Do("FLUSHDB")
 		mockFCM.Messages = nil
 
-		msgio.SendMessages(ctx, rt, rt.DB, fc, msgs)
+		msgio.SendMessages(ctx, rt, rt.DB, msgs)
 
 		testsuite.AssertCourierQueues(t, tc.QueueSizes, "courier queue sizes mismatch in '%s'", tc.Description)
 
@@ -175,3 +178,60 @@ func TestSendMessages(t *testing.T) {
 		assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE status = 'I'`).Returns(tc.UnqueuedMsgs, `initializing messages mismatch in '%s'`, tc.Description)
 	}
 }
+
+type testTransport struct {
+	batches []*msgio.Batch
+	fail    bool
+}
+
+func (t *testTransport) Send(ctx context.Context, rt *runtime.Runtime, batches []*msgio.Batch) []*models.Msg {
+	t.batches = append(t.batches, batches...)
+
+	unsent := make([]*models.Msg, 0)
+	if t.fail {
+		for _, b := range batches {
+			unsent = append(unsent, b.Msgs...)
+		}
+	}
+	return unsent
+}
+
+func TestSendMessagesWithTransport(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	transport := &testTransport{}
+	previous := msgio.RegisterTransport("TG", transport)
+	defer msgio.RegisterTransport("TG", previous)
+
+	gatewayChannel := testdata.InsertChannel(rt, testdata.Org1, "TG", "Gateway", []string{"tel"}, "SR", map[string]any{})
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	msgs := []*models.Msg{
+		(&msgSpec{Channel: gatewayChannel, Contact: testdata.Cathy}).createMsg(t, rt, oa),
+		(&msgSpec{Channel: gatewayChannel, Contact: testdata.Cathy}).createMsg(t, rt, oa),
+		(&msgSpec{Channel: gatewayChannel, Contact: testdata.Bob}).createMsg(t, rt, oa),
+		(&msgSpec{Channel: testdata.TwilioChannel, Contact: testdata.Cathy}).createMsg(t, rt, oa),
+	}
+
+	msgio.SendMessages(ctx, rt, rt.DB, msgs)
+
+	// messages on the gateway channel go to our transport, batched by contact, and the rest to courier
+	assert.Len(t, transport.batches, 2)
+	testsuite.AssertCourierQueues(t, map[string][]int{"msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/0": {1}})
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE status = 'I'`).Returns(0)
+
+	// messages that the transport couldn't send are marked for requeuing
+	transport.fail = true
+	transport.batches = nil
+
+	msgio.SendMessages(ctx, rt, rt.DB, msgs[:3])
+
+	assert.Len(t, transport.batches, 2)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE status = 'I'`).Returns(3)
+}
@@ -0,0 +1,45 @@
+package msgio
+
+import (
+	"context"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+)
+
+// Batch is a set of outgoing messages for a single contact and channel
+type Batch struct {
+	OrgAssets *models.OrgAssets
+	ContactID models.ContactID
+	Channel   *models.Channel
+	Msgs      []*models.Msg
+}
+
+// Transport is a way of getting outgoing messages to their channels
+type Transport interface {
+	// Send sends the given batches of messages, returning any messages that couldn't be sent and should be retried
+	Send(ctx context.Context, rt *runtime.Runtime, batches []*Batch) []*models.Msg
+}
+
+var registeredTransports = map[models.ChannelType]Transport{
+	models.ChannelTypeAndroid: &AndroidTransport{},
+}
+
+// DefaultTransport is the transport used for channel types which don't have a registered transport
+var DefaultTransport Transport = &CourierTransport{}
+
+// RegisterTransport registers the transport to be used for messages on channels of the given type, returning the
+// transport previously registered for that type if there was one
+func RegisterTransport(channelType models.ChannelType, t Transport) Transport {
+	previous := registeredTransports[channelType]
+	registeredTransports[channelType] = t
+	return previous
+}
+
+// TransportForChannel returns the transport to be used for messages on the given channel
+func TransportForChannel(channel *models.Channel) Transport {
+	if t := registeredTransports[channel.Type()]; t != nil {
+		return t
+	}
+	return DefaultTransport
+}
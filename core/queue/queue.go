@@ -40,6 +40,11 @@ const (
 
 	// HandlerQueue is our queue for message handling or other tasks related to just one contact
 	HandlerQueue = "handler"
+
+	// TypeHandleContactEvent is the task type for flagging that a contact has tasks to be handled
+	TypeHandleContactEvent = "handle_contact_event"
+
+	contactQueuePattern = "c:%d:%d"
 )
 
 // Size returns the number of tasks for the passed in queue
@@ -89,6 +94,34 @@ func AddTask(rc redis.Conn, queue string, taskType string, orgID int, task inter
 	return err
 }
 
+// AddContactTask adds the passed in task to the queue of tasks for the given contact, which are handled one at a time,
+// and flags on the handler queue that the contact has tasks. `front` specifies whether the task should be inserted in
+// front of all other tasks for that contact.
+func AddContactTask(rc redis.Conn, orgID int, contactID int, task *Task, front bool) error {
+	taskJSON, err := json.Marshal(task)
+	if err != nil {
+		return errors.Wrapf(err, "error marshalling contact task")
+	}
+
+	// first push the task on our contact queue
+	contactQ := fmt.Sprintf(contactQueuePattern, orgID, contactID)
+	if front {
+		_, err = redis.Int64(rc.Do("lpush", contactQ, string(taskJSON)))
+	} else {
+		_, err = redis.Int64(rc.Do("rpush", contactQ, string(taskJSON)))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error adding contact event")
+	}
+
+	// then add a handle task for that contact on our global handler queue
+	err = AddTask(rc, HandlerQueue, TypeHandleContactEvent, orgID, map[string]int{"contact_id": contactID}, DefaultPriority)
+	if err != nil {
+		return errors.Wrapf(err, "error adding handle event task")
+	}
+	return nil
+}
+
 var popTask = redis.NewScript(1, `-- KEYS: [QueueName]
     -- first get what is the active queue
 	local result = redis.call("zrange", KEYS[1] .. ":active", 0, 0, "WITHSCORES")
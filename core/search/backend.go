@@ -0,0 +1,49 @@
+package search
+
+import (
+	"context"
+
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+// Backend is something which can find the contacts matching a search
+type Backend interface {
+	// Count returns the number of contacts matching the given search
+	Count(ctx context.Context, oa *models.OrgAssets, s *Search) (int64, error)
+
+	// Page returns a page of the contacts matching the given search, ordered by the given sort, and the total number
+	// of matching contacts
+	Page(ctx context.Context, oa *models.OrgAssets, s *Search, sort string, offset, pageSize int) ([]models.ContactID, int64, error)
+
+	// IDs returns up to limit of the contacts matching the given search without sorting. Limit of -1 means return all.
+	IDs(ctx context.Context, oa *models.OrgAssets, s *Search, limit int) ([]models.ContactID, error)
+
+	// Stream calls fn with successive batches of up to batchSize of the contacts matching the given search with ids
+	// greater than afterID, in ascending id order, so that large result sets can be processed without holding them all
+	// in memory, and processing can be resumed from the last id seen
+	Stream(ctx context.Context, oa *models.OrgAssets, s *Search, afterID models.ContactID, batchSize int, fn func([]models.ContactID) error) error
+}
+
+// Search is a search for contacts, all parts of which are optional
+type Search struct {
+	Group      *models.Group
+	Status     models.ContactStatus
+	ExcludeIDs []models.ContactID
+	Query      *contactql.ContactQuery
+}
+
+// GetBackend returns the search backend selected in our config
+func GetBackend(rt *runtime.Runtime) (Backend, error) {
+	if rt.Config.SearchBackend == "postgres" {
+		return &postgresBackend{db: rt.ReadonlyDB}, nil
+	}
+
+	if rt.ES == nil {
+		return nil, errors.Errorf("no elastic client available, check your configuration")
+	}
+
+	return &elasticBackend{es: rt.ES, index: rt.Config.ElasticContactsIndex}, nil
+}
@@ -0,0 +1,137 @@
+package search
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/nyaruka/goflow/contactql/es"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+)
+
+// search backend which queries the contacts index in Elasticsearch
+type elasticBackend struct {
+	es    *elastic.Client
+	index string
+}
+
+func (b *elasticBackend) Count(ctx context.Context, oa *models.OrgAssets, s *Search) (int64, error) {
+	eq := BuildElasticQuery(oa, s.Group, s.Status, s.ExcludeIDs, s.Query)
+
+	count, err := b.es.Count(b.index).Routing(routing(oa)).Query(eq).Do(ctx)
+	if err != nil {
+		return 0, elasticError(err)
+	}
+
+	return count, nil
+}
+
+func (b *elasticBackend) Page(ctx context.Context, oa *models.OrgAssets, s *Search, sort string, offset, pageSize int) ([]models.ContactID, int64, error) {
+	eq := BuildElasticQuery(oa, s.Group, s.Status, s.ExcludeIDs, s.Query)
+
+	fieldSort, err := es.ToElasticFieldSort(sort, oa.SessionAssets())
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "error parsing sort")
+	}
+
+	src := b.es.Search(b.index).TrackTotalHits(true).Routing(routing(oa))
+	src = src.Size(pageSize).From(offset).Query(eq).SortBy(fieldSort).FetchSource(false)
+
+	results, err := src.Do(ctx)
+	if err != nil {
+		return nil, 0, elasticError(err)
+	}
+
+	ids := make([]models.ContactID, 0, pageSize)
+	ids, err = appendIDsFromHits(ids, results.Hits.Hits)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ids, results.Hits.TotalHits.Value, nil
+}
+
+func (b *elasticBackend) IDs(ctx context.Context, oa *models.OrgAssets, s *Search, limit int) ([]models.ContactID, error) {
+	eq := BuildElasticQuery(oa, s.Group, s.Status, s.ExcludeIDs, s.Query)
+	ids := make([]models.ContactID, 0, 100)
+
+	// if limit provided that can be done with regular search, do that
+	if limit >= 0 && limit <= 10000 {
+		results, err := b.es.Search(b.index).Routing(routing(oa)).From(0).Size(limit).Query(eq).FetchSource(false).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return appendIDsFromHits(ids, results.Hits.Hits)
+	}
+
+	// for larger limits, page through all results
+	err := b.Stream(ctx, oa, s, 0, 10000, func(batch []models.ContactID) error {
+		ids = append(ids, batch...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (b *elasticBackend) Stream(ctx context.Context, oa *models.OrgAssets, s *Search, afterID models.ContactID, batchSize int, fn func([]models.ContactID) error) error {
+	eq := BuildElasticQuery(oa, s.Group, s.Status, s.ExcludeIDs, s.Query)
+
+	// rather than scrolling, we page through results by id which means a stream can be resumed from any point
+	for {
+		bq := elastic.NewBoolQuery().Must(eq, elastic.NewRangeQuery("id").Gt(afterID))
+
+		results, err := b.es.Search(b.index).Routing(routing(oa)).Size(batchSize).Query(bq).SortBy(elastic.NewFieldSort("id").Asc()).FetchSource(false).Do(ctx)
+		if err != nil {
+			return elasticError(err)
+		}
+
+		batch, err := appendIDsFromHits(make([]models.ContactID, 0, len(results.Hits.Hits)), results.Hits.Hits)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := fn(batch); err != nil {
+			return err
+		}
+
+		if len(batch) < batchSize {
+			return nil
+		}
+		afterID = batch[len(batch)-1]
+	}
+}
+
+// contacts are routed by org in our index
+func routing(oa *models.OrgAssets) string {
+	return strconv.FormatInt(int64(oa.OrgID()), 10)
+}
+
+// wraps an error from elastic, including the reason if there is one
+func elasticError(err error) error {
+	// Get *elastic.Error which contains additional information
+	ee, ok := err.(*elastic.Error)
+	if !ok {
+		return errors.Wrap(err, "error performing query")
+	}
+
+	return errors.Wrapf(err, "error performing query: %s", ee.Details.Reason)
+}
+
+// utility to convert search hits to contact IDs and append them to the given slice
+func appendIDsFromHits(ids []models.ContactID, hits []*elastic.SearchHit) ([]models.ContactID, error) {
+	for _, hit := range hits {
+		id, err := strconv.Atoi(hit.Id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unexpected non-integer contact id: %s", hit.Id)
+		}
+
+		ids = append(ids, models.ContactID(id))
+	}
+	return ids, nil
+}
@@ -0,0 +1,277 @@
+package search
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+// ExportFormat is the format of a search results export
+type ExportFormat string
+
+// search results export formats
+const (
+	ExportFormatCSV    = ExportFormat("csv")
+	ExportFormatNDJSON = ExportFormat("ndjson")
+)
+
+// ContentType returns the content type of exports in this format
+func (f ExportFormat) ContentType() string {
+	if f == ExportFormatNDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv"
+}
+
+// ExportColumns are the optional columns to include in a search results export
+type ExportColumns struct {
+	Fields     []string `json:"fields"`
+	URNSchemes []string `json:"urn_schemes"`
+	Groups     bool     `json:"groups"`
+}
+
+// how many contacts we load and write at a time
+const exportBatchSize = 500
+
+// SearchExport is a search whose results are to be exported
+type SearchExport struct {
+	backend Backend
+	search  *Search
+	Total   int64
+}
+
+// PrepareSearchExport parses the given query and counts the contacts, in the given group if provided, which match it,
+// so that problems with the search are found before anything is written
+func PrepareSearchExport(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, group *models.Group, query string) (*SearchExport, error) {
+	backend, err := GetBackend(rt)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed *contactql.ContactQuery
+	if query != "" {
+		parsed, err = contactql.ParseQuery(oa.Env(), query, oa.SessionAssets())
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing query: %s", query)
+		}
+	}
+
+	s := &Search{Group: group, Query: parsed}
+
+	total, err := backend.Count(ctx, oa, s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error counting contacts for search: %s", query)
+	}
+
+	return &SearchExport{backend: backend, search: s, Total: total}, nil
+}
+
+// ExportSearchResults writes every contact matching the given search to the given writer in the given format,
+// returning the number of contacts written. Contacts are loaded and written in batches so memory use is bounded
+// regardless of the number of results.
+func ExportSearchResults(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, export *SearchExport, cols *ExportColumns, format ExportFormat, w io.Writer) (int, error) {
+	var ew exportWriter
+	if format == ExportFormatNDJSON {
+		ew = &ndjsonExportWriter{w: w, cols: cols}
+	} else {
+		ew = &csvExportWriter{w: csv.NewWriter(w), cols: cols}
+	}
+
+	if err := ew.writeHeader(); err != nil {
+		return 0, errors.Wrap(err, "error writing export header")
+	}
+
+	// if our writer can be flushed (e.g. it's an HTTP response) then flush after each batch
+	flusher, _ := w.(interface{ Flush() })
+
+	count := 0
+	err := export.backend.Stream(ctx, oa, export.search, 0, exportBatchSize, func(ids []models.ContactID) error {
+		contacts, err := models.LoadContacts(ctx, rt.ReadonlyDB, oa, ids)
+		if err != nil {
+			return errors.Wrap(err, "error loading contacts")
+		}
+
+		// write contacts in the order they were returned by the search, skipping any deleted since
+		byID := make(map[models.ContactID]*models.Contact, len(contacts))
+		for _, c := range contacts {
+			byID[c.ID()] = c
+		}
+
+		for _, id := range ids {
+			c := byID[id]
+			if c == nil {
+				continue
+			}
+
+			fc, err := c.FlowContact(oa)
+			if err != nil {
+				return errors.Wrapf(err, "error creating flow contact for contact #%d", id)
+			}
+
+			if err := ew.writeContact(fc); err != nil {
+				return errors.Wrap(err, "error writing contact")
+			}
+			count++
+		}
+
+		if err := ew.flush(); err != nil {
+			return errors.Wrap(err, "error writing contacts")
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	return count, errors.Wrap(err, "error streaming contacts for export")
+}
+
+type exportWriter interface {
+	writeHeader() error
+	writeContact(*flows.Contact) error
+	flush() error
+}
+
+// writes contacts as CSV with a column for each attribute, URN scheme and field
+type csvExportWriter struct {
+	w    *csv.Writer
+	cols *ExportColumns
+}
+
+func (e *csvExportWriter) writeHeader() error {
+	header := []string{"uuid", "id", "name", "language", "status", "created_on", "last_seen_on"}
+	for _, scheme := range e.cols.URNSchemes {
+		header = append(header, "urn:"+scheme)
+	}
+	for _, key := range e.cols.Fields {
+		header = append(header, "field:"+key)
+	}
+	if e.cols.Groups {
+		header = append(header, "groups")
+	}
+	return e.w.Write(header)
+}
+
+func (e *csvExportWriter) writeContact(c *flows.Contact) error {
+	lastSeenOn := ""
+	if c.LastSeenOn() != nil {
+		lastSeenOn = c.LastSeenOn().UTC().Format(time.RFC3339)
+	}
+
+	row := []string{string(c.UUID()), fmt.Sprint(c.ID()), c.Name(), string(c.Language()), string(c.Status()), c.CreatedOn().UTC().Format(time.RFC3339), lastSeenOn}
+
+	for _, scheme := range e.cols.URNSchemes {
+		row = append(row, strings.Join(urnPaths(c, scheme), ", "))
+	}
+	for _, key := range e.cols.Fields {
+		row = append(row, fieldText(c, key))
+	}
+	if e.cols.Groups {
+		row = append(row, strings.Join(groupNames(c), ", "))
+	}
+	return e.w.Write(row)
+}
+
+func (e *csvExportWriter) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// writes contacts as newline delimited JSON objects
+type ndjsonExportWriter struct {
+	w    io.Writer
+	cols *ExportColumns
+}
+
+type exportedContact struct {
+	UUID       flows.ContactUUID   `json:"uuid"`
+	ID         flows.ContactID     `json:"id"`
+	Name       string              `json:"name"`
+	Language   string              `json:"language"`
+	Status     flows.ContactStatus `json:"status"`
+	CreatedOn  time.Time           `json:"created_on"`
+	LastSeenOn *time.Time          `json:"last_seen_on"`
+	URNs       map[string][]string `json:"urns,omitempty"`
+	Fields     map[string]*string  `json:"fields,omitempty"`
+	Groups     *[]string           `json:"groups,omitempty"`
+}
+
+func (e *ndjsonExportWriter) writeHeader() error { return nil }
+
+func (e *ndjsonExportWriter) writeContact(c *flows.Contact) error {
+	ec := &exportedContact{
+		UUID:       c.UUID(),
+		ID:         c.ID(),
+		Name:       c.Name(),
+		Language:   string(c.Language()),
+		Status:     c.Status(),
+		CreatedOn:  c.CreatedOn(),
+		LastSeenOn: c.LastSeenOn(),
+	}
+
+	if len(e.cols.URNSchemes) > 0 {
+		ec.URNs = make(map[string][]string, len(e.cols.URNSchemes))
+		for _, scheme := range e.cols.URNSchemes {
+			ec.URNs[scheme] = urnPaths(c, scheme)
+		}
+	}
+	if len(e.cols.Fields) > 0 {
+		ec.Fields = make(map[string]*string, len(e.cols.Fields))
+		for _, key := range e.cols.Fields {
+			var value *string
+			if v := c.Fields()[key]; v != nil && v.Value != nil {
+				text := v.Text.Native()
+				value = &text
+			}
+			ec.Fields[key] = value
+		}
+	}
+	if e.cols.Groups {
+		names := groupNames(c)
+		ec.Groups = &names
+	}
+
+	line, err := json.Marshal(ec)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
+
+func (e *ndjsonExportWriter) flush() error { return nil }
+
+func urnPaths(c *flows.Contact, scheme string) []string {
+	withScheme := c.URNs().WithScheme(scheme)
+	paths := make([]string, len(withScheme))
+	for i, u := range withScheme {
+		paths[i] = u.URN().Path()
+	}
+	return paths
+}
+
+func fieldText(c *flows.Contact, key string) string {
+	if v := c.Fields()[key]; v != nil && v.Value != nil {
+		return v.Text.Native()
+	}
+	return ""
+}
+
+func groupNames(c *flows.Contact) []string {
+	groups := c.Groups().All()
+	names := make([]string, len(groups))
+	for i, g := range groups {
+		names[i] = g.Name()
+	}
+	return names
+}
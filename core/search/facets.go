@@ -0,0 +1,309 @@
+package search
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+)
+
+// FacetType is the type of aggregation used for a facet
+type FacetType string
+
+// facet types
+const (
+	FacetTypeTerms         = FacetType("terms")
+	FacetTypeHistogram     = FacetType("histogram")
+	FacetTypeDateHistogram = FacetType("date_histogram")
+)
+
+// Facet is a requested breakdown of the contacts matching a search by a property, which can be one of the attributes
+// language, status, group, scheme, tickets, created_on or last_seen_on, or the key of a contact field
+type Facet struct {
+	Name             string    `json:"name"              validate:"required"`
+	Type             FacetType `json:"type"              validate:"required,eq=terms|eq=histogram|eq=date_histogram"`
+	Property         string    `json:"property"          validate:"required"`
+	Size             int       `json:"size"              validate:"omitempty,min=1,max=1000"`
+	Interval         float64   `json:"interval"          validate:"omitempty,gt=0"`
+	CalendarInterval string    `json:"calendar_interval" validate:"omitempty,eq=day|eq=week|eq=month|eq=quarter|eq=year"`
+}
+
+// FacetBucket is a single bucket of a facet, i.e. a value or range of values and the number of contacts in it
+type FacetBucket struct {
+	Key   any    `json:"key"`
+	Name  string `json:"name,omitempty"`
+	Count int64  `json:"count"`
+}
+
+// default number of buckets returned for terms facets
+const defaultFacetSize = 10
+
+// which types of facet each attribute supports and the name of its field in the index
+var facetAttributes = map[string]struct {
+	field string
+	types []FacetType
+}{
+	"language":     {"language", []FacetType{FacetTypeTerms}},
+	"status":       {"status", []FacetType{FacetTypeTerms}},
+	"group":        {"group_ids", []FacetType{FacetTypeTerms}},
+	"scheme":       {"urns.scheme", []FacetType{FacetTypeTerms}},
+	"tickets":      {"tickets", []FacetType{FacetTypeTerms, FacetTypeHistogram}},
+	"created_on":   {"created_on", []FacetType{FacetTypeDateHistogram}},
+	"last_seen_on": {"last_seen_on", []FacetType{FacetTypeDateHistogram}},
+}
+
+// which types of facet each field type supports
+var facetFieldTypes = map[assets.FieldType][]FacetType{
+	assets.FieldTypeText:     {FacetTypeTerms},
+	assets.FieldTypeNumber:   {FacetTypeTerms, FacetTypeHistogram},
+	assets.FieldTypeDatetime: {FacetTypeDateHistogram},
+	assets.FieldTypeState:    {FacetTypeTerms},
+	assets.FieldTypeDistrict: {FacetTypeTerms},
+	assets.FieldTypeWard:     {FacetTypeTerms},
+}
+
+// where the values for a facet live in the contacts index
+type facetTarget struct {
+	field  string
+	nested string        // path if values are in nested documents
+	filter elastic.Query // filter for nested documents
+}
+
+// ValidateFacets checks that the given facets can be calculated for the given org
+func ValidateFacets(oa *models.OrgAssets, facets []*Facet) error {
+	names := make(map[string]bool, len(facets))
+
+	for _, f := range facets {
+		if names[f.Name] {
+			return errors.Errorf("duplicate facet name '%s'", f.Name)
+		}
+		names[f.Name] = true
+
+		if _, err := resolveFacet(oa, f); err != nil {
+			return err
+		}
+
+		if f.Type == FacetTypeHistogram && f.Interval == 0 {
+			return errors.Errorf("facet '%s' must specify an interval", f.Name)
+		}
+		if f.Type == FacetTypeDateHistogram && f.CalendarInterval == "" {
+			return errors.Errorf("facet '%s' must specify a calendar interval", f.Name)
+		}
+	}
+	return nil
+}
+
+// GetContactFacets calculates the given facets over the contacts, in the given group if provided, that match the
+// given query. Facets should have been validated with ValidateFacets.
+func GetContactFacets(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, group *models.Group, query string, facets []*Facet) (*contactql.ContactQuery, int64, map[string][]*FacetBucket, error) {
+	var parsed *contactql.ContactQuery
+	var err error
+
+	if rt.Config.SearchBackend != "elastic" {
+		return nil, 0, nil, errors.Errorf("facets are only supported by the elastic search backend")
+	}
+	if rt.ES == nil {
+		return nil, 0, nil, errors.Errorf("no elastic client available, check your configuration")
+	}
+
+	if query != "" {
+		parsed, err = contactql.ParseQuery(oa.Env(), query, oa.SessionAssets())
+		if err != nil {
+			return nil, 0, nil, errors.Wrapf(err, "error parsing query: %s", query)
+		}
+	}
+
+	eq := BuildElasticQuery(oa, group, models.NilContactStatus, nil, parsed)
+
+	src := rt.ES.Search(rt.Config.ElasticContactsIndex).TrackTotalHits(true).Routing(routing(oa)).Size(0).Query(eq)
+	targets := make(map[string]*facetTarget, len(facets))
+
+	for _, f := range facets {
+		target, err := resolveFacet(oa, f)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		targets[f.Name] = target
+
+		src = src.Aggregation(f.Name, f.aggregation(oa, target))
+	}
+
+	results, err := src.Do(ctx)
+	if err != nil {
+		return nil, 0, nil, elasticError(err)
+	}
+
+	buckets := make(map[string][]*FacetBucket, len(facets))
+	for _, f := range facets {
+		buckets[f.Name] = f.buckets(oa, targets[f.Name], results.Aggregations)
+	}
+
+	return parsed, results.Hits.TotalHits.Value, buckets, nil
+}
+
+// resolves the property of a facet to where its values live in the index, checking it supports the facet type
+func resolveFacet(oa *models.OrgAssets, f *Facet) (*facetTarget, error) {
+	var target *facetTarget
+	var types []FacetType
+
+	if attr, isAttr := facetAttributes[f.Property]; isAttr {
+		target = &facetTarget{field: attr.field}
+		types = attr.types
+
+		if f.Property == "scheme" {
+			target.nested = "urns"
+			target.filter = elastic.NewMatchAllQuery()
+		}
+	} else {
+		field := oa.FieldByKey(f.Property)
+		if field == nil {
+			return nil, errors.Errorf("facet '%s' has unknown property '%s'", f.Name, f.Property)
+		}
+
+		target = &facetTarget{
+			field:  "fields." + string(field.Type()),
+			nested: "fields",
+			filter: elastic.NewTermQuery("fields.field", field.UUID()),
+		}
+		types = facetFieldTypes[field.Type()]
+
+		switch field.Type() {
+		case assets.FieldTypeState, assets.FieldTypeDistrict, assets.FieldTypeWard:
+			target.field += "_keyword"
+		}
+	}
+
+	for _, t := range types {
+		if t == f.Type {
+			return target, nil
+		}
+	}
+	return nil, errors.Errorf("facet '%s' can't use %s aggregation with property '%s'", f.Name, f.Type, f.Property)
+}
+
+// builds the aggregation for this facet
+func (f *Facet) aggregation(oa *models.OrgAssets, t *facetTarget) elastic.Aggregation {
+	var agg elastic.Aggregation
+
+	switch f.Type {
+	case FacetTypeTerms:
+		size := f.Size
+		if size == 0 {
+			size = defaultFacetSize
+		}
+		a := elastic.NewTermsAggregation().Field(t.field).Size(size)
+		if t.nested != "" {
+			a = a.SubAggregation("contacts", elastic.NewReverseNestedAggregation())
+		}
+		agg = a
+	case FacetTypeHistogram:
+		a := elastic.NewHistogramAggregation().Field(t.field).Interval(f.Interval).MinDocCount(1)
+		if t.nested != "" {
+			a = a.SubAggregation("contacts", elastic.NewReverseNestedAggregation())
+		}
+		agg = a
+	case FacetTypeDateHistogram:
+		a := elastic.NewDateHistogramAggregation().Field(t.field).CalendarInterval(f.CalendarInterval).TimeZone(oa.Env().Timezone().String()).MinDocCount(1)
+		if t.nested != "" {
+			a = a.SubAggregation("contacts", elastic.NewReverseNestedAggregation())
+		}
+		agg = a
+	}
+
+	// values in nested documents need to be aggregated inside a nested aggregation
+	if t.nested != "" {
+		filtered := elastic.NewFilterAggregation().Filter(t.filter).SubAggregation("values", agg)
+		return elastic.NewNestedAggregation().Path(t.nested).SubAggregation("filtered", filtered)
+	}
+
+	return agg
+}
+
+// extracts the buckets for this facet from the given aggregation results
+func (f *Facet) buckets(oa *models.OrgAssets, t *facetTarget, aggs elastic.Aggregations) []*FacetBucket {
+	name := f.Name
+
+	if t.nested != "" {
+		nested, _ := aggs.Nested(f.Name)
+		if nested == nil {
+			return []*FacetBucket{}
+		}
+		filtered, _ := nested.Filter("filtered")
+		if filtered == nil {
+			return []*FacetBucket{}
+		}
+		aggs, name = filtered.Aggregations, "values"
+	}
+
+	// if values are in nested documents, count the contacts they belong to rather than the documents themselves
+	count := func(bucketAggs elastic.Aggregations, docCount int64) int64 {
+		if t.nested != "" {
+			if contacts, _ := bucketAggs.ReverseNested("contacts"); contacts != nil {
+				return contacts.DocCount
+			}
+		}
+		return docCount
+	}
+
+	buckets := make([]*FacetBucket, 0, 10)
+
+	switch f.Type {
+	case FacetTypeTerms:
+		items, _ := aggs.Terms(name)
+		if items == nil {
+			return buckets
+		}
+
+		for _, b := range items.Buckets {
+			bucket := &FacetBucket{Key: b.Key, Count: count(b.Aggregations, b.DocCount)}
+
+			switch f.Property {
+			case "status":
+				bucket.Key = statusFromCode(b.Key)
+			case "group":
+				id, _ := strconv.Atoi(string(b.KeyNumber))
+				if g := oa.GroupByID(models.GroupID(id)); g != nil {
+					bucket.Key, bucket.Name = g.UUID(), g.Name()
+				}
+			}
+			buckets = append(buckets, bucket)
+		}
+	case FacetTypeHistogram:
+		items, _ := aggs.Histogram(name)
+		if items == nil {
+			return buckets
+		}
+
+		for _, b := range items.Buckets {
+			buckets = append(buckets, &FacetBucket{Key: b.Key, Count: count(b.Aggregations, b.DocCount)})
+		}
+	case FacetTypeDateHistogram:
+		items, _ := aggs.DateHistogram(name)
+		if items == nil {
+			return buckets
+		}
+
+		for _, b := range items.Buckets {
+			key := time.UnixMilli(int64(b.Key)).In(oa.Env().Timezone())
+			buckets = append(buckets, &FacetBucket{Key: key, Count: count(b.Aggregations, b.DocCount)})
+		}
+	}
+
+	return buckets
+}
+
+// converts a status code as stored in the index back to a status name
+func statusFromCode(code any) any {
+	for name, c := range contactStatusCodes {
+		if c == code {
+			return name
+		}
+	}
+	return code
+}
@@ -2,8 +2,10 @@ package search
 
 import (
 	"context"
+	"math"
 	"time"
 
+	"github.com/nyaruka/goflow/contactql"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/runtime"
 	"github.com/olivere/elastic/v7"
@@ -11,92 +13,248 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// how many matching contacts we process at a time when populating a smart group
+const populateBatchSize = 1000
+
+// IndexerWaitTimeout is how long we'll wait for the indexer to catch up with changes to contacts before populating a
+// smart group
+var IndexerWaitTimeout = time.Second * 15
+
+// SmartGroupPopulation is the progress of populating a smart group. Contacts are processed in ascending id order, so
+// this can be saved after each batch and used to resume population from where it stopped.
+type SmartGroupPopulation struct {
+	Total     int              `json:"total"`
+	Processed int              `json:"processed"`
+	Added     int              `json:"added"`
+	Removed   int              `json:"removed"`
+	AfterID   models.ContactID `json:"after_id"`
+}
+
 // PopulateSmartGroup calculates which members should be part of a group and populates the contacts
 // for that group by performing the minimum number of inserts / deletes.
-func PopulateSmartGroup(ctx context.Context, rt *runtime.Runtime, es *elastic.Client, oa *models.OrgAssets, groupID models.GroupID, query string) (int, error) {
+func PopulateSmartGroup(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, groupID models.GroupID, query string) (int, error) {
+	pop, err := StartSmartGroupPopulation(ctx, rt, oa, groupID, query)
+	if err != nil {
+		return 0, err
+	}
+
+	err = ContinueSmartGroupPopulation(ctx, rt, oa, groupID, query, pop, func(*SmartGroupPopulation) error { return nil })
+	if err != nil {
+		return 0, err
+	}
+
+	return pop.Processed, nil
+}
+
+// StartSmartGroupPopulation marks the given group as evaluating, waits for the indexer to have seen all changes to
+// contacts in the org, and returns a new population with the total number of contacts matching the query
+func StartSmartGroupPopulation(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, groupID models.GroupID, query string) (*SmartGroupPopulation, error) {
 	err := models.UpdateGroupStatus(ctx, rt.DB, groupID, models.GroupStatusEvaluating)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error marking dynamic group as evaluating")
+		return nil, errors.Wrapf(err, "error marking dynamic group as evaluating")
 	}
 
-	start := time.Now()
+	// any contacts that changed before this group was updated but haven't been indexed yet need to be included
+	if err := WaitForIndexer(ctx, rt, oa, IndexerWaitTimeout); err != nil {
+		return nil, err
+	}
 
-	// we have a bit of a race with the indexer process.. we want to make sure that any contacts that changed
-	// before this group was updated but after the last index are included, so if a contact was modified
-	// more recently than 10 seconds ago, we wait that long before starting in populating our group
-	newest, err := models.GetNewestContactModifiedOn(ctx, rt.DB, oa)
+	backend, search, err := smartGroupSearch(rt, oa, query)
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := backend.Count(ctx, oa, search)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error getting most recent contact modified_on for org: %d", oa.OrgID())
+		return nil, errors.Wrapf(err, "error counting contacts for query: %s", query)
 	}
-	if newest != nil {
-		n := *newest
 
-		// if it was more recent than 10 seconds ago, sleep until it has been 10 seconds
-		if n.Add(time.Second * 10).After(start) {
-			sleep := n.Add(time.Second * 10).Sub(start)
-			logrus.WithField("sleep", sleep).Info("sleeping before evaluating dynamic group")
-			time.Sleep(sleep)
+	return &SmartGroupPopulation{Total: int(total)}, nil
+}
+
+// ContinueSmartGroupPopulation processes the contacts matching the query in batches, starting from where the given
+// population left off, adding and removing contacts from the group so that its membership matches the query. After
+// each batch, checkpoint is called with the updated population and if that returns an error, population stops and
+// the error is returned. Once all contacts have been processed, the group is marked as ready.
+func ContinueSmartGroupPopulation(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, groupID models.GroupID, query string, pop *SmartGroupPopulation, checkpoint func(*SmartGroupPopulation) error) error {
+	backend, search, err := smartGroupSearch(rt, oa, query)
+	if err != nil {
+		return err
+	}
+
+	err = backend.Stream(ctx, oa, search, pop.AfterID, populateBatchSize, func(ids []models.ContactID) error {
+		if err := syncGroupMembers(ctx, rt, oa, groupID, pop, ids, ids[len(ids)-1]); err != nil {
+			return err
 		}
+
+		pop.Processed += len(ids)
+		return checkpoint(pop)
+	})
+	if err != nil {
+		return err
+	}
+
+	// remove any remaining members after the last matching contact
+	if err := syncGroupMembers(ctx, rt, oa, groupID, pop, nil, models.ContactID(math.MaxInt64)); err != nil {
+		return err
 	}
 
-	// get current set of contacts in our group
-	ids, err := models.ContactIDsForGroupIDs(ctx, rt.DB, []models.GroupID{groupID})
+	// mark our group as no longer evaluating
+	err = models.UpdateGroupStatus(ctx, rt.DB, groupID, models.GroupStatusReady)
 	if err != nil {
-		return 0, errors.Wrapf(err, "unable to look up contact ids for group: %d", groupID)
+		return errors.Wrapf(err, "error marking dynamic group as ready")
 	}
-	present := make(map[models.ContactID]bool, len(ids))
-	for _, i := range ids {
-		present[i] = true
+
+	return nil
+}
+
+// WaitForIndexer waits until the contacts index has seen the most recent change to a contact in the given org, or
+// until the timeout is reached in which case we log and carry on rather than block population indefinitely
+func WaitForIndexer(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, timeout time.Duration) error {
+	// postgres backend queries contacts directly so is never behind
+	if rt.Config.SearchBackend == "postgres" {
+		return nil
 	}
 
-	// calculate new set of ids
-	new, err := GetContactIDsForQuery(ctx, rt, oa, query, -1)
+	newest, err := models.GetNewestContactModifiedOn(ctx, rt.DB, oa)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error performing query: %s for group: %d", query, groupID)
+		return errors.Wrapf(err, "error getting most recent contact modified_on for org: %d", oa.OrgID())
+	}
+	if newest == nil {
+		return nil
 	}
 
-	// find which contacts need to be added or removed
-	adds := make([]models.ContactID, 0, 100)
-	for _, id := range new {
-		if !present[id] {
-			adds = append(adds, id)
+	// dates in the index only have millisecond precision
+	target := newest.Truncate(time.Millisecond)
+	start := time.Now()
+
+	for {
+		watermark, err := GetIndexerWatermark(ctx, rt, oa)
+		if err != nil {
+			return err
+		}
+		if watermark != nil && !watermark.Before(target) {
+			return nil
+		}
+
+		if time.Since(start) >= timeout {
+			logrus.WithFields(logrus.Fields{"org_id": oa.OrgID(), "newest": newest, "watermark": watermark}).Warn("timed out waiting for indexer")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "error waiting for indexer")
+		case <-time.After(time.Second * 2):
 		}
-		delete(present, id)
 	}
+}
 
-	// build our list of removals
-	removals := make([]models.ContactID, 0, len(present))
-	for id := range present {
-		removals = append(removals, id)
+// GetIndexerWatermark returns the newest modified_on of the contacts in the given org that have been indexed, or nil
+// if none have been indexed
+func GetIndexerWatermark(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets) (*time.Time, error) {
+	if rt.ES == nil {
+		return nil, errors.Errorf("no elastic client available, check your configuration")
 	}
 
-	// first remove all the contacts
-	err = models.RemoveContactsFromGroupAndCampaigns(ctx, rt.DB, oa, groupID, removals)
+	results, err := rt.ES.Search(rt.Config.ElasticContactsIndex).Routing(routing(oa)).Size(0).
+		Query(elastic.NewTermQuery("org_id", oa.OrgID())).
+		Aggregation("newest", elastic.NewMaxAggregation().Field("modified_on")).
+		Do(ctx)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error removing contacts from group: %d", groupID)
+		return nil, elasticError(err)
+	}
+
+	newest, _ := results.Aggregations.Max("newest")
+	if newest == nil || newest.Value == nil {
+		return nil, nil
 	}
 
-	// then add them all
-	err = models.AddContactsToGroupAndCampaigns(ctx, rt.DB, oa, groupID, adds)
+	watermark := time.UnixMilli(int64(*newest.Value)).UTC()
+	return &watermark, nil
+}
+
+// gets the backend and search for the members of a smart group with the given query
+func smartGroupSearch(rt *runtime.Runtime, oa *models.OrgAssets, query string) (Backend, *Search, error) {
+	backend, err := GetBackend(rt)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error adding contacts to group: %d", groupID)
+		return nil, nil, err
 	}
 
-	// mark our group as no longer evaluating
-	err = models.UpdateGroupStatus(ctx, rt.DB, groupID, models.GroupStatusReady)
+	parsed, err := contactql.ParseQuery(oa.Env(), query, oa.SessionAssets())
 	if err != nil {
-		return 0, errors.Wrapf(err, "error marking dynamic group as ready")
+		return nil, nil, errors.Wrapf(err, "error parsing query: %s", query)
 	}
 
-	// finally update modified_on for all affected contacts to ensure these changes are seen by rp-indexer
-	changed := make([]models.ContactID, 0, len(adds))
-	changed = append(changed, adds...)
-	changed = append(changed, removals...)
+	return backend, &Search{Status: models.ContactStatusActive, Query: parsed}, nil
+}
 
-	err = models.UpdateContactModifiedOn(ctx, rt.DB, changed)
-	if err != nil {
-		return 0, errors.Wrapf(err, "error updating contact modified_on after group population")
+// syncs the members of the group with ids after the population's checkpoint and up to and including upToID, given
+// the contacts in that range which match the query, and then moves the checkpoint forward to upToID
+func syncGroupMembers(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, groupID models.GroupID, pop *SmartGroupPopulation, matching []models.ContactID, upToID models.ContactID) error {
+	isMatch := make(map[models.ContactID]bool, len(matching))
+	for _, id := range matching {
+		isMatch[id] = true
+	}
+
+	// go through the current members in this range, removing those which no longer match
+	isMember := make(map[models.ContactID]bool, len(matching))
+	afterID := pop.AfterID
+
+	for {
+		members, err := models.GroupContactIDsInRange(ctx, rt.DB, groupID, afterID, upToID, populateBatchSize)
+		if err != nil {
+			return errors.Wrapf(err, "unable to look up contact ids for group: %d", groupID)
+		}
+
+		removals := make([]models.ContactID, 0, len(members))
+		for _, id := range members {
+			if isMatch[id] {
+				isMember[id] = true
+			} else {
+				removals = append(removals, id)
+			}
+		}
+
+		if len(removals) > 0 {
+			err = models.RemoveContactsFromGroupAndCampaigns(ctx, rt.DB, oa, groupID, removals)
+			if err != nil {
+				return errors.Wrapf(err, "error removing contacts from group: %d", groupID)
+			}
+
+			// update modified_on for removed contacts to ensure these changes are seen by rp-indexer
+			if err := models.UpdateContactModifiedOn(ctx, rt.DB, removals); err != nil {
+				return errors.Wrapf(err, "error updating contact modified_on after group population")
+			}
+			pop.Removed += len(removals)
+		}
+
+		if len(members) < populateBatchSize {
+			break
+		}
+		afterID = members[len(members)-1]
+	}
+
+	// then add the matching contacts which aren't already members
+	adds := make([]models.ContactID, 0, len(matching))
+	for _, id := range matching {
+		if !isMember[id] {
+			adds = append(adds, id)
+		}
+	}
+
+	if len(adds) > 0 {
+		err := models.AddContactsToGroupAndCampaigns(ctx, rt.DB, oa, groupID, adds)
+		if err != nil {
+			return errors.Wrapf(err, "error adding contacts to group: %d", groupID)
+		}
+
+		if err := models.UpdateContactModifiedOn(ctx, rt.DB, adds); err != nil {
+			return errors.Wrapf(err, "error updating contact modified_on after group population")
+		}
+		pop.Added += len(adds)
 	}
 
-	return len(new), nil
+	pop.AfterID = upToID
+	return nil
 }
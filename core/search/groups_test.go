@@ -3,6 +3,7 @@ package search_test
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/lib/pq"
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
@@ -18,6 +19,10 @@ func TestSmartGroups(t *testing.T) {
 
 	defer testsuite.Reset(testsuite.ResetAll)
 
+	// populating a group modifies contacts which won't be reindexed during this test
+	defer func(t time.Duration) { search.IndexerWaitTimeout = t }(search.IndexerWaitTimeout)
+	search.IndexerWaitTimeout = 0
+
 	// insert an event on our campaign
 	newEvent := testdata.InsertCampaignFlowEvent(rt, testdata.RemindersCampaign, testdata.Favorites, testdata.JoinedField, 1000, "W")
 
@@ -61,7 +66,7 @@ func TestSmartGroups(t *testing.T) {
 		err := models.UpdateGroupStatus(ctx, rt.DB, testdata.DoctorsGroup.ID, models.GroupStatusInitializing)
 		assert.NoError(t, err)
 
-		count, err := search.PopulateSmartGroup(ctx, rt, rt.ES, oa, testdata.DoctorsGroup.ID, tc.query)
+		count, err := search.PopulateSmartGroup(ctx, rt, oa, testdata.DoctorsGroup.ID, tc.query)
 		assert.NoError(t, err, "error populating smart group for: %s", tc.query)
 
 		assert.Equal(t, count, len(tc.expectedContactIDs), "%d: contact count mismatch", i)
@@ -0,0 +1,490 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/pkg/errors"
+)
+
+// search backend which translates queries into SQL and runs them directly against the contacts table. This is much
+// slower than Elasticsearch for large orgs but means that smaller deployments can run without it.
+type postgresBackend struct {
+	db *sqlx.DB
+}
+
+func (b *postgresBackend) Count(ctx context.Context, oa *models.OrgAssets, s *Search) (int64, error) {
+	where, args := BuildPostgresQuery(oa, s.Group, s.Status, s.ExcludeIDs, s.Query)
+
+	var count int64
+	if err := b.db.GetContext(ctx, &count, `SELECT count(*) FROM contacts_contact c WHERE `+where, args...); err != nil {
+		return 0, errors.Wrap(err, "error performing query")
+	}
+
+	return count, nil
+}
+
+func (b *postgresBackend) Page(ctx context.Context, oa *models.OrgAssets, s *Search, sort string, offset, pageSize int) ([]models.ContactID, int64, error) {
+	where, args := BuildPostgresQuery(oa, s.Group, s.Status, s.ExcludeIDs, s.Query)
+
+	orderBy, err := ToPostgresSort(sort, oa.SessionAssets())
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "error parsing sort")
+	}
+
+	var total int64
+	if err := b.db.GetContext(ctx, &total, `SELECT count(*) FROM contacts_contact c WHERE `+where, args...); err != nil {
+		return nil, 0, errors.Wrap(err, "error performing query")
+	}
+
+	sql := fmt.Sprintf(`SELECT c.id FROM contacts_contact c WHERE %s ORDER BY %s LIMIT %d OFFSET %d`, where, orderBy, pageSize, offset)
+
+	ids := make([]models.ContactID, 0, pageSize)
+	if err := b.db.SelectContext(ctx, &ids, sql, args...); err != nil {
+		return nil, 0, errors.Wrap(err, "error performing query")
+	}
+
+	return ids, total, nil
+}
+
+func (b *postgresBackend) IDs(ctx context.Context, oa *models.OrgAssets, s *Search, limit int) ([]models.ContactID, error) {
+	where, args := BuildPostgresQuery(oa, s.Group, s.Status, s.ExcludeIDs, s.Query)
+
+	sql := `SELECT c.id FROM contacts_contact c WHERE ` + where
+	if limit >= 0 {
+		sql += fmt.Sprintf(` LIMIT %d`, limit)
+	}
+
+	ids := make([]models.ContactID, 0, 100)
+	if err := b.db.SelectContext(ctx, &ids, sql, args...); err != nil {
+		return nil, errors.Wrap(err, "error performing query")
+	}
+
+	return ids, nil
+}
+
+func (b *postgresBackend) Stream(ctx context.Context, oa *models.OrgAssets, s *Search, afterID models.ContactID, batchSize int, fn func([]models.ContactID) error) error {
+	where, args := BuildPostgresQuery(oa, s.Group, s.Status, s.ExcludeIDs, s.Query)
+
+	// page through results by id so that each batch is a cheap index range scan
+	sql := fmt.Sprintf(`SELECT c.id FROM contacts_contact c WHERE %s AND c.id > $%d ORDER BY c.id LIMIT %d`, where, len(args)+1, batchSize)
+
+	for {
+		batch := make([]models.ContactID, 0, batchSize)
+		if err := b.db.SelectContext(ctx, &batch, sql, append(args, afterID)...); err != nil {
+			return errors.Wrap(err, "error performing query")
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := fn(batch); err != nil {
+			return err
+		}
+
+		if len(batch) < batchSize {
+			return nil
+		}
+		afterID = batch[len(batch)-1]
+	}
+}
+
+// BuildPostgresQuery turns the passed in contact ql query into a SQL condition on contacts aliased as c, returning
+// the condition and its positional args
+func BuildPostgresQuery(oa *models.OrgAssets, group *models.Group, status models.ContactStatus, excludeIDs []models.ContactID, query *contactql.ContactQuery) (string, []any) {
+	b := &pgBuilder{env: oa.Env()}
+
+	// filter by org and active contacts
+	conds := []string{
+		fmt.Sprintf(`c.org_id = %s`, b.arg(oa.OrgID())),
+		`c.is_active = TRUE`,
+	}
+
+	// our group if present
+	if group != nil {
+		conds = append(conds, fmt.Sprintf(`EXISTS (SELECT 1 FROM contacts_contactgroup_contacts gc WHERE gc.contact_id = c.id AND gc.contactgroup_id = %s)`, b.arg(group.ID())))
+	}
+
+	// our status is present
+	if status != models.NilContactStatus {
+		conds = append(conds, fmt.Sprintf(`c.status = %s`, b.arg(status)))
+	}
+
+	// exclude ids if present
+	if len(excludeIDs) > 0 {
+		conds = append(conds, fmt.Sprintf(`NOT (c.id = ANY(%s))`, b.arg(pq.Array(excludeIDs))))
+	}
+
+	// and by our query if present
+	if query != nil {
+		if query.Resolver() == nil {
+			panic("can only convert queries parsed with a resolver")
+		}
+
+		b.resolver = query.Resolver()
+		conds = append(conds, b.node(query.Root()))
+	}
+
+	return strings.Join(conds, " AND "), b.args
+}
+
+// ToPostgresSort returns the SQL ORDER BY expression for the passed in sort by string
+func ToPostgresSort(sortBy string, resolver contactql.Resolver) (string, error) {
+	// default to most recent first by id
+	if sortBy == "" {
+		return `c.id DESC`, nil
+	}
+
+	// figure out if we are ascending or descending (default is ascending, can be changed with leading -)
+	property := sortBy
+	direction := "ASC"
+	if strings.HasPrefix(sortBy, "-") {
+		direction = "DESC"
+		property = sortBy[1:]
+	}
+
+	property = strings.ToLower(property)
+
+	var expr string
+
+	switch property {
+	case contactql.AttributeID:
+		return `c.id ` + direction, nil
+	case contactql.AttributeName, contactql.AttributeCreatedOn, contactql.AttributeLastSeenOn, contactql.AttributeLanguage:
+		expr = `c.` + property
+	default:
+		// we are sorting by a custom field
+		field := resolver.ResolveField(property)
+		if field == nil {
+			return "", errors.Errorf("no such field with key: %s", property)
+		}
+
+		expr = fieldValueExpr(pq.QuoteLiteral(string(field.UUID())), field.Type())
+	}
+
+	// contacts without a value always come last, and contacts with the same value are ordered by id
+	return fmt.Sprintf(`%s %s NULLS LAST, c.id %s`, expr, direction, direction), nil
+}
+
+// builds SQL conditions from query nodes, accumulating positional args as it goes
+type pgBuilder struct {
+	env      envs.Environment
+	resolver contactql.Resolver
+	args     []any
+}
+
+// adds an arg and returns its placeholder
+func (b *pgBuilder) arg(v any) string {
+	b.args = append(b.args, v)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+func (b *pgBuilder) node(node contactql.QueryNode) string {
+	switch n := node.(type) {
+	case *contactql.BoolCombination:
+		return b.boolCombination(n)
+	case *contactql.Condition:
+		return b.condition(n)
+	default:
+		panic(fmt.Sprintf("unsupported node type: %T", n))
+	}
+}
+
+func (b *pgBuilder) boolCombination(combination *contactql.BoolCombination) string {
+	conds := make([]string, len(combination.Children()))
+	for i, child := range combination.Children() {
+		conds[i] = b.node(child)
+	}
+
+	op := " OR "
+	if combination.Operator() == contactql.BoolOperatorAnd {
+		op = " AND "
+	}
+
+	return "(" + strings.Join(conds, op) + ")"
+}
+
+func (b *pgBuilder) condition(c *contactql.Condition) string {
+	switch c.PropertyType() {
+	case contactql.PropertyTypeField:
+		return b.fieldCondition(c)
+	case contactql.PropertyTypeAttribute:
+		return b.attributeCondition(c)
+	case contactql.PropertyTypeScheme:
+		return b.schemeCondition(c)
+	default:
+		panic(fmt.Sprintf("unsupported property type: %s", c.PropertyType()))
+	}
+}
+
+func (b *pgBuilder) fieldCondition(c *contactql.Condition) string {
+	field := b.resolver.ResolveField(c.PropertyKey())
+	fieldType := field.Type()
+	value := fieldValueExpr(b.arg(string(field.UUID()))+"::text", fieldType)
+
+	// special cases for set/unset
+	if isSetCheck(c) {
+		return setCheck(c, value+` IS NOT NULL`)
+	}
+
+	switch fieldType {
+	case assets.FieldTypeText, assets.FieldTypeState, assets.FieldTypeDistrict, assets.FieldTypeWard:
+		cond := fmt.Sprintf(`LOWER(%s) = %s`, value, b.arg(strings.ToLower(c.Value())))
+
+		switch c.Operator() {
+		case contactql.OpEqual:
+			return cond
+		case contactql.OpNotEqual:
+			return not(cond)
+		default:
+			panic(fmt.Sprintf("unsupported %s field operator: %s", fieldType, c.Operator()))
+		}
+
+	case assets.FieldTypeNumber:
+		number, _ := c.ValueAsNumber()
+		return numberCondition(c, value, b.arg(number.String())+"::numeric")
+
+	case assets.FieldTypeDatetime:
+		return b.dateCondition(c, value)
+	}
+
+	panic(fmt.Sprintf("unsupported field type: %s", fieldType))
+}
+
+func (b *pgBuilder) attributeCondition(c *contactql.Condition) string {
+	key := c.PropertyKey()
+	value := strings.ToLower(c.Value())
+
+	// special case for set/unset for name and language
+	if isSetCheck(c) && (key == contactql.AttributeName || key == contactql.AttributeLanguage) {
+		return setCheck(c, fmt.Sprintf(`COALESCE(c.%s, '') != ''`, key))
+	}
+
+	switch key {
+	case contactql.AttributeUUID:
+		return textCondition(c, `c.uuid`, b.arg(value))
+	case contactql.AttributeID:
+		return textCondition(c, `c.id::text`, b.arg(value))
+	case contactql.AttributeName:
+		switch c.Operator() {
+		case contactql.OpEqual:
+			return fmt.Sprintf(`c.name = %s`, b.arg(c.Value()))
+		case contactql.OpNotEqual:
+			return not(fmt.Sprintf(`c.name = %s`, b.arg(c.Value())))
+		case contactql.OpContains:
+			// match names with a word starting with the value
+			like := escapeLike(value)
+			return fmt.Sprintf(`(c.name ILIKE %s OR c.name ILIKE %s)`, b.arg(like+"%"), b.arg("% "+like+"%"))
+		default:
+			panic(fmt.Sprintf("unsupported name attribute operator: %s", c.Operator()))
+		}
+	case contactql.AttributeStatus:
+		return textCondition(c, `c.status`, b.arg(contactStatusCodes[value]))
+	case contactql.AttributeLanguage:
+		return textCondition(c, `c.language`, b.arg(value))
+	case contactql.AttributeCreatedOn:
+		return b.dateCondition(c, `c.created_on`)
+	case contactql.AttributeLastSeenOn:
+		if isSetCheck(c) {
+			return setCheck(c, `c.last_seen_on IS NOT NULL`)
+		}
+		return b.dateCondition(c, `c.last_seen_on`)
+	case contactql.AttributeURN:
+		return b.urnCondition(c, "")
+	case contactql.AttributeGroup:
+		if isSetCheck(c) {
+			return setCheck(c, `EXISTS (SELECT 1 FROM contacts_contactgroup_contacts gc INNER JOIN contacts_contactgroup g ON g.id = gc.contactgroup_id WHERE gc.contact_id = c.id AND g.group_type IN ('M', 'Q'))`)
+		}
+
+		group := c.ValueAsGroup(b.resolver).(*models.Group)
+		cond := fmt.Sprintf(`EXISTS (SELECT 1 FROM contacts_contactgroup_contacts gc WHERE gc.contact_id = c.id AND gc.contactgroup_id = %s)`, b.arg(group.ID()))
+
+		switch c.Operator() {
+		case contactql.OpEqual:
+			return cond
+		case contactql.OpNotEqual:
+			return not(cond)
+		default:
+			panic(fmt.Sprintf("unsupported group attribute operator: %s", c.Operator()))
+		}
+	case contactql.AttributeFlow:
+		if isSetCheck(c) {
+			return setCheck(c, `c.current_flow_id IS NOT NULL`)
+		}
+
+		flow := c.ValueAsFlow(b.resolver).(*models.Flow)
+		cond := fmt.Sprintf(`c.current_flow_id = %s`, b.arg(flow.ID()))
+
+		switch c.Operator() {
+		case contactql.OpEqual:
+			return cond
+		case contactql.OpNotEqual:
+			return not(cond)
+		default:
+			panic(fmt.Sprintf("unsupported flow attribute operator: %s", c.Operator()))
+		}
+	case contactql.AttributeHistory:
+		if isSetCheck(c) {
+			return setCheck(c, `EXISTS (SELECT 1 FROM flows_flowrun r WHERE r.contact_id = c.id)`)
+		}
+
+		flow := c.ValueAsFlow(b.resolver).(*models.Flow)
+		cond := fmt.Sprintf(`EXISTS (SELECT 1 FROM flows_flowrun r WHERE r.contact_id = c.id AND r.flow_id = %s)`, b.arg(flow.ID()))
+
+		switch c.Operator() {
+		case contactql.OpEqual:
+			return cond
+		case contactql.OpNotEqual:
+			return not(cond)
+		default:
+			panic(fmt.Sprintf("unsupported history attribute operator: %s", c.Operator()))
+		}
+	case contactql.AttributeTickets:
+		number, _ := c.ValueAsNumber()
+		return numberCondition(c, `c.ticket_count`, b.arg(number.String())+"::numeric")
+	default:
+		panic(fmt.Sprintf("unsupported contact attribute: %s", key))
+	}
+}
+
+func (b *pgBuilder) schemeCondition(c *contactql.Condition) string {
+	return b.urnCondition(c, c.PropertyKey())
+}
+
+// builds a condition on the contact's URNs, optionally restricted to the given scheme
+func (b *pgBuilder) urnCondition(c *contactql.Condition, scheme string) string {
+	value := strings.ToLower(c.Value())
+
+	urnExists := func(pathCond string) string {
+		conds := []string{`u.contact_id = c.id`}
+		if scheme != "" {
+			conds = append(conds, fmt.Sprintf(`u.scheme = %s`, b.arg(scheme)))
+		}
+		if pathCond != "" {
+			conds = append(conds, pathCond)
+		}
+		return `EXISTS (SELECT 1 FROM contacts_contacturn u WHERE ` + strings.Join(conds, " AND ") + `)`
+	}
+
+	// special case for set/unset
+	if isSetCheck(c) {
+		return setCheck(c, urnExists(""))
+	}
+
+	switch c.Operator() {
+	case contactql.OpEqual:
+		return urnExists(fmt.Sprintf(`LOWER(u.path) = %s`, b.arg(value)))
+	case contactql.OpNotEqual:
+		return not(urnExists(fmt.Sprintf(`LOWER(u.path) = %s`, b.arg(value))))
+	case contactql.OpContains:
+		return urnExists(fmt.Sprintf(`STRPOS(LOWER(u.path), %s) > 0`, b.arg(value)))
+	default:
+		panic(fmt.Sprintf("unsupported URN operator: %s", c.Operator()))
+	}
+}
+
+// builds a condition on a datetime expression, where equality means on the same day in the env timezone
+func (b *pgBuilder) dateCondition(c *contactql.Condition, expr string) string {
+	value, _ := c.ValueAsDate(b.env)
+	start, end := dates.DayToUTCRange(value, value.Location())
+
+	switch c.Operator() {
+	case contactql.OpEqual:
+		return fmt.Sprintf(`(%s >= %s AND %s < %s)`, expr, b.arg(start), expr, b.arg(end))
+	case contactql.OpNotEqual:
+		return not(fmt.Sprintf(`(%s >= %s AND %s < %s)`, expr, b.arg(start), expr, b.arg(end)))
+	case contactql.OpGreaterThan:
+		return fmt.Sprintf(`%s >= %s`, expr, b.arg(end))
+	case contactql.OpGreaterThanOrEqual:
+		return fmt.Sprintf(`%s >= %s`, expr, b.arg(start))
+	case contactql.OpLessThan:
+		return fmt.Sprintf(`%s < %s`, expr, b.arg(start))
+	case contactql.OpLessThanOrEqual:
+		return fmt.Sprintf(`%s < %s`, expr, b.arg(end))
+	default:
+		panic(fmt.Sprintf("unsupported datetime operator: %s", c.Operator()))
+	}
+}
+
+// we store contact status as single char codes
+var contactStatusCodes = map[string]string{
+	"active":   "A",
+	"blocked":  "B",
+	"stopped":  "S",
+	"archived": "V",
+}
+
+// gets the SQL expression for the value of the field with the given UUID expression, typed according to the field type
+func fieldValueExpr(fieldUUID string, fieldType assets.FieldType) string {
+	switch fieldType {
+	case assets.FieldTypeNumber:
+		return fmt.Sprintf(`(c.fields->%s->>'number')::numeric`, fieldUUID)
+	case assets.FieldTypeDatetime:
+		return fmt.Sprintf(`(c.fields->%s->>'datetime')::timestamptz`, fieldUUID)
+	case assets.FieldTypeState, assets.FieldTypeDistrict, assets.FieldTypeWard:
+		// locations are stored as full paths, e.g. "Rwanda > Kigali City", but we match on their names
+		return fmt.Sprintf(`REGEXP_REPLACE(c.fields->%s->>'%s', '^.* > ', '')`, fieldUUID, fieldType)
+	default:
+		return fmt.Sprintf(`(c.fields->%s->>'text')`, fieldUUID)
+	}
+}
+
+func isSetCheck(c *contactql.Condition) bool {
+	return (c.Operator() == contactql.OpEqual || c.Operator() == contactql.OpNotEqual) && c.Value() == ""
+}
+
+// takes a condition that checks if something is set, and inverts it if we're actually looking for unset
+func setCheck(c *contactql.Condition, isSet string) string {
+	if c.Operator() == contactql.OpEqual {
+		return not(isSet)
+	}
+	return isSet
+}
+
+func textCondition(c *contactql.Condition, expr, value string) string {
+	switch c.Operator() {
+	case contactql.OpEqual:
+		return fmt.Sprintf(`%s = %s`, expr, value)
+	case contactql.OpNotEqual:
+		return not(fmt.Sprintf(`%s = %s`, expr, value))
+	default:
+		panic(fmt.Sprintf("unsupported %s attribute operator: %s", c.PropertyKey(), c.Operator()))
+	}
+}
+
+func numberCondition(c *contactql.Condition, expr, value string) string {
+	switch c.Operator() {
+	case contactql.OpEqual:
+		return fmt.Sprintf(`%s = %s`, expr, value)
+	case contactql.OpNotEqual:
+		return not(fmt.Sprintf(`%s = %s`, expr, value))
+	case contactql.OpGreaterThan:
+		return fmt.Sprintf(`%s > %s`, expr, value)
+	case contactql.OpGreaterThanOrEqual:
+		return fmt.Sprintf(`%s >= %s`, expr, value)
+	case contactql.OpLessThan:
+		return fmt.Sprintf(`%s < %s`, expr, value)
+	case contactql.OpLessThanOrEqual:
+		return fmt.Sprintf(`%s <= %s`, expr, value)
+	default:
+		panic(fmt.Sprintf("unsupported %s operator: %s", c.PropertyKey(), c.Operator()))
+	}
+}
+
+// negates a condition, treating NULL as false so that contacts without a value match
+func not(cond string) string {
+	return fmt.Sprintf(`NOT COALESCE(%s, FALSE)`, cond)
+}
+
+// escapes the special characters in a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
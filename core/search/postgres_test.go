@@ -0,0 +1,106 @@
+package search_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/search"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildPostgresQuery(t *testing.T) {
+	_, rt := testsuite.Runtime()
+
+	oa := testdata.Org1.Load(rt)
+	doctors := oa.GroupByID(testdata.DoctorsGroup.ID)
+
+	tcs := []struct {
+		group        *models.Group
+		status       models.ContactStatus
+		excludeIDs   []models.ContactID
+		query        string
+		expectedSQL  string
+		expectedArgs []any
+	}{
+		{
+			expectedSQL:  `c.org_id = $1 AND c.is_active = TRUE`,
+			expectedArgs: []any{testdata.Org1.ID},
+		},
+		{
+			group:        doctors,
+			status:       models.ContactStatusActive,
+			query:        `name = "George"`,
+			expectedSQL:  `c.org_id = $1 AND c.is_active = TRUE AND EXISTS (SELECT 1 FROM contacts_contactgroup_contacts gc WHERE gc.contact_id = c.id AND gc.contactgroup_id = $2) AND c.status = $3 AND c.name = $4`,
+			expectedArgs: []any{testdata.Org1.ID, testdata.DoctorsGroup.ID, models.ContactStatusActive, "George"},
+		},
+		{
+			query:        `age >= 30 OR gender != "M"`,
+			expectedSQL:  `c.org_id = $1 AND c.is_active = TRUE AND ((c.fields->$2::text->>'number')::numeric >= $3::numeric OR NOT COALESCE(LOWER((c.fields->$4::text->>'text')) = $5, FALSE))`,
+			expectedArgs: []any{testdata.Org1.ID, string(testdata.AgeField.UUID), "30", string(testdata.GenderField.UUID), "m"},
+		},
+		{
+			query:        `tel ~ 7411 AND language = ""`,
+			expectedSQL:  `c.org_id = $1 AND c.is_active = TRUE AND (EXISTS (SELECT 1 FROM contacts_contacturn u WHERE u.contact_id = c.id AND u.scheme = $2 AND STRPOS(LOWER(u.path), $3) > 0) AND NOT COALESCE(COALESCE(c.language, '') != '', FALSE))`,
+			expectedArgs: []any{testdata.Org1.ID, "tel", "7411"},
+		},
+	}
+
+	for _, tc := range tcs {
+		var parsed *contactql.ContactQuery
+		if tc.query != "" {
+			var err error
+			parsed, err = contactql.ParseQuery(oa.Env(), tc.query, oa.SessionAssets())
+			require.NoError(t, err)
+		}
+
+		sql, args := search.BuildPostgresQuery(oa, tc.group, tc.status, tc.excludeIDs, parsed)
+		assert.Equal(t, tc.expectedSQL, sql, "sql mismatch for query '%s'", tc.query)
+		assert.Equal(t, tc.expectedArgs, args, "args mismatch for query '%s'", tc.query)
+	}
+}
+
+func TestPostgresBackend(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	rt.Config.SearchBackend = "postgres"
+	defer func() { rt.Config.SearchBackend = "elastic" }()
+
+	oa := testdata.Org1.Load(rt)
+
+	tcs := []struct {
+		query            string
+		sort             string
+		expectedContacts []models.ContactID
+	}{
+		{query: "george OR bob", sort: "name", expectedContacts: []models.ContactID{testdata.Bob.ID, testdata.George.ID}},
+		{query: "name ~ georg", expectedContacts: []models.ContactID{testdata.George.ID}},
+		{query: "age >= 30", sort: "-age", expectedContacts: []models.ContactID{testdata.George.ID}},
+		{query: "tel = +16055741111", expectedContacts: []models.ContactID{testdata.Cathy.ID}},
+		{query: `group = "Doctors" AND name = "Cathy"`, expectedContacts: []models.ContactID{testdata.Cathy.ID}},
+		{query: "nobody", expectedContacts: []models.ContactID{}},
+	}
+
+	for _, tc := range tcs {
+		_, total, err := search.GetContactTotal(ctx, rt, oa, tc.query)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(tc.expectedContacts)), total, "total mismatch for query '%s'", tc.query)
+
+		_, ids, total, err := search.GetContactIDsForQueryPage(ctx, rt, oa, nil, nil, tc.query, tc.sort, 0, 50)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expectedContacts, ids, "page mismatch for query '%s'", tc.query)
+		assert.Equal(t, int64(len(tc.expectedContacts)), total, "page total mismatch for query '%s'", tc.query)
+
+		ids, err = search.GetContactIDsForQuery(ctx, rt, oa, tc.query, -1)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, tc.expectedContacts, ids, "ids mismatch for query '%s'", tc.query)
+	}
+
+	// excluded contacts
+	_, ids, _, err := search.GetContactIDsForQueryPage(ctx, rt, oa, nil, []models.ContactID{testdata.George.ID}, "george OR bob", "", 0, 50)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.Bob.ID}, ids)
+}
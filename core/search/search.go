@@ -3,7 +3,6 @@ package search
 import (
 	"context"
 	"fmt"
-	"io"
 	"strconv"
 	"time"
 
@@ -69,32 +68,24 @@ func BuildElasticQuery(oa *models.OrgAssets, group *models.Group, status models.
 
 // GetContactTotal returns the total count of matching contacts for the given query
 func GetContactTotal(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, query string) (*contactql.ContactQuery, int64, error) {
-	env := oa.Env()
 	var parsed *contactql.ContactQuery
 	var err error
 
-	if rt.ES == nil {
-		return nil, 0, errors.Errorf("no elastic client available, check your configuration")
+	backend, err := GetBackend(rt)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	if query != "" {
-		parsed, err = contactql.ParseQuery(env, query, oa.SessionAssets())
+		parsed, err = contactql.ParseQuery(oa.Env(), query, oa.SessionAssets())
 		if err != nil {
 			return nil, 0, errors.Wrapf(err, "error parsing query: %s", query)
 		}
 	}
 
-	eq := BuildElasticQuery(oa, nil, models.NilContactStatus, nil, parsed)
-
-	count, err := rt.ES.Count(rt.Config.ElasticContactsIndex).Routing(strconv.FormatInt(int64(oa.OrgID()), 10)).Query(eq).Do(ctx)
+	count, err := backend.Count(ctx, oa, &Search{Query: parsed})
 	if err != nil {
-		// Get *elastic.Error which contains additional information
-		ee, ok := err.(*elastic.Error)
-		if !ok {
-			return nil, 0, errors.Wrap(err, "error performing query")
-		}
-
-		return nil, 0, errors.Wrapf(err, "error performing query: %s", ee.Details.Reason)
+		return nil, 0, err
 	}
 
 	return parsed, count, nil
@@ -102,119 +93,112 @@ func GetContactTotal(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAss
 
 // GetContactIDsForQueryPage returns a page of contact ids for the given query and sort
 func GetContactIDsForQueryPage(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, group *models.Group, excludeIDs []models.ContactID, query string, sort string, offset int, pageSize int) (*contactql.ContactQuery, []models.ContactID, int64, error) {
-	env := oa.Env()
-	index := rt.Config.ElasticContactsIndex
 	start := time.Now()
 	var parsed *contactql.ContactQuery
 	var err error
 
-	if rt.ES == nil {
-		return nil, nil, 0, errors.Errorf("no elastic client available, check your configuration")
+	backend, err := GetBackend(rt)
+	if err != nil {
+		return nil, nil, 0, err
 	}
 
 	if query != "" {
-		parsed, err = contactql.ParseQuery(env, query, oa.SessionAssets())
+		parsed, err = contactql.ParseQuery(oa.Env(), query, oa.SessionAssets())
 		if err != nil {
 			return nil, nil, 0, errors.Wrapf(err, "error parsing query: %s", query)
 		}
 	}
 
-	eq := BuildElasticQuery(oa, group, models.NilContactStatus, excludeIDs, parsed)
-
-	fieldSort, err := es.ToElasticFieldSort(sort, oa.SessionAssets())
+	ids, total, err := backend.Page(ctx, oa, &Search{Group: group, ExcludeIDs: excludeIDs, Query: parsed}, sort, offset, pageSize)
 	if err != nil {
-		return nil, nil, 0, errors.Wrapf(err, "error parsing sort")
+		return nil, nil, 0, err
 	}
 
-	s := rt.ES.Search(index).TrackTotalHits(true).Routing(strconv.FormatInt(int64(oa.OrgID()), 10))
-	s = s.Size(pageSize).From(offset).Query(eq).SortBy(fieldSort).FetchSource(false)
+	logrus.WithFields(logrus.Fields{"org_id": oa.OrgID(), "query": query, "elapsed": time.Since(start), "page_count": len(ids), "total_count": total}).Debug("paged contact query complete")
+
+	return parsed, ids, total, nil
+}
+
+// GetContactIDsForQuery returns up to limit the contact ids that match the given query without sorting. Limit of -1 means return all.
+func GetContactIDsForQuery(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, query string, limit int) ([]models.ContactID, error) {
+	start := time.Now()
 
-	results, err := s.Do(ctx)
+	backend, err := GetBackend(rt)
 	if err != nil {
-		// Get *elastic.Error which contains additional information
-		ee, ok := err.(*elastic.Error)
-		if !ok {
-			return nil, nil, 0, errors.Wrapf(err, "error performing query")
-		}
+		return nil, err
+	}
 
-		return nil, nil, 0, errors.Wrapf(err, "error performing query: %s", ee.Details.Reason)
+	parsed, err := contactql.ParseQuery(oa.Env(), query, oa.SessionAssets())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing query: %s", query)
 	}
 
-	ids := make([]models.ContactID, 0, pageSize)
-	ids, err = appendIDsFromHits(ids, results.Hits.Hits)
+	ids, err := backend.IDs(ctx, oa, &Search{Status: models.ContactStatusActive, Query: parsed}, limit)
 	if err != nil {
-		return nil, nil, 0, err
+		return nil, errors.Wrapf(err, "error searching for contacts: %s", query)
 	}
 
-	logrus.WithFields(logrus.Fields{"org_id": oa.OrgID(), "query": query, "elapsed": time.Since(start), "page_count": len(ids), "total_count": results.Hits.TotalHits.Value}).Debug("paged contact query complete")
+	logrus.WithFields(logrus.Fields{
+		"org_id":      oa.OrgID(),
+		"query":       query,
+		"elapsed":     time.Since(start),
+		"match_count": len(ids),
+	}).Debug("contact query complete")
 
-	return parsed, ids, results.Hits.TotalHits.Value, nil
+	return ids, nil
 }
 
-// GetContactIDsForQuery returns up to limit the contact ids that match the given query without sorting. Limit of -1 means return all.
-func GetContactIDsForQuery(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, query string, limit int) ([]models.ContactID, error) {
-	env := oa.Env()
-	index := rt.Config.ElasticContactsIndex
+// StreamContactIDsForQuery calls fn with successive batches of the contact ids, in the given group if provided, that
+// match the given query and are greater than afterID, in ascending order
+func StreamContactIDsForQuery(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, group *models.Group, query string, afterID models.ContactID, batchSize int, fn func([]models.ContactID) error) error {
 	start := time.Now()
+	var parsed *contactql.ContactQuery
+	var err error
 
-	if rt.ES == nil {
-		return nil, errors.Errorf("no elastic client available, check your configuration")
-	}
-
-	// turn into elastic query
-	parsed, err := contactql.ParseQuery(env, query, oa.SessionAssets())
+	backend, err := GetBackend(rt)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error parsing query: %s", query)
+		return err
 	}
 
-	routing := strconv.FormatInt(int64(oa.OrgID()), 10)
-	eq := BuildElasticQuery(oa, nil, models.ContactStatusActive, nil, parsed)
-	ids := make([]models.ContactID, 0, 100)
-
-	// if limit provided that can be done with regular search, do that
-	if limit >= 0 && limit <= 10000 {
-		results, err := rt.ES.Search(index).Routing(routing).From(0).Size(limit).Query(eq).FetchSource(false).Do(ctx)
-		if err != nil {
-			return nil, err
-		}
-		return appendIDsFromHits(ids, results.Hits.Hits)
-	}
-
-	// for larger limits, use scroll service
-	// note that this is no longer recommended, see https://www.elastic.co/guide/en/elasticsearch/reference/current/scroll-api.html
-	scroll := rt.ES.Scroll(index).Routing(routing).KeepAlive("15m").Size(10000).Query(eq).FetchSource(false)
-	for {
-		results, err := scroll.Do(ctx)
-		if err == io.EOF {
-			logrus.WithFields(logrus.Fields{
-				"org_id":      oa.OrgID(),
-				"query":       query,
-				"elapsed":     time.Since(start),
-				"match_count": len(ids),
-			}).Debug("contact query complete")
-
-			return ids, nil
-		}
+	if query != "" {
+		parsed, err = contactql.ParseQuery(oa.Env(), query, oa.SessionAssets())
 		if err != nil {
-			return nil, errors.Wrapf(err, "error scrolling through results for search: %s", query)
+			return errors.Wrapf(err, "error parsing query: %s", query)
 		}
+	}
 
-		ids, err = appendIDsFromHits(ids, results.Hits.Hits)
-		if err != nil {
-			return nil, err
-		}
+	count := 0
+	err = backend.Stream(ctx, oa, &Search{Group: group, Query: parsed}, afterID, batchSize, func(ids []models.ContactID) error {
+		count += len(ids)
+		return fn(ids)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error streaming contacts for search: %s", query)
 	}
+
+	logrus.WithFields(logrus.Fields{"org_id": oa.OrgID(), "query": query, "elapsed": time.Since(start), "match_count": count}).Debug("streamed contact query complete")
+
+	return nil
 }
 
-// utility to convert search hits to contact IDs and append them to the given slice
-func appendIDsFromHits(ids []models.ContactID, hits []*elastic.SearchHit) ([]models.ContactID, error) {
-	for _, hit := range hits {
-		id, err := strconv.Atoi(hit.Id)
-		if err != nil {
-			return nil, errors.Wrapf(err, "unexpected non-integer contact id: %s", hit.Id)
+// DeleteContact deletes the document for the given contact from the contacts index, returning whether a document
+// was deleted. A contact without a document isn't an error, and nothing is deleted if there's no index to delete from.
+func DeleteContact(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID, contactID models.ContactID) (bool, error) {
+	if rt.ES == nil {
+		if rt.Config.SearchBackend == "postgres" {
+			return false, nil
 		}
+		return false, errors.Errorf("no elastic client available, check your configuration")
+	}
+
+	routing := strconv.FormatInt(int64(orgID), 10)
 
-		ids = append(ids, models.ContactID(id))
+	_, err := rt.ES.Delete().Index(rt.Config.ElasticContactsIndex).Routing(routing).Id(strconv.FormatInt(int64(contactID), 10)).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return false, nil
 	}
-	return ids, nil
+	if err != nil {
+		return false, errors.Wrapf(err, "error deleting document for contact #%d", contactID)
+	}
+	return true, nil
 }
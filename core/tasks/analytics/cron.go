@@ -6,6 +6,7 @@ import (
 
 	"github.com/nyaruka/gocommon/analytics"
 	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/runtime"
 	"github.com/sirupsen/logrus"
@@ -13,6 +14,7 @@ import (
 
 func init() {
 	mailroom.RegisterCron("analytics", time.Second*60, true, reportAnalytics)
+	mailroom.RegisterCron("msg_duplicates_analytics", time.Second*60, false, reportMsgDuplicates)
 }
 
 var (
@@ -82,3 +84,19 @@ func reportAnalytics(ctx context.Context, rt *runtime.Runtime) error {
 
 	return nil
 }
+
+// reports the number of duplicate incoming messages ignored since the last report, which only runs on one instance as
+// reading the count resets it
+func reportMsgDuplicates(ctx context.Context, rt *runtime.Runtime) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	count, err := models.PopIncomingDuplicateCount(rc)
+	if err != nil {
+		return err
+	}
+
+	analytics.Gauge("mr.msg_duplicate_count", float64(count))
+
+	return nil
+}
@@ -0,0 +1,227 @@
+package contacts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/search"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeBulkModifyContacts is the type of the task to resolve and modify contacts in bulk
+const TypeBulkModifyContacts = "bulk_modify_contacts"
+
+// TypeBulkModifyContactsBatch is the type of the task to modify a batch of contacts
+const TypeBulkModifyContactsBatch = "bulk_modify_contacts_batch"
+
+const (
+	bulkModifyBatchSize   = 100
+	bulkModifyProgressKey = "bulk_modify:%d:%s"
+	bulkModifyProgressTTL = time.Hour * 24 * 7
+)
+
+func init() {
+	tasks.RegisterType(TypeBulkModifyContacts, func() tasks.Task { return &BulkModifyContactsTask{} })
+	tasks.RegisterType(TypeBulkModifyContactsBatch, func() tasks.Task { return &BulkModifyContactsBatchTask{} })
+}
+
+// BulkModifyContactsTask is our task to resolve the contacts matching a query or in a group, and queue batch tasks to
+// apply modifiers to them
+type BulkModifyContactsTask struct {
+	UUID      uuids.UUID        `json:"uuid"`
+	UserID    models.UserID     `json:"user_id"`
+	Query     string            `json:"query,omitempty"`
+	GroupID   models.GroupID    `json:"group_id,omitempty"`
+	Modifiers []json.RawMessage `json:"modifiers"`
+}
+
+func (t *BulkModifyContactsTask) Type() string {
+	return TypeBulkModifyContacts
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *BulkModifyContactsTask) Timeout() time.Duration {
+	return time.Minute * 60
+}
+
+// Perform resolves the contacts to modify and queues a batch task for each batch of them
+func (t *BulkModifyContactsTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	oa, err := models.GetOrgAssets(ctx, rt, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets")
+	}
+
+	var contactIDs []models.ContactID
+	if t.GroupID != 0 {
+		contactIDs, err = models.ContactIDsForGroupIDs(ctx, rt.DB, []models.GroupID{t.GroupID})
+	} else {
+		contactIDs, err = search.GetContactIDsForQuery(ctx, rt, oa, t.Query, -1)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error resolving contacts to modify")
+	}
+
+	idBatches := models.ChunkSlice(contactIDs, bulkModifyBatchSize)
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	progressKey := fmt.Sprintf(bulkModifyProgressKey, orgID, t.UUID)
+	rc.Send("MULTI")
+	rc.Send("HSET", progressKey, "total", len(contactIDs), "batches", len(idBatches))
+	rc.Send("EXPIRE", progressKey, int(bulkModifyProgressTTL/time.Second))
+	if _, err := rc.Do("EXEC"); err != nil {
+		return errors.Wrapf(err, "error recording bulk modify progress")
+	}
+
+	for i, idBatch := range idBatches {
+		batchTask := &BulkModifyContactsBatchTask{UUID: t.UUID, UserID: t.UserID, ContactIDs: idBatch, Modifiers: t.Modifiers}
+
+		err = tasks.Queue(rc, queue.BatchQueue, orgID, batchTask, queue.DefaultPriority)
+		if err != nil {
+			if i == 0 {
+				return errors.Wrap(err, "error queuing bulk modify batch")
+			}
+			// if we've already queued other batches.. we don't want to error and have the task be retried, so count
+			// this batch as done but failed so that the modification can still complete
+			logrus.WithError(err).Error("error queuing bulk modify batch")
+
+			rc.Send("MULTI")
+			rc.Send("HINCRBY", progressKey, "failed", len(idBatch))
+			rc.Send("HINCRBY", progressKey, "batches_done", 1)
+			if _, perr := rc.Do("EXEC"); perr != nil {
+				logrus.WithError(perr).WithField("uuid", t.UUID).Error("error recording bulk modify progress")
+			}
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{"org_id": orgID, "uuid": t.UUID, "contacts": len(contactIDs), "batches": len(idBatches)}).Info("queued bulk contact modification")
+
+	return nil
+}
+
+// BulkModifyContactsBatchTask is our task to apply modifiers to a batch of contacts
+type BulkModifyContactsBatchTask struct {
+	UUID       uuids.UUID         `json:"uuid"`
+	UserID     models.UserID      `json:"user_id"`
+	ContactIDs []models.ContactID `json:"contact_ids"`
+	Modifiers  []json.RawMessage  `json:"modifiers"`
+}
+
+func (t *BulkModifyContactsBatchTask) Type() string {
+	return TypeBulkModifyContactsBatch
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *BulkModifyContactsBatchTask) Timeout() time.Duration {
+	return time.Minute * 10
+}
+
+// Perform applies the modifiers to the contacts in this batch, recording how many were modified
+func (t *BulkModifyContactsBatchTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	modified, err := t.modify(ctx, rt, orgID)
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	progressKey := fmt.Sprintf(bulkModifyProgressKey, orgID, t.UUID)
+	rc.Send("MULTI")
+	if err != nil {
+		rc.Send("HINCRBY", progressKey, "failed", len(t.ContactIDs))
+	} else {
+		rc.Send("HINCRBY", progressKey, "modified", modified)
+		rc.Send("HINCRBY", progressKey, "skipped", len(t.ContactIDs)-modified)
+	}
+	rc.Send("HINCRBY", progressKey, "batches_done", 1)
+	if _, perr := rc.Do("EXEC"); perr != nil {
+		logrus.WithError(perr).WithField("uuid", t.UUID).Error("error recording bulk modify progress")
+	}
+
+	return err
+}
+
+func (t *BulkModifyContactsBatchTask) modify(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) (int, error) {
+	oa, err := models.GetOrgAssets(ctx, rt, orgID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	// assets may have been deleted since the modification was requested
+	mods, err := goflow.ReadModifiers(oa.SessionAssets(), t.Modifiers, goflow.IgnoreMissing)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading modifiers")
+	}
+
+	eventsByContact, _, err := models.LockAndModifyContacts(ctx, rt, oa, t.UserID, models.ContactChangeSourceAPI, t.ContactIDs, mods, time.Minute)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(eventsByContact), nil
+}
+
+// BulkModifyProgress is the progress of a bulk contact modification
+type BulkModifyProgress struct {
+	Status   string `json:"status"`
+	Total    int    `json:"total"`
+	Modified int    `json:"modified"`
+	Skipped  int    `json:"skipped"`
+	Failed   int    `json:"failed"`
+}
+
+// QueueBulkModify records a bulk contact modification as pending and queues the task to perform it
+func QueueBulkModify(rc redis.Conn, orgID models.OrgID, task *BulkModifyContactsTask) error {
+	progressKey := fmt.Sprintf(bulkModifyProgressKey, orgID, task.UUID)
+
+	rc.Send("MULTI")
+	rc.Send("HSET", progressKey, "batches", -1)
+	rc.Send("EXPIRE", progressKey, int(bulkModifyProgressTTL/time.Second))
+	if _, err := rc.Do("EXEC"); err != nil {
+		return errors.Wrapf(err, "error recording bulk modify progress")
+	}
+
+	return tasks.Queue(rc, queue.BatchQueue, orgID, task, queue.DefaultPriority)
+}
+
+// GetBulkModifyProgress gets the progress of the bulk contact modification with the given UUID, returning nil if it
+// doesn't exist or has expired
+func GetBulkModifyProgress(rc redis.Conn, orgID models.OrgID, uuid uuids.UUID) (*BulkModifyProgress, error) {
+	values, err := redis.Values(rc.Do("HGETALL", fmt.Sprintf(bulkModifyProgressKey, orgID, uuid)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading bulk modify progress")
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	p := struct {
+		Total       int `redis:"total"`
+		Batches     int `redis:"batches"`
+		BatchesDone int `redis:"batches_done"`
+		Modified    int `redis:"modified"`
+		Skipped     int `redis:"skipped"`
+		Failed      int `redis:"failed"`
+	}{}
+	if err := redis.ScanStruct(values, &p); err != nil {
+		return nil, errors.Wrapf(err, "error scanning bulk modify progress")
+	}
+
+	status := "complete"
+	if p.Batches < 0 {
+		status = "pending"
+	} else if p.BatchesDone < p.Batches {
+		status = "in_progress"
+	}
+
+	return &BulkModifyProgress{Status: status, Total: p.Total, Modified: p.Modified, Skipped: p.Skipped, Failed: p.Failed}, nil
+}
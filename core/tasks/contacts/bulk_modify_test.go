@@ -0,0 +1,52 @@
+package contacts_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkModify(t *testing.T) {
+	_, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	var numDoctors int
+	require.NoError(t, rt.DB.Get(&numDoctors, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, testdata.DoctorsGroup.ID))
+
+	task := &contacts.BulkModifyContactsTask{
+		UUID:      "f5901b62-ba76-4003-9c62-72fdacc1b7b7",
+		UserID:    testdata.Admin.ID,
+		GroupID:   testdata.DoctorsGroup.ID,
+		Modifiers: []json.RawMessage{[]byte(`{"type": "field", "field": {"key": "age", "name": "Age"}, "value": "30"}`)},
+	}
+
+	err := contacts.QueueBulkModify(rc, testdata.Org1.ID, task)
+	require.NoError(t, err)
+
+	progress, err := contacts.GetBulkModifyProgress(rc, testdata.Org1.ID, task.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, &contacts.BulkModifyProgress{Status: "pending"}, progress)
+
+	// perform the task and the batch tasks it queues
+	testsuite.FlushTasks(t, rt)
+
+	progress, err = contacts.GetBulkModifyProgress(rc, testdata.Org1.ID, task.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, &contacts.BulkModifyProgress{Status: "complete", Total: numDoctors, Modified: numDoctors}, progress)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contact WHERE fields->$1->>'text' = '30'`, testdata.AgeField.UUID).Returns(numDoctors)
+
+	// progress of a bulk modification that doesn't exist
+	progress, err = contacts.GetBulkModifyProgress(rc, testdata.Org1.ID, "bc6c9e5b-c5dc-48ee-9e0e-5b8e40b2ad84")
+	assert.NoError(t, err)
+	assert.Nil(t, progress)
+}
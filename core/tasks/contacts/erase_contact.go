@@ -0,0 +1,150 @@
+package contacts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/search"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/core/tasks/handler"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeEraseContact is the type of the erase contact task
+const TypeEraseContact = "erase_contact"
+
+// the report of what was erased is kept in redis for a week so that it can be fetched once the task has been performed
+const (
+	erasureReportKey = "contact_erasure:%d:%d"
+	erasureReportTTL = time.Hour * 24 * 7
+)
+
+func init() {
+	tasks.RegisterType(TypeEraseContact, func() tasks.Task { return &EraseContactTask{} })
+}
+
+// EraseContactTask is our task to purge or redact a contact's data from everywhere outside of the contact tables, i.e.
+// session storage, logs storage, HTTP logs, the contact's queue and the search index. It should be queued before the
+// contact's messages and calls are deleted. Performing it more than once is safe.
+type EraseContactTask struct {
+	ContactID models.ContactID `json:"contact_id"`
+}
+
+func (t *EraseContactTask) Type() string {
+	return TypeEraseContact
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *EraseContactTask) Timeout() time.Duration {
+	return time.Minute * 15
+}
+
+// Perform erases the contact's data from each store, saving a report of what was removed
+func (t *EraseContactTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	log := logrus.WithFields(logrus.Fields{"org_id": orgID, "contact_id": t.ContactID})
+
+	// lock the contact so that we're not handling any of its events whilst we erase it
+	locks, skipped, err := models.LockContacts(ctx, rt, orgID, []models.ContactID{t.ContactID}, time.Minute)
+	if err != nil {
+		return errors.Wrapf(err, "error locking contact")
+	}
+	defer models.UnlockContacts(rt, orgID, locks)
+
+	if len(skipped) > 0 {
+		return errors.Errorf("unable to lock contact #%d for erasure", t.ContactID)
+	}
+
+	erasure, err := t.erase(ctx, rt, orgID)
+	if err != nil {
+		return err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := saveContactErasure(rc, orgID, t.ContactID, erasure); err != nil {
+		return err
+	}
+
+	log.WithField("erasure", erasure).WithField("total", erasure.Total()).Info("erased contact")
+	return nil
+}
+
+func (t *EraseContactTask) erase(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) (*models.ContactErasure, error) {
+	erasure := &models.ContactErasure{ErasedOn: dates.Now()}
+
+	var err error
+
+	// interrupt any waiting session so that nothing more can be written to it
+	erasure.SessionsInterrupted, err = models.InterruptSessionsForContacts(ctx, rt.DB, []models.ContactID{t.ContactID})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error interrupting sessions")
+	}
+
+	erasure.SessionOutputs, err = models.RedactSessionOutputs(ctx, rt, t.ContactID)
+	if err != nil {
+		return nil, err
+	}
+
+	erasure.ChannelLogs, err = models.RedactChannelLogs(ctx, rt, t.ContactID)
+	if err != nil {
+		return nil, err
+	}
+
+	erasure.HTTPLogs, err = models.DeleteHTTPLogsForContact(ctx, rt.DB, orgID, t.ContactID)
+	if err != nil {
+		return nil, err
+	}
+
+	erasure.AuditEntries, err = models.RedactContactAudits(ctx, rt.DB, t.ContactID)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := rt.RP.Get()
+	erasure.QueuedEvents, err = handler.ClearContactQueue(rc, orgID, t.ContactID)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := search.DeleteContact(ctx, rt, orgID, t.ContactID)
+	if err != nil {
+		return nil, err
+	}
+	if deleted {
+		erasure.SearchDocuments = 1
+	}
+
+	return erasure, nil
+}
+
+func saveContactErasure(rc redis.Conn, orgID models.OrgID, contactID models.ContactID, erasure *models.ContactErasure) error {
+	_, err := rc.Do("SET", fmt.Sprintf(erasureReportKey, orgID, contactID), jsonx.MustMarshal(erasure), "EX", int(erasureReportTTL/time.Second))
+	return errors.Wrapf(err, "error saving erasure report")
+}
+
+// GetContactErasure gets the report of the latest erasure of the given contact, returning nil if it hasn't been erased
+// or the report has expired
+func GetContactErasure(rc redis.Conn, orgID models.OrgID, contactID models.ContactID) (*models.ContactErasure, error) {
+	value, err := redis.Bytes(rc.Do("GET", fmt.Sprintf(erasureReportKey, orgID, contactID)))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error reading erasure report")
+	}
+
+	erasure := &models.ContactErasure{}
+	if err := json.Unmarshal(value, erasure); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling erasure report")
+	}
+	return erasure, nil
+}
@@ -0,0 +1,59 @@
+package contacts_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/core/tasks/handler"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/redisx/assertredis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEraseContact(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	sessionID := testdata.InsertWaitingSession(rt, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now().Add(time.Hour), true, nil)
+
+	httpLog := models.NewWebhookCalledLog(testdata.Org1.ID, testdata.Favorites.ID, "http://example.com", 200, `{"phone":"+16055741111"}`, "OK", false, time.Second, 0, time.Now())
+	httpLog.SetContactID(testdata.Cathy.ID)
+
+	err := models.InsertHTTPLogs(ctx, rt.DB, []*models.HTTPLog{httpLog})
+	require.NoError(t, err)
+
+	err = handler.QueueHandleTask(rc, testdata.Cathy.ID, &queue.Task{Type: handler.MsgEventType, OrgID: int(testdata.Org1.ID), Task: []byte(`{}`)})
+	require.NoError(t, err)
+	assertredis.LLen(t, rt.RP, "c:1:10000", 1)
+
+	task := &contacts.EraseContactTask{ContactID: testdata.Cathy.ID}
+
+	// perform twice to check that erasing is idempotent
+	for i := 0; i < 2; i++ {
+		err = task.Perform(ctx, rt, testdata.Org1.ID)
+		require.NoError(t, err)
+
+		assertdb.Query(t, rt.DB, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND status = 'I' AND output IS NULL`, sessionID).Returns(1)
+		assertdb.Query(t, rt.DB, `SELECT count(*) FROM request_logs_httplog`).Returns(0)
+		assertredis.LLen(t, rt.RP, "c:1:10000", 0)
+	}
+
+	// and a report of the last erasure is saved
+	erasure, err := contacts.GetContactErasure(rc, testdata.Org1.ID, testdata.Cathy.ID)
+	require.NoError(t, err)
+	require.NotNil(t, erasure)
+	assert.Equal(t, 0, erasure.Total())
+
+	erasure, err = contacts.GetContactErasure(rc, testdata.Org1.ID, testdata.Bob.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, erasure)
+}
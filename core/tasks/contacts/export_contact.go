@@ -0,0 +1,71 @@
+package contacts
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeExportContact is the type of the export contact task
+const TypeExportContact = "export_contact"
+
+func init() {
+	tasks.RegisterType(TypeExportContact, func() tasks.Task { return &ExportContactTask{} })
+}
+
+// ExportContactTask is our task to write a complete export of a contact to export storage
+type ExportContactTask struct {
+	ExportUUID uuids.UUID                 `json:"export_uuid"`
+	ContactID  models.ContactID           `json:"contact_id"`
+	Format     models.ContactExportFormat `json:"format"`
+}
+
+func (t *ExportContactTask) Type() string {
+	return TypeExportContact
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *ExportContactTask) Timeout() time.Duration {
+	return time.Hour
+}
+
+// Perform exports the contact and writes the export to models.ContactExportPath in export storage
+func (t *ExportContactTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	start := time.Now()
+
+	oa, err := models.GetOrgAssets(ctx, rt, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets")
+	}
+
+	// storage only accepts whole objects so the export is built in memory, but it's written as it's generated so that
+	// only one copy of it is held
+	export := &bytes.Buffer{}
+
+	if err := models.ExportContact(ctx, rt, oa, t.ContactID, t.Format, export); err != nil {
+		return errors.Wrapf(err, "error exporting contact #%d", t.ContactID)
+	}
+
+	url, err := rt.ExportStorage.Put(ctx, models.ContactExportPath(orgID, t.ExportUUID, t.Format), t.Format.ContentType(), export.Bytes())
+	if err != nil {
+		return errors.Wrapf(err, "error writing contact export to storage")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":      orgID,
+		"contact_id":  t.ContactID,
+		"export_uuid": t.ExportUUID,
+		"url":         url,
+		"size":        export.Len(),
+		"elapsed":     time.Since(start),
+	}).Info("exported contact")
+
+	return nil
+}
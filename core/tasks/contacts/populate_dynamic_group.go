@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/core/search"
 	"github.com/nyaruka/mailroom/core/tasks"
 	"github.com/nyaruka/mailroom/runtime"
@@ -17,16 +19,28 @@ import (
 // TypePopulateDynamicGroup is the type of the populate group task
 const TypePopulateDynamicGroup = "populate_dynamic_group"
 
-const populateLockKey string = "lock:pop_dyn_group_%d"
+const (
+	populateLockKey     = "lock:pop_dyn_group_%d"
+	populateProgressKey = "pop_dyn_group:%d:%d"
+	populateProgressTTL = time.Hour * 24
+)
+
+// PopulateTaskDeadline is how long the task populates a group for before stopping and queuing itself to resume from
+// where it stopped, which must be less than its timeout
+var PopulateTaskDeadline = time.Minute * 50
+
+var errPopulationPaused = errors.New("smart group population paused")
 
 func init() {
 	tasks.RegisterType(TypePopulateDynamicGroup, func() tasks.Task { return &PopulateDynamicGroupTask{} })
 }
 
-// PopulateDynamicGroupTask is our task to populate the contacts for a dynamic group
+// PopulateDynamicGroupTask is our task to populate the contacts for a dynamic group. If the task was paused, it's
+// queued again with the population to resume.
 type PopulateDynamicGroupTask struct {
-	GroupID models.GroupID `json:"group_id"`
-	Query   string         `json:"query"`
+	GroupID models.GroupID               `json:"group_id"`
+	Query   string                       `json:"query"`
+	Resume  *search.SmartGroupPopulation `json:"resume,omitempty"`
 }
 
 func (t *PopulateDynamicGroupTask) Type() string {
@@ -38,7 +52,8 @@ func (t *PopulateDynamicGroupTask) Timeout() time.Duration {
 	return time.Hour
 }
 
-// Perform figures out the membership for a query based group then repopulates it
+// Perform figures out the membership for a query based group then repopulates it. Progress is saved after each batch
+// of contacts, and if the task runs out of time, it queues itself to resume from where it stopped.
 func (t *PopulateDynamicGroupTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
 	locker := redisx.NewLocker(fmt.Sprintf(populateLockKey, t.GroupID), time.Hour)
 	lock, err := locker.Grab(rt.RP, time.Minute*5)
@@ -54,18 +69,115 @@ func (t *PopulateDynamicGroupTask) Perform(ctx context.Context, rt *runtime.Runt
 		"query":    t.Query,
 	})
 
-	log.Info("starting population of smart group")
-
 	oa, err := models.GetOrgAssets(ctx, rt, orgID)
 	if err != nil {
 		return errors.Wrapf(err, "unable to load org when populating group: %d", t.GroupID)
 	}
 
-	count, err := search.PopulateSmartGroup(ctx, rt, rt.ES, oa, t.GroupID, t.Query)
-	if err != nil {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	progressKey := fmt.Sprintf(populateProgressKey, orgID, t.GroupID)
+
+	// resume the population this task was paused in, or start a new one
+	pop := t.Resume
+	if pop != nil {
+		log.WithField("after_id", pop.AfterID).Info("resuming population of smart group")
+	} else {
+		pop, err = search.StartSmartGroupPopulation(ctx, rt, oa, t.GroupID, t.Query)
+		if err != nil {
+			return errors.Wrapf(err, "error populating smart group: %d", t.GroupID)
+		}
+	}
+
+	if err := t.saveProgress(rc, progressKey, pop, false); err != nil {
+		return err
+	}
+
+	err = search.ContinueSmartGroupPopulation(ctx, rt, oa, t.GroupID, t.Query, pop, func(p *search.SmartGroupPopulation) error {
+		if err := t.saveProgress(rc, progressKey, p, false); err != nil {
+			return err
+		}
+		if time.Since(start) > PopulateTaskDeadline {
+			return errPopulationPaused
+		}
+		return nil
+	})
+
+	if err == errPopulationPaused {
+		log.WithFields(logrus.Fields{"processed": pop.Processed, "total": pop.Total}).Info("pausing population of smart group")
+
+		resume := &PopulateDynamicGroupTask{GroupID: t.GroupID, Query: t.Query, Resume: pop}
+		return tasks.Queue(rc, queue.BatchQueue, orgID, resume, queue.DefaultPriority)
+	} else if err != nil {
 		return errors.Wrapf(err, "error populating smart group: %d", t.GroupID)
 	}
-	logrus.WithField("elapsed", time.Since(start)).WithField("count", count).Info("completed populating smart group")
 
+	if err := t.saveProgress(rc, progressKey, pop, true); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{"elapsed": time.Since(start), "count": pop.Processed, "added": pop.Added, "removed": pop.Removed}).Info("completed populating smart group")
+
+	return nil
+}
+
+func (t *PopulateDynamicGroupTask) saveProgress(rc redis.Conn, progressKey string, pop *search.SmartGroupPopulation, complete bool) error {
+	rc.Send("MULTI")
+	rc.Send("HSET", progressKey, "complete", complete, "total", pop.Total, "processed", pop.Processed, "added", pop.Added, "removed", pop.Removed)
+	rc.Send("EXPIRE", progressKey, int(populateProgressTTL/time.Second))
+	if _, err := rc.Do("EXEC"); err != nil {
+		return errors.Wrapf(err, "error recording smart group population progress")
+	}
 	return nil
 }
+
+// how population progress is stored in redis
+type storedPopulationProgress struct {
+	Complete  bool `redis:"complete"`
+	Total     int  `redis:"total"`
+	Processed int  `redis:"processed"`
+	Added     int  `redis:"added"`
+	Removed   int  `redis:"removed"`
+}
+
+func readPopulationProgress(rc redis.Conn, progressKey string) (*storedPopulationProgress, error) {
+	values, err := redis.Values(rc.Do("HGETALL", progressKey))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading smart group population progress")
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	p := &storedPopulationProgress{}
+	if err := redis.ScanStruct(values, p); err != nil {
+		return nil, errors.Wrapf(err, "error scanning smart group population progress")
+	}
+	return p, nil
+}
+
+// GroupPopulationProgress is the progress of the latest population of a smart group
+type GroupPopulationProgress struct {
+	Status    string `json:"status"`
+	Total     int    `json:"total"`
+	Processed int    `json:"processed"`
+	Added     int    `json:"added"`
+	Removed   int    `json:"removed"`
+}
+
+// GetGroupPopulationProgress gets the progress of the latest population of the given smart group, returning nil if
+// there isn't one or it has expired
+func GetGroupPopulationProgress(rc redis.Conn, orgID models.OrgID, groupID models.GroupID) (*GroupPopulationProgress, error) {
+	p, err := readPopulationProgress(rc, fmt.Sprintf(populateProgressKey, orgID, groupID))
+	if err != nil || p == nil {
+		return nil, err
+	}
+
+	status := "in_progress"
+	if p.Complete {
+		status = "complete"
+	}
+
+	return &GroupPopulationProgress{Status: status, Total: p.Total, Processed: p.Processed, Added: p.Added, Removed: p.Removed}, nil
+}
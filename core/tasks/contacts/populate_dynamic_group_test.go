@@ -2,32 +2,100 @@ package contacts_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/search"
 	"github.com/nyaruka/mailroom/core/tasks/contacts"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
-
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestPopulateTask(t *testing.T) {
 	ctx, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
 
 	defer testsuite.Reset(testsuite.ResetAll)
 
+	defer func(t time.Duration) { search.IndexerWaitTimeout = t }(search.IndexerWaitTimeout)
+	search.IndexerWaitTimeout = 0
+
 	group := testdata.InsertContactGroup(rt, testdata.Org1, "e52fee05-2f95-4445-aef6-2fe7dac2fd56", "Women", "gender = F")
 	start := dates.Now()
 
+	progress, err := contacts.GetGroupPopulationProgress(rc, testdata.Org1.ID, group.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, progress)
+
 	task := &contacts.PopulateDynamicGroupTask{
 		GroupID: group.ID,
 		Query:   "gender = F",
 	}
-	err := task.Perform(ctx, rt, testdata.Org1.ID)
+	err = task.Perform(ctx, rt, testdata.Org1.ID)
 	require.NoError(t, err)
 
 	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, group.ID).Returns(1)
 	assertdb.Query(t, rt.DB, `SELECT contact_id FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, group.ID).Returns(int64(testdata.Cathy.ID))
 	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND modified_on > $2`, testdata.Cathy.ID, start).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT status FROM contacts_contactgroup WHERE id = $1`, group.ID).Returns("R")
+
+	progress, err = contacts.GetGroupPopulationProgress(rc, testdata.Org1.ID, group.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, &contacts.GroupPopulationProgress{Status: "complete", Total: 1, Processed: 1, Added: 1, Removed: 0}, progress)
+}
+
+func TestPopulateTaskResume(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	defer func(t time.Duration) { search.IndexerWaitTimeout = t }(search.IndexerWaitTimeout)
+	search.IndexerWaitTimeout = 0
+
+	// make the task pause after its first batch
+	defer func(d time.Duration) { contacts.PopulateTaskDeadline = d }(contacts.PopulateTaskDeadline)
+	contacts.PopulateTaskDeadline = 0
+
+	group := testdata.InsertContactGroup(rt, testdata.Org1, "e52fee05-2f95-4445-aef6-2fe7dac2fd56", "Women", "gender = F")
+
+	task := &contacts.PopulateDynamicGroupTask{GroupID: group.ID, Query: "gender = F"}
+	err := task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// contacts in the first batch have been added but the group is still evaluating
+	assertdb.Query(t, rt.DB, `SELECT contact_id FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, group.ID).Returns(int64(testdata.Cathy.ID))
+	assertdb.Query(t, rt.DB, `SELECT status FROM contacts_contactgroup WHERE id = $1`, group.ID).Returns("V")
+
+	progress, err := contacts.GetGroupPopulationProgress(rc, testdata.Org1.ID, group.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, &contacts.GroupPopulationProgress{Status: "in_progress", Total: 1, Processed: 1, Added: 1, Removed: 0}, progress)
+
+	// and the task has queued itself to resume from where it paused
+	qtask, err := queue.PopNextTask(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	require.NotNil(t, qtask)
+	assert.Equal(t, contacts.TypePopulateDynamicGroup, qtask.Type)
+
+	resumed := &contacts.PopulateDynamicGroupTask{}
+	jsonx.MustUnmarshal(qtask.Task, resumed)
+	assert.Equal(t, group.ID, resumed.GroupID)
+	assert.Equal(t, &search.SmartGroupPopulation{Total: 1, Processed: 1, Added: 1, AfterID: testdata.Cathy.ID}, resumed.Resume)
+
+	err = resumed.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, group.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT status FROM contacts_contactgroup WHERE id = $1`, group.ID).Returns("R")
+
+	progress, err = contacts.GetGroupPopulationProgress(rc, testdata.Org1.ID, group.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, &contacts.GroupPopulationProgress{Status: "complete", Total: 1, Processed: 1, Added: 1, Removed: 0}, progress)
 }
@@ -37,6 +37,7 @@ const (
 	ExpirationEventType      = "expiration_event"
 	TimeoutEventType         = "timeout_event"
 	TicketClosedEventType    = "ticket_closed"
+	TriggerEventType         = models.TriggerEventType
 )
 
 // handleTimedEvent is called for timeout events
@@ -293,6 +294,39 @@ func HandleChannelEvent(ctx context.Context, rt *runtime.Runtime, eventType mode
 
 // handleStopEvent is called when a contact is stopped by courier
 func handleStopEvent(ctx context.Context, rt *runtime.Runtime, event *StopEvent) error {
+	oa, err := models.GetOrgAssets(ctx, rt, event.OrgID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading org")
+	}
+
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, []models.ContactID{event.ContactID})
+	if err != nil {
+		return errors.Wrapf(err, "error loading contact")
+	}
+
+	// contact has been deleted, nothing to stop
+	if len(contacts) == 0 {
+		return nil
+	}
+	modelContact := contacts[0]
+
+	// start any flow triggered by the contact opting out, before they're stopped so that the flow can still send them
+	// messages, e.g. to confirm they've opted out
+	if modelContact.Status() == models.ContactStatusActive {
+		contact, err := modelContact.FlowContact(oa)
+		if err != nil {
+			return errors.Wrapf(err, "error creating flow contact")
+		}
+
+		if trigger := models.FindMatchingOptOutTrigger(oa, contact); trigger != nil {
+			params := types.NewXObject(map[string]types.XValue{"type": types.NewXText("opt_out")})
+
+			if err := startTriggeredFlow(ctx, rt, oa, trigger, modelContact, contact, params); err != nil {
+				return err
+			}
+		}
+	}
+
 	tx, err := rt.DB.BeginTxx(ctx, nil)
 	if err != nil {
 		return errors.Wrapf(err, "unable to start transaction for stopping contact")
@@ -314,11 +348,86 @@ func handleStopEvent(ctx context.Context, rt *runtime.Runtime, event *StopEvent)
 	if err != nil {
 		return errors.Wrapf(err, "unable to commit for contact stop")
 	}
-	return err
+	return nil
+}
+
+// handleTriggerEvent is called when a change to a contact outside of message handling has matched a trigger
+func handleTriggerEvent(ctx context.Context, rt *runtime.Runtime, event *models.TriggerEvent) error {
+	oa, err := models.GetOrgAssets(ctx, rt, event.OrgID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading org")
+	}
+
+	// trigger has since been archived or deleted, ignore this event
+	var trigger *models.Trigger
+	for _, t := range oa.Triggers() {
+		if t.ID() == event.TriggerID {
+			trigger = t
+			break
+		}
+	}
+	if trigger == nil {
+		return nil
+	}
+
+	// load our contact
+	contacts, err := models.LoadContacts(ctx, rt.ReadonlyDB, oa, []models.ContactID{event.ContactID})
+	if err != nil {
+		return errors.Wrapf(err, "error loading contact")
+	}
+
+	// contact has been deleted or blocked, ignore this event
+	if len(contacts) == 0 || contacts[0].Status() == models.ContactStatusBlocked {
+		return nil
+	}
+	modelContact := contacts[0]
+
+	contact, err := modelContact.FlowContact(oa)
+	if err != nil {
+		return errors.Wrapf(err, "error creating flow contact")
+	}
+
+	var params *types.XObject
+	if len(event.Params) > 0 {
+		params, err = types.ReadXObject(event.Params)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read trigger params")
+		}
+	}
+
+	return startTriggeredFlow(ctx, rt, oa, trigger, modelContact, contact, params)
+}
+
+// starts the flow of the given trigger for a contact, passing the given params
+func startTriggeredFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, trigger *models.Trigger, modelContact *models.Contact, contact *flows.Contact, params *types.XObject) error {
+	flow, err := oa.FlowByID(trigger.FlowID())
+	if err == models.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error loading flow for trigger")
+	}
+
+	// if this is an IVR flow, we need to trigger that start (which happens in a different queue)
+	if flow.FlowType() == models.FlowTypeVoice {
+		err = TriggerIVRFlow(ctx, rt, oa.OrgID(), flow.ID(), []models.ContactID{modelContact.ID()}, nil)
+		if err != nil {
+			return errors.Wrapf(err, "error while triggering ivr flow")
+		}
+		return nil
+	}
+
+	flowTrigger := triggers.NewBuilder(oa.Env(), flow.Reference(), contact).Manual().WithParams(params).Build()
+
+	_, err = runner.StartFlowForContacts(ctx, rt, oa, flow, []*models.Contact{modelContact}, []flows.Trigger{flowTrigger}, nil, true)
+	if err != nil {
+		return errors.Wrapf(err, "error starting flow for contact")
+	}
+	return nil
 }
 
 // handleMsgEvent is called when a new message arrives from a contact
-func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) error {
+func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) (err error) {
 	oa, err := models.GetOrgAssets(ctx, rt, event.OrgID)
 	if err != nil {
 		return errors.Wrap(err, "error loading org")
@@ -327,6 +436,38 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 	// load the channel for this message
 	channel := oa.ChannelByID(event.ChannelID)
 
+	// channels can redeliver webhooks so ignore any message which is a duplicate of one we've already seen, but mark it
+	// as handled
+	if channel != nil {
+		originalID, err := models.GetIncomingDuplicate(rt.RP, channel, event.MsgID, string(event.MsgExternalID), event.URN, event.Text, event.Attachments)
+		if err != nil {
+			return err
+		}
+		if originalID != models.NilMsgID {
+			logrus.WithField("msg_id", event.MsgID).WithField("original_id", originalID).WithField("channel_uuid", channel.UUID()).Info("ignoring duplicate incoming message")
+
+			attachments := make([]utils.Attachment, len(event.Attachments))
+			for i, attURL := range event.Attachments {
+				attachments[i] = utils.Attachment(attURL)
+			}
+
+			err := models.MarkMessageHandled(ctx, rt.DB, event.MsgID, models.MsgStatusHandled, models.VisibilityVisible, models.NilFlowID, models.NilTicketID, attachments, nil)
+			if err != nil {
+				return errors.Wrapf(err, "error updating duplicate message")
+			}
+			return nil
+		}
+
+		// if handling this message fails, forget it so that a redelivery of it isn't ignored as a duplicate
+		defer func() {
+			if err != nil {
+				if err := models.ClearIncomingDuplicate(rt.RP, channel, event.MsgID, string(event.MsgExternalID), event.URN, event.Text, event.Attachments); err != nil {
+					logrus.WithError(err).WithField("msg_id", event.MsgID).Error("error clearing incoming msg for duplicate checking")
+				}
+			}
+		}()
+	}
+
 	// fetch the attachments on the message (i.e. ask courier to fetch them)
 	attachments := make([]utils.Attachment, 0, len(event.Attachments))
 	logUUIDs := make([]models.ChannelLogUUID, 0, len(event.Attachments))
@@ -397,6 +538,18 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 		}
 	}
 
+	// flow will only see the attachments we were able to fetch
+	availableAttachments := make([]utils.Attachment, 0, len(attachments))
+	for _, att := range attachments {
+		if att.ContentType() != utils.UnavailableType {
+			availableAttachments = append(availableAttachments, att)
+		}
+	}
+
+	msgIn := flows.NewMsgIn(event.MsgUUID, event.URN, channel.ChannelReference(), event.Text, availableAttachments)
+	msgIn.SetExternalID(string(event.MsgExternalID))
+	msgIn.SetID(flows.MsgID(event.MsgID))
+
 	// look up any open tickes for this contact and forward this message to that
 	ticket, err := models.LoadOpenTicketForContact(ctx, rt.DB, modelContact)
 	if err != nil {
@@ -406,6 +559,15 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 		ticket.ForwardIncoming(ctx, rt, oa, event.MsgUUID, event.Text, attachments)
 	}
 
+	// STOP and START keywords opt the URN out of or back in to messages on this channel, and take precedence over triggers
+	handled, err := handleConsentKeyword(ctx, rt, oa, channel, contact, msgIn)
+	if err != nil {
+		return errors.Wrapf(err, "error handling consent keyword")
+	}
+	if handled {
+		return markMsgHandled(ctx, rt.DB, contact, msgIn, nil, attachments, ticket, logUUIDs)
+	}
+
 	// find any matching triggers
 	trigger := models.FindMatchingMsgTrigger(oa, contact, event.Text)
 
@@ -431,18 +593,6 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 		}
 	}
 
-	// flow will only see the attachments we were able to fetch
-	availableAttachments := make([]utils.Attachment, 0, len(attachments))
-	for _, att := range attachments {
-		if att.ContentType() != utils.UnavailableType {
-			availableAttachments = append(availableAttachments, att)
-		}
-	}
-
-	msgIn := flows.NewMsgIn(event.MsgUUID, event.URN, channel.ChannelReference(), event.Text, availableAttachments)
-	msgIn.SetExternalID(string(event.MsgExternalID))
-	msgIn.SetID(flows.MsgID(event.MsgID))
-
 	// build our hook to mark a flow message as handled
 	flowMsgHook := func(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, sessions []*models.Session) error {
 		// set our incoming message event on our session
@@ -478,7 +628,10 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 			}
 
 			// otherwise build the trigger and start the flow directly
-			trigger := triggers.NewBuilder(oa.Env(), flow.Reference(), contact).Msg(msgIn).WithMatch(trigger.Match()).Build()
+			trigger, err := trigger.BuildMsgTrigger(oa, flow, contact, msgIn)
+			if err != nil {
+				return errors.Wrapf(err, "error building trigger for contact")
+			}
 			_, err = runner.StartFlowForContacts(ctx, rt, oa, flow, []*models.Contact{modelContact}, []flows.Trigger{trigger}, flowMsgHook, true)
 			if err != nil {
 				return errors.Wrapf(err, "error starting flow for contact")
@@ -609,7 +762,7 @@ func handleAsInbox(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAsset
 	contact.SetLastSeenOn(msgEvent.CreatedOn())
 	contactEvents := map[*flows.Contact][]flows.Event{contact: {msgEvent}}
 
-	err := models.HandleAndCommitEvents(ctx, rt, oa, models.NilUserID, contactEvents)
+	err := models.HandleAndCommitEvents(ctx, rt, oa, models.NilUserID, models.ContactChangeSourceSystem, contactEvents)
 	if err != nil {
 		return errors.Wrap(err, "error handling inbox message events")
 	}
@@ -617,6 +770,28 @@ func handleAsInbox(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAsset
 	return markMsgHandled(ctx, rt.DB, contact, msg, nil, attachments, ticket, logUUIDs)
 }
 
+// handleConsentKeyword checks whether the given message is a STOP or START keyword for the contact's language, and if
+// so opts the URN out of or back in to messages on the channel. START keywords are only handled if the URN is currently
+// opted out, so that they can still match triggers otherwise.
+func handleConsentKeyword(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, channel *models.Channel, contact *flows.Contact, msg *flows.MsgIn) (bool, error) {
+	keywords := models.ConsentKeywordsForLanguage(oa.Org(), contact.Language())
+	if keywords == nil {
+		return false, nil
+	}
+
+	keyword, optOut := keywords.Match(msg.Text())
+	if keyword == "" {
+		return false, nil
+	}
+
+	changed, err := models.RecordConsentChange(ctx, rt.DB, oa.OrgID(), models.ContactID(contact.ID()), channel, msg.URN(), optOut, keyword, msg.UUID())
+	if err != nil {
+		return false, err
+	}
+
+	return optOut || changed, nil
+}
+
 // utility to mark as message as handled and update any open contact tickets
 func markMsgHandled(ctx context.Context, db models.Queryer, contact *flows.Contact, msg *flows.MsgIn, flow *models.Flow, attachments []utils.Attachment, ticket *models.Ticket, logUUIDs []models.ChannelLogUUID) error {
 	flowID := models.NilFlowID
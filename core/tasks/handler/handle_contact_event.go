@@ -18,7 +18,7 @@ import (
 )
 
 // TypeHandleContactEvent is the task type for flagging that a contact has tasks to be handled
-const TypeHandleContactEvent = "handle_contact_event"
+const TypeHandleContactEvent = queue.TypeHandleContactEvent
 
 func init() {
 	tasks.RegisterType(TypeHandleContactEvent, func() tasks.Task { return &HandleContactEventTask{} })
@@ -123,6 +123,14 @@ func (t *HandleContactEventTask) Perform(ctx context.Context, rt *runtime.Runtim
 			}
 			err = handleTicketEvent(ctx, rt, evt)
 
+		case TriggerEventType:
+			evt := &models.TriggerEvent{}
+			err = json.Unmarshal(contactEvent.Task, evt)
+			if err != nil {
+				return errors.Wrapf(err, "error unmarshalling trigger event: %s", event)
+			}
+			err = handleTriggerEvent(ctx, rt, evt)
+
 		case TimeoutEventType, ExpirationEventType:
 			evt := &TimedEvent{}
 			err = json.Unmarshal(contactEvent.Task, evt)
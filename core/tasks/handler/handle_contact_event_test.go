@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/urns"
@@ -18,6 +19,7 @@ import (
 	"github.com/nyaruka/mailroom/core/tasks/handler"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/null/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -519,24 +521,34 @@ func TestStopEvent(t *testing.T) {
 	// and george to doctors group, cathy is already part of it
 	rt.DB.MustExec(`INSERT INTO contacts_contactgroup_contacts(contactgroup_id, contact_id) VALUES($1, $2);`, testdata.DoctorsGroup.ID, testdata.George.ID)
 
-	event := &handler.StopEvent{OrgID: testdata.Org1.ID, ContactID: testdata.Cathy.ID}
-	eventJSON, err := json.Marshal(event)
-	require.NoError(t, err)
-	task := &queue.Task{
-		Type:  handler.StopEventType,
-		OrgID: int(testdata.Org1.ID),
-		Task:  eventJSON,
-	}
+	// and a flow to start when contacts opt out
+	testdata.InsertOptOutTrigger(rt, testdata.Org1, testdata.Favorites)
 
-	err = handler.QueueHandleTask(rc, testdata.Cathy.ID, task)
-	assert.NoError(t, err, "error adding task")
+	handleStop := func(contactID models.ContactID) error {
+		event := &handler.StopEvent{OrgID: testdata.Org1.ID, ContactID: contactID}
+		eventJSON, err := json.Marshal(event)
+		require.NoError(t, err)
+		task := &queue.Task{
+			Type:  handler.StopEventType,
+			OrgID: int(testdata.Org1.ID),
+			Task:  eventJSON,
+		}
 
-	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
-	assert.NoError(t, err, "error popping next task")
+		err = handler.QueueHandleTask(rc, contactID, task)
+		assert.NoError(t, err, "error adding task")
 
-	err = tasks.Perform(ctx, rt, task)
+		task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+		assert.NoError(t, err, "error popping next task")
+
+		return tasks.Perform(ctx, rt, task)
+	}
+
+	err := handleStop(testdata.Cathy.ID)
 	assert.NoError(t, err, "error when handling event")
 
+	// the opt-out flow was started before cathy was stopped so its message wasn't failed
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND text = 'What is your favorite color?'`, testdata.Cathy.ID).Returns("Q")
+
 	// check that only george is in our group
 	assertdb.Query(t, rt.DB, `SELECT count(*) from contacts_contactgroup_contacts WHERE contactgroup_id = $1 AND contact_id = $2`, testdata.DoctorsGroup.ID, testdata.Cathy.ID).Returns(0)
 	assertdb.Query(t, rt.DB, `SELECT count(*) from contacts_contactgroup_contacts WHERE contactgroup_id = $1 AND contact_id = $2`, testdata.DoctorsGroup.ID, testdata.George.ID).Returns(1)
@@ -547,6 +559,146 @@ func TestStopEvent(t *testing.T) {
 	// and has no upcoming events
 	assertdb.Query(t, rt.DB, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1`, testdata.Cathy.ID).Returns(0)
 	assertdb.Query(t, rt.DB, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1`, testdata.George.ID).Returns(1)
+
+	// a stop event for a contact which has since been deleted is ignored
+	rt.DB.MustExec(`UPDATE contacts_contact SET is_active = FALSE WHERE id = $1`, testdata.Bob.ID)
+
+	err = handleStop(testdata.Bob.ID)
+	assert.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O'`, testdata.Bob.ID).Returns(0)
+}
+
+func TestConsentKeywords(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	rt.DB.MustExec(`UPDATE orgs_org SET config = config || '{"consent_keywords": {"eng": {"stop": ["stop"], "start": ["start"]}}}'::jsonb, flow_languages = '{"eng"}' WHERE id = $1`, testdata.Org1.ID)
+
+	testdata.InsertKeywordTrigger(rt, testdata.Org1, testdata.Favorites, "start", models.MatchOnly, nil, nil)
+
+	handleMsg := func(text string) *flows.MsgIn {
+		msg := testdata.InsertIncomingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, text, models.MsgStatusPending)
+
+		task := &queue.Task{Type: handler.MsgEventType, OrgID: int(testdata.Org1.ID), Task: jsonx.MustMarshal(&handler.MsgEvent{
+			ContactID: testdata.Cathy.ID,
+			OrgID:     testdata.Org1.ID,
+			ChannelID: testdata.TwilioChannel.ID,
+			MsgID:     models.MsgID(msg.ID()),
+			MsgUUID:   msg.UUID(),
+			URN:       testdata.Cathy.URN,
+			URNID:     testdata.Cathy.URNID,
+			Text:      text,
+		})}
+
+		err := handler.QueueHandleTask(rc, testdata.Cathy.ID, task)
+		require.NoError(t, err)
+
+		task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+		require.NoError(t, err)
+
+		err = tasks.Perform(ctx, rt, task)
+		require.NoError(t, err)
+
+		return msg
+	}
+
+	// STOP opts Cathy's URN out of messages on the channel without starting any flows
+	msg := handleMsg("Stop")
+
+	assertdb.Query(t, rt.DB, `SELECT status, flow_id FROM msgs_msg WHERE id = $1`, msg.ID()).Columns(map[string]any{"status": "H", "flow_id": nil})
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactaudit WHERE contact_id = $1 AND event_type = 'consent_changed'`, testdata.Cathy.ID).Returns(1)
+
+	oa := testdata.Org1.Load(rt)
+	optedOut, err := models.IsOptedOut(ctx, rt.DB, oa.ChannelByID(testdata.TwilioChannel.ID), testdata.Cathy.URN)
+	require.NoError(t, err)
+	assert.True(t, optedOut)
+
+	// START opts it back in, and takes precedence over the keyword trigger
+	msg = handleMsg("start")
+
+	assertdb.Query(t, rt.DB, `SELECT status, flow_id FROM msgs_msg WHERE id = $1`, msg.ID()).Columns(map[string]any{"status": "H", "flow_id": nil})
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactaudit WHERE contact_id = $1 AND event_type = 'consent_changed'`, testdata.Cathy.ID).Returns(2)
+
+	// but when the URN isn't opted out, START is left to match triggers
+	msg = handleMsg("start")
+
+	assertdb.Query(t, rt.DB, `SELECT flow_id FROM msgs_msg WHERE id = $1`, msg.ID()).Returns(int64(testdata.Favorites.ID))
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM contacts_contactaudit WHERE contact_id = $1 AND event_type = 'consent_changed'`, testdata.Cathy.ID).Returns(2)
+}
+
+func TestDuplicateMsgEvents(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	testdata.InsertKeywordTrigger(rt, testdata.Org1, testdata.Favorites, "start", models.MatchOnly, nil, nil)
+
+	// twitter channel opts in to checking for duplicates by content
+	rt.DB.MustExec(`UPDATE channels_channel SET config = config || '{"dedupe_by_content": true}'::jsonb WHERE id = $1`, testdata.TwitterChannel.ID)
+	models.FlushCache()
+
+	handleMsg := func(channel *testdata.Channel, text, externalID string) *flows.MsgIn {
+		msg := testdata.InsertIncomingMsg(rt, testdata.Org1, channel, testdata.Cathy, text, models.MsgStatusPending)
+
+		task := &queue.Task{Type: handler.MsgEventType, OrgID: int(testdata.Org1.ID), Task: jsonx.MustMarshal(&handler.MsgEvent{
+			ContactID:     testdata.Cathy.ID,
+			OrgID:         testdata.Org1.ID,
+			ChannelID:     channel.ID,
+			MsgID:         models.MsgID(msg.ID()),
+			MsgUUID:       msg.UUID(),
+			MsgExternalID: null.String(externalID),
+			URN:           testdata.Cathy.URN,
+			URNID:         testdata.Cathy.URNID,
+			Text:          text,
+		})}
+
+		err := handler.QueueHandleTask(rc, testdata.Cathy.ID, task)
+		require.NoError(t, err)
+
+		task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+		require.NoError(t, err)
+
+		err = tasks.Perform(ctx, rt, task)
+		require.NoError(t, err)
+
+		return msg
+	}
+
+	msg1 := handleMsg(testdata.TwitterChannel, "start", "EX123")
+	msg2 := handleMsg(testdata.TwitterChannel, "start", "EX123") // redelivery with same external ID
+	msg3 := handleMsg(testdata.TwitterChannel, "red", "")
+	msg4 := handleMsg(testdata.TwitterChannel, "red", "") // redelivery with same content and no external ID
+	msg5 := handleMsg(testdata.TwitterChannel, "red", "EX456")
+	msg6 := handleMsg(testdata.TwilioChannel, "start", "")
+	msg7 := handleMsg(testdata.TwilioChannel, "start", "") // same content but channel hasn't opted in
+
+	// only the first of each is handled by the flow
+	assertdb.Query(t, rt.DB, `SELECT flow_id FROM msgs_msg WHERE id = $1`, msg1.ID()).Returns(int64(testdata.Favorites.ID))
+	assertdb.Query(t, rt.DB, `SELECT flow_id FROM msgs_msg WHERE id = $1`, msg3.ID()).Returns(int64(testdata.Favorites.ID))
+	assertdb.Query(t, rt.DB, `SELECT flow_id FROM msgs_msg WHERE id = $1`, msg5.ID()).Returns(int64(testdata.Favorites.ID))
+	assertdb.Query(t, rt.DB, `SELECT flow_id FROM msgs_msg WHERE id = $1`, msg6.ID()).Returns(int64(testdata.Favorites.ID))
+	assertdb.Query(t, rt.DB, `SELECT flow_id FROM msgs_msg WHERE id = $1`, msg7.ID()).Returns(int64(testdata.Favorites.ID))
+
+	// duplicates are marked as handled but left visible
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE id = ANY($1) AND status = 'H' AND visibility = 'V' AND flow_id IS NULL`, pq.Array([]models.MsgID{models.MsgID(msg2.ID()), models.MsgID(msg4.ID())})).Returns(2)
+
+	// and don't generate any replies
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O'`, testdata.Cathy.ID).Returns(5)
+
+	// and are counted until the count is reported
+	count, err := models.PopIncomingDuplicateCount(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = models.PopIncomingDuplicateCount(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
 }
 
 func TestTimedEvents(t *testing.T) {
@@ -1,7 +1,6 @@
 package handler
 
 import (
-	"encoding/json"
 	"fmt"
 
 	"github.com/gomodule/redigo/redis"
@@ -9,7 +8,6 @@ import (
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
-	"github.com/nyaruka/mailroom/core/tasks"
 	"github.com/pkg/errors"
 )
 
@@ -36,31 +34,23 @@ func QueueTicketEvent(rc redis.Conn, contactID models.ContactID, evt *models.Tic
 	return queueHandleTask(rc, contactID, task, false)
 }
 
-// queueHandleTask queues a single task for the passed in contact. `front` specifies whether the task
-// should be inserted in front of all other tasks for that contact
-func queueHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task, front bool) error {
-	// marshal our task
-	taskJSON, err := json.Marshal(task)
-	if err != nil {
-		return errors.Wrapf(err, "error marshalling contact task")
-	}
-
-	// first push the event on our contact queue
-	contactQ := fmt.Sprintf("c:%d:%d", task.OrgID, contactID)
-	if front {
-		_, err = redis.Int64(rc.Do("lpush", contactQ, string(taskJSON)))
+// ClearContactQueue removes all pending tasks for the given contact, returning how many were removed
+func ClearContactQueue(rc redis.Conn, orgID models.OrgID, contactID models.ContactID) (int, error) {
+	contactQ := fmt.Sprintf("c:%d:%d", orgID, contactID)
 
-	} else {
-		_, err = redis.Int64(rc.Do("rpush", contactQ, string(taskJSON)))
-	}
+	rc.Send("MULTI")
+	rc.Send("LLEN", contactQ)
+	rc.Send("DEL", contactQ)
+	res, err := redis.Values(rc.Do("EXEC"))
 	if err != nil {
-		return errors.Wrapf(err, "error adding contact event")
+		return 0, errors.Wrapf(err, "error clearing contact queue")
 	}
 
-	// then add a handle task for that contact on our global handler queue to
-	err = tasks.Queue(rc, queue.HandlerQueue, models.OrgID(task.OrgID), &HandleContactEventTask{ContactID: contactID}, queue.DefaultPriority)
-	if err != nil {
-		return errors.Wrapf(err, "error adding handle event task")
-	}
-	return nil
+	return redis.Int(res[0], nil)
+}
+
+// queueHandleTask queues a single task for the passed in contact. `front` specifies whether the task
+// should be inserted in front of all other tasks for that contact
+func queueHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task, front bool) error {
+	return queue.AddContactTask(rc, task.OrgID, int(contactID), task, front)
 }
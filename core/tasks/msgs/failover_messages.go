@@ -0,0 +1,144 @@
+package msgs
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/msgio"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	mailroom.RegisterCron("failover_messages", time.Second*60, false, FailoverMessages)
+}
+
+// FailoverMessages looks for outgoing messages which have failed permanently on a channel or in an org with failover
+// enabled (i.e. "failover": true in the channel or org config), and if the contact has another URN with a channel
+// that can send to it, creates a copy of the message on that channel.
+func FailoverMessages(ctx context.Context, rt *runtime.Runtime) error {
+	start := time.Now()
+
+	msgs, err := models.GetMessagesForFailover(ctx, rt.DB)
+	if err != nil {
+		return errors.Wrap(err, "error fetching failed messages to failover")
+	}
+	if len(msgs) == 0 {
+		return nil // nothing to failover
+	}
+
+	// organize messages by org
+	msgsByOrg := make(map[models.OrgID][]*models.Msg)
+	for _, m := range msgs {
+		msgsByOrg[m.OrgID()] = append(msgsByOrg[m.OrgID()], m)
+	}
+
+	copies := make([]*models.Msg, 0, len(msgs))
+	failovers := make([]*models.MsgFailover, 0, len(msgs))
+	copyFailovers := make([]*models.MsgFailover, 0, len(msgs))
+
+	for orgID, orgMsgs := range msgsByOrg {
+		orgCopies, err := createFailoverMsgs(ctx, rt, orgID, orgMsgs)
+		if err != nil {
+			return errors.Wrapf(err, "error creating failover messages for org #%d", orgID)
+		}
+
+		for i, m := range orgMsgs {
+			failover := &models.MsgFailover{MsgID: models.MsgID(m.ID()), Reason: m.FailedReason()}
+			if orgCopies[i] != nil {
+				copies = append(copies, orgCopies[i])
+				copyFailovers = append(copyFailovers, failover)
+			}
+			failovers = append(failovers, failover)
+		}
+	}
+
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting transaction")
+	}
+
+	if err := models.InsertMessages(ctx, tx, copies); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "error inserting failover messages")
+	}
+
+	// now that copies have IDs, record them on the original messages
+	for i, c := range copies {
+		copyID := models.MsgID(c.ID())
+		copyFailovers[i].FailoverID = &copyID
+	}
+
+	if err := models.RecordMsgFailovers(ctx, tx, failovers); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "error recording msg failovers")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "error committing failover messages")
+	}
+
+	msgio.SendMessages(ctx, rt, rt.DB, copies)
+
+	logrus.WithField("failed", len(msgs)).WithField("failovers", len(copies)).WithField("elapsed", time.Since(start)).Info("failed over messages")
+
+	return nil
+}
+
+// creates failover copies of the given failed messages, with nil for messages which have nowhere to failover to
+func createFailoverMsgs(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID, msgs []*models.Msg) ([]*models.Msg, error) {
+	oa, err := models.GetOrgAssets(ctx, rt, orgID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading org assets")
+	}
+
+	contactIDs := make([]models.ContactID, len(msgs))
+	for i, m := range msgs {
+		contactIDs[i] = m.ContactID()
+	}
+
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, contactIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading contacts")
+	}
+
+	flowContacts := make(map[models.ContactID]*flows.Contact, len(contacts))
+	for _, c := range contacts {
+		fc, err := c.FlowContact(oa)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating flow contact for contact #%d", c.ID())
+		}
+		flowContacts[c.ID()] = fc
+	}
+
+	copies := make([]*models.Msg, len(msgs))
+
+	for i, m := range msgs {
+		contact := flowContacts[m.ContactID()]
+		if contact == nil {
+			continue
+		}
+
+		// look for a destination with a different URN and a different channel to the original
+		for _, dest := range contact.ResolveDestinations(true) {
+			channel := oa.ChannelByUUID(dest.Channel.UUID())
+			if dest.URN.URN().Identity() == m.URN().Identity() || channel == nil || channel.ID() == m.ChannelID() {
+				continue
+			}
+
+			out := flows.NewMsgOut(dest.URN.URN(), dest.Channel.Reference(), m.Text(), m.Attachments(), m.QuickReplies(), nil, flows.NilMsgTopic, m.Locale(), flows.NilUnsendableReason)
+
+			copies[i], err = models.NewFailoverMsg(rt, oa.Org(), channel, contact, out, m)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error creating failover of msg #%d", m.ID())
+			}
+			break
+		}
+	}
+
+	return copies, nil
+}
@@ -0,0 +1,65 @@
+package msgs_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/msgs"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverMessages(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// give Cathy a twitter URN as well as her phone number
+	testdata.InsertContactURN(rt, testdata.Org1, testdata.Cathy, urns.URN("twitter:cathy"), 500)
+
+	msg1 := testdata.InsertOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", nil, models.MsgStatusFailed, false)
+	msg2 := testdata.InsertOutgoingMsg(rt, testdata.Org1, testdata.VonageChannel, testdata.Bob, "Hi", nil, models.MsgStatusFailed, false)
+	rt.DB.MustExec(`UPDATE msgs_msg SET failed_reason = 'E' WHERE id IN ($1, $2)`, msg1.ID(), msg2.ID())
+
+	// failover isn't enabled so nothing happens
+	err := msgs.FailoverMessages(ctx, rt)
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE direction = 'O' AND channel_id = $1`, testdata.TwitterChannel.ID).Returns(0)
+
+	// enable failover on the org
+	rt.DB.MustExec(`UPDATE orgs_org SET config = config || '{"failover": true}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+
+	err = msgs.FailoverMessages(ctx, rt)
+	require.NoError(t, err)
+
+	// Cathy's message is copied to her twitter URN
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE direction = 'O' AND channel_id = $1 AND text = 'Hi' AND status = 'Q' AND metadata::jsonb->>'failover_of' = $2::text`, testdata.TwitterChannel.ID, msg1.ID()).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT metadata::jsonb->'failover'->>'reason' FROM msgs_msg WHERE id = $1`, msg1.ID()).Returns("E")
+	assertdb.Query(t, rt.DB, `SELECT (metadata::jsonb->'failover'->>'msg_id')::bigint = (SELECT id FROM msgs_msg WHERE channel_id = $2) FROM msgs_msg WHERE id = $1`, msg1.ID(), testdata.TwitterChannel.ID).Returns(true)
+
+	// Bob has nowhere else to failover to but that's still recorded
+	assertdb.Query(t, rt.DB, `SELECT metadata::jsonb->'failover'->>'reason' FROM msgs_msg WHERE id = $1`, msg2.ID()).Returns("E")
+	assertdb.Query(t, rt.DB, `SELECT metadata::jsonb->'failover'->'msg_id' = 'null'::jsonb FROM msgs_msg WHERE id = $1`, msg2.ID()).Returns(true)
+
+	// messages aren't failed over again
+	err = msgs.FailoverMessages(ctx, rt)
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE direction = 'O' AND channel_id = $1`, testdata.TwitterChannel.ID).Returns(1)
+
+	// failover can be disabled on a channel even if it's enabled on the org
+	rt.DB.MustExec(`UPDATE channels_channel SET config = config || '{"failover": false}'::jsonb WHERE id = $1`, testdata.TwilioChannel.ID)
+
+	msg3 := testdata.InsertOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Bye", nil, models.MsgStatusFailed, false)
+	rt.DB.MustExec(`UPDATE msgs_msg SET failed_reason = 'E' WHERE id = $1`, msg3.ID())
+
+	err = msgs.FailoverMessages(ctx, rt)
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE direction = 'O' AND channel_id = $1`, testdata.TwitterChannel.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT metadata IS NULL FROM msgs_msg WHERE id = $1`, msg3.ID()).Returns(true)
+}
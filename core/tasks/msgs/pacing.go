@@ -0,0 +1,169 @@
+package msgs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	pacingChannelKey    = "broadcast_pacing:%s"
+	pacingCompletionKey = "broadcast_completion:%d"
+	pacedBatchesKey     = "paced_broadcast_batches"
+	pacingTTL           = time.Hour * 24 * 7
+)
+
+// PacingWindow is how far ahead of now a broadcast batch can be scheduled to be released and still be sent straight
+// away, with courier pacing its messages within that window
+var PacingWindow = time.Minute
+
+func init() {
+	mailroom.RegisterCron("release_paced_broadcasts", time.Second*10, false, ReleasePacedBroadcasts)
+}
+
+var reserveCapacityScript = redis.NewScript(2, `
+-- KEYS: [ChannelKey, CompletionKey]
+-- ARGV: [Now, Duration, TTL]
+local now, duration, ttl = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+
+-- broadcast capacity on the channel is next free at the later of now and the end of the last reservation
+local start = tonumber(redis.call("GET", KEYS[1]) or "0")
+if start < now then
+  start = now
+end
+local finish = start + duration
+redis.call("SET", KEYS[1], tostring(finish), "EX", ttl)
+
+-- and the broadcast will complete no earlier than the end of this reservation
+if KEYS[2] ~= "" then
+  local completion = tonumber(redis.call("GET", KEYS[2]) or "0")
+  if finish > completion then
+    redis.call("SET", KEYS[2], tostring(finish), "EX", ttl)
+  end
+end
+
+return tostring(start)
+`)
+
+// reserves broadcast capacity on each channel for the given number of messages, returning when the batch can be
+// released, which is when capacity is available on all of its channels
+func reserveBroadcastCapacity(rc redis.Conn, rt *runtime.Runtime, broadcastID models.BroadcastID, counts map[*models.Channel]int, now time.Time) (time.Time, error) {
+	release := now
+
+	completionKey := ""
+	if broadcastID != models.NilBroadcastID {
+		completionKey = fmt.Sprintf(pacingCompletionKey, broadcastID)
+	}
+
+	for ch, count := range counts {
+		// android channels send via the relayer so aren't paced
+		if ch.Type() == models.ChannelTypeAndroid || ch.TPS() <= 0 {
+			continue
+		}
+
+		// broadcasts only get a share of the channel's capacity so flow and ticket messages aren't held up
+		rate := float64(ch.TPS()) * rt.Config.BroadcastTPSShare
+		duration := float64(count) / rate
+
+		value, err := redis.String(reserveCapacityScript.Do(rc, fmt.Sprintf(pacingChannelKey, ch.UUID()), completionKey, epochSeconds(now), duration, int(pacingTTL/time.Second)))
+		if err != nil {
+			return now, errors.Wrapf(err, "error reserving broadcast capacity on channel %s", ch.UUID())
+		}
+
+		start, _ := strconv.ParseFloat(value, 64)
+		if startTime := fromEpochSeconds(start); startTime.After(release) {
+			release = startTime
+		}
+	}
+
+	return release, nil
+}
+
+// a broadcast batch waiting to be released
+type pacedBatch struct {
+	OrgID models.OrgID           `json:"org_id"`
+	Batch *models.BroadcastBatch `json:"batch"`
+}
+
+// defers the given broadcast batch until its release time
+func deferBroadcastBatch(rc redis.Conn, orgID models.OrgID, batch *models.BroadcastBatch, release time.Time) error {
+	member := jsonx.MustMarshal(&pacedBatch{OrgID: orgID, Batch: batch})
+
+	_, err := rc.Do("ZADD", pacedBatchesKey, epochSeconds(release), member)
+	return errors.Wrap(err, "error deferring broadcast batch")
+}
+
+// ReleasePacedBroadcasts queues broadcast batches whose release time has been reached
+func ReleasePacedBroadcasts(ctx context.Context, rt *runtime.Runtime) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	start := time.Now()
+
+	members, err := redis.ByteSlices(rc.Do("ZRANGEBYSCORE", pacedBatchesKey, "-inf", epochSeconds(start), "LIMIT", 0, 1000))
+	if err != nil {
+		return errors.Wrap(err, "error fetching paced broadcast batches")
+	}
+
+	for _, member := range members {
+		paced := &pacedBatch{}
+		if err := jsonx.Unmarshal(member, paced); err != nil {
+			logrus.WithError(err).Error("error unmarshaling paced broadcast batch")
+		} else {
+			task := &SendBroadcastBatchTask{BroadcastBatch: paced.Batch, Paced: true}
+
+			if err := tasks.Queue(rc, queue.BatchQueue, paced.OrgID, task, queue.DefaultPriority); err != nil {
+				return errors.Wrap(err, "error queuing paced broadcast batch")
+			}
+		}
+
+		if _, err := rc.Do("ZREM", pacedBatchesKey, member); err != nil {
+			return errors.Wrap(err, "error removing paced broadcast batch")
+		}
+	}
+
+	if len(members) > 0 {
+		logrus.WithField("count", len(members)).WithField("elapsed", time.Since(start)).Info("released paced broadcast batches")
+	}
+
+	return nil
+}
+
+// GetBroadcastProjectedCompletion gets the time when all the messages of the given broadcast are projected to have
+// been released, returning nil if the broadcast hasn't been paced
+func GetBroadcastProjectedCompletion(rc redis.Conn, broadcastID models.BroadcastID) (*time.Time, error) {
+	value, err := redis.String(rc.Do("GET", fmt.Sprintf(pacingCompletionKey, broadcastID)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading broadcast projected completion")
+	}
+
+	secs, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing broadcast projected completion")
+	}
+
+	completion := fromEpochSeconds(secs)
+	return &completion, nil
+}
+
+func epochSeconds(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMicro())/1000000, 'f', 6, 64)
+}
+
+func fromEpochSeconds(secs float64) time.Time {
+	return time.UnixMicro(int64(secs * 1000000)).UTC()
+}
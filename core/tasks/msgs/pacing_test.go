@@ -0,0 +1,88 @@
+package msgs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/core/tasks/msgs"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroadcastPacing(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	// only allow batches to be sent straight away if capacity is available now
+	defer func(w time.Duration) { msgs.PacingWindow = w }(msgs.PacingWindow)
+	msgs.PacingWindow = 0
+
+	bcastID := testdata.InsertBroadcast(rt, testdata.Org1, "eng", map[envs.Language]string{"eng": "hello"}, models.NilScheduleID, nil, nil)
+
+	bcast := models.NewBroadcast(testdata.Org1.ID, flows.BroadcastTranslations{"eng": {Text: "hello"}}, models.TemplateStateEvaluated, "eng", nil, nil, nil, "", models.NilUserID)
+	bcast.ID = bcastID
+
+	// first batch goes out straight away
+	task1 := &msgs.SendBroadcastBatchTask{BroadcastBatch: bcast.CreateBatch([]models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, false)}
+	err := task1.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE broadcast_id = $1`, bcastID).Returns(2)
+
+	completion, err := msgs.GetBroadcastProjectedCompletion(rc, bcastID)
+	assert.NoError(t, err)
+	assert.NotNil(t, completion)
+
+	// second batch has to wait for capacity on the channel so is deferred, and broadcast isn't marked as sent
+	task2 := &msgs.SendBroadcastBatchTask{BroadcastBatch: bcast.CreateBatch([]models.ContactID{testdata.Cathy.ID}, true)}
+	err = task2.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE broadcast_id = $1`, bcastID).Returns(2)
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_broadcast WHERE id = $1`, bcastID).Returns("P")
+
+	// projected completion has moved later
+	completion2, err := msgs.GetBroadcastProjectedCompletion(rc, bcastID)
+	assert.NoError(t, err)
+	assert.True(t, completion2.After(*completion))
+
+	// nothing to release until its release time
+	err = msgs.ReleasePacedBroadcasts(ctx, rt)
+	require.NoError(t, err)
+
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	time.Sleep(time.Until(*completion) + time.Millisecond*50)
+
+	err = msgs.ReleasePacedBroadcasts(ctx, rt)
+	require.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, msgs.TypeSendBroadcastBatch, task.Type)
+
+	// when released batch is performed, it isn't paced again
+	released, err := tasks.ReadTask(task.Type, task.Task)
+	require.NoError(t, err)
+	assert.True(t, released.(*msgs.SendBroadcastBatchTask).Paced)
+
+	err = released.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE broadcast_id = $1`, bcastID).Returns(3)
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_broadcast WHERE id = $1`, bcastID).Returns("S")
+}
@@ -2,8 +2,10 @@ package msgs
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	"github.com/nyaruka/gocommon/analytics"
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/msgio"
@@ -16,12 +18,18 @@ func init() {
 	mailroom.RegisterCron("retry_errored_messages", time.Second*60, false, RetryErroredMessages)
 }
 
+// RetryErroredMessages retries errored messages according to the retry policies of their channels. Messages which
+// have exhausted their policy are failed, and messages which aren't yet due according to it are rescheduled.
 func RetryErroredMessages(ctx context.Context, rt *runtime.Runtime) error {
 	rc := rt.RP.Get()
 	defer rc.Close()
 
 	start := time.Now()
 
+	if err := reportRetryBacklog(ctx, rt); err != nil {
+		return err
+	}
+
 	msgs, err := models.GetMessagesForRetry(ctx, rt.DB)
 	if err != nil {
 		return errors.Wrap(err, "error fetching errored messages to retry")
@@ -30,14 +38,98 @@ func RetryErroredMessages(ctx context.Context, rt *runtime.Runtime) error {
 		return nil // nothing to retry
 	}
 
-	err = models.MarkMessagesQueued(ctx, rt.DB, msgs)
+	retries, reschedules, nextAttempts, fails, err := applyRetryPolicies(ctx, rt, msgs, start)
+	if err != nil {
+		return err
+	}
+
+	for reason, failMsgs := range fails {
+		if err := models.FailMessages(ctx, rt.DB, failMsgs, reason); err != nil {
+			return errors.Wrap(err, "error failing messages")
+		}
+	}
+
+	if len(reschedules) > 0 {
+		if err := models.RescheduleErroredMessages(ctx, rt.DB, reschedules, nextAttempts); err != nil {
+			return errors.Wrap(err, "error rescheduling messages")
+		}
+	}
+
+	if len(retries) > 0 {
+		err = models.MarkMessagesQueued(ctx, rt.DB, retries)
+		if err != nil {
+			return errors.Wrap(err, "error marking messages as queued")
+		}
+
+		msgio.SendMessages(ctx, rt, rt.DB, retries)
+	}
+
+	logrus.WithField("retried", len(retries)).WithField("rescheduled", len(reschedules)).WithField("failed", len(msgs)-len(retries)-len(reschedules)).WithField("elapsed", time.Since(start)).Info("retried errored messages")
+
+	return nil
+}
+
+// sorts the given messages into those to be retried now, those to be rescheduled and those to be failed
+func applyRetryPolicies(ctx context.Context, rt *runtime.Runtime, msgs []*models.Msg, now time.Time) ([]*models.Msg, []*models.Msg, []time.Time, map[models.MsgFailedReason][]*models.Msg, error) {
+	channelIDs := make([]models.ChannelID, 0, 10)
+	seen := make(map[models.ChannelID]bool)
+	for _, m := range msgs {
+		if !seen[m.ChannelID()] {
+			channelIDs = append(channelIDs, m.ChannelID())
+			seen[m.ChannelID()] = true
+		}
+	}
+
+	channels, err := models.GetChannelsByID(ctx, rt.DB, channelIDs)
 	if err != nil {
-		return errors.Wrap(err, "error marking messages as queued")
+		return nil, nil, nil, nil, errors.Wrap(err, "error loading channels")
+	}
+
+	policies := make(map[models.ChannelID]*models.RetryPolicy, len(channels))
+	for _, ch := range channels {
+		policies[ch.ID()] = models.RetryPolicyForChannel(ch)
 	}
 
-	msgio.SendMessages(ctx, rt, rt.DB, nil, msgs)
+	retries := make([]*models.Msg, 0, len(msgs))
+	reschedules := make([]*models.Msg, 0)
+	nextAttempts := make([]time.Time, 0)
+	fails := make(map[models.MsgFailedReason][]*models.Msg)
+
+	for _, m := range msgs {
+		policy := policies[m.ChannelID()]
 
-	logrus.WithField("count", len(msgs)).WithField("elapsed", time.Since(start)).Info("retried errored messages")
+		// messages which failed to queue, rather than errored on the channel, are always retried
+		if m.Status() != models.MsgStatusErrored || policy == nil {
+			retries = append(retries, m)
+			continue
+		}
+
+		if reason := policy.FailedReason(m.ErrorCount(), m.CreatedOn(), now); reason != models.NilMsgFailedReason {
+			fails[reason] = append(fails[reason], m)
+		} else if nextAttempt := policy.NextAttempt(m.ErrorCount(), m.ModifiedOn()); nextAttempt.After(now) {
+			reschedules = append(reschedules, m)
+			nextAttempts = append(nextAttempts, nextAttempt)
+		} else {
+			retries = append(retries, m)
+		}
+	}
+
+	return retries, reschedules, nextAttempts, fails, nil
+}
+
+// reports the number of errored messages waiting to be retried on each type of channel
+func reportRetryBacklog(ctx context.Context, rt *runtime.Runtime) error {
+	backlog, err := models.GetRetryBacklog(ctx, rt.DB)
+	if err != nil {
+		return errors.Wrap(err, "error fetching retry backlog")
+	}
+
+	total := 0
+	for channelType, count := range backlog {
+		analytics.Gauge(fmt.Sprintf("mr.retry_backlog.%s", channelType), float64(count))
+		total += count
+	}
+	analytics.Gauge("mr.retry_backlog", float64(total))
 
 	return nil
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/nyaruka/mailroom/core/tasks/msgs"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,8 +40,15 @@ func TestRetryErroredMessages(t *testing.T) {
 
 	rt.DB.MustExec(`UPDATE msgs_msg SET status = 'I' WHERE id = $1`, msg5.ID())
 
+	// an errored message to a URN which has since opted out (should be failed)
+	msg7 := testdata.InsertErroredOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Alexandria, "Hi", 1, time.Now().Add(-time.Hour), false)
+	rt.DB.MustExec(`INSERT INTO msgs_optout(org_id, channel_id, urn_identity, created_on) VALUES($1, $2, $3, NOW())`, testdata.Org1.ID, testdata.TwilioChannel.ID, testdata.Alexandria.URN.Identity())
+
+	// make sure the default retry policy backoff has elapsed since they errored
+	rt.DB.MustExec(`UPDATE msgs_msg SET modified_on = NOW() - INTERVAL '1 day' WHERE status IN ('E', 'I')`)
+
 	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE status = 'I'`).Returns(1)
-	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE status = 'E'`).Returns(4)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE status = 'E'`).Returns(5)
 
 	// try again...
 	err = msgs.RetryErroredMessages(ctx, rt)
@@ -49,6 +57,7 @@ func TestRetryErroredMessages(t *testing.T) {
 	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE status = 'D'`).Returns(1)
 	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE status = 'E'`).Returns(1)
 	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE status = 'Q'`).Returns(4)
+	assertdb.Query(t, rt.DB, `SELECT failed_reason FROM msgs_msg WHERE id = $1 AND status = 'F'`, msg7.ID()).Returns("P")
 
 	testsuite.AssertCourierQueues(t, map[string][]int{
 		"msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/0": {1}, // twilio, bulk priority
@@ -56,3 +65,49 @@ func TestRetryErroredMessages(t *testing.T) {
 		"msgs:19012bfd-3ce3-4cae-9bb9-76cf92c73d49|10/1": {1}, // vonage, high priority
 	})
 }
+
+func TestRetryPolicies(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	// on Twilio allow 5 errors with a fixed backoff of 10 minutes and give up after a day
+	rt.DB.MustExec(`UPDATE channels_channel SET config = config || '{"retry_max_errors": 5, "retry_backoff": 600, "retry_backoff_factor": 1, "retry_give_up": 86400}'::jsonb WHERE id = $1`, testdata.TwilioChannel.ID)
+
+	// errored messages that courier would retry now
+	msg1 := testdata.InsertErroredOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", 4, time.Now().Add(-time.Minute), false)
+	msg2 := testdata.InsertErroredOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", 5, time.Now().Add(-time.Minute), false)
+	msg3 := testdata.InsertErroredOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", 1, time.Now().Add(-time.Minute), false)
+	msg4 := testdata.InsertErroredOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", 1, time.Now().Add(-time.Minute), false)
+	msg5 := testdata.InsertErroredOutgoingMsg(rt, testdata.Org1, testdata.VonageChannel, testdata.Bob, "Hi", 3, time.Now().Add(-time.Minute), false)
+
+	rt.DB.MustExec(`UPDATE msgs_msg SET modified_on = NOW() - INTERVAL '15 minutes' WHERE id IN ($1, $2, $3, $4)`, msg1.ID(), msg2.ID(), msg3.ID(), msg5.ID())
+	rt.DB.MustExec(`UPDATE msgs_msg SET modified_on = NOW() - INTERVAL '5 minutes' WHERE id = $1`, msg4.ID())
+	rt.DB.MustExec(`UPDATE msgs_msg SET created_on = NOW() - INTERVAL '2 days' WHERE id = $1`, msg3.ID())
+
+	err := msgs.RetryErroredMessages(ctx, rt)
+	require.NoError(t, err)
+
+	// under max errors and backoff has elapsed
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_msg WHERE id = $1`, msg1.ID()).Returns("Q")
+
+	// reached max errors
+	assertdb.Query(t, rt.DB, `SELECT failed_reason FROM msgs_msg WHERE id = $1 AND status = 'F'`, msg2.ID()).Returns("E")
+
+	// older than give up window
+	assertdb.Query(t, rt.DB, `SELECT failed_reason FROM msgs_msg WHERE id = $1 AND status = 'F'`, msg3.ID()).Returns("O")
+
+	// backoff hasn't elapsed so rescheduled for 10 minutes after it errored
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_msg WHERE id = $1 AND next_attempt > NOW() + INTERVAL '4 minutes'`, msg4.ID()).Returns("E")
+
+	// default policy for Vonage fails after 3 errors
+	assertdb.Query(t, rt.DB, `SELECT failed_reason FROM msgs_msg WHERE id = $1 AND status = 'F'`, msg5.ID()).Returns("E")
+
+	backlog, err := models.GetRetryBacklog(ctx, rt.DB)
+	require.NoError(t, err)
+	assert.Equal(t, 1, backlog[testdata.TwilioChannel.Type])
+
+	// channel types with nothing waiting are still reported so their gauges drop back to zero
+	assert.Contains(t, backlog, testdata.VonageChannel.Type)
+	assert.Equal(t, 0, backlog[testdata.VonageChannel.Type])
+}
@@ -2,8 +2,10 @@ package msgs
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/goflow/contactql"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
@@ -19,6 +21,9 @@ const (
 	TypeSendBroadcast = "send_broadcast"
 
 	startBatchSize = 100
+
+	broadcastBatchesKey = "broadcast_batches:%d"
+	broadcastBatchesTTL = time.Hour * 24 * 7
 )
 
 func init() {
@@ -93,8 +98,16 @@ func createBroadcastBatches(ctx context.Context, rt *runtime.Runtime, bcast *mod
 	rc := rt.RP.Get()
 	defer rc.Close()
 
-	// create tasks for batches of contacts
 	idBatches := models.ChunkSlice(contactIDs, startBatchSize)
+
+	// batches can be deferred by pacing and so may not send in order, so track how many are still to be sent
+	if bcast.ID != models.NilBroadcastID {
+		if _, err := rc.Do("SET", fmt.Sprintf(broadcastBatchesKey, bcast.ID), len(idBatches), "EX", int(broadcastBatchesTTL/time.Second)); err != nil {
+			return errors.Wrap(err, "error setting broadcast outstanding batch count")
+		}
+	}
+
+	// create tasks for batches of contacts
 	for i, idBatch := range idBatches {
 		isLast := (i == len(idBatches)-1)
 
@@ -106,8 +119,48 @@ func createBroadcastBatches(ctx context.Context, rt *runtime.Runtime, bcast *mod
 			}
 			// if we've already queued other batches.. we don't want to error and have the task be retried
 			logrus.WithError(err).Error("error queuing broadcast batch")
+
+			// but this batch will never be sent so it's no longer outstanding
+			if err := completeBroadcastBatch(ctx, rt, rc, batch); err != nil {
+				logrus.WithError(err).Error("error completing unqueued broadcast batch")
+			}
 		}
 	}
 
 	return nil
 }
+
+var completeBatchScript = redis.NewScript(1, `
+-- KEYS: [BatchesKey]
+
+-- if the broadcast's batches aren't being counted, e.g. they were queued before counting was added
+if redis.call("EXISTS", KEYS[1]) == 0 then
+  return -1
+end
+
+local remaining = redis.call("DECR", KEYS[1])
+if remaining <= 0 then
+  redis.call("DEL", KEYS[1])
+  return 0
+end
+return remaining
+`)
+
+// records that the given broadcast batch is no longer outstanding and marks its broadcast as sent if that was the last
+// outstanding batch
+func completeBroadcastBatch(ctx context.Context, rt *runtime.Runtime, rc redis.Conn, batch *models.BroadcastBatch) error {
+	if batch.BroadcastID == models.NilBroadcastID {
+		return nil
+	}
+
+	remaining, err := redis.Int(completeBatchScript.Do(rc, fmt.Sprintf(broadcastBatchesKey, batch.BroadcastID)))
+	if err != nil {
+		return errors.Wrap(err, "error decrementing broadcast outstanding batch count")
+	}
+
+	// batches which weren't counted fall back to the last batch marking the broadcast as sent
+	if remaining == 0 || (remaining < 0 && batch.IsLast) {
+		return errors.Wrap(models.MarkBroadcastSent(ctx, rt.DB, batch.BroadcastID), "error marking broadcast as sent")
+	}
+	return nil
+}
@@ -18,9 +18,12 @@ func init() {
 	tasks.RegisterType(TypeSendBroadcastBatch, func() tasks.Task { return &SendBroadcastBatchTask{} })
 }
 
-// SendBroadcastTask is the task send broadcast batches
+// SendBroadcastBatchTask is the task send broadcast batches
 type SendBroadcastBatchTask struct {
 	*models.BroadcastBatch
+
+	// whether this batch has already been paced, i.e. capacity has been reserved for it on its channels
+	Paced bool `json:"paced,omitempty"`
 }
 
 func (t *SendBroadcastBatchTask) Type() string {
@@ -33,12 +36,17 @@ func (t *SendBroadcastBatchTask) Timeout() time.Duration {
 }
 
 func (t *SendBroadcastBatchTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
-	// always set our broadcast as sent if it is our last
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	deferred := false
+
+	// unless we're deferring it until later, this batch is no longer outstanding once we're done with it, and if it's
+	// the last outstanding batch, the broadcast is sent
 	defer func() {
-		if t.BroadcastBatch.IsLast && t.BroadcastBatch.BroadcastID != models.NilBroadcastID {
-			err := models.MarkBroadcastSent(ctx, rt.DB, t.BroadcastBatch.BroadcastID)
-			if err != nil {
-				logrus.WithError(err).Error("error marking broadcast as sent")
+		if !deferred {
+			if err := completeBroadcastBatch(ctx, rt, rc, t.BroadcastBatch); err != nil {
+				logrus.WithError(err).Error("error completing broadcast batch")
 			}
 		}
 	}()
@@ -48,12 +56,36 @@ func (t *SendBroadcastBatchTask) Perform(ctx context.Context, rt *runtime.Runtim
 		return errors.Wrapf(err, "error getting org assets")
 	}
 
+	contacts, err := t.BroadcastBatch.LoadContacts(ctx, rt.DB, oa)
+	if err != nil {
+		return err
+	}
+
+	// reserve capacity for this batch on its channels and if that isn't available soon, defer it until it is
+	if !t.Paced {
+		counts, err := t.BroadcastBatch.ChannelCounts(oa, contacts)
+		if err != nil {
+			return errors.Wrapf(err, "error calculating broadcast channel counts")
+		}
+
+		now := time.Now()
+		release, err := reserveBroadcastCapacity(rc, rt, t.BroadcastBatch.BroadcastID, counts, now)
+		if err != nil {
+			return err
+		}
+
+		if release.After(now.Add(PacingWindow)) {
+			deferred = true
+			return deferBroadcastBatch(rc, orgID, t.BroadcastBatch, release)
+		}
+	}
+
 	// create this batch of messages
-	msgs, err := t.BroadcastBatch.CreateMessages(ctx, rt, oa)
+	msgs, err := t.BroadcastBatch.CreateMessages(ctx, rt, oa, contacts)
 	if err != nil {
 		return errors.Wrapf(err, "error creating broadcast messages")
 	}
 
-	msgio.SendMessages(ctx, rt, rt.DB, nil, msgs)
+	msgio.SendMessages(ctx, rt, rt.DB, msgs)
 	return nil
 }
@@ -2,10 +2,12 @@ package msgs_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
@@ -18,6 +20,7 @@ import (
 	"github.com/nyaruka/mailroom/core/tasks/msgs"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/redisx/assertredis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -292,3 +295,48 @@ func TestBroadcastTask(t *testing.T) {
 		time.Sleep(10 * time.Millisecond)
 	}
 }
+
+func TestBroadcastSentWhenAllBatchesSent(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	bcastID := testdata.InsertBroadcast(rt, testdata.Org1, "eng", map[envs.Language]string{"eng": "hello"}, models.NilScheduleID, nil, []*testdata.Group{testdata.DoctorsGroup})
+
+	bcast := models.NewBroadcast(testdata.Org1.ID, flows.BroadcastTranslations{"eng": {Text: "hello"}}, models.TemplateStateEvaluated, "eng", nil, nil, []models.GroupID{testdata.DoctorsGroup.ID}, "", models.NilUserID)
+	bcast.ID = bcastID
+
+	err := (&msgs.SendBroadcastTask{Broadcast: bcast}).Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	assertredis.Get(t, rt.RP, fmt.Sprintf("broadcast_batches:%d", bcastID), "2")
+
+	var batches []*msgs.SendBroadcastBatchTask
+	for {
+		task, err := queue.PopNextTask(rc, queue.BatchQueue)
+		require.NoError(t, err)
+		if task == nil {
+			break
+		}
+		batch := &msgs.SendBroadcastBatchTask{}
+		jsonx.MustUnmarshal(task.Task, batch)
+		batches = append(batches, batch)
+	}
+	require.Len(t, batches, 2)
+
+	// sending the last batch first doesn't mark the broadcast as sent
+	err = batches[1].Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_broadcast WHERE id = $1`, bcastID).Returns("P")
+	assertredis.Get(t, rt.RP, fmt.Sprintf("broadcast_batches:%d", bcastID), "1")
+
+	// but sending the other batch does
+	err = batches[0].Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_broadcast WHERE id = $1`, bcastID).Returns("S")
+	assertredis.NotExists(t, rt.RP, fmt.Sprintf("broadcast_batches:%d", bcastID))
+}
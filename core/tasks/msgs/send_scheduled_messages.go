@@ -0,0 +1,55 @@
+package msgs
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/msgio"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	mailroom.RegisterCron("send_scheduled_messages", time.Second*60, false, SendScheduledMessages)
+}
+
+// SendScheduledMessages sends scheduled messages which are now due
+func SendScheduledMessages(ctx context.Context, rt *runtime.Runtime) error {
+	start := time.Now()
+
+	// messages are marked as queued as they're loaded so they can no longer be cancelled
+	msgs, err := models.ClaimScheduledMessagesDue(ctx, rt.DB)
+	if err != nil {
+		return errors.Wrap(err, "error claiming scheduled messages to send")
+	}
+	if len(msgs) == 0 {
+		return nil // nothing to send
+	}
+
+	msgio.SendMessages(ctx, rt, rt.DB, msgs)
+
+	// replies to tickets are only recorded as such once they're sent
+	for _, msg := range msgs {
+		if msg.TicketID() != models.NilTicketID {
+			if err := recordTicketReply(ctx, rt, msg); err != nil {
+				logrus.WithError(err).WithField("msg_id", msg.ID()).Error("error recording ticket reply for scheduled message")
+			}
+		}
+	}
+
+	logrus.WithField("count", len(msgs)).WithField("elapsed", time.Since(start)).Info("sent scheduled messages")
+
+	return nil
+}
+
+func recordTicketReply(ctx context.Context, rt *runtime.Runtime, msg *models.Msg) error {
+	oa, err := models.GetOrgAssets(ctx, rt, msg.OrgID())
+	if err != nil {
+		return errors.Wrap(err, "error loading org assets")
+	}
+
+	return models.RecordTicketReply(ctx, rt.DB, oa, msg.TicketID(), msg.CreatedByID())
+}
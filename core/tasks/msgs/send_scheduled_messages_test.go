@@ -0,0 +1,112 @@
+package msgs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/msgs"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendScheduledMessages(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// nothing to send
+	err := msgs.SendScheduledMessages(ctx, rt)
+	require.NoError(t, err)
+
+	testsuite.AssertCourierQueues(t, map[string][]int{})
+
+	// a scheduled message which isn't due yet (should be ignored)
+	msg1 := testdata.InsertScheduledOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Later", time.Now().Add(time.Hour))
+
+	// scheduled messages which are due
+	msg2 := testdata.InsertScheduledOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Now", time.Now().Add(-time.Minute))
+	msg3 := testdata.InsertScheduledOutgoingMsg(rt, testdata.Org1, testdata.VonageChannel, testdata.Bob, "Now", time.Now().Add(-time.Minute))
+
+	// a due message for a contact who has since been stopped (should be failed)
+	msg4 := testdata.InsertScheduledOutgoingMsg(rt, testdata.Org1, testdata.VonageChannel, testdata.George, "Now", time.Now().Add(-time.Minute))
+	rt.DB.MustExec(`UPDATE contacts_contact SET status = 'S' WHERE id = $1`, testdata.George.ID)
+
+	// a due message on a channel which has since been removed (should be failed)
+	msg6 := testdata.InsertScheduledOutgoingMsg(rt, testdata.Org1, testdata.TwitterChannel, testdata.Cathy, "Now", time.Now().Add(-time.Minute))
+	rt.DB.MustExec(`UPDATE channels_channel SET is_active = FALSE WHERE id = $1`, testdata.TwitterChannel.ID)
+
+	// a due message which is a ticket reply (should be recorded as a reply when it's sent)
+	ticket := testdata.InsertOpenTicket(rt, testdata.Org1, testdata.Cathy, testdata.Internal, testdata.DefaultTopic, "Where are my cookies?", "", time.Now(), nil)
+	msg7 := testdata.InsertScheduledOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Here they are", time.Now().Add(-time.Minute))
+	rt.DB.MustExec(`UPDATE msgs_msg SET ticket_id = $2, created_by_id = $3 WHERE id = $1`, msg7.ID(), ticket.ID, testdata.Agent.ID)
+
+	// a due message to a URN which has since opted out (should be failed)
+	msg8 := testdata.InsertScheduledOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Alexandria, "Now", time.Now().Add(-time.Minute))
+	rt.DB.MustExec(`INSERT INTO msgs_optout(org_id, channel_id, urn_identity, created_on) VALUES($1, $2, $3, NOW())`, testdata.Org1.ID, testdata.TwilioChannel.ID, testdata.Alexandria.URN.Identity())
+
+	// a due message which has been cancelled (should be ignored)
+	msg5 := testdata.InsertScheduledOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Cancelled", time.Now().Add(-time.Minute))
+
+	cancelled, err := models.CancelScheduledMessage(ctx, rt.DB, testdata.Org1.ID, models.MsgID(msg5.ID()))
+	assert.NoError(t, err)
+	assert.True(t, cancelled)
+
+	// can't cancel a message which isn't scheduled
+	cancelled, err = models.CancelScheduledMessage(ctx, rt.DB, testdata.Org1.ID, models.MsgID(msg5.ID()))
+	assert.NoError(t, err)
+	assert.False(t, cancelled)
+
+	err = msgs.SendScheduledMessages(ctx, rt)
+	require.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_msg WHERE id = $1`, msg1.ID()).Returns("T")
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_msg WHERE id = $1`, msg2.ID()).Returns("Q")
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_msg WHERE id = $1`, msg3.ID()).Returns("Q")
+	assertdb.Query(t, rt.DB, `SELECT failed_reason FROM msgs_msg WHERE id = $1 AND status = 'F'`, msg4.ID()).Returns("C")
+	assertdb.Query(t, rt.DB, `SELECT failed_reason FROM msgs_msg WHERE id = $1 AND status = 'F'`, msg5.ID()).Returns("X")
+	assertdb.Query(t, rt.DB, `SELECT failed_reason FROM msgs_msg WHERE id = $1 AND status = 'F'`, msg6.ID()).Returns("R")
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_msg WHERE id = $1`, msg7.ID()).Returns("Q")
+	assertdb.Query(t, rt.DB, `SELECT failed_reason FROM msgs_msg WHERE id = $1 AND status = 'F'`, msg8.ID()).Returns("P")
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM tickets_ticket WHERE id = $1 AND replied_on IS NOT NULL`, ticket.ID).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT SUM(count) FROM tickets_ticketdailycount WHERE count_type = 'R' AND scope = 'o:1:u:6'`).Returns(1)
+
+	testsuite.AssertCourierQueues(t, map[string][]int{
+		"msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/0": {2}, // twilio, bulk priority
+		"msgs:19012bfd-3ce3-4cae-9bb9-76cf92c73d49|10/0": {1}, // vonage, bulk priority
+	})
+}
+
+func TestCancelClaimedScheduledMessage(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	msg1 := testdata.InsertScheduledOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Now", time.Now().Add(-time.Minute))
+
+	// claim the message as the cron would before sending it
+	claimed, err := models.ClaimScheduledMessagesDue(ctx, rt.DB)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	assert.Equal(t, msg1.ID(), claimed[0].ID())
+	assert.Equal(t, models.MsgStatusQueued, claimed[0].Status())
+
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_msg WHERE id = $1`, msg1.ID()).Returns("Q")
+
+	// cancelling it now has no effect because it's already on its way
+	cancelled, err := models.CancelScheduledMessage(ctx, rt.DB, testdata.Org1.ID, models.MsgID(msg1.ID()))
+	assert.NoError(t, err)
+	assert.False(t, cancelled)
+
+	assertdb.Query(t, rt.DB, `SELECT status FROM msgs_msg WHERE id = $1`, msg1.ID()).Returns("Q")
+
+	// and it can't be claimed again
+	claimed, err = models.ClaimScheduledMessagesDue(ctx, rt.DB)
+	require.NoError(t, err)
+	assert.Len(t, claimed, 0)
+}
@@ -0,0 +1,355 @@
+package msgs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/eventstream"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/redisx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	statusCallbacksWatermarksKey = "status_callbacks_watermarks"
+	statusCallbacksQueueKey      = "status_callbacks:%d"
+	statusCallbacksQueueTTL      = time.Hour * 24 * 7
+
+	statusCallbacksBatchSize = 1000
+	statusCallbacksSendLimit = 100
+	statusCallbacksMaxQueued = 10000
+)
+
+// StatusCallbacksOrgConcurrency is how many status callbacks can be sent to a single org's URL at the same time
+var StatusCallbacksOrgConcurrency = 10
+
+// the last status we notified each org of for each message, so that changes which don't change the status we report,
+// e.g. wired to sent, or a change to a message's metadata, don't generate another callback
+var statusCallbacksNotified = redisx.NewIntervalHash("status_callbacks_notified", time.Hour*24, 8)
+
+// StatusCallbackBackoffs are the delays before each retry of a status callback which couldn't be delivered, after
+// which it is dropped
+var StatusCallbackBackoffs = []time.Duration{time.Minute, time.Minute * 5, time.Minute * 30, time.Hour * 2}
+
+func init() {
+	mailroom.RegisterCron("queue_status_callbacks", time.Second*10, false, QueueStatusCallbacks)
+	mailroom.RegisterCron("send_status_callbacks", time.Second*5, false, SendStatusCallbacks)
+}
+
+var statusCallbackNames = map[models.MsgStatus]string{
+	models.MsgStatusWired:     "sent",
+	models.MsgStatusSent:      "sent",
+	models.MsgStatusDelivered: "delivered",
+	models.MsgStatusFailed:    "failed",
+}
+
+var failedReasonNames = map[models.MsgFailedReason]string{
+	models.MsgFailedSuspended:      "suspended",
+	models.MsgFailedContact:        "contact",
+	models.MsgFailedLooping:        "looping",
+	models.MsgFailedErrorLimit:     "error_limit",
+	models.MsgFailedTooOld:         "too_old",
+	models.MsgFailedNoDestination:  "no_destination",
+	models.MsgFailedChannelRemoved: "channel_removed",
+	models.MsgFailedCancelled:      "cancelled",
+	models.MsgFailedOptedOut:       "opted_out",
+}
+
+// StatusCallback is the payload POSTed to an org's status callback URL
+type StatusCallback struct {
+	MsgID        models.MsgID      `json:"msg_id"`
+	MsgUUID      flows.MsgUUID     `json:"msg_uuid"`
+	ContactUUID  flows.ContactUUID `json:"contact_uuid"`
+	Origin       models.MsgOrigin  `json:"origin"`
+	Status       string            `json:"status"`
+	FailedReason string            `json:"failed_reason,omitempty"`
+	ModifiedOn   time.Time         `json:"modified_on"`
+}
+
+// a status callback waiting to be delivered
+type queuedStatusCallback struct {
+	OrgID    models.OrgID    `json:"org_id"`
+	Attempts int             `json:"attempts"`
+	Callback *StatusCallback `json:"callback"`
+}
+
+// QueueStatusCallbacks looks for outgoing messages which have moved to sent, delivered or failed in orgs with a status
+// callback URL, and queues callbacks for those with an origin the org is interested in. Each org's queue is bounded, so
+// if an org's URL is failing for a long time, its oldest callbacks are dropped.
+func QueueStatusCallbacks(ctx context.Context, rt *runtime.Runtime) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	start := time.Now()
+
+	configs, err := models.GetStatusCallbackConfigs(ctx, rt.DB)
+	if err != nil {
+		return errors.Wrap(err, "error loading status callback configs")
+	}
+
+	numQueued := 0
+
+	for _, cfg := range configs {
+		sinceOn, sinceID, err := getStatusCallbacksWatermark(rc, cfg.OrgID)
+		if err != nil {
+			return err
+		}
+
+		// if this is the first time we've looked at this org, start from now as we don't send callbacks for changes
+		// which happened before they were configured
+		if sinceOn.IsZero() {
+			if _, err := rc.Do("HSET", statusCallbacksWatermarksKey, cfg.OrgID, formatStatusCallbacksWatermark(dates.Now(), models.NilMsgID)); err != nil {
+				return errors.Wrap(err, "error initializing status callbacks watermark")
+			}
+			continue
+		}
+
+		changes, err := models.GetMsgStatusChanges(ctx, rt.DB, cfg.OrgID, sinceOn, sinceID, statusCallbacksBatchSize)
+		if err != nil {
+			return errors.Wrapf(err, "error loading msg status changes for org #%d", cfg.OrgID)
+		}
+		if len(changes) == 0 {
+			continue
+		}
+
+		callbacks := make([]*StatusCallback, 0, len(changes))
+
+		for _, c := range changes {
+			if !cfg.Includes(c.Origin()) {
+				continue
+			}
+
+			status := statusCallbackNames[c.Status]
+
+			// ignore changes which don't change the status we've already notified the org of
+			notified, err := statusCallbacksNotified.Get(rc, fmt.Sprint(c.ID))
+			if err != nil {
+				return errors.Wrap(err, "error reading notified status")
+			}
+			if notified == status {
+				continue
+			}
+
+			callbacks = append(callbacks, &StatusCallback{
+				MsgID:        c.ID,
+				MsgUUID:      c.UUID,
+				ContactUUID:  c.ContactUUID,
+				Origin:       c.Origin(),
+				Status:       status,
+				FailedReason: failedReasonNames[c.FailedReason],
+				ModifiedOn:   c.ModifiedOn,
+			})
+		}
+
+		queueKey := fmt.Sprintf(statusCallbacksQueueKey, cfg.OrgID)
+		last := changes[len(changes)-1]
+
+		rc.Send("MULTI")
+		for _, callback := range callbacks {
+			rc.Send("ZADD", queueKey, start.Unix(), jsonx.MustMarshal(&queuedStatusCallback{OrgID: cfg.OrgID, Callback: callback}))
+		}
+		rc.Send("ZREMRANGEBYRANK", queueKey, 0, -(statusCallbacksMaxQueued + 1))
+		rc.Send("EXPIRE", queueKey, int(statusCallbacksQueueTTL/time.Second))
+		rc.Send("HSET", statusCallbacksWatermarksKey, cfg.OrgID, formatStatusCallbacksWatermark(last.ModifiedOn, last.ID))
+
+		replies, err := redis.Values(rc.Do("EXEC"))
+		if err != nil {
+			return errors.Wrapf(err, "error queuing status callbacks for org #%d", cfg.OrgID)
+		}
+		if dropped, _ := redis.Int(replies[len(callbacks)], nil); dropped > 0 {
+			logrus.WithField("org_id", cfg.OrgID).WithField("dropped", dropped).Warn("status callbacks queue full, dropped oldest callbacks")
+		}
+
+		for _, callback := range callbacks {
+			if err := statusCallbacksNotified.Set(rc, fmt.Sprint(callback.MsgID), callback.Status); err != nil {
+				return errors.Wrap(err, "error recording notified status")
+			}
+		}
+
+		numQueued += len(callbacks)
+	}
+
+	if numQueued > 0 {
+		logrus.WithField("queued", numQueued).WithField("elapsed", time.Since(start)).Info("queued status callbacks")
+	}
+
+	return nil
+}
+
+// gets the modified on and ID of the last message status change seen in the given org, with a zero time if we haven't
+// looked at this org before
+func getStatusCallbacksWatermark(rc redis.Conn, orgID models.OrgID) (time.Time, models.MsgID, error) {
+	value, err := redis.String(rc.Do("HGET", statusCallbacksWatermarksKey, orgID))
+	if err == redis.ErrNil {
+		return time.Time{}, models.NilMsgID, nil
+	}
+	if err != nil {
+		return time.Time{}, models.NilMsgID, errors.Wrap(err, "error reading status callbacks watermark")
+	}
+
+	parts := strings.SplitN(value, "|", 2)
+	sinceOn, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil || len(parts) != 2 {
+		return time.Time{}, models.NilMsgID, errors.Errorf("invalid status callbacks watermark: %s", value)
+	}
+	sinceID, _ := strconv.Atoi(parts[1])
+
+	return sinceOn, models.MsgID(sinceID), nil
+}
+
+func formatStatusCallbacksWatermark(modifiedOn time.Time, id models.MsgID) string {
+	return fmt.Sprintf("%s|%d", modifiedOn.Format(time.RFC3339Nano), id)
+}
+
+// SendStatusCallbacks delivers queued status callbacks which are due, requeuing those which fail for a later retry.
+// Orgs are sent to in parallel, and each org's callbacks are sent concurrently up to a limit.
+func SendStatusCallbacks(ctx context.Context, rt *runtime.Runtime) error {
+	start := time.Now()
+
+	configs, err := models.GetStatusCallbackConfigs(ctx, rt.DB)
+	if err != nil {
+		return errors.Wrap(err, "error loading status callback configs")
+	}
+
+	var numSent, numFailed int64
+	wg := &sync.WaitGroup{}
+
+	for _, cfg := range configs {
+		wg.Add(1)
+
+		go func(cfg *models.StatusCallbackConfig) {
+			defer wg.Done()
+
+			sent, failed, err := sendOrgStatusCallbacks(ctx, rt, cfg, start)
+			if err != nil {
+				logrus.WithError(err).WithField("org_id", cfg.OrgID).Error("error sending status callbacks")
+			}
+
+			atomic.AddInt64(&numSent, int64(sent))
+			atomic.AddInt64(&numFailed, int64(failed))
+		}(cfg)
+	}
+
+	wg.Wait()
+
+	if numSent > 0 || numFailed > 0 {
+		logrus.WithField("sent", numSent).WithField("failed", numFailed).WithField("elapsed", time.Since(start)).Info("sent status callbacks")
+	}
+
+	return nil
+}
+
+// sends the given org's queued status callbacks which are due, returning how many were sent and how many failed
+func sendOrgStatusCallbacks(ctx context.Context, rt *runtime.Runtime, cfg *models.StatusCallbackConfig, now time.Time) (int, int, error) {
+	queueKey := fmt.Sprintf(statusCallbacksQueueKey, cfg.OrgID)
+
+	rc := rt.RP.Get()
+	members, err := redis.ByteSlices(rc.Do("ZRANGEBYSCORE", queueKey, "-inf", now.Unix(), "LIMIT", 0, statusCallbacksSendLimit))
+	rc.Close()
+
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error fetching queued status callbacks")
+	}
+
+	var numSent, numFailed int64
+	sem := make(chan bool, StatusCallbacksOrgConcurrency)
+	wg := &sync.WaitGroup{}
+
+	for _, member := range members {
+		sem <- true
+		wg.Add(1)
+
+		go func(member []byte) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			sent, err := sendQueuedStatusCallback(ctx, rt, cfg, queueKey, member, now)
+			if err != nil {
+				logrus.WithError(err).WithField("org_id", cfg.OrgID).Error("error processing queued status callback")
+			} else if sent {
+				atomic.AddInt64(&numSent, 1)
+			} else {
+				atomic.AddInt64(&numFailed, 1)
+			}
+		}(member)
+	}
+
+	wg.Wait()
+
+	return int(numSent), int(numFailed), nil
+}
+
+// sends a single queued status callback, requeuing it for a retry if it fails, and returns whether it was sent
+func sendQueuedStatusCallback(ctx context.Context, rt *runtime.Runtime, cfg *models.StatusCallbackConfig, queueKey string, member []byte, now time.Time) (bool, error) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	sent := false
+
+	queued := &queuedStatusCallback{}
+	if err := jsonx.Unmarshal(member, queued); err != nil {
+		logrus.WithError(err).Error("error unmarshaling queued status callback")
+	} else if err := sendStatusCallback(ctx, rt, cfg, queued.Callback); err != nil {
+		logrus.WithError(err).WithField("org_id", queued.OrgID).WithField("msg_id", queued.Callback.MsgID).Warn("error sending status callback")
+
+		// requeue for a retry if we haven't used them all up
+		if queued.Attempts < len(StatusCallbackBackoffs) {
+			retry := &queuedStatusCallback{OrgID: queued.OrgID, Attempts: queued.Attempts + 1, Callback: queued.Callback}
+			if _, err := rc.Do("ZADD", queueKey, now.Add(StatusCallbackBackoffs[queued.Attempts]).Unix(), jsonx.MustMarshal(retry)); err != nil {
+				return false, errors.Wrap(err, "error requeuing status callback")
+			}
+		}
+	} else {
+		sent = true
+	}
+
+	if _, err := rc.Do("ZREM", queueKey, member); err != nil {
+		return sent, errors.Wrap(err, "error removing queued status callback")
+	}
+
+	return sent, nil
+}
+
+// POSTs the given callback to the org's callback URL, signing it if the org has a secret
+func sendStatusCallback(ctx context.Context, rt *runtime.Runtime, cfg *models.StatusCallbackConfig, callback *StatusCallback) error {
+	body := jsonx.MustMarshal(callback)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "error creating status callback request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if cfg.Secret != "" {
+		req.Header.Set(eventstream.SignatureHeader, eventstream.Sign(cfg.Secret, dates.Now(), body))
+	}
+
+	client, _, access := goflow.HTTP(rt.Config)
+
+	trace, err := httpx.DoTrace(client, req, nil, access, 1024)
+	if err != nil {
+		return errors.Wrap(err, "error making status callback request")
+	}
+	if trace.Response.StatusCode/100 != 2 {
+		return errors.Errorf("status callback request returned non-2XX status: %d", trace.Response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package msgs_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/mailroom/core/eventstream"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/msgs"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusCallbacks(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	// send one at a time so that requests match mocked responses in order
+	msgs.StatusCallbacksOrgConcurrency = 1
+	defer func() { msgs.StatusCallbacksOrgConcurrency = 10 }()
+
+	mocks := httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"http://example.com/callbacks": {
+			httpx.NewMockResponse(200, nil, []byte(`{}`)),
+			httpx.NewMockResponse(503, nil, []byte(`{}`)),
+			httpx.NewMockResponse(200, nil, []byte(`{}`)),
+		},
+	})
+	httpx.SetRequestor(mocks)
+
+	// org 1 wants callbacks for messages from flows and chats only
+	rt.DB.MustExec(`UPDATE orgs_org SET config = config || '{"status_callback_url": "http://example.com/callbacks", "status_callback_secret": "sesame", "status_callback_origins": ["flow", "chat"]}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+
+	// first look at an org just records where we start from
+	err := msgs.QueueStatusCallbacks(ctx, rt)
+	require.NoError(t, err)
+
+	rc.Do("HSET", "status_callbacks_watermarks", testdata.Org1.ID, "2020-01-01T00:00:00Z|0")
+
+	msg1 := testdata.InsertOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", nil, models.MsgStatusDelivered, false)
+	msg2 := testdata.InsertOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "Hi", nil, models.MsgStatusFailed, false)
+	msg3 := testdata.InsertOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.George, "Hi", nil, models.MsgStatusSent, false)
+	ticket := testdata.InsertOpenTicket(rt, testdata.Org1, testdata.George, testdata.Internal, testdata.DefaultTopic, "help", "", time.Now(), nil)
+	testdata.InsertOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", nil, models.MsgStatusQueued, false)   // not a status we report
+	testdata.InsertOutgoingMsg(rt, testdata.Org2, testdata.Org2Channel, testdata.Org2Contact, "Hi", nil, models.MsgStatusSent, false) // org not configured
+
+	rt.DB.MustExec(`UPDATE msgs_msg SET failed_reason = 'E' WHERE id = $1`, msg2.ID())
+	rt.DB.MustExec(`UPDATE msgs_msg SET ticket_id = $2 WHERE id = $1`, msg3.ID(), ticket.ID)
+	rt.DB.MustExec(`UPDATE msgs_msg SET modified_on = NOW() - INTERVAL '1 minute'`)
+
+	err = msgs.QueueStatusCallbacks(ctx, rt)
+	require.NoError(t, err)
+
+	// msg3 is from a ticket so not included
+	assert.Equal(t, 2, zcard(t, rc, "status_callbacks:1"))
+
+	// nothing more to queue on the next run
+	err = msgs.QueueStatusCallbacks(ctx, rt)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, zcard(t, rc, "status_callbacks:1"))
+
+	// a change to a message which doesn't change its status doesn't generate another callback
+	rt.DB.MustExec(`UPDATE msgs_msg SET metadata = '{"failover": true}', modified_on = NOW() - INTERVAL '30 seconds' WHERE id = $1`, msg1.ID())
+
+	// and nor does a message moving from wired to sent
+	msg4 := testdata.InsertOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "Hi", nil, models.MsgStatusWired, false)
+	rt.DB.MustExec(`UPDATE msgs_msg SET modified_on = NOW() - INTERVAL '20 seconds' WHERE id = $1`, msg4.ID())
+
+	err = msgs.QueueStatusCallbacks(ctx, rt)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, zcard(t, rc, "status_callbacks:1"))
+
+	rt.DB.MustExec(`UPDATE msgs_msg SET status = 'S', modified_on = NOW() - INTERVAL '10 seconds' WHERE id = $1`, msg4.ID())
+
+	err = msgs.QueueStatusCallbacks(ctx, rt)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, zcard(t, rc, "status_callbacks:1"))
+
+	err = msgs.SendStatusCallbacks(ctx, rt)
+	require.NoError(t, err)
+
+	// first and third callbacks were delivered and signed, second failed and has been requeued for a retry
+	assert.Equal(t, 1, zcard(t, rc, "status_callbacks:1"))
+
+	requests := mocks.Requests()
+	require.Len(t, requests, 3)
+	assert.Contains(t, requests[0].Header.Get(eventstream.SignatureHeader), "v1=")
+
+	body, _ := requests[0].GetBody()
+	payload, _ := io.ReadAll(body)
+	callback := &msgs.StatusCallback{}
+	jsonx.MustUnmarshal(payload, callback)
+
+	assert.Equal(t, models.MsgID(msg1.ID()), callback.MsgID)
+	assert.Equal(t, testdata.Cathy.UUID, callback.ContactUUID)
+	assert.Equal(t, models.MsgOriginChat, callback.Origin)
+	assert.Equal(t, "delivered", callback.Status)
+
+	body, _ = requests[1].GetBody()
+	payload, _ = io.ReadAll(body)
+	jsonx.MustUnmarshal(payload, callback)
+
+	assert.Equal(t, models.MsgID(msg2.ID()), callback.MsgID)
+	assert.Equal(t, "failed", callback.Status)
+	assert.Equal(t, "error_limit", callback.FailedReason)
+
+	body, _ = requests[2].GetBody()
+	payload, _ = io.ReadAll(body)
+	callback = &msgs.StatusCallback{}
+	jsonx.MustUnmarshal(payload, callback)
+
+	assert.Equal(t, models.MsgID(msg4.ID()), callback.MsgID)
+	assert.Equal(t, "sent", callback.Status)
+
+	// retry isn't due yet so nothing is sent
+	err = msgs.SendStatusCallbacks(ctx, rt)
+	require.NoError(t, err)
+
+	assert.Len(t, mocks.Requests(), 3)
+}
+
+func zcard(t *testing.T, rc redis.Conn, key string) int {
+	n, err := redis.Int(rc.Do("ZCARD", key))
+	require.NoError(t, err)
+	return n
+}
@@ -0,0 +1,136 @@
+package streams
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/eventstream"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	mailroom.RegisterCron("publish_events", time.Second*5, false, PublishEvents)
+}
+
+var sinkMutex sync.Mutex
+var sink eventstream.Sink
+var sinkURL string
+
+// if publishing to the sink fails, we back off exponentially before trying it again
+var sinkFailures int
+var sinkRetryAfter time.Time
+
+// returns the sink for the configured event stream, creating it if necessary
+func getSink(rt *runtime.Runtime) (eventstream.Sink, error) {
+	if sink == nil || sinkURL != rt.Config.EventStream {
+		s, err := eventstream.NewSink(rt.Config.EventStream, rt.Config.EventStreamSecret)
+		if err != nil {
+			return nil, err
+		}
+		sink, sinkURL = s, rt.Config.EventStream
+		sinkFailures, sinkRetryAfter = 0, time.Time{}
+	}
+	return sink, nil
+}
+
+// records a failure to publish to the current sink, returning how long we'll wait before trying it again
+func backoffSink(rt *runtime.Runtime) time.Duration {
+	backoff := time.Duration(rt.Config.EventStreamBackoff) * time.Second
+	maxBackoff := time.Duration(rt.Config.EventStreamMaxBackoff) * time.Second
+
+	for i := 0; i < sinkFailures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	sinkFailures++
+	sinkRetryAfter = dates.Now().Add(backoff)
+	return backoff
+}
+
+// PublishEvents publishes queued events to the event stream. Each run publishes a limited number of batches of each
+// org's events so that a busy org can't starve the others. Events are only removed once they've been published so if
+// publishing fails, they'll be retried once the sink's backoff has passed, and as this cron only runs on one instance
+// at a time, each org's events are published in the order they were queued.
+func PublishEvents(ctx context.Context, rt *runtime.Runtime) error {
+	if rt.Config.EventStream == "" {
+		return nil
+	}
+
+	sinkMutex.Lock()
+	defer sinkMutex.Unlock()
+
+	log := logrus.WithField("comp", "event_stream")
+	start := time.Now()
+
+	sink, err := getSink(rt)
+	if err != nil {
+		return errors.Wrap(err, "error creating event stream sink")
+	}
+
+	if dates.Now().Before(sinkRetryAfter) {
+		return nil
+	}
+
+	orgIDs, err := eventstream.QueuedOrgs(ctx, rt.DB)
+	if err != nil {
+		return err
+	}
+
+	numPublished := 0
+
+	for _, orgID := range orgIDs {
+		published, err := publishOrgEvents(ctx, rt, sink, orgID)
+		numPublished += published
+
+		if err != nil {
+			backoff := backoffSink(rt)
+			log.WithField("published", numPublished).WithField("backoff", backoff).Info("backing off event stream after failure")
+
+			return errors.Wrapf(err, "error publishing events for org #%d to %s sink", orgID, sink.Name())
+		}
+	}
+
+	sinkFailures = 0
+
+	if numPublished > 0 {
+		log.WithField("elapsed", time.Since(start)).WithField("published", numPublished).WithField("orgs", len(orgIDs)).Info("published events to event stream")
+	}
+
+	return nil
+}
+
+// publishes up to the configured number of batches of the given org's queued events
+func publishOrgEvents(ctx context.Context, rt *runtime.Runtime, sink eventstream.Sink, orgID models.OrgID) (int, error) {
+	numPublished := 0
+
+	for i := 0; i < rt.Config.EventStreamMaxBatches; i++ {
+		events, err := eventstream.Peek(ctx, rt.DB, orgID, rt.Config.EventStreamBatchSize)
+		if err != nil {
+			return numPublished, err
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		if err := sink.Publish(ctx, events); err != nil {
+			return numPublished, err
+		}
+
+		if err := eventstream.Ack(ctx, rt.DB, events); err != nil {
+			return numPublished, err
+		}
+
+		numPublished += len(events)
+	}
+
+	return numPublished, nil
+}
@@ -0,0 +1,143 @@
+package streams_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/modifiers"
+	"github.com/nyaruka/mailroom/core/eventstream"
+	_ "github.com/nyaruka/mailroom/core/handlers"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/streams"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishEvents(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+
+	rt.Config.EventStream = "file://" + path
+	rt.Config.EventStreamTypes = "contact_name_changed,contact_groups_changed"
+	defer func() { rt.Config.EventStream = "" }()
+
+	oa := testdata.Org1.Load(rt)
+	_, cathy := testdata.Cathy.Load(rt, oa)
+	_, bob := testdata.Bob.Load(rt, oa)
+
+	// change names and a field, the latter of which won't be streamed
+	_, err := models.ApplyModifiers(ctx, rt, oa, models.NilUserID, models.ContactChangeSourceAPI, map[*flows.Contact][]flows.Modifier{
+		cathy: {modifiers.NewName("Catherine"), modifiers.NewField(oa.SessionAssets().Fields().Get("gender"), "F")},
+		bob:   {modifiers.NewName("Robert")},
+	})
+	require.NoError(t, err)
+
+	assertOrgQueued(t, rt, testdata.Org1.ID, 2)
+
+	err = streams.PublishEvents(ctx, rt)
+	assert.NoError(t, err)
+
+	assertOrgQueued(t, rt, testdata.Org1.ID, 0)
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	assert.Len(t, lines, 2)
+	for _, line := range lines {
+		assert.Contains(t, line, `"type":"contact_name_changed"`)
+	}
+
+	// if the sink fails, events remain queued to be retried
+	_, err = models.ApplyModifiers(ctx, rt, oa, models.NilUserID, models.ContactChangeSourceAPI, map[*flows.Contact][]flows.Modifier{cathy: {modifiers.NewName("Cat")}})
+	require.NoError(t, err)
+
+	rt.Config.EventStream = "file://" + filepath.Join(path, "notadir", "events.ndjson")
+
+	err = streams.PublishEvents(ctx, rt)
+	assert.Error(t, err)
+
+	assertOrgQueued(t, rt, testdata.Org1.ID, 1)
+
+	// and the sink isn't tried again until its backoff has passed
+	defer dates.SetNowSource(dates.DefaultNowSource)
+	dates.SetNowSource(dates.NewFixedNowSource(time.Now().Add(time.Second * 3)))
+
+	err = streams.PublishEvents(ctx, rt)
+	assert.NoError(t, err)
+	assertOrgQueued(t, rt, testdata.Org1.ID, 1)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Now().Add(time.Second * 6)))
+
+	err = streams.PublishEvents(ctx, rt)
+	assert.Error(t, err)
+	assertOrgQueued(t, rt, testdata.Org1.ID, 1)
+
+	// second failure doubles the backoff
+	dates.SetNowSource(dates.NewFixedNowSource(time.Now().Add(time.Second * 12)))
+
+	err = streams.PublishEvents(ctx, rt)
+	assert.NoError(t, err)
+	assertOrgQueued(t, rt, testdata.Org1.ID, 1)
+
+	// changing the sink clears the backoff
+	rt.Config.EventStream = "file://" + path
+
+	err = streams.PublishEvents(ctx, rt)
+	assert.NoError(t, err)
+	assertOrgQueued(t, rt, testdata.Org1.ID, 0)
+}
+
+func TestPublishEventsBatching(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+
+	rt.Config.EventStream = "file://" + path
+	rt.Config.EventStreamBatchSize = 2
+	rt.Config.EventStreamMaxBatches = 2
+	defer func() {
+		rt.Config.EventStream = ""
+		rt.Config.EventStreamBatchSize = 100
+		rt.Config.EventStreamMaxBatches = 10
+	}()
+
+	newEvents := func(orgID models.OrgID, n int) []*eventstream.Event {
+		events := make([]*eventstream.Event, n)
+		for i := range events {
+			events[i] = &eventstream.Event{Type: "msg_created", OrgID: orgID, Event: []byte(`{}`)}
+		}
+		return events
+	}
+
+	require.NoError(t, eventstream.Queue(ctx, rt.DB, newEvents(testdata.Org1.ID, 7)))
+	require.NoError(t, eventstream.Queue(ctx, rt.DB, newEvents(testdata.Org2.ID, 3)))
+
+	// each org gets at most 2 batches of 2 events per run
+	err := streams.PublishEvents(ctx, rt)
+	assert.NoError(t, err)
+	assertOrgQueued(t, rt, testdata.Org1.ID, 3)
+	assertOrgQueued(t, rt, testdata.Org2.ID, 0)
+
+	err = streams.PublishEvents(ctx, rt)
+	assert.NoError(t, err)
+	assertOrgQueued(t, rt, testdata.Org1.ID, 0)
+}
+
+func assertOrgQueued(t *testing.T, rt *runtime.Runtime, orgID models.OrgID, expected int) {
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM eventstream_event WHERE org_id = $1`, orgID).Returns(expected)
+}
@@ -132,10 +132,12 @@ func (mr *Mailroom) Start() error {
 		mr.rt.AttachmentStorage = storage.NewS3(s3Client, mr.rt.Config.S3AttachmentsBucket, c.S3Region, s3.BucketCannedACLPublicRead, 32)
 		mr.rt.SessionStorage = storage.NewS3(s3Client, mr.rt.Config.S3SessionsBucket, c.S3Region, s3.ObjectCannedACLPrivate, 32)
 		mr.rt.LogStorage = storage.NewS3(s3Client, mr.rt.Config.S3LogsBucket, c.S3Region, s3.ObjectCannedACLPrivate, 32)
+		mr.rt.ExportStorage = storage.NewS3(s3Client, mr.rt.Config.S3ExportsBucket, c.S3Region, s3.ObjectCannedACLPrivate, 32)
 	} else {
 		mr.rt.AttachmentStorage = storage.NewFS("_storage/attachments", 0766)
 		mr.rt.SessionStorage = storage.NewFS("_storage/sessions", 0766)
 		mr.rt.LogStorage = storage.NewFS("_storage/logs", 0766)
+		mr.rt.ExportStorage = storage.NewFS("_storage/exports", 0766)
 	}
 
 	// check our storages
@@ -154,6 +156,11 @@ func (mr *Mailroom) Start() error {
 	} else {
 		log.Info(mr.rt.LogStorage.Name() + " log storage ok")
 	}
+	if err := checkStorage(mr.rt.ExportStorage); err != nil {
+		log.WithError(err).Error(mr.rt.ExportStorage.Name() + " export storage not available")
+	} else {
+		log.Info(mr.rt.ExportStorage.Name() + " export storage ok")
+	}
 
 	// initialize our elastic client
 	mr.rt.ES, err = newElasticClient(c.Elastic, c.ElasticUsername, c.ElasticPassword)
@@ -164,7 +171,7 @@ func (mr *Mailroom) Start() error {
 	}
 
 	// warn if we won't be doing FCM syncing
-	if c.FCMKey == "" {
+	if c.FCMCredentialsFile == "" {
 		logrus.Warn("fcm not configured, no syncing of android channels")
 	}
 
@@ -4,6 +4,7 @@ import (
 	"encoding/csv"
 	"io"
 	"net"
+	"net/url"
 	"os"
 	"strings"
 
@@ -14,6 +15,7 @@ import (
 
 func init() {
 	utils.RegisterValidatorAlias("session_storage", "eq=db|eq=s3", func(e validator.FieldError) string { return "is not a valid session storage mode" })
+	utils.RegisterValidatorAlias("search_backend", "eq=elastic|eq=postgres", func(e validator.FieldError) string { return "is not a valid search backend" })
 }
 
 // Config is our top level configuration object
@@ -34,6 +36,8 @@ type Config struct {
 	HandlerWorkers       int  `help:"the number of go routines that will be used to handle messages"`
 	RetryPendingMessages bool `help:"whether to requeue pending messages older than five minutes to retry"`
 
+	BroadcastTPSShare float64 `validate:"gt=0,lte=1" help:"the share of a channel's TPS that broadcasts can use, the rest being kept for flow and ticket messages"`
+
 	WebhooksTimeout              int     `help:"the timeout in milliseconds for webhook calls from engine"`
 	WebhooksMaxRetries           int     `help:"the number of times to retry a failed webhook call"`
 	WebhooksMaxBodyBytes         int     `help:"the maximum size of bytes to a webhook call response body"`
@@ -48,6 +52,7 @@ type Config struct {
 	MaxValueLength       int    `help:"the maximum size in characters for contact field values and run result values"`
 	SessionStorage       string `validate:"omitempty,session_storage"         help:"where to store session output (s3|db)"`
 
+	SearchBackend        string `validate:"omitempty,search_backend" help:"the backend used for contact searches (elastic|postgres)"`
 	Elastic              string `validate:"url" help:"the URL of your ElasticSearch instance"`
 	ElasticUsername      string `help:"the username for ElasticSearch if using basic auth"`
 	ElasticPassword      string `help:"the password for ElasticSearch if using basic auth"`
@@ -59,6 +64,7 @@ type Config struct {
 	S3AttachmentsPrefix string `help:"the prefix that will be added to attachment filenames"`
 	S3SessionsBucket    string `help:"the S3 bucket we will write attachments to"`
 	S3LogsBucket        string `help:"the S3 bucket we will write logs to"`
+	S3ExportsBucket     string `help:"the S3 bucket we will write exports to"`
 	S3DisableSSL        bool   `help:"whether we disable SSL when accessing S3. Should always be set to False unless you're hosting an S3 compatible service within a secure internal network"`
 	S3ForcePathStyle    bool   `help:"whether we force S3 path style. Should generally need to default to False unless you're hosting an S3 compatible service"`
 
@@ -66,11 +72,20 @@ type Config struct {
 	AWSSecretAccessKey string `help:"the secret access key id to use when authenticating S3"`
 	AWSUseCredChain    bool   `help:"whether to use the AWS credentials chain. Defaults to false."`
 
-	CourierAuthToken  string `help:"the authentication token used for requests to Courier"`
-	LibratoUsername   string `help:"the username that will be used to authenticate to Librato"`
-	LibratoToken      string `help:"the token that will be used to authenticate to Librato"`
-	FCMKey            string `help:"the FCM API key used to notify Android relayers to sync"`
-	MailgunSigningKey string `help:"the signing key used to validate requests from mailgun"`
+	CourierAuthToken   string `help:"the authentication token used for requests to Courier"`
+	LibratoUsername    string `help:"the username that will be used to authenticate to Librato"`
+	LibratoToken       string `help:"the token that will be used to authenticate to Librato"`
+	FCMCredentialsFile string `help:"the path of the Firebase service account credentials file used to notify Android relayers to sync"`
+	MailgunSigningKey  string `help:"the signing key used to validate requests from mailgun"`
+
+	EventStream       string `help:"the URL of the sink events are published to (redis://, http(s):// or file://), empty to disable"`
+	EventStreamTypes  string `help:"comma separated list of event types to publish to the event stream"`
+	EventStreamSecret string `help:"the secret used to sign requests to an HTTP event stream"`
+
+	EventStreamBatchSize  int `validate:"gt=0" help:"the maximum number of events published to the event stream in one request"`
+	EventStreamMaxBatches int `validate:"gt=0" help:"the maximum number of batches published for each org each time the event stream is drained"`
+	EventStreamBackoff    int `validate:"gt=0" help:"the initial time in seconds to wait before retrying an event stream that failed"`
+	EventStreamMaxBackoff int `validate:"gt=0" help:"the maximum time in seconds to wait before retrying an event stream that keeps failing"`
 
 	InstanceName string `help:"the unique name of this instance used for analytics"`
 	LogLevel     string `help:"the logging level courier should use"`
@@ -95,6 +110,8 @@ func NewDefaultConfig() *Config {
 		HandlerWorkers:       32,
 		RetryPendingMessages: true,
 
+		BroadcastTPSShare: 0.8,
+
 		WebhooksTimeout:              15000,
 		WebhooksMaxRetries:           2,
 		WebhooksMaxBodyBytes:         1024 * 1024, // 1MB
@@ -109,6 +126,7 @@ func NewDefaultConfig() *Config {
 		MaxValueLength:       640,
 		SessionStorage:       "db",
 
+		SearchBackend:        "elastic",
 		Elastic:              "http://localhost:9200",
 		ElasticUsername:      "",
 		ElasticPassword:      "",
@@ -120,6 +138,7 @@ func NewDefaultConfig() *Config {
 		S3AttachmentsPrefix: "attachments/",
 		S3SessionsBucket:    "sessions-bucket",
 		S3LogsBucket:        "logs-bucket",
+		S3ExportsBucket:     "exports-bucket",
 		S3DisableSSL:        false,
 		S3ForcePathStyle:    false,
 
@@ -127,6 +146,14 @@ func NewDefaultConfig() *Config {
 		AWSSecretAccessKey: "",
 		AWSUseCredChain:    false,
 
+		EventStream:      "",
+		EventStreamTypes: "msg_created,contact_field_changed,run_result_changed,contact_groups_changed,ticket_opened",
+
+		EventStreamBatchSize:  100,
+		EventStreamMaxBatches: 10,
+		EventStreamBackoff:    5,
+		EventStreamMaxBackoff: 300,
+
 		InstanceName: hostname,
 		LogLevel:     "error",
 		UUIDSeed:     0,
@@ -143,9 +170,29 @@ func (c *Config) Validate() error {
 	if _, _, err := c.ParseDisallowedNetworks(); err != nil {
 		return errors.Wrap(err, "unable to parse 'DisallowedNetworks'")
 	}
+
+	if c.EventStream != "" {
+		u, err := url.Parse(c.EventStream)
+		if err != nil || !(u.Scheme == "redis" || u.Scheme == "rediss" || u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "file") {
+			return errors.New("field 'EventStream' is not a valid event stream URL")
+		}
+	}
 	return nil
 }
 
+// StreamsEventType returns whether events of the given type should be published to the event stream
+func (c *Config) StreamsEventType(eventType string) bool {
+	if c.EventStream == "" {
+		return false
+	}
+	for _, t := range strings.Split(c.EventStreamTypes, ",") {
+		if strings.TrimSpace(t) == eventType {
+			return true
+		}
+	}
+	return false
+}
+
 // ParseDisallowedNetworks parses the list of IPs and IP networks (written in CIDR notation)
 func (c *Config) ParseDisallowedNetworks() ([]net.IP, []*net.IPNet, error) {
 	addrs, err := csv.NewReader(strings.NewReader(c.DisallowedNetworks)).Read()
@@ -17,5 +17,6 @@ type Runtime struct {
 	AttachmentStorage storage.Storage
 	SessionStorage    storage.Storage
 	LogStorage        storage.Storage
+	ExportStorage     storage.Storage
 	Config            *Config
 }
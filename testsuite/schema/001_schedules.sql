@@ -0,0 +1,8 @@
+-- schedule intervals, week of month and yearly recurrence, and end conditions
+ALTER TABLE schedules_schedule
+    ADD COLUMN IF NOT EXISTS repeat_week_of_month integer,
+    ADD COLUMN IF NOT EXISTS repeat_month_of_year integer,
+    ADD COLUMN IF NOT EXISTS repeat_interval integer NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS end_date timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS max_fires integer,
+    ADD COLUMN IF NOT EXISTS fire_count integer NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+-- multiple keywords and priorities on keyword triggers, and longer keywords for regular expressions
+ALTER TABLE triggers_trigger
+    ALTER COLUMN keyword TYPE character varying(255),
+    ADD COLUMN IF NOT EXISTS keywords character varying(255)[],
+    ADD COLUMN IF NOT EXISTS priority integer NOT NULL DEFAULT 0;
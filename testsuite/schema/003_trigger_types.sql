@@ -0,0 +1,2 @@
+ALTER TABLE triggers_trigger ADD COLUMN IF NOT EXISTS group_id integer;
+ALTER TABLE triggers_trigger ADD COLUMN IF NOT EXISTS field_id integer;
@@ -0,0 +1,5 @@
+ALTER TABLE triggers_trigger ADD COLUMN IF NOT EXISTS active_days varchar(7);
+ALTER TABLE triggers_trigger ADD COLUMN IF NOT EXISTS active_from_time time;
+ALTER TABLE triggers_trigger ADD COLUMN IF NOT EXISTS active_until_time time;
+ALTER TABLE triggers_trigger ADD COLUMN IF NOT EXISTS active_from_date date;
+ALTER TABLE triggers_trigger ADD COLUMN IF NOT EXISTS active_until_date date;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS contacts_contactaudit (
+    id bigserial PRIMARY KEY,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    contact_id integer NOT NULL REFERENCES contacts_contact(id),
+    user_id integer NULL REFERENCES auth_user(id),
+    flow_id integer NULL REFERENCES flows_flow(id),
+    source character varying(1) NOT NULL,
+    event_type character varying(32) NOT NULL,
+    attribute character varying(128) NOT NULL,
+    before jsonb NULL,
+    after jsonb NULL,
+    created_on timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS contacts_contactaudit_contact_id ON contacts_contactaudit(contact_id, id DESC);
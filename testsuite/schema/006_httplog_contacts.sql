@@ -0,0 +1 @@
+ALTER TABLE request_logs_httplog ADD COLUMN IF NOT EXISTS contact_id integer;
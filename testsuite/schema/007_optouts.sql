@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS msgs_optout (
+    id serial PRIMARY KEY,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    channel_id integer NOT NULL REFERENCES channels_channel(id),
+    urn_identity character varying(255) NOT NULL,
+    created_on timestamp with time zone NOT NULL,
+    UNIQUE (channel_id, urn_identity)
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS eventstream_event (
+    id bigserial PRIMARY KEY,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    data json NOT NULL,
+    created_on timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS eventstream_event_org_id ON eventstream_event(org_id, id);
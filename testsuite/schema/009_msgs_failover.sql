@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS msgs_msg_failed_for_failover ON msgs_msg(modified_on, id)
+    WHERE direction = 'O' AND status = 'F' AND failed_reason IN ('E', 'R');
@@ -43,6 +43,11 @@ func InsertErroredOutgoingMsg(rt *runtime.Runtime, org *Org, channel *Channel, c
 	return insertOutgoingMsg(rt, org, channel, contact, text, nil, envs.NilLocale, models.MsgTypeText, models.MsgStatusErrored, highPriority, errorCount, &nextAttempt)
 }
 
+// InsertScheduledOutgoingMsg inserts a SCHEDULED(T) outgoing text message
+func InsertScheduledOutgoingMsg(rt *runtime.Runtime, org *Org, channel *Channel, contact *Contact, text string, sendOn time.Time) *flows.MsgOut {
+	return insertOutgoingMsg(rt, org, channel, contact, text, nil, envs.NilLocale, models.MsgTypeText, models.MsgStatusScheduled, false, 0, &sendOn)
+}
+
 func insertOutgoingMsg(rt *runtime.Runtime, org *Org, channel *Channel, contact *Contact, text string, attachments []utils.Attachment, locale envs.Locale, typ models.MsgType, status models.MsgStatus, highPriority bool, errorCount int, nextAttempt *time.Time) *flows.MsgOut {
 	var channelRef *assets.ChannelReference
 	var channelID models.ChannelID
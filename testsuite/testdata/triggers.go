@@ -1,6 +1,7 @@
 package testdata
 
 import (
+	"github.com/lib/pq"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/runtime"
 )
@@ -9,6 +10,20 @@ func InsertKeywordTrigger(rt *runtime.Runtime, org *Org, flow *Flow, keyword str
 	return insertTrigger(rt, org, models.KeywordTriggerType, flow, keyword, matchType, includeGroups, excludeGroups, nil, "", nil)
 }
 
+func InsertKeywordsTrigger(rt *runtime.Runtime, org *Org, flow *Flow, keywords []string, matchType models.MatchType, priority int, includeGroups []*Group, excludeGroups []*Group) models.TriggerID {
+	id := insertTrigger(rt, org, models.KeywordTriggerType, flow, keywords[0], matchType, includeGroups, excludeGroups, nil, "", nil)
+	rt.DB.MustExec(`UPDATE triggers_trigger SET keywords = $2, priority = $3 WHERE id = $1`, id, pq.Array(keywords[1:]), priority)
+	return id
+}
+
+// RestrictTrigger restricts when an existing trigger is active, with empty values meaning no restriction
+func RestrictTrigger(rt *runtime.Runtime, id models.TriggerID, days, fromTime, untilTime, fromDate, untilDate string) {
+	rt.DB.MustExec(
+		`UPDATE triggers_trigger SET active_days = NULLIF($2, ''), active_from_time = NULLIF($3, '')::time, active_until_time = NULLIF($4, '')::time, active_from_date = NULLIF($5, '')::date, active_until_date = NULLIF($6, '')::date WHERE id = $1`,
+		id, days, fromTime, untilTime, fromDate, untilDate,
+	)
+}
+
 func InsertIncomingCallTrigger(rt *runtime.Runtime, org *Org, flow *Flow, includeGroups, excludeGroups []*Group) models.TriggerID {
 	return insertTrigger(rt, org, models.IncomingCallTriggerType, flow, "", "", includeGroups, excludeGroups, nil, "", nil)
 }
@@ -37,6 +52,26 @@ func InsertTicketClosedTrigger(rt *runtime.Runtime, org *Org, flow *Flow) models
 	return insertTrigger(rt, org, models.TicketClosedTriggerType, flow, "", "", nil, nil, nil, "", nil)
 }
 
+func InsertOptInTrigger(rt *runtime.Runtime, org *Org, flow *Flow) models.TriggerID {
+	return insertTrigger(rt, org, models.OptInTriggerType, flow, "", "", nil, nil, nil, "", nil)
+}
+
+func InsertOptOutTrigger(rt *runtime.Runtime, org *Org, flow *Flow) models.TriggerID {
+	return insertTrigger(rt, org, models.OptOutTriggerType, flow, "", "", nil, nil, nil, "", nil)
+}
+
+func InsertGroupJoinedTrigger(rt *runtime.Runtime, org *Org, flow *Flow, group *Group, excludeGroups []*Group) models.TriggerID {
+	id := insertTrigger(rt, org, models.GroupJoinedTriggerType, flow, "", "", nil, excludeGroups, nil, "", nil)
+	rt.DB.MustExec(`UPDATE triggers_trigger SET group_id = $2 WHERE id = $1`, id, group.ID)
+	return id
+}
+
+func InsertFieldChangedTrigger(rt *runtime.Runtime, org *Org, flow *Flow, field *Field) models.TriggerID {
+	id := insertTrigger(rt, org, models.FieldChangedTriggerType, flow, "", "", nil, nil, nil, "", nil)
+	rt.DB.MustExec(`UPDATE triggers_trigger SET field_id = $2 WHERE id = $1`, id, field.ID)
+	return id
+}
+
 func insertTrigger(rt *runtime.Runtime, org *Org, triggerType models.TriggerType, flow *Flow, keyword string, matchType models.MatchType, includeGroups, excludeGroups []*Group, contactIDs []*Contact, referrerID string, channel *Channel) models.TriggerID {
 	channelID := models.NilChannelID
 	if channel != nil {
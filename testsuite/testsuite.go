@@ -6,6 +6,8 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"sort"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
@@ -26,6 +28,7 @@ const postgresContainerName = "textit-postgres-1"
 const attachmentStorageDir = "_test_attachments_storage"
 const sessionStorageDir = "_test_session_storage"
 const logStorageDir = "_test_log_storage"
+const exportStorageDir = "_test_export_storage"
 
 // Refresh is our type for the pieces of org assets we want fresh (not cached)
 type ResetFlag int
@@ -81,6 +84,7 @@ func Runtime() (context.Context, *runtime.Runtime) {
 		AttachmentStorage: storage.NewFS(attachmentStorageDir, 0766),
 		SessionStorage:    storage.NewFS(sessionStorageDir, 0766),
 		LogStorage:        storage.NewFS(logStorageDir, 0766),
+		ExportStorage:     storage.NewFS(exportStorageDir, 0766),
 		Config:            cfg,
 	}
 
@@ -111,10 +115,27 @@ func getDB() *sqlx.DB {
 			loadTestDump()
 			return getDB()
 		}
+
+		applySchemaChanges(_db)
 	}
 	return _db
 }
 
+// applies the schema changes in testsuite/schema which aren't yet in our test database dump. These are written to be
+// idempotent so they can be applied every time we connect, and can be removed once the dump has been regenerated.
+func applySchemaChanges(db *sqlx.DB) {
+	files, err := filepath.Glob(absPath("./testsuite/schema/*.sql"))
+	must(err)
+	sort.Strings(files)
+
+	for _, file := range files {
+		sql, err := os.ReadFile(file)
+		must(err)
+
+		db.MustExec(string(sql))
+	}
+}
+
 // returns a redis pool to our test database
 func getRP() *redis.Pool {
 	return &redis.Pool{
@@ -213,6 +234,7 @@ func resetStorage() {
 	must(os.RemoveAll(attachmentStorageDir))
 	must(os.RemoveAll(sessionStorageDir))
 	must(os.RemoveAll(logStorageDir))
+	must(os.RemoveAll(exportStorageDir))
 }
 
 // clears indexed data in Elastic
@@ -240,6 +262,9 @@ func resetElastic(ctx context.Context) {
 var sqlResetTestData = `
 UPDATE contacts_contact SET current_flow_id = NULL;
 
+DELETE FROM contacts_contactaudit;
+DELETE FROM msgs_optout;
+DELETE FROM eventstream_event;
 DELETE FROM tickets_ticketdailycount;
 DELETE FROM tickets_ticketdailytiming;
 DELETE FROM notifications_notification;
@@ -289,6 +314,8 @@ ALTER SEQUENCE msgs_broadcast_id_seq RESTART WITH 1;
 ALTER SEQUENCE flows_flowrun_id_seq RESTART WITH 1;
 ALTER SEQUENCE flows_flowstart_id_seq RESTART WITH 1;
 ALTER SEQUENCE flows_flowsession_id_seq RESTART WITH 1;
+ALTER SEQUENCE contacts_contactaudit_id_seq RESTART WITH 1;
+ALTER SEQUENCE eventstream_event_id_seq RESTART WITH 1;
 ALTER SEQUENCE contacts_contact_id_seq RESTART WITH 30000;
 ALTER SEQUENCE contacts_contacturn_id_seq RESTART WITH 30000;
 ALTER SEQUENCE contacts_contactgroup_id_seq RESTART WITH 30000;
@@ -0,0 +1,74 @@
+package contact
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/contact/audit", web.RequireAuthToken(web.JSONPayload(handleAudit)))
+}
+
+// Request a contact's audit history, newest first. Older entries can be paged through by passing the id of the last
+// entry returned as before_id.
+//
+//	{
+//	  "org_id": 1,
+//	  "contact_id": 235,
+//	  "before_id": 1234,
+//	  "limit": 50
+//	}
+type auditRequest struct {
+	OrgID     models.OrgID          `json:"org_id"     validate:"required"`
+	ContactID models.ContactID      `json:"contact_id" validate:"required"`
+	BeforeID  models.ContactAuditID `json:"before_id"`
+	Limit     int                   `json:"limit"      validate:"omitempty,min=1"`
+}
+
+// Response is the list of audit entries
+//
+//	{
+//	  "entries": [
+//	    {
+//	      "id": 1235,
+//	      "contact_id": 235,
+//	      "user_id": 3,
+//	      "source": "A",
+//	      "event_type": "contact_name_changed",
+//	      "attribute": "name",
+//	      "before": "Bob",
+//	      "after": "Robert",
+//	      "created_on": "2023-06-15T12:30:00.123456Z"
+//	    }
+//	  ]
+//	}
+type auditResponse struct {
+	Entries []*models.ContactAudit `json:"entries"`
+}
+
+// handles a request to get a contact's audit history
+func handleAudit(ctx context.Context, rt *runtime.Runtime, r *auditRequest) (any, int, error) {
+	limit := r.Limit
+	if limit == 0 {
+		limit = defaultAuditLimit
+	} else if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+
+	entries, err := models.GetContactAudits(ctx, rt.ReadonlyDB, r.OrgID, r.ContactID, r.BeforeID, limit)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "error loading contact audits")
+	}
+
+	return &auditResponse{Entries: entries}, http.StatusOK, nil
+}
@@ -10,11 +10,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
 	_ "github.com/nyaruka/mailroom/core/handlers"
 	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/search"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
 	_ "github.com/nyaruka/mailroom/services/tickets/intern"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
@@ -86,6 +89,108 @@ func TestModify(t *testing.T) {
 	testsuite.RunWebTests(t, ctx, rt, "testdata/modify.json", nil)
 }
 
+func TestAudit(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	rt.DB.MustExec(`INSERT INTO contacts_contactaudit(org_id, contact_id, user_id, flow_id, source, event_type, attribute, before, after, created_on) VALUES
+		(1, 10000, 3, NULL, 'A', 'contact_name_changed', 'name', '"Cathy"', '"Kathy"', '2023-06-15T12:30:00Z'),
+		(1, 10000, NULL, 10000, 'F', 'contact_field_changed', 'fields.age', NULL, '"32"', '2023-06-15T12:31:00Z'),
+		(1, 10001, 3, NULL, 'A', 'contact_name_changed', 'name', '"Bob"', '"Robert"', '2023-06-15T12:32:00Z')`)
+
+	testsuite.RunWebTests(t, ctx, rt, "testdata/audit.json", nil)
+}
+
+func TestBulkModify(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	testsuite.RunWebTests(t, ctx, rt, "testdata/bulk_modify.json", nil)
+}
+
+func TestExport(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetRedis | testsuite.ResetStorage)
+
+	testsuite.RunWebTests(t, ctx, rt, "testdata/export.json", nil)
+
+	assert.Equal(t, map[string]int{"export_contact": 1}, testsuite.FlushTasks(t, rt))
+	assert.FileExists(t, "_test_export_storage/orgs/1/contact_exports/d2f852ec-7b4e-457f-ae7f-f8b243c49ff5.zip")
+}
+
+func TestExportSearch(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	testsuite.RunWebTests(t, ctx, rt, "testdata/export_search.json", nil)
+}
+
+func TestFacets(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetElastic)
+
+	// give our contacts some field values to facet on
+	setFields := func(contact *testdata.Contact, gender string, age int, joined string) {
+		rt.DB.MustExec(
+			fmt.Sprintf(
+				`UPDATE contacts_contact SET fields = '{"%s": {"text": "%s"}, "%s": {"text": "%d", "number": %d}, "%s": {"text": "%s", "datetime": "%s"}}'::jsonb, modified_on = NOW() WHERE id = $1`,
+				testdata.GenderField.UUID, gender, testdata.AgeField.UUID, age, age, testdata.JoinedField.UUID, joined, joined,
+			),
+			contact.ID,
+		)
+	}
+	setFields(testdata.Cathy, "Female", 30, "2023-04-01T03:00:00+00:00") // which is still March in the org's timezone
+	setFields(testdata.Bob, "Male", 35, "2023-04-15T12:00:00+00:00")
+	setFields(testdata.George, "Male", 52, "2023-03-10T12:00:00+00:00")
+
+	testsuite.ReindexElastic(ctx)
+
+	testsuite.RunWebTests(t, ctx, rt, "testdata/facets.json", nil)
+}
+
+func TestPopulateStatus(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	defer func(t time.Duration) { search.IndexerWaitTimeout = t }(search.IndexerWaitTimeout)
+	search.IndexerWaitTimeout = 0
+
+	task := &contacts.PopulateDynamicGroupTask{GroupID: testdata.DoctorsGroup.ID, Query: "name = Bob"}
+	err := task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.RunWebTests(t, ctx, rt, "testdata/populate_status.json", nil)
+}
+
+func TestErasure(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2023, 6, 20, 9, 45, 12, 0, time.UTC)))
+
+	testdata.InsertWaitingSession(rt, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now().Add(time.Hour), true, nil)
+
+	task := &contacts.EraseContactTask{ContactID: testdata.Cathy.ID}
+	err := task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.RunWebTests(t, ctx, rt, "testdata/erasure.json", nil)
+}
+
+func TestMerge(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	testsuite.RunWebTests(t, ctx, rt, "testdata/merge.json", nil)
+}
+
 func TestResolve(t *testing.T) {
 	ctx, rt := testsuite.Runtime()
 
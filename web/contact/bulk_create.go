@@ -76,7 +76,7 @@ func handleBulkCreate(ctx context.Context, rt *runtime.Runtime, r *bulkCreateReq
 		modifiersByContact[contact] = c.Mods
 	}
 
-	_, err = models.ApplyModifiers(ctx, rt, oa, r.UserID, modifiersByContact)
+	_, err = models.ApplyModifiers(ctx, rt, oa, r.UserID, models.ContactChangeSourceAPI, modifiersByContact)
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "error modifying new contacts")
 	}
@@ -0,0 +1,138 @@
+package contact
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/contact/bulk_modify", web.RequireAuthToken(web.JSONPayload(handleBulkModify)))
+	web.RegisterRoute(http.MethodPost, "/mr/contact/bulk_modify_status", web.RequireAuthToken(web.JSONPayload(handleBulkModifyStatus)))
+}
+
+// Request that all the contacts matching a query, or in a group, are modified in the background.
+//
+//	{
+//	  "org_id": 1,
+//	  "user_id": 1,
+//	  "query": "district = \"Gasabo\"",
+//	  "modifiers": [{
+//	     "type": "groups",
+//	     "modification": "add",
+//	     "groups": [{
+//	         "uuid": "a8e8efdb-78ee-46e7-9eb0-6a578da3b02d",
+//	         "name": "Doctors"
+//	     }]
+//	  }]
+//	}
+type bulkModifyRequest struct {
+	OrgID     models.OrgID      `json:"org_id"    validate:"required"`
+	UserID    models.UserID     `json:"user_id"   validate:"required"`
+	Query     string            `json:"query"`
+	GroupID   models.GroupID    `json:"group_id"`
+	Modifiers []json.RawMessage `json:"modifiers" validate:"required"`
+}
+
+// Response is the UUID of the bulk modification which can be used to check its progress
+//
+//	{
+//	  "uuid": "f5901b62-ba76-4003-9c62-72fdacc1b7b7"
+//	}
+type bulkModifyResponse struct {
+	UUID uuids.UUID `json:"uuid"`
+}
+
+// handles a request to modify contacts in bulk
+func handleBulkModify(ctx context.Context, rt *runtime.Runtime, r *bulkModifyRequest) (any, int, error) {
+	if (r.Query == "") == (r.GroupID == 0) {
+		return errors.New("must provide a query or a group but not both"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, r.OrgID)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	if r.GroupID != 0 && oa.GroupByID(r.GroupID) == nil {
+		return errors.Errorf("no such group with id %d", r.GroupID), http.StatusBadRequest, nil
+	}
+
+	if r.Query != "" {
+		_, err := contactql.ParseQuery(oa.Env(), r.Query, oa.SessionAssets())
+		if err != nil {
+			isQueryError, qerr := contactql.IsQueryError(err)
+			if isQueryError {
+				return qerr, http.StatusBadRequest, nil
+			}
+			return nil, 0, err
+		}
+	}
+
+	// check the modifiers are valid, they're read again when they're applied
+	if _, err := goflow.ReadModifiers(oa.SessionAssets(), r.Modifiers, goflow.ErrorOnMissing); err != nil {
+		return nil, 0, err
+	}
+
+	task := &contacts.BulkModifyContactsTask{
+		UUID:      uuids.New(),
+		UserID:    r.UserID,
+		Query:     r.Query,
+		GroupID:   r.GroupID,
+		Modifiers: r.Modifiers,
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := contacts.QueueBulkModify(rc, oa.OrgID(), task); err != nil {
+		return nil, 0, errors.Wrapf(err, "error queuing bulk modify task")
+	}
+
+	return &bulkModifyResponse{UUID: task.UUID}, http.StatusOK, nil
+}
+
+// Request the progress of a bulk modification.
+//
+//	{
+//	  "org_id": 1,
+//	  "uuid": "f5901b62-ba76-4003-9c62-72fdacc1b7b7"
+//	}
+type bulkModifyStatusRequest struct {
+	OrgID models.OrgID `json:"org_id" validate:"required"`
+	UUID  uuids.UUID   `json:"uuid"   validate:"required"`
+}
+
+// Response is the progress of the bulk modification. Status is one of pending, in_progress or complete. Contacts are
+// skipped if they couldn't be locked or no longer exist, and failed if their batch errored.
+//
+//	{
+//	  "status": "in_progress",
+//	  "total": 1234,
+//	  "modified": 200,
+//	  "skipped": 0,
+//	  "failed": 0
+//	}
+func handleBulkModifyStatus(ctx context.Context, rt *runtime.Runtime, r *bulkModifyStatusRequest) (any, int, error) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	progress, err := contacts.GetBulkModifyProgress(rc, r.OrgID, r.UUID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if progress == nil {
+		return errors.Errorf("no such bulk modification with uuid %s", r.UUID), http.StatusBadRequest, nil
+	}
+
+	return progress, http.StatusOK, nil
+}
@@ -52,7 +52,7 @@ func handleCreate(ctx context.Context, rt *runtime.Runtime, r *createRequest) (a
 	}
 
 	modifiersByContact := map[*flows.Contact][]flows.Modifier{contact: c.Mods}
-	_, err = models.ApplyModifiers(ctx, rt, oa, r.UserID, modifiersByContact)
+	_, err = models.ApplyModifiers(ctx, rt, oa, r.UserID, models.ContactChangeSourceAPI, modifiersByContact)
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "error modifying new contact")
 	}
@@ -0,0 +1,54 @@
+package contact
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/contact/erasure", web.RequireAuthToken(web.JSONPayload(handleErasure)))
+}
+
+// Request the report of the latest erasure of a contact's data.
+//
+//	{
+//	  "org_id": 1,
+//	  "contact_id": 12345
+//	}
+type erasureRequest struct {
+	OrgID     models.OrgID     `json:"org_id"     validate:"required"`
+	ContactID models.ContactID `json:"contact_id" validate:"required"`
+}
+
+// Response is the number of things removed or redacted from each store.
+//
+//	{
+//	  "erased_on": "2023-06-20T09:45:12.123456Z",
+//	  "sessions_interrupted": 1,
+//	  "session_outputs": 3,
+//	  "channel_logs": 12,
+//	  "http_logs": 2,
+//	  "audit_entries": 5,
+//	  "queued_events": 0,
+//	  "search_documents": 1
+//	}
+func handleErasure(ctx context.Context, rt *runtime.Runtime, r *erasureRequest) (any, int, error) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	erasure, err := contacts.GetContactErasure(rc, r.OrgID, r.ContactID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if erasure == nil {
+		return errors.Errorf("no erasure of contact with id %d", r.ContactID), http.StatusBadRequest, nil
+	}
+
+	return erasure, http.StatusOK, nil
+}
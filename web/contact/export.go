@@ -0,0 +1,114 @@
+package contact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+)
+
+// contacts with more messages and runs than this are always exported by a task
+const maxInlineExportHistory = 1000
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/contact/export", web.RequireAuthToken(web.JSONPayload(handleExport)))
+}
+
+// Request a complete export of a contact, including its fields, URNs and groups, as well as its messages, runs,
+// tickets, campaign fires and channel events. Format can be json (default) or zip, which is a zip of NDJSON files.
+//
+//	{
+//	  "org_id": 1,
+//	  "contact_id": 235,
+//	  "format": "json"
+//	}
+type exportRequest struct {
+	OrgID     models.OrgID               `json:"org_id"     validate:"required"`
+	ContactID models.ContactID           `json:"contact_id" validate:"required"`
+	Format    models.ContactExportFormat `json:"format"`
+}
+
+// Response is the export itself if it's a JSON export of a contact with a small enough history. Otherwise the export
+// is queued to be written to export storage at the returned path.
+//
+//	{
+//	  "status": "complete",
+//	  "export": {
+//	    "contact": {...},
+//	    "messages": [...],
+//	    ...
+//	  }
+//	}
+//
+//	{
+//	  "status": "queued",
+//	  "uuid": "f5901b62-ba76-4003-9c62-72fdacc1b7b7",
+//	  "path": "orgs/1/contact_exports/f5901b62-ba76-4003-9c62-72fdacc1b7b7.zip"
+//	}
+type exportResponse struct {
+	Status string          `json:"status"`
+	Export json.RawMessage `json:"export,omitempty"`
+	UUID   uuids.UUID      `json:"uuid,omitempty"`
+	Path   string          `json:"path,omitempty"`
+}
+
+// handles a request to export a contact
+func handleExport(ctx context.Context, rt *runtime.Runtime, r *exportRequest) (any, int, error) {
+	format := r.Format
+	if format == "" {
+		format = models.ContactExportFormatJSON
+	} else if format != models.ContactExportFormatJSON && format != models.ContactExportFormatZip {
+		return errors.Errorf("invalid export format: %s", format), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, r.OrgID)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	found, err := models.LoadContacts(ctx, rt.ReadonlyDB, oa, []models.ContactID{r.ContactID})
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "unable to load contact")
+	}
+	if len(found) == 0 {
+		return errors.Errorf("no such contact with id %d", r.ContactID), http.StatusBadRequest, nil
+	}
+
+	history, err := models.CountContactHistory(ctx, rt.ReadonlyDB, r.ContactID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if format == models.ContactExportFormatJSON && history <= maxInlineExportHistory {
+		export := &bytes.Buffer{}
+		if err := models.ExportContact(ctx, rt, oa, r.ContactID, format, export); err != nil {
+			return nil, 0, err
+		}
+
+		return &exportResponse{Status: "complete", Export: export.Bytes()}, http.StatusOK, nil
+	}
+
+	task := &contacts.ExportContactTask{ExportUUID: uuids.New(), ContactID: r.ContactID, Format: format}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := tasks.Queue(rc, queue.BatchQueue, oa.OrgID(), task, queue.DefaultPriority); err != nil {
+		return nil, 0, errors.Wrapf(err, "error queuing contact export task")
+	}
+
+	return &exportResponse{
+		Status: "queued",
+		UUID:   task.ExportUUID,
+		Path:   models.ContactExportPath(oa.OrgID(), task.ExportUUID, format),
+	}, http.StatusOK, nil
+}
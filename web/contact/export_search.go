@@ -0,0 +1,98 @@
+package contact
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/search"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/contact/export_search", web.RequireAuthToken(handleExportSearch))
+}
+
+// Streams all the contacts matching a search as CSV or NDJSON. Name, language, status etc are always included and
+// fields, URNs and groups can be included as additional columns. The number of matching contacts is returned in the
+// X-Total-Count header, and if the export fails once it has started, the connection is closed without completing it.
+//
+//	{
+//	  "org_id": 1,
+//	  "group_id": 234,
+//	  "query": "age > 10",
+//	  "format": "csv",
+//	  "columns": {
+//	    "fields": ["age", "gender"],
+//	    "urn_schemes": ["tel"],
+//	    "groups": true
+//	  }
+//	}
+type exportSearchRequest struct {
+	OrgID   models.OrgID         `json:"org_id"  validate:"required"`
+	GroupID models.GroupID       `json:"group_id"`
+	Query   string               `json:"query"`
+	Format  search.ExportFormat  `json:"format"  validate:"required,eq=csv|eq=ndjson"`
+	Columns search.ExportColumns `json:"columns"`
+}
+
+// handles a request to export the results of a contact search
+func handleExportSearch(ctx context.Context, rt *runtime.Runtime, r *http.Request, rawW http.ResponseWriter) error {
+	request := &exportSearchRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return web.WriteMarshalled(rawW, http.StatusBadRequest, web.NewErrorResponse(errors.Wrap(err, "request failed validation")))
+	}
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, models.RefreshFields|models.RefreshGroups)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets")
+	}
+
+	var group *models.Group
+	if request.GroupID != 0 {
+		if group = oa.GroupByID(request.GroupID); group == nil {
+			return web.WriteMarshalled(rawW, http.StatusBadRequest, web.NewErrorResponse(errors.Errorf("no such group with id %d", request.GroupID)))
+		}
+	}
+
+	for _, key := range request.Columns.Fields {
+		if oa.FieldByKey(key) == nil {
+			return web.WriteMarshalled(rawW, http.StatusBadRequest, web.NewErrorResponse(errors.Errorf("no such field with key %s", key)))
+		}
+	}
+
+	// resolve the search before we start writing the response so that any problem with it can still be reported
+	export, err := search.PrepareSearchExport(ctx, rt, oa, group, request.Query)
+	if err != nil {
+		isQueryError, qerr := contactql.IsQueryError(err)
+		if isQueryError {
+			return web.WriteMarshalled(rawW, http.StatusBadRequest, web.NewErrorResponse(qerr))
+		}
+		return err
+	}
+
+	w := middleware.NewWrapResponseWriter(rawW, r.ProtoMajor)
+	w.Header().Set("Content-type", request.Format.ContentType())
+	w.Header().Set("X-Total-Count", strconv.FormatInt(export.Total, 10))
+	w.WriteHeader(http.StatusOK)
+
+	count, err := search.ExportSearchResults(ctx, rt, oa, export, &request.Columns, request.Format, w)
+
+	log := logrus.WithFields(logrus.Fields{"org_id": request.OrgID, "query": request.Query, "total": export.Total, "count": count})
+
+	// by now we've started writing the response so we can't change its status, but we can abort the connection so that
+	// the client sees the export didn't complete, rather than it looking like a complete but shorter export
+	if err != nil {
+		log.WithError(err).Error("error exporting contact search results")
+		panic(http.ErrAbortHandler)
+	}
+
+	log.Info("exported contact search results")
+	return nil
+}
@@ -0,0 +1,89 @@
+package contact
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/search"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/contact/facets", web.RequireAuthToken(web.JSONPayload(handleFacets)))
+}
+
+// Calculates counts of the contacts matching a search broken down by attributes or field values. Terms facets count
+// contacts by distinct value, histogram facets by numerical ranges and date_histogram facets by calendar periods.
+//
+//	{
+//	  "org_id": 1,
+//	  "group_id": 234,
+//	  "query": "gender = F",
+//	  "facets": [
+//	    {"name": "districts", "type": "terms", "property": "district", "size": 20},
+//	    {"name": "ages", "type": "histogram", "property": "age", "interval": 10},
+//	    {"name": "joined", "type": "date_histogram", "property": "created_on", "calendar_interval": "month"}
+//	  ]
+//	}
+type facetsRequest struct {
+	OrgID   models.OrgID    `json:"org_id"   validate:"required"`
+	GroupID models.GroupID  `json:"group_id"`
+	Query   string          `json:"query"`
+	Facets  []*search.Facet `json:"facets"   validate:"required,dive"`
+}
+
+// Response for a facets request
+//
+//	{
+//	  "query": "gender = \"F\"",
+//	  "total": 123,
+//	  "facets": {
+//	    "districts": [{"key": "gasabo", "count": 80}, {"key": "nyarugenge", "count": 43}],
+//	    "ages": [{"key": 20, "count": 67}, {"key": 30, "count": 56}],
+//	    "joined": [{"key": "2023-01-01T00:00:00+02:00", "count": 123}]
+//	  }
+//	}
+type facetsResponse struct {
+	Query  string                           `json:"query"`
+	Total  int64                            `json:"total"`
+	Facets map[string][]*search.FacetBucket `json:"facets"`
+}
+
+// handles a request to calculate facets for a contact search
+func handleFacets(ctx context.Context, rt *runtime.Runtime, r *facetsRequest) (any, int, error) {
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, r.OrgID, models.RefreshFields|models.RefreshGroups)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	var group *models.Group
+	if r.GroupID != 0 {
+		if group = oa.GroupByID(r.GroupID); group == nil {
+			return errors.Errorf("no such group with id %d", r.GroupID), http.StatusBadRequest, nil
+		}
+	}
+
+	if err := search.ValidateFacets(oa, r.Facets); err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	parsed, total, facets, err := search.GetContactFacets(ctx, rt, oa, group, r.Query, r.Facets)
+	if err != nil {
+		isQueryError, qerr := contactql.IsQueryError(err)
+		if isQueryError {
+			return qerr, http.StatusBadRequest, nil
+		}
+		return nil, 0, err
+	}
+
+	normalized := ""
+	if parsed != nil {
+		normalized = parsed.String()
+	}
+
+	return &facetsResponse{Query: normalized, Total: total, Facets: facets}, http.StatusOK, nil
+}
@@ -0,0 +1,106 @@
+package contact
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/contact/merge", web.RequireAuthToken(web.JSONPayload(handleMerge)))
+}
+
+// Request that a secondary contact is merged into a primary contact. The policy decides whether the primary contact
+// keeps its own field values (keep) or takes those of the secondary contact (replace) when both have a value.
+//
+//	{
+//	  "org_id": 1,
+//	  "user_id": 3,
+//	  "primary_id": 235,
+//	  "secondary_id": 236,
+//	  "policy": "keep"
+//	}
+type mergeRequest struct {
+	OrgID       models.OrgID       `json:"org_id"       validate:"required"`
+	UserID      models.UserID      `json:"user_id"      validate:"required"`
+	PrimaryID   models.ContactID   `json:"primary_id"   validate:"required"`
+	SecondaryID models.ContactID   `json:"secondary_id" validate:"required"`
+	Policy      models.MergePolicy `json:"policy"`
+}
+
+// Response is the merged contact and the events generated for it
+//
+//	{
+//	  "contact": {
+//	    "id": 235,
+//	    "uuid": "559d4cf7-8ed3-43db-9bbb-2be85345f87e",
+//	    "name": "Joe",
+//	    ...
+//	  },
+//	  "events": [
+//	    ...
+//	  ]
+//	}
+type mergeResponse struct {
+	Contact *flows.Contact `json:"contact"`
+	Events  []flows.Event  `json:"events"`
+}
+
+// handles a request to merge two contacts
+func handleMerge(ctx context.Context, rt *runtime.Runtime, r *mergeRequest) (any, int, error) {
+	policy := r.Policy
+	if policy == "" {
+		policy = models.MergePolicyKeepPrimary
+	} else if policy != models.MergePolicyKeepPrimary && policy != models.MergePolicyUseSecondary {
+		return errors.Errorf("invalid merge policy: %s", policy), http.StatusBadRequest, nil
+	}
+	if r.PrimaryID == r.SecondaryID {
+		return errors.New("can't merge a contact with itself"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, r.OrgID)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	ids := []models.ContactID{r.PrimaryID, r.SecondaryID}
+
+	locks, skipped, err := models.LockContacts(ctx, rt, oa.OrgID(), ids, time.Second*10)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer models.UnlockContacts(rt, oa.OrgID(), locks)
+
+	if len(skipped) > 0 {
+		return nil, 0, errors.Errorf("unable to lock contacts for merge")
+	}
+
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, ids)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "unable to load contacts")
+	}
+
+	byID := make(map[models.ContactID]*models.Contact, len(contacts))
+	for _, c := range contacts {
+		byID[c.ID()] = c
+	}
+	for _, id := range ids {
+		if byID[id] == nil {
+			return errors.Errorf("no such contact with id %d", id), http.StatusBadRequest, nil
+		}
+	}
+
+	contact, events, err := models.MergeContacts(ctx, rt, oa, r.UserID, byID[r.PrimaryID], byID[r.SecondaryID], policy)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &mergeResponse{Contact: contact, Events: events}, http.StatusOK, nil
+}
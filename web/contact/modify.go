@@ -12,7 +12,6 @@ import (
 	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/web"
 	"github.com/pkg/errors"
-	"golang.org/x/exp/maps"
 )
 
 func init() {
@@ -85,57 +84,15 @@ func handleModify(ctx context.Context, rt *runtime.Runtime, r *modifyRequest) (a
 		return nil, 0, err
 	}
 
-	results := make(map[flows.ContactID]modifyResult, len(r.ContactIDs))
-	remaining := r.ContactIDs
-	start := time.Now()
-
-	for len(remaining) > 0 && time.Since(start) < time.Second*10 {
-		eventsByContact, skipped, err := tryToLockAndModify(ctx, rt, oa, remaining, mods, r.UserID)
-		if err != nil {
-			return nil, 0, err
-		}
-
-		for flowContact, contactEvents := range eventsByContact {
-			results[flowContact.ID()] = modifyResult{Contact: flowContact, Events: contactEvents}
-		}
-
-		remaining = skipped
-	}
-
-	return &modifyResponse{Modified: results, Skipped: remaining}, http.StatusOK, nil
-}
-
-func tryToLockAndModify(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, ids []models.ContactID, mods []flows.Modifier, userID models.UserID) (map[*flows.Contact][]flows.Event, []models.ContactID, error) {
-	locks, skipped, err := models.LockContacts(ctx, rt, oa.OrgID(), ids, time.Second)
+	eventsByContact, skipped, err := models.LockAndModifyContacts(ctx, rt, oa, r.UserID, models.ContactChangeSourceAPI, r.ContactIDs, mods, time.Second*10)
 	if err != nil {
-		return nil, nil, err
-	}
-
-	locked := maps.Keys(locks)
-
-	defer models.UnlockContacts(rt, oa.OrgID(), locks)
-
-	// load our contacts
-	contacts, err := models.LoadContacts(ctx, rt.DB, oa, locked)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "unable to load contacts")
-	}
-
-	// convert to map of flow contacts to modifiers
-	modifiersByContact := make(map[*flows.Contact][]flows.Modifier, len(contacts))
-	for _, contact := range contacts {
-		flowContact, err := contact.FlowContact(oa)
-		if err != nil {
-			return nil, nil, errors.Wrap(err, "error creating flow contact")
-		}
-
-		modifiersByContact[flowContact] = mods
+		return nil, 0, err
 	}
 
-	eventsByContact, err := models.ApplyModifiers(ctx, rt, oa, userID, modifiersByContact)
-	if err != nil {
-		return nil, nil, err
+	results := make(map[flows.ContactID]modifyResult, len(eventsByContact))
+	for flowContact, contactEvents := range eventsByContact {
+		results[flowContact.ID()] = modifyResult{Contact: flowContact, Events: contactEvents}
 	}
 
-	return eventsByContact, skipped, nil
+	return &modifyResponse{Modified: results, Skipped: skipped}, http.StatusOK, nil
 }
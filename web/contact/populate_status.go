@@ -0,0 +1,51 @@
+package contact
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/contact/populate_status", web.RequireAuthToken(web.JSONPayload(handlePopulateStatus)))
+}
+
+// Request the progress of the latest population of a smart group.
+//
+//	{
+//	  "org_id": 1,
+//	  "group_id": 234
+//	}
+type populateStatusRequest struct {
+	OrgID   models.OrgID   `json:"org_id"   validate:"required"`
+	GroupID models.GroupID `json:"group_id" validate:"required"`
+}
+
+// Response is the progress of the population. Status is one of in_progress or complete.
+//
+//	{
+//	  "status": "in_progress",
+//	  "total": 1234,
+//	  "processed": 1000,
+//	  "added": 23,
+//	  "removed": 5
+//	}
+func handlePopulateStatus(ctx context.Context, rt *runtime.Runtime, r *populateStatusRequest) (any, int, error) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	progress, err := contacts.GetGroupPopulationProgress(rc, r.OrgID, r.GroupID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if progress == nil {
+		return errors.Errorf("no population of group with id %d", r.GroupID), http.StatusBadRequest, nil
+	}
+
+	return progress, http.StatusOK, nil
+}
@@ -46,6 +46,12 @@ func panicRecovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if rvr := recover(); rvr != nil {
+				// handlers abort responses they've already started writing by panicking with this, which the server
+				// handles by closing the connection
+				if rvr == http.ErrAbortHandler {
+					panic(rvr)
+				}
+
 				debug.PrintStack()
 				log.WithError(errors.New(fmt.Sprint(rvr))).Error("recovered from panic in web handling")
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
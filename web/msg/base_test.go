@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
@@ -21,7 +22,39 @@ func TestSend(t *testing.T) {
 		"cathy_ticket_id": fmt.Sprintf("%d", cathyTicket.ID),
 	})
 
-	testsuite.AssertCourierQueues(t, map[string][]int{"msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/1": {1, 1, 1}})
+	testsuite.AssertCourierQueues(t, map[string][]int{"msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/1": {1, 1, 1, 1, 1, 1}})
+}
+
+func TestCancel(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	scheduled := testdata.InsertScheduledOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "later", time.Now().Add(time.Hour))
+	sent := testdata.InsertOutgoingMsg(rt, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "how can we help", nil, models.MsgStatusSent, false)
+
+	testsuite.RunWebTests(t, ctx, rt, "testdata/cancel.json", map[string]string{
+		"scheduled_msg_id": fmt.Sprintf("%d", scheduled.ID()),
+		"sent_msg_id":      fmt.Sprintf("%d", sent.ID()),
+	})
+}
+
+func TestBroadcastStatus(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	paced := testdata.InsertBroadcast(rt, testdata.Org1, "eng", map[envs.Language]string{"eng": "Hi"}, models.NilScheduleID, []*testdata.Contact{testdata.Cathy}, nil)
+	unpaced := testdata.InsertBroadcast(rt, testdata.Org1, "eng", map[envs.Language]string{"eng": "Hi"}, models.NilScheduleID, []*testdata.Contact{testdata.Bob}, nil)
+
+	rc.Do("SET", fmt.Sprintf("broadcast_completion:%d", paced), "1687254312.5")
+
+	testsuite.RunWebTests(t, ctx, rt, "testdata/broadcast_status.json", map[string]string{
+		"paced_id":   fmt.Sprintf("%d", paced),
+		"unpaced_id": fmt.Sprintf("%d", unpaced),
+	})
 }
 
 func TestResend(t *testing.T) {
@@ -0,0 +1,59 @@
+package msg
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/msgs"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/msg/broadcast_status", web.RequireAuthToken(web.JSONPayload(handleBroadcastStatus)))
+}
+
+// Request the status of a broadcast which is being sent.
+//
+//	{
+//	  "org_id": 1,
+//	  "broadcast_id": 1234
+//	}
+type broadcastStatusRequest struct {
+	OrgID       models.OrgID       `json:"org_id"       validate:"required"`
+	BroadcastID models.BroadcastID `json:"broadcast_id" validate:"required"`
+}
+
+// Response is when all the broadcast's messages are projected to have been released to its channels, which is based
+// on their TPS and is null if the broadcast hasn't been paced.
+//
+//	{
+//	  "projected_completion": "2023-06-20T09:45:12.123456Z"
+//	}
+type broadcastStatusResponse struct {
+	ProjectedCompletion *time.Time `json:"projected_completion"`
+}
+
+// handles a request for the status of a broadcast
+func handleBroadcastStatus(ctx context.Context, rt *runtime.Runtime, r *broadcastStatusRequest) (any, int, error) {
+	exists, err := models.BroadcastExists(ctx, rt.DB, r.OrgID, r.BroadcastID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !exists {
+		return errors.Errorf("no broadcast with id %d", r.BroadcastID), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	completion, err := msgs.GetBroadcastProjectedCompletion(rc, r.BroadcastID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &broadcastStatusResponse{ProjectedCompletion: completion}, http.StatusOK, nil
+}
@@ -0,0 +1,39 @@
+package msg
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/msg/cancel", web.RequireAuthToken(web.JSONPayload(handleCancel)))
+}
+
+// Request to cancel a scheduled message before it is sent.
+//
+//	{
+//	  "org_id": 1,
+//	  "msg_id": 123456
+//	}
+type cancelRequest struct {
+	OrgID models.OrgID `json:"org_id" validate:"required"`
+	MsgID models.MsgID `json:"msg_id" validate:"required"`
+}
+
+// handles a request to cancel a scheduled message
+func handleCancel(ctx context.Context, rt *runtime.Runtime, r *cancelRequest) (any, int, error) {
+	cancelled, err := models.CancelScheduledMessage(ctx, rt.DB, r.OrgID, r.MsgID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !cancelled {
+		return errors.Errorf("no scheduled message with id %d", r.MsgID), http.StatusBadRequest, nil
+	}
+
+	return map[string]any{"id": r.MsgID}, http.StatusOK, nil
+}
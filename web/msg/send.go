@@ -3,8 +3,12 @@ package msg
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/excellent"
+	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/msgio"
@@ -23,18 +27,38 @@ func init() {
 //	  "org_id": 1,
 //	  "contact_id": 123456,
 //	  "user_id": 56,
-//	  "text": "hi there"
+//	  "text": "Hi @contact.name",
+//	  "quick_replies": ["Yes", "No"],
+//	  "send_on": "2023-06-20T09:00:00Z"
 //	}
+//
+// Instead of text, attachments and quick replies, the content can be given as translations with a base language, in
+// which case the translation is selected based on the contact's language:
+//
+//	{
+//	  "org_id": 1,
+//	  "contact_id": 123456,
+//	  "user_id": 56,
+//	  "translations": {"eng": {"text": "Hi @contact.name"}, "spa": {"text": "Hola @contact.name"}},
+//	  "base_language": "eng"
+//	}
+//
+// Text and quick replies are evaluated as templates against the contact. If send_on is provided and in the future,
+// the message is scheduled to be sent at that time rather than now.
 type sendRequest struct {
-	OrgID       models.OrgID       `json:"org_id"       validate:"required"`
-	UserID      models.UserID      `json:"user_id"      validate:"required"`
-	ContactID   models.ContactID   `json:"contact_id"   validate:"required"`
-	Text        string             `json:"text"`
-	Attachments []utils.Attachment `json:"attachments"`
-	TicketID    models.TicketID    `json:"ticket_id"`
+	OrgID        models.OrgID                `json:"org_id"       validate:"required"`
+	UserID       models.UserID               `json:"user_id"      validate:"required"`
+	ContactID    models.ContactID            `json:"contact_id"   validate:"required"`
+	Text         string                      `json:"text"`
+	Attachments  []utils.Attachment          `json:"attachments"`
+	QuickReplies []string                    `json:"quick_replies"`
+	Translations flows.BroadcastTranslations `json:"translations"`
+	BaseLanguage envs.Language               `json:"base_language"`
+	TicketID     models.TicketID             `json:"ticket_id"`
+	SendOn       *time.Time                  `json:"send_on"`
 }
 
-// handles a request to resend the given messages
+// handles a request to send a message
 func handleSend(ctx context.Context, rt *runtime.Runtime, r *sendRequest) (any, int, error) {
 	// grab our org
 	oa, err := models.GetOrgAssets(ctx, rt, r.OrgID)
@@ -53,7 +77,28 @@ func handleSend(ctx context.Context, rt *runtime.Runtime, r *sendRequest) (any,
 		return nil, 0, errors.Wrap(err, "error creating flow contact")
 	}
 
-	out, ch := models.NewMsgOut(oa, contact, r.Text, r.Attachments, nil, contact.Locale(oa.Env()))
+	text, attachments, quickReplies, locale := r.Text, r.Attachments, r.QuickReplies, contact.Locale(oa.Env())
+
+	if len(r.Translations) > 0 {
+		trans, lang := r.Translations.ForContact(oa.Env(), contact, r.BaseLanguage)
+		if trans == nil {
+			return errors.Errorf("no translation for base language '%s'", r.BaseLanguage), http.StatusBadRequest, nil
+		}
+
+		text, attachments, quickReplies = trans.Text, trans.Attachments, trans.QuickReplies
+		locale = envs.NewLocale(lang, envs.NilCountry)
+	}
+
+	// evaluate text and quick replies as templates
+	templateCtx := models.NewTemplateContext(oa, contact)
+	text, _ = excellent.EvaluateTemplate(oa.Env(), templateCtx, text, nil)
+
+	evaluatedQRs := make([]string, len(quickReplies))
+	for i := range quickReplies {
+		evaluatedQRs[i], _ = excellent.EvaluateTemplate(oa.Env(), templateCtx, quickReplies[i], nil)
+	}
+
+	out, ch := models.NewMsgOut(oa, contact, text, attachments, evaluatedQRs, locale)
 	var msg *models.Msg
 
 	if r.TicketID != models.NilTicketID {
@@ -66,29 +111,39 @@ func handleSend(ctx context.Context, rt *runtime.Runtime, r *sendRequest) (any,
 		return nil, 0, errors.Wrap(err, "error creating outgoing message")
 	}
 
+	// only schedule messages which would otherwise be queued now
+	scheduled := r.SendOn != nil && r.SendOn.After(dates.Now()) && msg.Status() == models.MsgStatusQueued
+	if scheduled {
+		msg.SetScheduled(*r.SendOn)
+	}
+
 	err = models.InsertMessages(ctx, rt.DB, []*models.Msg{msg})
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "error inserting outgoing message")
 	}
 
-	// if message was a ticket reply, update the ticket
-	if r.TicketID != models.NilTicketID {
+	// if message was a ticket reply, update the ticket, unless it's scheduled in which case that happens when it's sent
+	if r.TicketID != models.NilTicketID && !scheduled {
 		if err := models.RecordTicketReply(ctx, rt.DB, oa, r.TicketID, r.UserID); err != nil {
 			return nil, 0, errors.Wrap(err, "error recording ticket reply")
 		}
 	}
 
-	msgio.SendMessages(ctx, rt, rt.DB, nil, []*models.Msg{msg})
+	if !scheduled {
+		msgio.SendMessages(ctx, rt, rt.DB, []*models.Msg{msg})
+	}
 
 	return map[string]any{
-		"id":          msg.ID(),
-		"channel":     out.Channel(),
-		"contact":     contact.Reference(),
-		"urn":         msg.URN(),
-		"text":        msg.Text(),
-		"attachments": msg.Attachments(),
-		"status":      msg.Status(),
-		"created_on":  msg.CreatedOn(),
-		"modified_on": msg.ModifiedOn(),
+		"id":            msg.ID(),
+		"channel":       out.Channel(),
+		"contact":       contact.Reference(),
+		"urn":           msg.URN(),
+		"text":          msg.Text(),
+		"attachments":   msg.Attachments(),
+		"quick_replies": msg.QuickReplies(),
+		"status":        msg.Status(),
+		"send_on":       msg.NextAttempt(),
+		"created_on":    msg.CreatedOn(),
+		"modified_on":   msg.ModifiedOn(),
 	}, http.StatusOK, nil
 }
@@ -228,7 +228,10 @@ func handleResume(ctx context.Context, rt *runtime.Runtime, r *resumeRequest) (a
 						// non-simulation IVR triggers to use that so that this is consistent.
 						sessionTrigger = tb.Manual().WithCall(testChannel, testURN).Build()
 					} else {
-						sessionTrigger = tb.Msg(msgResume.Msg()).WithMatch(trigger.Match()).Build()
+						sessionTrigger, err = trigger.BuildMsgTrigger(oa, triggeredFlow, resume.Contact(), msgResume.Msg())
+						if err != nil {
+							return nil, 0, errors.Wrapf(err, "unable to build trigger")
+						}
 					}
 
 					return triggerFlow(ctx, rt, oa, sessionTrigger)
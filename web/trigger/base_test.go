@@ -0,0 +1,28 @@
+package trigger_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+)
+
+func TestExplain(t *testing.T) {
+	ctx, rt := testsuite.Runtime()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	rt.DB.MustExec(`DELETE FROM triggers_trigger`)
+
+	joinID := testdata.InsertKeywordTrigger(rt, testdata.Org1, testdata.Favorites, "join", models.MatchFirst, nil, nil)
+	doctorsJoinID := testdata.InsertKeywordTrigger(rt, testdata.Org1, testdata.Favorites, "join", models.MatchFirst, []*testdata.Group{testdata.DoctorsGroup}, nil)
+	catchallID := testdata.InsertCatchallTrigger(rt, testdata.Org1, testdata.Favorites, nil, nil)
+
+	testsuite.RunWebTests(t, ctx, rt, "testdata/explain.json", map[string]string{
+		"join_id":         fmt.Sprint(joinID),
+		"doctors_join_id": fmt.Sprint(doctorsJoinID),
+		"catchall_id":     fmt.Sprint(catchallID),
+	})
+}
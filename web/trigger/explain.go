@@ -0,0 +1,139 @@
+package trigger
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/trigger/explain", web.RequireAuthToken(web.JSONPayload(handleExplain)))
+}
+
+// Request to explain which trigger would match an incoming message. Either a contact can be provided or the groups
+// of a hypothetical contact. There's no channel input because incoming messages are matched to triggers regardless of
+// the channel they arrived on.
+//
+//	{
+//	  "org_id": 1,
+//	  "contact_id": 12345,
+//	  "group_ids": [234, 345],
+//	  "text": "join now"
+//	}
+type explainRequest struct {
+	OrgID     models.OrgID     `json:"org_id"     validate:"required"`
+	ContactID models.ContactID `json:"contact_id"`
+	GroupIDs  []models.GroupID `json:"group_ids"`
+	Text      string           `json:"text"`
+}
+
+// Response with every keyword and catchall trigger considered, and the one that would be matched (if any)
+//
+//	{
+//	  "candidates": [
+//	    {
+//	      "trigger_id": 123,
+//	      "trigger_type": "K",
+//	      "flow": {"uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85", "name": "Registration"},
+//	      "keywords": ["join"],
+//	      "match_type": "F",
+//	      "priority": 0,
+//	      "channel_id": null,
+//	      "include_group_ids": [234],
+//	      "exclude_group_ids": [],
+//	      "active": true,
+//	      "matched": true,
+//	      "qualified": true,
+//	      "score": 2
+//	    }
+//	  ],
+//	  "winner_id": 123
+//	}
+type explainResponse struct {
+	Candidates []*candidateInfo `json:"candidates"`
+	WinnerID   models.TriggerID `json:"winner_id,omitempty"`
+}
+
+type candidateInfo struct {
+	TriggerID       models.TriggerID      `json:"trigger_id"`
+	TriggerType     models.TriggerType    `json:"trigger_type"`
+	Flow            *assets.FlowReference `json:"flow"`
+	Keywords        []string              `json:"keywords,omitempty"`
+	MatchType       models.MatchType      `json:"match_type,omitempty"`
+	Priority        int                   `json:"priority"`
+	ChannelID       models.ChannelID      `json:"channel_id"`
+	IncludeGroupIDs []models.GroupID      `json:"include_group_ids"`
+	ExcludeGroupIDs []models.GroupID      `json:"exclude_group_ids"`
+	Active          bool                  `json:"active"`
+	Matched         bool                  `json:"matched"`
+	Qualified       bool                  `json:"qualified"`
+	Score           int                   `json:"score"`
+}
+
+// handles a request to explain trigger matching
+func handleExplain(ctx context.Context, rt *runtime.Runtime, r *explainRequest) (any, int, error) {
+	oa, err := models.GetOrgAssets(ctx, rt, r.OrgID)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	var groups []*models.Group
+
+	if r.ContactID != models.NilContactID {
+		contacts, err := models.LoadContacts(ctx, rt.ReadonlyDB, oa, []models.ContactID{r.ContactID})
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "error loading contact")
+		}
+		if len(contacts) == 0 {
+			return errors.Errorf("no such contact with id %d", r.ContactID), http.StatusBadRequest, nil
+		}
+		groups = contacts[0].Groups()
+	} else {
+		for _, id := range r.GroupIDs {
+			group := oa.GroupByID(id)
+			if group == nil {
+				return errors.Errorf("no such group with id %d", id), http.StatusBadRequest, nil
+			}
+			groups = append(groups, group)
+		}
+	}
+
+	candidates, winner := models.ExplainMsgTrigger(oa, groups, r.Text)
+
+	response := &explainResponse{Candidates: make([]*candidateInfo, len(candidates))}
+	if winner != nil {
+		response.WinnerID = winner.ID()
+	}
+
+	for i, c := range candidates {
+		t := c.Trigger
+
+		var flowRef *assets.FlowReference
+		if flow, _ := oa.FlowByID(t.FlowID()); flow != nil {
+			flowRef = flow.Reference()
+		}
+
+		response.Candidates[i] = &candidateInfo{
+			TriggerID:       t.ID(),
+			TriggerType:     t.TriggerType(),
+			Flow:            flowRef,
+			Keywords:        t.AllKeywords(),
+			MatchType:       t.MatchType(),
+			Priority:        t.Priority(),
+			ChannelID:       t.ChannelID(),
+			IncludeGroupIDs: t.IncludeGroupIDs(),
+			ExcludeGroupIDs: t.ExcludeGroupIDs(),
+			Active:          c.Active,
+			Matched:         c.Matched,
+			Qualified:       c.Qualified,
+			Score:           c.Score,
+		}
+	}
+
+	return response, http.StatusOK, nil
+}